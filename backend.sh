@@ -10,6 +10,7 @@ helpFunction()
    echo "\t-port Port number of the HTTP backend server (default: 80)"
    echo "\t-rh_time Max number of seconds the HTTP backend server entire will spend reading the headers of the request (default: 20)"
    echo "\t-w_time Max number of seconds the HTTP backend server will wait before timing out writes of the response (default: 20)"
+   echo "\tAny other flags (i.e. -workers) are passed through to cmd/http_backend"
    exit 1 # Exit script after printing help
 }
 
@@ -17,10 +18,16 @@ helpFunction()
 portNum="80"
 rh_time=20
 w_time=20
+extra=""
 
-# Verify that golang installed
+# Verify that golang 1.20 or newer is installed
 if ! [ -x "$(command -v go)" ]; then
-    echo "golang is not installed. Please install go1.15. Aborting"
+    echo "golang is not installed. Please install go1.20 or newer. Aborting"
+    exit 1
+fi
+goMinor=$(go version | sed -n 's/^go version go1\.\([0-9]*\).*/\1/p')
+if [ -n "$goMinor" ] && [ "$goMinor" -lt 20 ]; then
+    echo "$(go version) is too old. Please install go1.20 or newer. Aborting"
     exit 1
 fi
 
@@ -66,11 +73,12 @@ while [ "$#" -gt 0 ]; do
         -p|-port) portNum="$2"; shift ;;
         -rh|-rh_time) rh_time="$2"; shift ;;
         -w|-w_time) w_time="$2"; shift ;;
-        *) echo "Unknown parameter passed: $1"; helpFunction ;;
+        -help|--help) helpFunction ;;
+        *) extra="$extra $1" ;;
     esac
     shift
 done
 
 # Run http_backendgo with positional args
-go run ./http_backend.go -port="$portNum" -rh_time="$rh_time" -w_time="$w_time"
+go run ./cmd/http_backend -port="$portNum" -rh_time="$rh_time" -w_time="$w_time" $extra
 
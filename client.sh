@@ -9,8 +9,9 @@ helpFunction()
    echo "Usage: $0 -host hostName -port portNum -c_time connectionTime -buffer channelBufferSize"
    echo "\t-host IPv4 of host to connect to (i.e. 169.254.105.13)"
    echo "\t-port Port number of host to connect to (default: 40000)"
-   echo "\t-c_time Number of minutes the connection with the server will stay alive for (default: 10)"
+   echo "\t-c_time How long the connection with the server will stay alive for, as a duration (i.e. 30s) or a number of minutes (default: 10)"
    echo "\t-buffer The max buffer size of the channels used to record packets sent and received (default: 1000000)"
+   echo "\tAny other flags (i.e. -pps) are passed through to cmd/udp_client"
    exit 1 # Exit script after printing help
 }
 
@@ -20,14 +21,20 @@ hostName="localhost"
 portNum="40000"
 c_time=10
 buffer=1000000
+extra=""
 
 if [ $# -eq 0 ] ; then
 	echo "Host name required as positional argument 1. Aborting";
 	helpFunction
 else
-	# Verify that golang installed
+	# Verify that golang 1.20 or newer is installed
 	if ! [ -x "$(command -v go)" ]; then
-		echo "golang is not installed. Please install go1.15. Aborting"
+		echo "golang is not installed. Please install go1.20 or newer. Aborting"
+		exit 1
+	fi
+	goMinor=$(go version | sed -n 's/^go version go1\.\([0-9]*\).*/\1/p')
+	if [ -n "$goMinor" ] && [ "$goMinor" -lt 20 ]; then
+		echo "$(go version) is too old. Please install go1.20 or newer. Aborting"
 		exit 1
 	fi
 
@@ -62,11 +69,12 @@ else
 			-p|-port) portNum="$2"; shift ;;
 			-c|-c_time) c_time="$2"; shift ;;
 			-b|-buffer) buffer="$2"; shift ;;
-			*) echo "Unknown parameter passed: $1"; helpFunction ;;
+			-help|--help) helpFunction ;;
+			*) extra="$extra $1" ;;
 		esac
 		shift
 	done
 
 	# Run udp_client.go with positional args
-	go run ./udp_client.go -host="$hostName" -port="$portNum" -c_time="$c_time" -buffer="$buffer"
+	go run ./cmd/udp_client -host="$hostName" -port="$portNum" -c_time="$c_time" -buffer="$buffer" $extra
 fi
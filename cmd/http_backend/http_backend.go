@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"context"
+	"flag"
+
+	"github.com/nbopardi/udp_client_server/pkg/hashsvc"
+)
+
+// Create the HTTP server and listen and serve incoming requests
+func main() {
+	// Command line args
+	var options hashsvc.Options
+	options.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	service, err := hashsvc.New(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Serve on the sockets of the backend this one replaces, if it was started by a restart
+	sockets, err := inheritedSockets()
+	if err != nil {
+		log.Fatal(err)
+	}
+	service.Inherit(sockets)
+	ctx, shutdown := context.WithCancel(context.Background())
+	go handleSignals(service, shutdown)
+	if err := service.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
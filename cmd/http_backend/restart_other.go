@@ -0,0 +1,29 @@
+//go:build !unix
+// +build !unix
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/nbopardi/udp_client_server/pkg/hashsvc"
+)
+
+// Finds no inherited sockets, since only Unix backends hand their sockets over on restart
+func inheritedSockets() ([]*os.File, error) {
+	return nil, nil
+}
+
+// Shuts the backend down on an interrupt
+// There is no SIGUSR2 to restart on, so start a second backend with reuse_port where it is supported instead
+func handleSignals(service *hashsvc.Service, shutdown context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	sig := <-signals
+	log.Printf("Received %v, shutting down\n", sig)
+	signal.Stop(signals)
+	shutdown()
+}
@@ -0,0 +1,83 @@
+//go:build unix
+// +build unix
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/nbopardi/udp_client_server/pkg/hashsvc"
+)
+
+// Environment variable through which a backend started by another one's restart learns how many sockets it inherits
+const inheritedSocketsEnv = "BACKEND_INHERITED_SOCKETS"
+
+// Finds the sockets inherited from the backend this one replaces, as the files after stderr, or none if it started afresh
+func inheritedSockets() ([]*os.File, error) {
+	value := os.Getenv(inheritedSocketsEnv)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(inheritedSocketsEnv)
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("%s is not a number of sockets: %q", inheritedSocketsEnv, value)
+	}
+	var sockets []*os.File
+	for i := 0; i < count; i++ {
+		sockets = append(sockets, os.NewFile(uintptr(3 + i), "inherited socket"))
+	}
+	return sockets, nil
+}
+
+// Starts a new backend from the executable on disk with the same arguments, handing it the sockets of this one,
+// so an upgraded binary takes over without refusing a connection while this one drains its in-flight requests
+// Returns the process ID of the new backend
+func restartBackend(service *hashsvc.Service) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	var pid int
+	err = service.Handover(func(files []*os.File) error {
+		cmd := exec.Command(executable, os.Args[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		cmd.ExtraFiles = files
+		cmd.Env = append(os.Environ(), inheritedSocketsEnv + "=" + strconv.Itoa(len(files)))
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		pid = cmd.Process.Pid
+		return nil
+	})
+	return pid, err
+}
+
+// Shuts the backend down on SIGINT or SIGTERM, so it stops cleanly under process supervisors
+// On SIGUSR2, first starts a new backend that takes over the sockets, to upgrade without downtime
+func handleSignals(service *hashsvc.Service, shutdown context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	for sig := range signals {
+		if sig != syscall.SIGUSR2 {
+			log.Printf("Received %v, shutting down\n", sig)
+			break
+		}
+		pid, err := restartBackend(service)
+		if err != nil {
+			log.Printf("Could not restart the backend, so it keeps running: %v\n", err)
+			continue
+		}
+		log.Printf("Started new backend %d on the same sockets, shutting down\n", pid)
+		break
+	}
+	signal.Stop(signals)
+	shutdown()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"flag"
+	"context"
+
+	"github.com/nbopardi/udp_client_server/internal/selftest"
+	"github.com/nbopardi/udp_client_server/pkg/udpclient"
+)
+
+// Returns a context that is done on the first Ctrl-C (or SIGTERM), so a run stops early and still reports its statistics
+// Only the first signal is caught, so a second Ctrl-C exits right away
+func interruptContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx
+}
+
+// Main function to set up a client that sends and received packets to a server over a UDP connection
+func main() {
+	// Run the compare, selftest, agent, orchestrate, or scenario subcommand instead of a test if asked to
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		os.Exit(udpclient.Compare(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		os.Exit(udpclient.Agent(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "orchestrate" {
+		os.Exit(udpclient.Orchestrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scenario" {
+		os.Exit(udpclient.Scenario(interruptContext(), os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		os.Exit(selftest.Main(os.Args[2:]))
+	}
+
+	// Command line args
+	var options udpclient.Options
+	options.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	// Exit with a distinct code for the results that fail the run, so it can gate automation
+	_, err := udpclient.Run(interruptContext(), options)
+	switch err {
+	case nil:
+	case udpclient.ErrServerNotListening:
+		os.Exit(udpclient.ExitServerNotListening)
+	case udpclient.ErrThresholdExceeded:
+		os.Exit(udpclient.ExitThresholdExceeded)
+	default:
+		log.Fatal(err)
+	}
+}
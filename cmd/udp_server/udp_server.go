@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+	"flag"
+
+	"github.com/nbopardi/udp_client_server/pkg/udpserver"
+)
+
+// Main function to set up a UDP server that listens for packets sent from a UDP client
+// The server makes a call to the HTTP backend server to get the hash of each packet (fnv1a unless another algorithm is chosen)
+// The hash is appended to the end of each packet's payload and reflected back to the UDP client
+func main() {
+	// Command line args
+	var options udpserver.Options
+	options.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := udpserver.Run(options); err != nil {
+		log.Fatal(err)
+	}
+}
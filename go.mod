@@ -0,0 +1,3 @@
+module github.com/nbopardi/udp_client_server
+
+go 1.20
@@ -0,0 +1,92 @@
+// Package backendwire defines what the UDP server and the HTTP backend agree on besides the hash endpoints themselves:
+// how requests to the backend are authenticated, and the layout of the datagrams of its UDP hash service
+package backendwire
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+// Environment variables holding the bearer token and the HMAC key when they are not given as flags,
+// which keeps them out of the process list
+const AuthTokenEnv = "BACKEND_AUTH_TOKEN"
+const HMACKeyEnv = "BACKEND_HMAC_KEY"
+
+// Headers carrying the time (in seconds since the Unix epoch) a request was signed at, and its HMAC signature
+const TimestampHeader = "X-Timestamp"
+const SignatureHeader = "X-Signature"
+
+// Computes the hex encoded HMAC-SHA256 signature of a request's method, path, signing time, and body
+func SignRequest(key []byte, method string, path string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Layout of the requests of the UDP hash service, with the request ID in little endian
+//   0: request ID (uint64) chosen by the caller and echoed in the response
+//   8: length (uint8) of the hash algorithm's name, or 0 for the backend's default algorithm
+//   9: name of the hash algorithm, followed by the payload
+// A response holds the request ID, a status byte, then the hash, or an error message if the status is not UDPHashOK
+const UDPHashHeaderSize = 9
+const idSize = 8
+
+// Status of a response of the UDP hash service
+const (
+	UDPHashOK = 0
+	UDPHashMalformed = 1
+	UDPHashUnknownAlgo = 2
+	UDPHashRateLimited = 3
+	UDPHashInjectedError = 4
+)
+
+// Largest datagram of the UDP hash service
+const MaxUDPHashDatagram = 65535
+
+// Appends a request of the UDP hash service for the hash of a payload with the named algorithm, or with the backend's
+// default algorithm if the name is empty
+func AppendUDPHashRequest(b []byte, id uint64, algoName string, payload []byte) []byte {
+	b = binary.LittleEndian.AppendUint64(b, id)
+	b = append(b, byte(len(algoName)))
+	b = append(b, algoName...)
+	return append(b, payload...)
+}
+
+// Splits a request of the UDP hash service into the name of its hash algorithm, empty for the default one, and its payload
+// Returns an error if the request is shorter than its header and name
+func ParseUDPHashRequest(request []byte) (string, []byte, error) {
+	if len(request) < UDPHashHeaderSize || len(request) < UDPHashHeaderSize + int(request[idSize]) {
+		return "", nil, errors.New("request is shorter than its header")
+	}
+	nameEnd := UDPHashHeaderSize + int(request[idSize])
+	return string(request[UDPHashHeaderSize:nameEnd]), request[nameEnd:], nil
+}
+
+// Reads the request ID a datagram of the UDP hash service starts with, or returns 0 if it is too short to hold one,
+// so even a malformed request is answered with the ID it carries
+func RequestID(datagram []byte) uint64 {
+	if len(datagram) < idSize {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(datagram)
+}
+
+// Appends a response of the UDP hash service to the request with the ID, holding the status and the hash or error message
+func AppendUDPHashResponse(b []byte, id uint64, status uint8, body []byte) []byte {
+	b = binary.LittleEndian.AppendUint64(b, id)
+	b = append(b, status)
+	return append(b, body...)
+}
+
+// Splits a response of the UDP hash service into its request ID, status, and the hash or error message
+// Returns an error if the response is shorter than its header
+func ParseUDPHashResponse(response []byte) (uint64, uint8, []byte, error) {
+	if len(response) < UDPHashHeaderSize {
+		return 0, 0, nil, errors.New("response is shorter than its header")
+	}
+	return RequestID(response), response[idSize], response[UDPHashHeaderSize:], nil
+}
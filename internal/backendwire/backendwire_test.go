@@ -0,0 +1,48 @@
+package backendwire
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The signature must stay the one older servers and backends compute
+func TestSignRequest(t *testing.T) {
+	signature := SignRequest([]byte("k3y"), "POST", "/hash", "1700000000", []byte("payload"))
+	if signature != "660133849b6640e132459cc673316f03e977bb5a88ed68bc2e5b44897c342e1e" {
+		t.Fatalf("signed as %s", signature)
+	}
+}
+
+// Requests and responses of the UDP hash service keep their layout byte for byte, and parse back to what was written
+func TestUDPHashLayout(t *testing.T) {
+	request := AppendUDPHashRequest(nil, 0x0807060504030201, "sha256", []byte("payload"))
+	want := append([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 6}, "sha256payload"...)
+	if !bytes.Equal(request, want) {
+		t.Fatalf("request laid out as %x, want %x", request, want)
+	}
+	algoName, payload, err := ParseUDPHashRequest(request)
+	if err != nil || algoName != "sha256" || string(payload) != "payload" || RequestID(request) != 0x0807060504030201 {
+		t.Fatalf("parsed %q, %q, %x (%v)", algoName, payload, RequestID(request), err)
+	}
+	algoName, payload, err = ParseUDPHashRequest(AppendUDPHashRequest(nil, 1, "", nil))
+	if err != nil || algoName != "" || len(payload) != 0 {
+		t.Fatalf("parsed an empty request as %q, %q (%v)", algoName, payload, err)
+	}
+	for _, malformed := range [][]byte{nil, {1, 2, 3}, {0, 0, 0, 0, 0, 0, 0, 0, 4, 'x'}} {
+		if _, _, err := ParseUDPHashRequest(malformed); err == nil {
+			t.Fatalf("parsed malformed request %x", malformed)
+		}
+	}
+	if RequestID([]byte{1, 2, 3}) != 0 {
+		t.Fatal("read an ID from a request too short to hold one")
+	}
+
+	response := AppendUDPHashResponse(nil, 42, UDPHashUnknownAlgo, []byte("unknown"))
+	id, status, body, err := ParseUDPHashResponse(response)
+	if err != nil || id != 42 || status != UDPHashUnknownAlgo || string(body) != "unknown" || len(response) != UDPHashHeaderSize + 7 {
+		t.Fatalf("parsed %x as %d, %d, %q (%v)", response, id, status, body, err)
+	}
+	if _, _, _, err := ParseUDPHashResponse(response[:UDPHashHeaderSize - 1]); err == nil {
+		t.Fatal("parsed a response shorter than its header")
+	}
+}
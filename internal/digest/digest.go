@@ -0,0 +1,439 @@
+// Package digest holds the hash algorithms shared by the HTTP backend, the UDP server, and the UDP client
+package digest
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"hash/crc32"
+	"hash/crc64"
+	"hash/fnv"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+// Hash algorithms the HTTP backend can compute over a payload, shared by the backend, the server, and the client
+// Every digest is appended to the payload as the algorithm's Sum outputs it, so the 64bit ones are in big endian
+// Each algorithm keeps a pool of hashing objects, so concurrent requests never share one
+
+// Name of the algorithm used when none is given, which is the fnv1a hash that was always used
+const Default = "fnv1a64"
+
+// Largest digest produced by any of the algorithms
+const MaxSize = 32
+
+// A hash algorithm with a pool of its hashing objects
+// name: the name the algorithm was looked up by
+// size: the number of bytes in the algorithm's digests
+type Algorithm struct {
+	name	string
+	size	int
+	pool	*sync.Pool
+}
+
+// Creates an algorithm whose hashing objects are created with newHash
+func newAlgorithm(newHash func() hash.Hash) Algorithm {
+	return Algorithm{
+		size: newHash().Size(),
+		pool: &sync.Pool{
+			New: func() interface{} {
+				return newHash()
+			},
+		},
+	}
+}
+
+// Supported hash algorithms by name
+var algorithms = map[string]Algorithm{
+	"fnv1a64": newAlgorithm(func() hash.Hash { return fnv.New64a() }),
+	"fnv1a128": newAlgorithm(fnv.New128a),
+	"xxhash64": newAlgorithm(func() hash.Hash { return newXXHash64() }),
+	"crc32": newAlgorithm(func() hash.Hash { return crc32.NewIEEE() }),
+	"crc64": newAlgorithm(func() hash.Hash { return crc64.New(crc64.MakeTable(crc64.ECMA)) }),
+	"sha256": newAlgorithm(sha256.New),
+	"blake3": newAlgorithm(func() hash.Hash { return newBlake3() }),
+}
+
+// Returns the names of the supported hash algorithms in sorted order
+func Names() []string {
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Looks up a supported hash algorithm by name
+func Lookup(name string) (Algorithm, error) {
+	algo, ok := algorithms[name]
+	if !ok {
+		return Algorithm{}, fmt.Errorf("unknown hash algorithm %q (supported: %v)", name, Names())
+	}
+	algo.name = name
+	return algo, nil
+}
+
+// Returns the name the algorithm was looked up by
+func (algo Algorithm) Name() string {
+	return algo.name
+}
+
+// Returns the number of bytes in the algorithm's digests
+func (algo Algorithm) Size() int {
+	return algo.size
+}
+
+// Calculates the digest of a given byte slice with a hashing object from the algorithm's pool
+func (algo Algorithm) Sum(data []byte) []byte {
+	hasher := algo.pool.Get().(hash.Hash)
+	defer algo.pool.Put(hasher)
+	hasher.Reset()
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
+
+// Calculates the digest of everything read from a reader, hashing it as it is read instead of buffering it
+func (algo Algorithm) SumReader(r io.Reader) ([]byte, error) {
+	hasher := algo.pool.Get().(hash.Hash)
+	defer algo.pool.Put(hasher)
+	hasher.Reset()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// Primes of the 64bit xxHash algorithm
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// Streaming 64bit xxHash with a seed of 0
+// acc: the four accumulators of the stripes of 32 bytes hashed so far
+// buffer: the bytes written since the last full stripe
+// total: the number of bytes written in total
+type xxHash64 struct {
+	acc		[4]uint64
+	buffer	[32]byte
+	buffered	int
+	total	uint64
+}
+
+// Creates a 64bit xxHash hashing object
+func newXXHash64() *xxHash64 {
+	h := &xxHash64{}
+	h.Reset()
+	return h
+}
+
+// Mixes 8 bytes of input into an accumulator
+func xxRound(acc uint64, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+// Merges an accumulator into the hash of a long input
+func xxMergeRound(h uint64, acc uint64) uint64 {
+	h ^= xxRound(0, acc)
+	return h * xxPrime1 + xxPrime4
+}
+
+func (h *xxHash64) Reset() {
+	// The accumulators wrap around, which constant arithmetic would not allow
+	prime1 := xxPrime1
+	h.acc = [4]uint64{prime1 + xxPrime2, xxPrime2, 0, -prime1}
+	h.buffered = 0
+	h.total = 0
+}
+
+func (h *xxHash64) Size() int {
+	return 8
+}
+
+func (h *xxHash64) BlockSize() int {
+	return 32
+}
+
+// Hashes a full stripe of 32 bytes into the accumulators
+func (h *xxHash64) stripe(b []byte) {
+	for i := range h.acc {
+		h.acc[i] = xxRound(h.acc[i], binary.LittleEndian.Uint64(b[i * 8:]))
+	}
+}
+
+func (h *xxHash64) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+
+	// Complete a partly buffered stripe first
+	if h.buffered > 0 {
+		copied := copy(h.buffer[h.buffered:], p)
+		h.buffered += copied
+		p = p[copied:]
+		if h.buffered < len(h.buffer) {
+			return n, nil
+		}
+		h.stripe(h.buffer[:])
+		h.buffered = 0
+	}
+	for len(p) >= len(h.buffer) {
+		h.stripe(p[:len(h.buffer)])
+		p = p[len(h.buffer):]
+	}
+	h.buffered = copy(h.buffer[:], p)
+	return n, nil
+}
+
+// Returns the hash of the bytes written so far
+func (h *xxHash64) Sum64() uint64 {
+	var sum uint64
+	if h.total >= 32 {
+		sum = bits.RotateLeft64(h.acc[0], 1) + bits.RotateLeft64(h.acc[1], 7) + bits.RotateLeft64(h.acc[2], 12) + bits.RotateLeft64(h.acc[3], 18)
+		for _, acc := range h.acc {
+			sum = xxMergeRound(sum, acc)
+		}
+	} else {
+		sum = h.acc[2] + xxPrime5
+	}
+	sum += h.total
+
+	// Mix in the bytes left over after the last full stripe
+	rest := h.buffer[:h.buffered]
+	for ; len(rest) >= 8; rest = rest[8:] {
+		sum ^= xxRound(0, binary.LittleEndian.Uint64(rest))
+		sum = bits.RotateLeft64(sum, 27) * xxPrime1 + xxPrime4
+	}
+	if len(rest) >= 4 {
+		sum ^= uint64(binary.LittleEndian.Uint32(rest)) * xxPrime1
+		sum = bits.RotateLeft64(sum, 23) * xxPrime2 + xxPrime3
+		rest = rest[4:]
+	}
+	for _, b := range rest {
+		sum ^= uint64(b) * xxPrime5
+		sum = bits.RotateLeft64(sum, 11) * xxPrime1
+	}
+
+	// Avalanche the bits
+	sum ^= sum >> 33
+	sum *= xxPrime2
+	sum ^= sum >> 29
+	sum *= xxPrime3
+	sum ^= sum >> 32
+	return sum
+}
+
+func (h *xxHash64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.Sum64())
+	return append(b, sum[:]...)
+}
+
+// Sizes and domain separation flags of the BLAKE3 algorithm
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+	blake3ChunkStart = 1 << 0
+	blake3ChunkEnd = 1 << 1
+	blake3Parent = 1 << 2
+	blake3Root = 1 << 3
+)
+
+// Initial chaining value of BLAKE3, which is the same as SHA-256's
+var blake3IV = [8]uint32{0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19}
+
+// Order the message words are permuted into between rounds
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+// Mixes two message words into a column or diagonal of the state
+func blake3G(state *[16]uint32, a, b, c, d int, mx, my uint32) {
+	state[a] += state[b] + mx
+	state[d] = bits.RotateLeft32(state[d] ^ state[a], -16)
+	state[c] += state[d]
+	state[b] = bits.RotateLeft32(state[b] ^ state[c], -12)
+	state[a] += state[b] + my
+	state[d] = bits.RotateLeft32(state[d] ^ state[a], -8)
+	state[c] += state[d]
+	state[b] = bits.RotateLeft32(state[b] ^ state[c], -7)
+}
+
+// Compresses a block into a chaining value, returning the full 16 word state so the root can be read from it
+func blake3Compress(cv [8]uint32, block [16]uint32, counter uint64, blockLen uint32, flags uint32) [16]uint32 {
+	state := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	for round := 0; round < 7; round++ {
+		blake3G(&state, 0, 4, 8, 12, block[0], block[1])
+		blake3G(&state, 1, 5, 9, 13, block[2], block[3])
+		blake3G(&state, 2, 6, 10, 14, block[4], block[5])
+		blake3G(&state, 3, 7, 11, 15, block[6], block[7])
+		blake3G(&state, 0, 5, 10, 15, block[8], block[9])
+		blake3G(&state, 1, 6, 11, 12, block[10], block[11])
+		blake3G(&state, 2, 7, 8, 13, block[12], block[13])
+		blake3G(&state, 3, 4, 9, 14, block[14], block[15])
+		var permuted [16]uint32
+		for i, j := range blake3Permutation {
+			permuted[i] = block[j]
+		}
+		block = permuted
+	}
+	for i := 0; i < 8; i++ {
+		state[i] ^= state[i + 8]
+		state[i + 8] ^= cv[i]
+	}
+	return state
+}
+
+// Converts a block of bytes into little endian words
+func blake3Words(block []byte) [16]uint32 {
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(block[i * 4:])
+	}
+	return words
+}
+
+// Returns the first 8 words of a compressed state, which are the chaining value
+func blake3FirstEight(state [16]uint32) [8]uint32 {
+	var cv [8]uint32
+	copy(cv[:], state[:8])
+	return cv
+}
+
+// The inputs of the last compression of a node, kept so it can be compressed either as a chaining value or as the root
+type blake3Output struct {
+	cv			[8]uint32
+	block		[16]uint32
+	counter		uint64
+	blockLen	uint32
+	flags		uint32
+}
+
+func (out blake3Output) chainingValue() [8]uint32 {
+	return blake3FirstEight(blake3Compress(out.cv, out.block, out.counter, out.blockLen, out.flags))
+}
+
+func (out blake3Output) root() [32]byte {
+	var digest [32]byte
+	state := blake3Compress(out.cv, out.block, 0, out.blockLen, out.flags | blake3Root)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(digest[i * 4:], state[i])
+	}
+	return digest
+}
+
+// Builds the output of a parent node from the chaining values of its two children
+func blake3ParentOutput(left [8]uint32, right [8]uint32) blake3Output {
+	var block [16]uint32
+	copy(block[:8], left[:])
+	copy(block[8:], right[:])
+	return blake3Output{cv: blake3IV, block: block, blockLen: blake3BlockLen, flags: blake3Parent}
+}
+
+// Streaming BLAKE3 in its default hash mode, with a 32 byte digest
+// cv, counter: the chaining value and index of the current chunk
+// block: the bytes of the current chunk's block that are not compressed yet
+// blocksCompressed: the number of blocks of the current chunk compressed so far
+// stack: the chaining values of the completed subtrees, merged as chunks complete
+type blake3Hash struct {
+	cv					[8]uint32
+	counter				uint64
+	block				[blake3BlockLen]byte
+	blockLen			int
+	blocksCompressed	int
+	stack				[][8]uint32
+}
+
+// Creates a BLAKE3 hashing object
+func newBlake3() *blake3Hash {
+	h := &blake3Hash{}
+	h.Reset()
+	return h
+}
+
+func (h *blake3Hash) Reset() {
+	h.cv = blake3IV
+	h.counter = 0
+	h.blockLen = 0
+	h.blocksCompressed = 0
+	h.stack = h.stack[:0]
+}
+
+func (h *blake3Hash) Size() int {
+	return 32
+}
+
+func (h *blake3Hash) BlockSize() int {
+	return blake3BlockLen
+}
+
+// Returns the flag that marks the first block of a chunk, if the current block is it
+func (h *blake3Hash) startFlag() uint32 {
+	if h.blocksCompressed == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+// Returns the output of the current chunk, with its last block not compressed yet
+func (h *blake3Hash) chunkOutput() blake3Output {
+	var block [blake3BlockLen]byte
+	copy(block[:], h.block[:h.blockLen])
+	return blake3Output{cv: h.cv, block: blake3Words(block[:]), counter: h.counter, blockLen: uint32(h.blockLen), flags: h.startFlag() | blake3ChunkEnd}
+}
+
+// Pushes the chaining value of a completed chunk, first merging it with the completed subtrees of the same size
+// The number of trailing zero bits of the total number of chunks is the number of subtrees to merge
+func (h *blake3Hash) pushChunk(cv [8]uint32, totalChunks uint64) {
+	for totalChunks & 1 == 0 {
+		cv = blake3ParentOutput(h.stack[len(h.stack) - 1], cv).chainingValue()
+		h.stack = h.stack[:len(h.stack) - 1]
+		totalChunks >>= 1
+	}
+	h.stack = append(h.stack, cv)
+}
+
+func (h *blake3Hash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// Start a new chunk once the current one is full, since only now is it known not to be the last
+		if h.blocksCompressed * blake3BlockLen + h.blockLen == blake3ChunkLen {
+			h.pushChunk(h.chunkOutput().chainingValue(), h.counter + 1)
+			h.cv = blake3IV
+			h.counter++
+			h.blockLen = 0
+			h.blocksCompressed = 0
+		}
+
+		// Compress a full block once more input arrives, since only now is it known not to be the chunk's last
+		if h.blockLen == blake3BlockLen {
+			h.cv = blake3FirstEight(blake3Compress(h.cv, blake3Words(h.block[:]), h.counter, blake3BlockLen, h.startFlag()))
+			h.blocksCompressed++
+			h.blockLen = 0
+		}
+		copied := copy(h.block[h.blockLen:], p)
+		h.blockLen += copied
+		p = p[copied:]
+	}
+	return n, nil
+}
+
+func (h *blake3Hash) Sum(b []byte) []byte {
+	// Merge the last chunk with all the completed subtrees, from the smallest to the largest
+	out := h.chunkOutput()
+	for i := len(h.stack) - 1; i >= 0; i-- {
+		out = blake3ParentOutput(h.stack[i], out.chainingValue())
+	}
+	digest := out.root()
+	return append(b, digest[:]...)
+}
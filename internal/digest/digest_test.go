@@ -0,0 +1,140 @@
+package digest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// Returns the input of the BLAKE3 test vectors: the bytes 0 to 250 repeated up to the given length
+func blake3Input(size int) []byte {
+	input := make([]byte, size)
+	for i := range input {
+		input[i] = byte(i % 251)
+	}
+	return input
+}
+
+// Writes the input to a new hashing object of the algorithm a piece at a time, so that buffering across writes is covered
+func sumInPieces(algo Algorithm, input []byte, piece int) []byte {
+	hasher := algo.pool.New().(hash.Hash)
+	for len(input) > 0 {
+		n := piece
+		if n > len(input) {
+			n = len(input)
+		}
+		hasher.Write(input[:n])
+		input = input[n:]
+	}
+	return hasher.Sum(nil)
+}
+
+// Digests of the published xxh64 test vectors, with a seed of 0
+func TestXXHash64(t *testing.T) {
+	s63 := "Call me Ishmael. Some years ago--never mind how long precisely-"
+	vectors := []struct {
+		input	string
+		hash	string
+	}{
+		{"", "ef46db3751d8e999"},
+		{"a", "d24ec4f1a98c6e5b"},
+		{"as", "1c330fb2d66be179"},
+		{"asd", "631c37ce72a97393"},
+		{"asdf", "415872f599cea71e"},
+		{s63, "02a2e85470d6fd96"},
+	}
+	algo, err := Lookup("xxhash64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors {
+		if got := hex.EncodeToString(algo.Sum([]byte(v.input))); got != v.hash {
+			t.Errorf("xxhash64 of %q is %s, want %s", v.input, got, v.hash)
+		}
+		for _, piece := range []int{1, 7, 32} {
+			if got := hex.EncodeToString(sumInPieces(algo, []byte(v.input), piece)); got != v.hash {
+				t.Errorf("xxhash64 of %q written %d bytes at a time is %s, want %s", v.input, piece, got, v.hash)
+			}
+		}
+	}
+}
+
+// Digests of the official BLAKE3 test vectors, which cover the boundaries of blocks (64 bytes) and chunks (1024 bytes)
+// and trees of chunks of every shape up to 100 chunks
+func TestBlake3(t *testing.T) {
+	vectors := []struct {
+		size	int
+		hash	string
+	}{
+		{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{2049, "5f4d72f40d7a5f82b15ca2b2e44b1de3c2ef86c426c95c1af0b6879522563030"},
+		{3072, "b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2"},
+		{3073, "7124b49501012f81cc7f11ca069ec9226cecb8a2c850cfe644e327d22d3e1cd3"},
+		{4096, "015094013f57a5277b59d8475c0501042c0b642e531b0a1c8f58d2163229e969"},
+		{4097, "9b4052b38f1c5fc8b1f9ff7ac7b27cd242487b3d890d15c96a1c25b8aa0fb995"},
+		{5120, "9cadc15fed8b5d854562b26a9536d9707cadeda9b143978f319ab34230535833"},
+		{5121, "628bd2cb2004694adaab7bbd778a25df25c47b9d4155a55f8fbd79f2fe154cff"},
+		{6144, "3e2e5b74e048f3add6d21faab3f83aa44d3b2278afb83b80b3c35164ebeca205"},
+		{6145, "f1323a8631446cc50536a9f705ee5cb619424d46887f3c376c695b70e0f0507f"},
+		{7168, "61da957ec2499a95d6b8023e2b0e604ec7f6b50e80a9678b89d2628e99ada77a"},
+		{7169, "a003fc7a51754a9b3c7fae0367ab3d782dccf28855a03d435f8cfe74605e7817"},
+		{8192, "aae792484c8efe4f19e2ca7d371d8c467ffb10748d8a5a1ae579948f718a2a63"},
+		{8193, "bab6c09cb8ce8cf459261398d2e7aef35700bf488116ceb94a36d0f5f1b7bc3b"},
+		{16384, "f875d6646de28985646f34ee13be9a576fd515f76b5b0a26bb324735041ddde4"},
+		{31744, "62b6960e1a44bcc1eb1a611a8d6235b6b4b78f32e7abc4fb4c6cdcce94895c47"},
+		{102400, "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+	}
+	algo, err := Lookup("blake3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors {
+		input := blake3Input(v.size)
+		if got := hex.EncodeToString(algo.Sum(input)); got != v.hash {
+			t.Errorf("blake3 of %d bytes is %s, want %s", v.size, got, v.hash)
+		}
+		for _, piece := range []int{1, 63, 64, 1000, 1024} {
+			if got := hex.EncodeToString(sumInPieces(algo, input, piece)); got != v.hash {
+				t.Errorf("blake3 of %d bytes written %d bytes at a time is %s, want %s", v.size, piece, got, v.hash)
+			}
+		}
+	}
+}
+
+// Hashing a reader gives the same digest as hashing its bytes, for every algorithm, however the reader splits them up
+func TestSumReader(t *testing.T) {
+	inputs := [][]byte{nil, []byte("a"), []byte(strings.Repeat("payload ", 100)), blake3Input(5000)}
+	for _, name := range Names() {
+		algo, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if algo.Name() != name || algo.Size() > MaxSize || len(algo.Sum(nil)) != algo.Size() {
+			t.Fatalf("%s has name %q and size %d, and a digest of %d bytes", name, algo.Name(), algo.Size(), len(algo.Sum(nil)))
+		}
+		for _, input := range inputs {
+			want := algo.Sum(input)
+			for _, r := range []io.Reader{bytes.NewReader(input), iotest.OneByteReader(bytes.NewReader(input)), iotest.HalfReader(bytes.NewReader(input))} {
+				got, err := algo.SumReader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s of a reader of %d bytes is %x, want %x", name, len(input), got, want)
+				}
+			}
+		}
+	}
+	if _, err := Lookup("md5"); err == nil {
+		t.Fatal("unknown algorithm found")
+	}
+}
@@ -0,0 +1,223 @@
+// Package protocol defines the layout of the packets the UDP client sends and the UDP server reflects
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Layout of the versioned header the client writes at the start of each payload, with all fields in little endian
+//   0: magic (uint16) identifies packets of this tool
+//   2: version (uint8) of the header layout
+//   3: flags (uint8) for per-packet options (i.e. FlagRetransmit, FlagServerTimestamps, FlagEcho, FlagHeartbeat, FlagExtension)
+//   4: connection ID (uint32) of the client connection (flow) the packet belongs to, each with its own sequence space
+//   8: sequence number (uint64)
+//  16: send timestamp (int64) in nanoseconds since the Unix epoch
+// The body the client's payload generators fill follows the header, starting with an extension area if the packet has one,
+// and the server appends the digest of the whole payload (header and body) after it, followed by its own timestamps if
+// the packet asks for them
+const HeaderSize = 24
+const Magic = 0x55DB
+const Version = 1
+const magicOffset = 0
+const versionOffset = 2
+const flagsOffset = 3
+const connIDOffset = 4
+const seqOffset = 8
+const timestampOffset = 16
+
+// Header flag marking a packet as a retransmission of an earlier attempt
+// Retransmissions keep the sequence number and send timestamp of the first attempt
+const FlagRetransmit = 0x01
+
+// Header flag asking the server to append the times it received and reflected the packet after the digest
+const FlagServerTimestamps = 0x02
+
+// Header flag asking the server to hash the packet itself instead of calling the HTTP backend
+// The reflection looks the same either way, so only the cost to the server differs
+const FlagEcho = 0x04
+
+// Header flag marking a heartbeat, sent only to keep NAT and conntrack entries alive while idle
+// Heartbeats have just a header, are not reflected, and are left out of every statistic
+const FlagHeartbeat = 0x08
+
+// Header flag marking a packet whose body starts with an extension area: its length (uint16) in little endian followed by
+// that many bytes of a protobuf PacketMetadata message (see packet.proto)
+// The extension is part of the payload, so the digest covers it and the reflection carries it back unchanged
+const FlagExtension = 0x10
+
+// Number of bytes of the length before an extension, which limits an extension to MaxExtensionSize bytes
+const ExtensionLengthSize = 2
+const MaxExtensionSize = 65535
+
+// Number of bytes of server timestamps appended after the digest when asked for
+// The receive time is followed by the send time, each an int64 in nanoseconds since the Unix epoch in little endian
+const ServerTimestampsSize = 16
+
+// Largest payload of a single UDP datagram over IPv4, which a reflection with its digest must fit in
+const MaxDatagramSize = 65507
+
+// Fields of the header at the start of each payload
+type Header struct {
+	Flags		uint8
+	ConnID		uint32
+	Seq			uint64
+	Timestamp	int64
+}
+
+// A packet as the client sends it, or as the server reflects it
+// Extension: the extension area after the header, without its length, if the packet has the FlagExtension flag
+// Body: the bytes after the header and extension
+// Digest: the digest the server appended, or nil for a packet that has not been reflected
+// ServerRecvTime, ServerSendTime: the times the server received and reflected the packet, if the packet asked for them
+type Packet struct {
+	Header
+	Extension		[]byte
+	Body			[]byte
+	Digest			[]byte
+	ServerRecvTime	int64
+	ServerSendTime	int64
+}
+
+// Writes the header to the start of a payload, which must be at least HeaderSize bytes long
+func PutHeader(payload []byte, header Header) {
+	binary.LittleEndian.PutUint16(payload[magicOffset:], Magic)
+	payload[versionOffset] = Version
+	payload[flagsOffset] = header.Flags
+	binary.LittleEndian.PutUint32(payload[connIDOffset:], header.ConnID)
+	binary.LittleEndian.PutUint64(payload[seqOffset:], header.Seq)
+	binary.LittleEndian.PutUint64(payload[timestampOffset:], uint64(header.Timestamp))
+}
+
+// Reads the header from the start of a payload
+// Returns an error if the payload is too short or was not written with this header version
+func ParseHeader(payload []byte) (Header, error) {
+	if len(payload) < HeaderSize {
+		return Header{}, fmt.Errorf("payload of %d bytes is shorter than the %d byte header", len(payload), HeaderSize)
+	}
+	if magic := binary.LittleEndian.Uint16(payload[magicOffset:]); magic != Magic {
+		return Header{}, fmt.Errorf("unknown header magic %#04x", magic)
+	}
+	if version := payload[versionOffset]; version != Version {
+		return Header{}, fmt.Errorf("unsupported header version %d", version)
+	}
+	return Header{
+		Flags: payload[flagsOffset],
+		ConnID: binary.LittleEndian.Uint32(payload[connIDOffset:]),
+		Seq: binary.LittleEndian.Uint64(payload[seqOffset:]),
+		Timestamp: int64(binary.LittleEndian.Uint64(payload[timestampOffset:])),
+	}, nil
+}
+
+// Checks that a payload starts with a header of the supported version
+func ValidHeader(payload []byte) bool {
+	return len(payload) >= HeaderSize &&
+		binary.LittleEndian.Uint16(payload[magicOffset:]) == Magic &&
+		payload[versionOffset] == Version
+}
+
+// Sets flags in the header of a payload in place, keeping the ones already set
+func AddFlags(payload []byte, flags uint8) {
+	payload[flagsOffset] |= flags
+}
+
+// Appends the times the server received and reflected a packet to it, in nanoseconds since the Unix epoch
+func AppendServerTimestamps(packet []byte, recvTime int64, sendTime int64) []byte {
+	var timestamps [ServerTimestampsSize]byte
+	binary.LittleEndian.PutUint64(timestamps[:], uint64(recvTime))
+	binary.LittleEndian.PutUint64(timestamps[8:], uint64(sendTime))
+	return append(packet, timestamps[:]...)
+}
+
+// Reads the times the server received and reflected a packet from the timestamps it appended
+// Returns an error if there are fewer than ServerTimestampsSize bytes
+func ParseServerTimestamps(timestamps []byte) (int64, int64, error) {
+	if len(timestamps) < ServerTimestampsSize {
+		return 0, 0, fmt.Errorf("server timestamps of %d bytes are shorter than %d bytes", len(timestamps), ServerTimestampsSize)
+	}
+	return int64(binary.LittleEndian.Uint64(timestamps)), int64(binary.LittleEndian.Uint64(timestamps[8:])), nil
+}
+
+// Appends the extension area of a packet, the length of the extension followed by the extension itself
+// The extension must be at most MaxExtensionSize bytes long
+func AppendExtension(packet []byte, extension []byte) []byte {
+	var length [ExtensionLengthSize]byte
+	binary.LittleEndian.PutUint16(length[:], uint16(len(extension)))
+	return append(append(packet, length[:]...), extension...)
+}
+
+// Reads the extension area at the start of the body of a packet with the FlagExtension flag
+// Returns the extension and the rest of the body, which share the memory of body, or an error if body is too short
+func ParseExtension(body []byte) ([]byte, []byte, error) {
+	if len(body) < ExtensionLengthSize {
+		return nil, nil, fmt.Errorf("body of %d bytes is too short for the extension length", len(body))
+	}
+	length := int(binary.LittleEndian.Uint16(body))
+	body = body[ExtensionLengthSize:]
+	if len(body) < length {
+		return nil, nil, fmt.Errorf("extension of %d bytes is longer than the %d bytes after its length", length, len(body))
+	}
+	return body[:length], body[length:], nil
+}
+
+// Returns the packet as it is sent, with the digest and the server timestamps after the body if it has a digest
+// The extension area is only written if the packet has the FlagExtension flag, and the server timestamps if it asks for them
+func (p *Packet) Marshal() []byte {
+	size := HeaderSize + len(p.Body) + len(p.Digest)
+	if p.Flags & FlagExtension != 0 {
+		size += ExtensionLengthSize + len(p.Extension)
+	}
+	if p.Digest != nil && p.Flags & FlagServerTimestamps != 0 {
+		size += ServerTimestampsSize
+	}
+	data := make([]byte, HeaderSize, size)
+	PutHeader(data, p.Header)
+	if p.Flags & FlagExtension != 0 {
+		data = AppendExtension(data, p.Extension)
+	}
+	data = append(data, p.Body...)
+	if p.Digest == nil {
+		return data
+	}
+	data = append(data, p.Digest...)
+	if p.Flags & FlagServerTimestamps != 0 {
+		data = AppendServerTimestamps(data, p.ServerRecvTime, p.ServerSendTime)
+	}
+	return data
+}
+
+// Reads a packet as the client sent it if digestSize is 0, or as the server reflected it with a digest of digestSize bytes
+// A reflected packet asking for the server timestamps must have them after the digest
+// The extension, body, and digest of the packet share the memory of data
+// Returns an error if data is too short, including for its extension area, or does not start with a header of the supported version
+func Unmarshal(data []byte, digestSize int) (Packet, error) {
+	header, err := ParseHeader(data)
+	if err != nil {
+		return Packet{}, err
+	}
+	packet := Packet{Header: header}
+	end := len(data)
+	if digestSize > 0 {
+		trailer := digestSize
+		if header.Flags & FlagServerTimestamps != 0 {
+			trailer += ServerTimestampsSize
+		}
+		if end - HeaderSize < trailer {
+			return Packet{}, fmt.Errorf("packet of %d bytes is too short for a %d byte digest after the header", len(data), digestSize)
+		}
+		if header.Flags & FlagServerTimestamps != 0 {
+			end -= ServerTimestampsSize
+			packet.ServerRecvTime, packet.ServerSendTime, _ = ParseServerTimestamps(data[end:])
+		}
+		end -= digestSize
+		packet.Digest = data[end:end + digestSize]
+	}
+	packet.Body = data[HeaderSize:end]
+	if header.Flags & FlagExtension != 0 {
+		packet.Extension, packet.Body, err = ParseExtension(packet.Body)
+		if err != nil {
+			return Packet{}, err
+		}
+	}
+	return packet, nil
+}
@@ -0,0 +1,373 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// Headers covering every flag combination along with the extremes of the other fields
+func testHeaders() []Header {
+	var headers []Header
+	for flags := 0; flags < 256; flags++ {
+		headers = append(headers,
+			Header{Flags: uint8(flags)},
+			Header{Flags: uint8(flags), ConnID: 7, Seq: 42, Timestamp: 1602857400123456789},
+			Header{Flags: uint8(flags), ConnID: math.MaxUint32, Seq: math.MaxUint64, Timestamp: math.MaxInt64},
+			Header{Flags: uint8(flags), ConnID: 1, Seq: 1, Timestamp: math.MinInt64},
+		)
+	}
+	return headers
+}
+
+// The header must keep the layout older clients and servers use, byte for byte
+func TestHeaderLayout(t *testing.T) {
+	payload := make([]byte, HeaderSize)
+	PutHeader(payload, Header{Flags: FlagServerTimestamps | FlagEcho, ConnID: 0x04030201, Seq: 0x0c0b0a0908070605, Timestamp: 0x14131211100f0e0d})
+	want := []byte{
+		0xdb, 0x55, 0x01, 0x06,
+		0x01, 0x02, 0x03, 0x04,
+		0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c,
+		0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12, 0x13, 0x14,
+	}
+	if !bytes.Equal(payload, want) {
+		t.Fatalf("header is %x, want %x", payload, want)
+	}
+}
+
+// The flags must be distinct bits, since a packet can carry several at once
+func TestFlagsDistinct(t *testing.T) {
+	flags := []uint8{FlagRetransmit, FlagServerTimestamps, FlagEcho, FlagHeartbeat, FlagExtension}
+	var seen uint8
+	for _, flag := range flags {
+		if flag == 0 || flag & (flag - 1) != 0 {
+			t.Errorf("flag %#02x is not a single bit", flag)
+		}
+		if seen & flag != 0 {
+			t.Errorf("flag %#02x is used twice", flag)
+		}
+		seen |= flag
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	for _, header := range testHeaders() {
+		payload := make([]byte, HeaderSize)
+		PutHeader(payload, header)
+		if !ValidHeader(payload) {
+			t.Fatalf("header %+v is not valid once written", header)
+		}
+		got, err := ParseHeader(payload)
+		if err != nil {
+			t.Fatalf("could not parse header %+v: %v", header, err)
+		}
+		if got != header {
+			t.Fatalf("parsed header %+v, want %+v", got, header)
+		}
+	}
+}
+
+// Every payload shorter than the header, or with a corrupted magic or version, must be rejected without panicking
+func TestParseHeaderErrors(t *testing.T) {
+	valid := make([]byte, HeaderSize)
+	PutHeader(valid, Header{Flags: FlagEcho, ConnID: 3, Seq: 9, Timestamp: 27})
+
+	for n := 0; n < HeaderSize; n++ {
+		if _, err := ParseHeader(valid[:n]); err == nil {
+			t.Errorf("parsed a header from %d bytes", n)
+		}
+		if ValidHeader(valid[:n]) {
+			t.Errorf("header of %d bytes is valid", n)
+		}
+	}
+
+	for i := 0; i <= versionOffset; i++ {
+		for value := 0; value < 256; value++ {
+			corrupted := append([]byte(nil), valid...)
+			if byte(value) == corrupted[i] {
+				continue
+			}
+			corrupted[i] = byte(value)
+			if _, err := ParseHeader(corrupted); err == nil {
+				t.Fatalf("parsed a header with byte %d set to %#02x", i, value)
+			}
+			if ValidHeader(corrupted) {
+				t.Fatalf("header with byte %d set to %#02x is valid", i, value)
+			}
+		}
+	}
+}
+
+func TestAddFlags(t *testing.T) {
+	for _, header := range testHeaders() {
+		for flags := 0; flags < 256; flags += 17 {
+			payload := make([]byte, HeaderSize)
+			PutHeader(payload, header)
+			AddFlags(payload, uint8(flags))
+			got, err := ParseHeader(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := header
+			want.Flags |= uint8(flags)
+			if got != want {
+				t.Fatalf("header with added flags %#02x is %+v, want %+v", flags, got, want)
+			}
+		}
+	}
+}
+
+func TestServerTimestamps(t *testing.T) {
+	times := []int64{0, 1, -1, 1602857400123456789, math.MaxInt64, math.MinInt64}
+	for _, recvTime := range times {
+		for _, sendTime := range times {
+			packet := AppendServerTimestamps([]byte("payload"), recvTime, sendTime)
+			if len(packet) != len("payload") + ServerTimestampsSize {
+				t.Fatalf("appended %d bytes of timestamps, want %d", len(packet) - len("payload"), ServerTimestampsSize)
+			}
+			gotRecv, gotSend, err := ParseServerTimestamps(packet[len("payload"):])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotRecv != recvTime || gotSend != sendTime {
+				t.Fatalf("parsed timestamps %d and %d, want %d and %d", gotRecv, gotSend, recvTime, sendTime)
+			}
+		}
+	}
+	for n := 0; n < ServerTimestampsSize; n++ {
+		if _, _, err := ParseServerTimestamps(make([]byte, n)); err == nil {
+			t.Errorf("parsed server timestamps from %d bytes", n)
+		}
+	}
+}
+
+// Packets as the client sends them, and as the server reflects them with digests of every size the algorithms produce
+func TestMarshalUnmarshal(t *testing.T) {
+	bodies := [][]byte{{}, []byte("x"), bytes.Repeat([]byte{0xab}, 1448)}
+	digestSizes := []int{0, 4, 8, 16, 32}
+	for _, header := range testHeaders() {
+		for _, body := range bodies {
+			for _, digestSize := range digestSizes {
+				packet := Packet{Header: header, Body: body}
+				if header.Flags & FlagExtension != 0 {
+					packet.Extension = []byte{0x0a, 0x03, 'r', 'u', 'n'}
+				}
+				if digestSize > 0 {
+					packet.Digest = bytes.Repeat([]byte{0xcd}, digestSize)
+					if header.Flags & FlagServerTimestamps != 0 {
+						packet.ServerRecvTime = header.Timestamp + 1
+						packet.ServerSendTime = header.Timestamp + 2
+					}
+				}
+
+				data := packet.Marshal()
+				size := HeaderSize + len(body) + digestSize
+				if header.Flags & FlagExtension != 0 {
+					size += ExtensionLengthSize + len(packet.Extension)
+				}
+				if digestSize > 0 && header.Flags & FlagServerTimestamps != 0 {
+					size += ServerTimestampsSize
+				}
+				if len(data) != size {
+					t.Fatalf("marshaled %d bytes, want %d", len(data), size)
+				}
+
+				got, err := Unmarshal(data, digestSize)
+				if err != nil {
+					t.Fatalf("could not unmarshal packet %+v: %v", packet, err)
+				}
+				if got.Header != packet.Header || !bytes.Equal(got.Extension, packet.Extension) || !bytes.Equal(got.Body, packet.Body) || !bytes.Equal(got.Digest, packet.Digest) ||
+					got.ServerRecvTime != packet.ServerRecvTime || got.ServerSendTime != packet.ServerSendTime {
+					t.Fatalf("unmarshaled %+v, want %+v", got, packet)
+				}
+				if digestSize == 0 && got.Digest != nil {
+					t.Fatalf("unmarshaled a digest from a packet without one")
+				}
+			}
+		}
+	}
+}
+
+// Every prefix of a reflected packet that cannot hold the header, extension area, and trailer must be rejected without panicking
+func TestUnmarshalTruncated(t *testing.T) {
+	for _, flags := range []uint8{0, FlagServerTimestamps, FlagExtension, FlagExtension | FlagServerTimestamps} {
+		for _, digestSize := range []int{0, 8, 32} {
+			packet := Packet{Header: Header{Flags: flags, Seq: 5}, Body: []byte("body")}
+			extension := 0
+			if flags & FlagExtension != 0 {
+				packet.Extension = []byte("metadata")
+				extension = ExtensionLengthSize + len(packet.Extension)
+			}
+			trailer := 0
+			if digestSize > 0 {
+				packet.Digest = make([]byte, digestSize)
+				trailer = digestSize
+				if flags & FlagServerTimestamps != 0 {
+					trailer += ServerTimestampsSize
+				}
+			}
+			data := packet.Marshal()
+			for n := 0; n <= len(data); n++ {
+				got, err := Unmarshal(data[:n], digestSize)
+				if n < HeaderSize + extension + trailer {
+					if err == nil {
+						t.Fatalf("unmarshaled %d of %d bytes with a %d byte digest and flags %#02x", n, len(data), digestSize, flags)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("could not unmarshal %d of %d bytes with a %d byte digest and flags %#02x: %v", n, len(data), digestSize, flags, err)
+				}
+				if len(got.Body) != n - HeaderSize - extension - trailer || len(got.Digest) != digestSize || !bytes.Equal(got.Extension, packet.Extension) {
+					t.Fatalf("unmarshaled a %d byte body and %d byte digest from %d bytes", len(got.Body), len(got.Digest), n)
+				}
+			}
+		}
+	}
+}
+
+func TestExtension(t *testing.T) {
+	for _, size := range []int{0, 1, 255, 256, MaxExtensionSize} {
+		extension := bytes.Repeat([]byte{0xee}, size)
+		area := AppendExtension([]byte("head"), extension)
+		if len(area) != len("head") + ExtensionLengthSize + size {
+			t.Fatalf("appended %d bytes for a %d byte extension", len(area) - len("head"), size)
+		}
+		got, rest, err := ParseExtension(append(area[len("head"):], "body"...))
+		if err != nil {
+			t.Fatalf("could not parse a %d byte extension: %v", size, err)
+		}
+		if !bytes.Equal(got, extension) || string(rest) != "body" {
+			t.Fatalf("parsed a %d byte extension and body %q from a %d byte extension", len(got), rest, size)
+		}
+	}
+	area := AppendExtension(nil, []byte("metadata"))
+	for n := 0; n < len(area); n++ {
+		if _, _, err := ParseExtension(area[:n]); err == nil {
+			t.Errorf("parsed an extension from %d of %d bytes", n, len(area))
+		}
+	}
+}
+
+// The body and digest are slices of the data, so the server can append to a payload without copying it again
+func TestUnmarshalSharesData(t *testing.T) {
+	packet := Packet{Header: Header{Seq: 1}, Body: []byte("body"), Digest: []byte("hash")}
+	data := packet.Marshal()
+	got, err := Unmarshal(data, len(packet.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[HeaderSize] = 'B'
+	data[len(data) - 1] = 'H'
+	if string(got.Body) != "Body" || string(got.Digest) != "hasH" {
+		t.Fatalf("unmarshaled body %q and digest %q do not share the data", got.Body, got.Digest)
+	}
+}
+
+// Payload sizes of the benchmarks: the client's default, and the largest that fits an Ethernet frame
+var benchmarkSizes = []int{100, 1448}
+
+// Returns a reflected packet with a payload of the given size, as the benchmarks marshal and unmarshal it
+func benchmarkPacket(size int) Packet {
+	return Packet{
+		Header: Header{Flags: FlagServerTimestamps, ConnID: 7, Seq: 42, Timestamp: 1602857400123456789},
+		Body: bytes.Repeat([]byte{0xab}, size),
+		Digest: bytes.Repeat([]byte{0xcd}, 8),
+		ServerRecvTime: 1602857400123456790,
+		ServerSendTime: 1602857400123456791,
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		packet := benchmarkPacket(size)
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			b.SetBytes(int64(len(packet.Body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				packet.Seq = uint64(i)
+				packet.Marshal()
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		packet := benchmarkPacket(size)
+		data := packet.Marshal()
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			b.SetBytes(int64(len(packet.Body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Unmarshal(data, 8); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The server parses the header of every packet it receives, whether or not it reflects it
+func BenchmarkParseHeader(b *testing.B) {
+	packet := benchmarkPacket(100)
+	data := packet.Marshal()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseHeader(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Any bytes must either be rejected or parse into a header that writes back the same bytes, without panicking
+func FuzzParseHeader(f *testing.F) {
+	for _, header := range testHeaders()[:8] {
+		payload := make([]byte, HeaderSize)
+		PutHeader(payload, header)
+		f.Add(payload)
+	}
+	f.Add([]byte{})
+	f.Add(make([]byte, HeaderSize - 1))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		header, err := ParseHeader(payload)
+		if ValidHeader(payload) != (err == nil) {
+			t.Fatalf("ValidHeader and ParseHeader disagree on %x: %v", payload, err)
+		}
+		if err != nil {
+			return
+		}
+		written := make([]byte, HeaderSize)
+		PutHeader(written, header)
+		if !bytes.Equal(written, payload[:HeaderSize]) {
+			t.Fatalf("parsed %x into %+v, which is written as %x", payload[:HeaderSize], header, written)
+		}
+	})
+}
+
+// Any bytes must either be rejected or unmarshal into a packet that marshals back into the same bytes, without panicking,
+// whatever the digest size
+func FuzzUnmarshal(f *testing.F) {
+	for _, size := range benchmarkSizes {
+		packet := benchmarkPacket(size)
+		f.Add(packet.Marshal(), uint8(len(packet.Digest)))
+		packet.Digest = nil
+		f.Add(packet.Marshal(), uint8(0))
+	}
+	packet := Packet{Header: Header{Flags: FlagExtension | FlagServerTimestamps}, Extension: []byte("run"), Body: []byte("x"), Digest: []byte{1, 2, 3, 4}}
+	f.Add(packet.Marshal(), uint8(4))
+	f.Add(packet.Marshal()[:HeaderSize + 1], uint8(0))
+	f.Fuzz(func(t *testing.T, data []byte, digestSize uint8) {
+		packet, err := Unmarshal(data, int(digestSize))
+		if err != nil {
+			return
+		}
+		if len(packet.Digest) != int(digestSize) {
+			t.Fatalf("unmarshaled a %d byte digest, want %d bytes", len(packet.Digest), digestSize)
+		}
+		if marshaled := packet.Marshal(); !bytes.Equal(marshaled, data) {
+			t.Fatalf("unmarshaled %x into %+v, which marshals into %x", data, packet, marshaled)
+		}
+	})
+}
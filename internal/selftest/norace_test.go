@@ -0,0 +1,7 @@
+//go:build !race
+// +build !race
+
+package selftest
+
+// Whether the test binary was built with the race detector
+const raceEnabled = false
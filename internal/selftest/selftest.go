@@ -0,0 +1,249 @@
+// Package selftest runs the HTTP backend, the UDP server, and the UDP client together in one process over loopback, and
+// checks that every packet made it through the whole pipeline with the right digest
+package selftest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbopardi/udp_client_server/internal/digest"
+	"github.com/nbopardi/udp_client_server/pkg/hashsvc"
+	"github.com/nbopardi/udp_client_server/pkg/udpclient"
+	"github.com/nbopardi/udp_client_server/pkg/udpserver"
+)
+
+// Processor that gets each digest from the HTTP backend like the server does, and checks it against its own digest of the payload
+// hashed: the number of digests the backend returned
+// mismatched: the number of those that differ from the processor's own digest
+type checkingProcessor struct {
+	backend		*udpserver.BackendProcessor
+	algo		digest.Algorithm
+	hashed		int64
+	mismatched	int64
+}
+
+func (p *checkingProcessor) Process(payload []byte, requestID string) ([]byte, error) {
+	hash, err := p.backend.Process(payload, requestID)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&p.hashed, 1)
+	if !bytes.Equal(hash, p.algo.Sum(payload)) {
+		atomic.AddInt64(&p.mismatched, 1)
+	}
+	return hash, nil
+}
+
+// Runs the selftest subcommand with its command line args, printing the outcome of every check
+// Returns the exit code: 0 if every check passed, 1 if any failed, and 2 for bad usage
+func Main(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	var count = flags.Int("count", 200, "Number of packets the client sends (i.e. 1000)")
+	var pps = flags.Float64("pps", 1000, "Number of packets per second the client sends (i.e. 500)")
+	var payloadSize = flags.Int("payload_size", 100, "Number of bytes in each packet's payload (i.e. 1400)")
+	var hashPercent = flags.Float64("hash_percent", 50, "Percentage of packets hashed by the HTTP backend, with the server echoing the rest itself (i.e. 100)")
+	var algoName = flags.String("algo", digest.Default, "Hash algorithm of the backend, server, and client: " + strings.Join(digest.Names(), ", ") + " (i.e. sha256)")
+	var verbose = flags.Bool("v", false, "Show the logs of the backend, server, and client")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: udp_client selftest [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	algo, err := digest.Lookup(*algoName)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	// The components log every step, which would bury the outcome of the checks
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	numFailed := 0
+	report := func(check string, err error) {
+		if err != nil {
+			numFailed++
+			fmt.Printf("[FAIL] %s: %v\n", check, err)
+		} else {
+			fmt.Printf("[ OK ] %s\n", check)
+		}
+	}
+
+	// Serve the backend on a free loopback port, without any processing delay
+	backendOptions := hashsvc.DefaultOptions()
+	backendOptions.Delay = "0"
+	backendOptions.LogLevel = "none"
+	service, err := hashsvc.New(backendOptions)
+	if err == nil {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			backend := &http.Server{Handler: service.Handler}
+			go backend.Serve(listener)
+			defer backend.Close()
+			backendOptions.Port = fmt.Sprint(listener.Addr().(*net.TCPAddr).Port)
+		}
+	}
+	report("Start the HTTP backend", err)
+	if err != nil {
+		return 1
+	}
+
+	// Start the server on a free loopback port, getting its digests from the backend through the checking processor
+	serverOptions := udpserver.DefaultOptions()
+	serverOptions.BackendHost = "127.0.0.1"
+	serverOptions.BackendPort = backendOptions.Port
+	serverOptions.Port = "0"
+	serverOptions.ReadTime = 1
+	serverOptions.Algo = algo.Name()
+	var server *udpserver.Server
+	processor := &checkingProcessor{algo: algo}
+	processor.backend, err = udpserver.NewBackendProcessor(serverOptions)
+	if err == nil {
+		server, err = udpserver.Listen(serverOptions, processor)
+	}
+	report("Start the UDP server", err)
+	if err != nil {
+		return 1
+	}
+	defer server.Close()
+	serverDone := make(chan udpserver.Report, 1)
+	var serverErr error
+	go func() {
+		var serverReport udpserver.Report
+		serverReport, serverErr = server.Serve()
+		serverDone <- serverReport
+	}()
+
+	// Send the packets, tracing every reflection to check its digest
+	trace, err := ioutil.TempFile("", "selftest-trace-*.csv")
+	if err != nil {
+		report("Create the trace file", err)
+		return 1
+	}
+	trace.Close()
+	defer os.Remove(trace.Name())
+	clientOptions := udpclient.DefaultOptions()
+	clientOptions.Host = "127.0.0.1"
+	clientOptions.Port = fmt.Sprint(server.LocalAddr().(*net.UDPAddr).Port)
+	clientOptions.Count = *count
+	clientOptions.PPS = *pps
+	clientOptions.PayloadSize = *payloadSize
+	clientOptions.Pattern = "incrementing"
+	clientOptions.HashPercent = *hashPercent
+	clientOptions.Algo = algo.Name()
+	clientOptions.ConnTime = (time.Duration(float64(*count) / *pps * float64(time.Second)) + 10 * time.Second).String()
+	clientOptions.Drain = time.Second
+	clientOptions.StatsInterval = 0
+	clientOptions.Trace = trace.Name()
+	results, err := udpclient.Run(context.Background(), clientOptions)
+	report("Run the UDP client", err)
+	if err != nil {
+		return 1
+	}
+
+	// The server stops once the client has been quiet for its read time
+	serverReport := <-serverDone
+	processor.backend.Close()
+	report("Serve until the client is done", serverErr)
+
+	// Every packet must have come back exactly once
+	err = nil
+	if results.Sent != *count || results.Received != *count || results.Duplicates != 0 {
+		err = fmt.Errorf("sent %d, received %d with %d duplicates, want %d each without duplicates", results.Sent, results.Received, results.Duplicates, *count)
+	}
+	report(fmt.Sprintf("Client received all %d packets", *count), err)
+
+	// Every reflection must carry the digest of its payload
+	reflections, mismatched, err := readTrace(trace.Name())
+	if err == nil && (reflections != *count || mismatched != 0) {
+		err = fmt.Errorf("%d of %d traced reflections have the wrong digest, want %d reflections", mismatched, reflections, *count)
+	}
+	report("Reflections carry the " + algo.Name() + " digest of their payload", err)
+
+	// The server must have reflected every packet it received, and received nothing else
+	err = nil
+	if serverReport.Received != *count || serverReport.Sent != *count || serverReport.Invalid != 0 {
+		err = fmt.Errorf("received %d, reflected %d, dropped %d invalid, want %d, %d, and 0", serverReport.Received, serverReport.Sent, serverReport.Invalid, *count, *count)
+	}
+	report("Server reflected every packet", err)
+
+	// The backend must have hashed every packet the server did not echo itself, each correctly
+	hashed, err := fetchPayloadsHashed(serverOptions, algo.Name())
+	wantHashed := *count - serverReport.Echoed
+	if err == nil && (hashed != int64(wantHashed) || atomic.LoadInt64(&processor.hashed) != int64(wantHashed)) {
+		err = fmt.Errorf("backend hashed %d payloads and the server got %d digests, want %d (%d echoed by the server)", hashed, atomic.LoadInt64(&processor.hashed), wantHashed, serverReport.Echoed)
+	}
+	if err == nil && atomic.LoadInt64(&processor.mismatched) != 0 {
+		err = fmt.Errorf("%d of the backend's digests are wrong", atomic.LoadInt64(&processor.mismatched))
+	}
+	report(fmt.Sprintf("Backend hashed the %d packets not echoed by the server", wantHashed), err)
+
+	if numFailed > 0 {
+		fmt.Printf("%d checks failed\n", numFailed)
+		return 1
+	}
+	fmt.Println("All checks passed")
+	return 0
+}
+
+// Reads a trace file of the client, returning the number of reflections and how many of them had the wrong digest
+func readTrace(name string) (int, int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	reflections, mismatched := 0, 0
+	scanner := bufio.NewScanner(file)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) != 7 {
+			return 0, 0, fmt.Errorf("malformed trace record %q", scanner.Text())
+		}
+		reflections++
+		if fields[5] != "true" {
+			mismatched++
+		}
+	}
+	return reflections, mismatched, scanner.Err()
+}
+
+// Reads the number of payloads the backend hashed with an algorithm from its stats endpoint
+func fetchPayloadsHashed(options udpserver.Options, algoName string) (int64, error) {
+	resp, err := http.Get("http://" + options.BackendHost + ":" + options.BackendPort + options.StatsPath)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("backend responded with %s", resp.Status)
+	}
+	var stats struct {
+		Algorithms	map[string]int64	`json:"algorithms"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return 0, fmt.Errorf("could not unmarshal the stats: %v", err)
+	}
+	return stats.Algorithms[algoName], nil
+}
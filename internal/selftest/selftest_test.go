@@ -0,0 +1,40 @@
+package selftest
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Every check of the selftest passes in process, for the default exchange and with every packet hashed by the backend
+func TestSelftest(t *testing.T) {
+	for _, args := range [][]string{nil, {"-hash_percent", "100", "-algo", "sha256"}} {
+		if code := Main(args); code != 0 {
+			t.Errorf("selftest %s exited with code %d, want 0", strings.Join(args, " "), code)
+		}
+	}
+}
+
+// Every check of the selftest passes with the race detector on, which also catches packets lost by the server's queues
+// A test binary already built with -race covers this in TestSelftest, so the subcommand is only built with -race otherwise
+func TestSelftestRace(t *testing.T) {
+	if raceEnabled {
+		t.Skip("covered by TestSelftest under -race")
+	}
+	if testing.Short() {
+		t.Skip("builds the client with -race")
+	}
+	binary := filepath.Join(t.TempDir(), "udp_client")
+	output, err := exec.Command("go", "build", "-race", "-o", binary, "../../cmd/udp_client").CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "-race requires cgo") {
+			t.Skip("the race detector needs cgo")
+		}
+		t.Fatalf("Could not build the client with -race: %v\n%s", err, output)
+	}
+	output, err = exec.Command(binary, "selftest").CombinedOutput()
+	if err != nil {
+		t.Fatalf("selftest failed with -race: %v\n%s", err, output)
+	}
+}
@@ -0,0 +1,233 @@
+// Package dashboard serves a web page with the live counters and charts of a running client or server, streamed to
+// every browser viewing it over a WebSocket, so a test can be watched by several people without a terminal on its host
+// The server side of the WebSocket protocol (RFC 6455) is implemented in the package
+package dashboard
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The page of the dashboard, which connects to /ws and draws the samples it receives
+//go:embed index.html
+var indexHTML []byte
+
+// Number of samples kept to fill in the charts of browsers that connect during a run
+const historySize = 300
+
+// Number of messages queued for a browser before it is considered too slow and further samples are dropped for it
+const viewerQueueSize = 64
+
+// A value of a sample, shown as a counter, and charted along with the other metrics of its Chart if it has one
+// Unit: the unit the value is in, shown after it (i.e. ms)
+type Metric struct {
+	Name	string	`json:"name"`
+	Value	float64	`json:"value"`
+	Unit	string	`json:"unit,omitempty"`
+	Chart	string	`json:"chart,omitempty"`
+}
+
+// The metrics of a run at a point in time
+type Sample struct {
+	Time	time.Time	`json:"time"`
+	Metrics	[]Metric	`json:"metrics"`
+}
+
+// Message sent to a browser: the title and the samples so far once it connects, and then each new sample
+type message struct {
+	Title	string				`json:"title,omitempty"`
+	Samples	[]json.RawMessage	`json:"samples"`
+}
+
+// A browser viewing the dashboard
+// queue: the frames waiting to be written to it, by a goroutine of its own so a slow browser cannot hold up the rest
+type viewer struct {
+	conn	net.Conn
+	queue	chan []byte
+	closed	chan struct{}
+	once	sync.Once
+}
+
+// Closes the viewer's connection, which ends both of its goroutines
+func (v *viewer) close() {
+	v.once.Do(func() {
+		close(v.closed)
+		v.conn.Close()
+	})
+}
+
+// Queues a frame for the viewer, dropping it if the viewer has fallen too far behind
+// A close frame that cannot be queued closes the connection right away instead
+func (v *viewer) send(opcode byte, payload []byte) {
+	frame := append([]byte{opcode}, payload...)
+	select {
+	case v.queue <- frame:
+	default:
+		if opcode == opClose {
+			v.close()
+		}
+	}
+}
+
+// Writes the queued frames to the viewer until it is closed
+func (v *viewer) writeLoop() {
+	for {
+		select {
+		case frame := <-v.queue:
+			v.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := writeFrame(v.conn, frame[0], frame[1:]); err != nil || frame[0] == opClose {
+				v.close()
+				return
+			}
+		case <-v.closed:
+			return
+		}
+	}
+}
+
+// Reads the frames of the viewer, answering pings and closes, until its connection is closed
+// Anything else a browser sends is ignored, since the dashboard is only for watching
+func (v *viewer) readLoop(r *bufio.Reader) {
+	for {
+		opcode, payload, err := readFrame(r)
+		if err != nil {
+			v.close()
+			return
+		}
+		switch opcode {
+		case opPing:
+			v.send(opPong, payload)
+		case opClose:
+			// The connection is closed once the close frame answering it is written
+			v.send(opClose, payload)
+			return
+		}
+	}
+}
+
+// Web dashboard of a run, keeping its recent samples and streaming new ones to every browser viewing it
+type Dashboard struct {
+	title		string
+	mutex		sync.Mutex
+	history		[]json.RawMessage
+	viewers		map[*viewer]bool
+	listener	net.Listener
+	server		*http.Server
+}
+
+// Creates a dashboard with the title shown on its page, to serve with Handler
+func New(title string) *Dashboard {
+	return &Dashboard{title: title, viewers: make(map[*viewer]bool)}
+}
+
+// Creates a dashboard and serves it at an address until it is closed, logging the URL to view it at
+func Serve(addr string, title string) (*Dashboard, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d := New(title)
+	d.listener = listener
+	d.server = &http.Server{Handler: d.Handler()}
+	go d.server.Serve(listener)
+	log.Printf("Serving dashboard on http://%s/\n", listener.Addr())
+	return d, nil
+}
+
+// Returns the address the dashboard is served at, or nil if it was not started with Serve
+func (d *Dashboard) Addr() net.Addr {
+	if d.listener == nil {
+		return nil
+	}
+	return d.listener.Addr()
+}
+
+// Handler serving the page of the dashboard at / and the stream of samples at /ws
+func (d *Dashboard) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(indexHTML)
+	})
+	mux.HandleFunc("/ws", d.serveWebSocket)
+	return mux
+}
+
+// Upgrades a request to a WebSocket, sends it the samples so far, and adds it to the viewers receiving new samples
+func (d *Dashboard) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	conn, rw, err := upgradeWebSocket(w, req)
+	if err != nil {
+		return
+	}
+	v := &viewer{conn: conn, queue: make(chan []byte, viewerQueueSize), closed: make(chan struct{})}
+
+	// Send the history while holding the lock, so no sample is sent before it or missed
+	d.mutex.Lock()
+	hello, err := json.Marshal(message{Title: d.title, Samples: d.history})
+	if err == nil {
+		v.send(opText, hello)
+		d.viewers[v] = true
+	}
+	d.mutex.Unlock()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go v.writeLoop()
+	v.readLoop(rw.Reader)
+	d.mutex.Lock()
+	delete(d.viewers, v)
+	d.mutex.Unlock()
+}
+
+// Adds a sample to the dashboard and sends it to every browser viewing it
+func (d *Dashboard) Publish(sample Sample) {
+	if sample.Time.IsZero() {
+		sample.Time = time.Now()
+	}
+	encoded, err := json.Marshal(sample)
+	if err != nil {
+		log.Println("Could not encode dashboard sample: ", err)
+		return
+	}
+	update, err := json.Marshal(message{Samples: []json.RawMessage{encoded}})
+	if err != nil {
+		log.Println("Could not encode dashboard sample: ", err)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.history = append(d.history, encoded)
+	if len(d.history) > historySize {
+		d.history = d.history[len(d.history) - historySize:]
+	}
+	for v := range d.viewers {
+		v.send(opText, update)
+	}
+}
+
+// Stops serving the dashboard and disconnects every browser viewing it
+func (d *Dashboard) Close() error {
+	var err error
+	if d.server != nil {
+		err = d.server.Close()
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for v := range d.viewers {
+		v.close()
+	}
+	return err
+}
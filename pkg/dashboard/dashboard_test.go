@@ -0,0 +1,180 @@
+package dashboard
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example handshake of RFC 6455
+func TestWebSocketAccept(t *testing.T) {
+	if accept := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("accept is %s", accept)
+	}
+}
+
+// Connects to the dashboard's stream like a browser, failing the test unless the handshake succeeds
+func dial(t *testing.T, url string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: dashboard\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake answered with %s and accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return conn, r
+}
+
+// Writes a masked frame, as a browser must
+func writeMaskedFrame(w io.Writer, opcode byte, payload []byte) {
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload)), 1, 2, 3, 4}
+	for i, b := range payload {
+		frame = append(frame, b ^ frame[2 + i % 4])
+	}
+	w.Write(frame)
+}
+
+// Reads an unmasked frame from the dashboard
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] & 0x80 == 0 || header[1] & 0x80 != 0 {
+		t.Fatalf("frame header %x is fragmented or masked", header)
+	}
+	length := uint64(header[1] & 0x7F)
+	if length == 126 {
+		var extended [2]byte
+		io.ReadFull(r, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+// Reads the next message of samples from the dashboard
+func readMessage(t *testing.T, r *bufio.Reader) (string, []Sample) {
+	opcode, payload := readServerFrame(t, r)
+	if opcode != opText {
+		t.Fatalf("got a frame with opcode %d instead of text", opcode)
+	}
+	var m struct {
+		Title	string		`json:"title"`
+		Samples	[]Sample	`json:"samples"`
+	}
+	if err := json.Unmarshal(payload, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m.Title, m.Samples
+}
+
+// A browser connecting during a run gets the samples so far, then every new one, and is answered when it pings and closes
+func TestStream(t *testing.T) {
+	d := New("test run")
+	server := httptest.NewServer(d.Handler())
+	defer server.Close()
+	defer d.Close()
+
+	d.Publish(Sample{Metrics: []Metric{{Name: "Sent", Value: 1}}})
+	d.Publish(Sample{Metrics: []Metric{{Name: "Sent", Value: 2}}})
+	conn, r := dial(t, server.URL)
+	defer conn.Close()
+	title, samples := readMessage(t, r)
+	if title != "test run" || len(samples) != 2 || samples[1].Metrics[0].Value != 2 {
+		t.Fatalf("first message has title %q and samples %+v", title, samples)
+	}
+
+	d.Publish(Sample{Metrics: []Metric{{Name: "RTT p50", Value: 1.5, Unit: "ms", Chart: "RTT"}}})
+	title, samples = readMessage(t, r)
+	if title != "" || len(samples) != 1 || samples[0].Metrics[0] != (Metric{Name: "RTT p50", Value: 1.5, Unit: "ms", Chart: "RTT"}) {
+		t.Fatalf("update has title %q and samples %+v", title, samples)
+	}
+
+	writeMaskedFrame(conn, opPing, []byte("hello"))
+	if opcode, payload := readServerFrame(t, r); opcode != opPong || string(payload) != "hello" {
+		t.Fatalf("ping answered with opcode %d and %q", opcode, payload)
+	}
+	writeMaskedFrame(conn, opClose, []byte{0x03, 0xE8})
+	if opcode, _ := readServerFrame(t, r); opcode != opClose {
+		t.Fatalf("close answered with opcode %d", opcode)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("connection still open after closing, read %v", err)
+	}
+}
+
+// A handshake from a page of another site is refused, while one from the dashboard's own page is accepted
+func TestCrossOriginHandshake(t *testing.T) {
+	server := httptest.NewServer(New("test run").Handler())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, test := range []struct {
+		origin	string
+		status	int
+	}{
+		{"http://evil.example", http.StatusForbidden},
+		{"http://" + host + ".evil.example", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+		{server.URL, http.StatusSwitchingProtocols},
+	} {
+		conn, err := net.Dial("tcp", host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nOrigin: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", host, test.origin)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("handshake from %s answered with %s, want %d", test.origin, resp.Status, test.status)
+		}
+	}
+}
+
+func TestPageAndBadHandshake(t *testing.T) {
+	server := httptest.NewServer(New("test run").Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "new WebSocket") {
+		t.Fatalf("page answered with %s", resp.Status)
+	}
+
+	resp, err = http.Get(server.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain request for the stream answered with %s", resp.Status)
+	}
+}
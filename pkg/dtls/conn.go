@@ -0,0 +1,329 @@
+package dtls
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbopardi/udp_client_server/pkg/netsim"
+)
+
+// Size of the buffers datagrams are received into before they are decrypted
+const maxDatagramSize = 65535
+
+// Epoch of the records sent and received with the keys of the handshake, in the top 16 bits of their sequence numbers
+const epochProtected = 1 << 48
+
+// Names of the alerts a server is most likely to end a handshake with
+var alertDescriptions = map[byte]string{
+	0: "close_notify",
+	20: "bad_record_mac",
+	40: "handshake_failure",
+	47: "illegal_parameter",
+	51: "decrypt_error",
+	70: "protocol_version",
+	80: "internal_error",
+	115: "unknown_psk_identity",
+}
+
+// Settings of the sessions of a network
+// PSK: the pre-shared key the server knows the client by
+// Identity: the PSK identity the client names itself with, which the server looks the key up by
+// HandshakeTimeout: how long a client waits for the server to answer a flight of the handshake before sending it again,
+// or 0 for 1s
+// HandshakeAttempts: the number of times a client sends each flight of the handshake before giving up, or 0 for 5
+type Config struct {
+	PSK					[]byte
+	Identity			string
+	HandshakeTimeout	time.Duration
+	HandshakeAttempts	int
+}
+
+// Counters of the sessions of a network
+// Handshakes: the handshakes completed
+// Rejected: the datagrams dropped for not holding an application data record of the session or failing to decrypt
+// Alerts: the alerts the server sent after the handshake, such as the close_notify of a server shutting down
+type Stats struct {
+	Handshakes	int64
+	Rejected	int64
+	Alerts		int64
+}
+
+// Logs the counters
+func (s Stats) Log() {
+	log.Printf("DTLS handshakes: %d, rejected datagrams: %d, alerts: %d\n", s.Handshakes, s.Rejected, s.Alerts)
+}
+
+// Network whose connected sockets send and receive every datagram as a record of a DTLS session, set up by a handshake
+// with the server over the sockets of a base network
+type Network struct {
+	base	netsim.Network
+	config	Config
+	stats	Stats
+}
+
+// Creates a network securing the sockets of the base network with the config
+func Secure(base netsim.Network, config Config) *Network {
+	if config.HandshakeTimeout <= 0 {
+		config.HandshakeTimeout = time.Second
+	}
+	if config.HandshakeAttempts <= 0 {
+		config.HandshakeAttempts = 5
+	}
+	return &Network{base: base, config: config}
+}
+
+// Returns the counters of the network's sessions so far
+func (n *Network) Stats() Stats {
+	return Stats{
+		Handshakes: atomic.LoadInt64(&n.stats.Handshakes),
+		Rejected: atomic.LoadInt64(&n.stats.Rejected),
+		Alerts: atomic.LoadInt64(&n.stats.Alerts),
+	}
+}
+
+// Only the client side of DTLS is implemented, so a network cannot listen
+func (n *Network) ListenUDP(network string, laddr *net.UDPAddr) (netsim.PacketConn, error) {
+	return nil, errors.New("DTLS servers are not supported, only clients")
+}
+
+func (n *Network) DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (netsim.PacketConn, error) {
+	if len(n.config.PSK) == 0 {
+		return nil, errors.New("missing pre-shared key")
+	}
+	conn, err := n.base.DialUDP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := n.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &clientConn{PacketConn: conn, network: n, session: s}, nil
+}
+
+// Completes a handshake with the server of a connected socket, returning the session it sets up
+// Each flight of the client is sent again until the server answers it, with a new record sequence number for every record
+func (n *Network) handshake(conn netsim.PacketConn) (*session, error) {
+	hs, err := newClientHandshake(n.config.PSK, n.config.Identity)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{network: n}
+	var next uint64
+	plainRecord := func(dst []byte, recordType byte, fragment []byte) []byte {
+		dst = appendRecordHeader(dst, recordType, next, len(fragment))
+		next++
+		return append(dst, fragment...)
+	}
+
+	// The first flight is the ClientHello, sent again with the server's cookie if it asks for one, and the last is the
+	// ClientKeyExchange, ChangeCipherSpec, and encrypted Finished
+	hello := hs.clientHello()
+	var keyExchange, finished []byte
+	flight := func() []byte {
+		if s.send == nil {
+			return plainRecord(nil, recordHandshake, hello)
+		}
+		datagram := plainRecord(nil, recordHandshake, keyExchange)
+		datagram = plainRecord(datagram, recordChangeCipherSpec, []byte{1})
+		return s.seal(datagram, recordHandshake, finished)
+	}
+
+	buffer := make([]byte, maxDatagramSize)
+	pending := make(map[uint16]*pendingMessage)
+	protected := make(map[uint16]*pendingMessage)
+	for attempt := 0; attempt < n.config.HandshakeAttempts; {
+		if _, err := conn.Write(flight()); err != nil {
+			return nil, err
+		}
+
+		// Wait for the server's answer to the flight, which may take several datagrams
+		conn.SetReadDeadline(time.Now().Add(n.config.HandshakeTimeout))
+		newFlight := false
+		for !newFlight {
+			size, err := conn.Read(buffer)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			records, err := parseRecords(buffer[:size])
+			if err != nil {
+				continue
+			}
+			for _, r := range records {
+				switch {
+				case r.recordType == recordAlert && epochOf(r.epochSeq) == 0:
+					return nil, alertError(r.fragment)
+				case r.recordType == recordHandshake && epochOf(r.epochSeq) == 0:
+					addFragments(pending, r.fragment)
+				case r.recordType == recordHandshake && epochOf(r.epochSeq) == 1 && s.recv != nil:
+					if fragment, err := s.recv.open(r.epochSeq, r.recordType, r.fragment); err == nil {
+						addFragments(protected, fragment)
+					}
+				}
+			}
+
+			// Go on to the next flight once the server's flight is in
+			if s.send == nil {
+				retry, err := hs.readMessages(pending)
+				if err != nil {
+					return nil, err
+				}
+				if retry {
+					hello = hs.clientHello()
+					newFlight = true
+				} else if hs.serverHelloDone {
+					keyExchange, finished, s.send, s.recv = hs.finish()
+					newFlight = true
+				}
+			} else if message := protected[hs.recvSeq]; message != nil && message.missing == 0 {
+				if message.msgType != typeFinished {
+					return nil, fmt.Errorf("unexpected handshake message of type %d instead of Finished", message.msgType)
+				}
+				if err := hs.readFinished(message.body); err != nil {
+					return nil, err
+				}
+				conn.SetReadDeadline(time.Time{})
+				atomic.AddInt64(&n.stats.Handshakes, 1)
+				return s, nil
+			}
+		}
+		// Every flight gets as many attempts as the first
+		if newFlight {
+			attempt = 0
+		} else {
+			attempt++
+		}
+	}
+	// A server drops a Finished message it cannot decrypt without answering, as DTLS drops any such record
+	if s.send != nil {
+		return nil, fmt.Errorf("no answer to %d DTLS Finished messages from %v, which may have another pre-shared key for %q", n.config.HandshakeAttempts, conn.RemoteAddr(), n.config.Identity)
+	}
+	return nil, fmt.Errorf("no answer to %d DTLS handshakes from %v", n.config.HandshakeAttempts, conn.RemoteAddr())
+}
+
+// Returns the error of an alert the server ended the handshake with
+func alertError(fragment []byte) error {
+	if len(fragment) != 2 {
+		return errors.New("server sent a malformed DTLS alert")
+	}
+	if name, ok := alertDescriptions[fragment[1]]; ok {
+		return fmt.Errorf("server sent DTLS alert %s", name)
+	}
+	return fmt.Errorf("server sent DTLS alert %d", fragment[1])
+}
+
+// The keys a client and server share, set up by a handshake, and the sequence number of the next record the client sends
+// with them
+type session struct {
+	network	*Network
+	send	*cipherState
+	recv	*cipherState
+	mutex	sync.Mutex
+	next	uint64
+}
+
+// Appends a record encrypted with the next sequence number of the session
+func (s *session) seal(dst []byte, recordType byte, plaintext []byte) []byte {
+	s.mutex.Lock()
+	n := s.next
+	s.next++
+	s.mutex.Unlock()
+	return s.send.seal(dst, epochProtected | n, recordType, plaintext)
+}
+
+// Error of a datagram holding an alert, which is counted apart from the datagrams that do not decrypt
+var errAlert = errors.New("datagram holds an alert")
+
+// Decrypts the application data record of a datagram in place, returning its packet
+func (s *session) open(datagram []byte) ([]byte, error) {
+	records, err := parseRecords(datagram)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if epochOf(r.epochSeq) != 1 {
+			continue
+		}
+		switch r.recordType {
+		case recordApplicationData:
+			return s.recv.open(r.epochSeq, r.recordType, r.fragment)
+		case recordAlert:
+			if _, err := s.recv.open(r.epochSeq, r.recordType, r.fragment); err == nil {
+				atomic.AddInt64(&s.network.stats.Alerts, 1)
+				return nil, errAlert
+			}
+		}
+	}
+	return nil, errors.New("no application data record of the session")
+}
+
+// Buffers datagrams are received into
+var bufferPool = sync.Pool{New: func() interface{} {
+	buffer := make([]byte, maxDatagramSize)
+	return &buffer
+}}
+
+// Client socket, connected to a server it completed a handshake with
+type clientConn struct {
+	netsim.PacketConn
+	network	*Network
+	session	*session
+}
+
+func (c *clientConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buffer := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buffer)
+	for {
+		size, addr, err := c.PacketConn.ReadFrom(*buffer)
+		if err != nil {
+			return 0, addr, err
+		}
+		packet, err := c.session.open((*buffer)[:size])
+		if err != nil {
+			if err != errAlert {
+				atomic.AddInt64(&c.network.stats.Rejected, 1)
+			}
+			continue
+		}
+		return copy(b, packet), addr, nil
+	}
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// Returns the error of a packet too large for a single record, since the client does not split packets across records
+func tooLarge(b []byte) error {
+	return fmt.Errorf("packet of %d bytes is larger than the %d bytes a DTLS record can carry", len(b), MaxPacketSize)
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	if len(b) > MaxPacketSize {
+		return 0, tooLarge(b)
+	}
+	if _, err := c.PacketConn.Write(c.session.seal(make([]byte, 0, Overhead + len(b)), recordApplicationData, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *clientConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > MaxPacketSize {
+		return 0, tooLarge(b)
+	}
+	if _, err := c.PacketConn.WriteTo(c.session.seal(make([]byte, 0, Overhead + len(b)), recordApplicationData, b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,183 @@
+package dtls
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbopardi/udp_client_server/pkg/netsim"
+)
+
+// The TLS 1.2 PRF test vector for SHA-256 that OpenSSL and other implementations check against
+func TestPRF(t *testing.T) {
+	secret, _ := hex.DecodeString("9bbe436ba940f017b17652849a71db35")
+	seed, _ := hex.DecodeString("a0ba9f936cda311827a6f796ffd5198c")
+	want := "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff70187347b66"
+	if out := hex.EncodeToString(prf(secret, "test label", seed, 100)); out != want {
+		t.Fatalf("PRF gave %s", out)
+	}
+}
+
+// A record only decrypts with its own header and key
+func TestRecord(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, keySize)
+	cs := newCipherState(key, []byte{1, 2, 3, 4})
+	datagram := cs.seal(nil, epochProtected | 5, recordApplicationData, []byte("packet"))
+	if len(datagram) != Overhead + len("packet") {
+		t.Fatalf("record is %d bytes", len(datagram))
+	}
+
+	records, err := parseRecords(append(append([]byte(nil), datagram...), datagram...))
+	if err != nil || len(records) != 2 || epochOf(records[0].epochSeq) != 1 || records[0].recordType != recordApplicationData {
+		t.Fatalf("parsed %+v, %v", records, err)
+	}
+	packet, err := cs.open(records[0].epochSeq, records[0].recordType, records[0].fragment)
+	if err != nil || string(packet) != "packet" {
+		t.Fatalf("opened %q, %v", packet, err)
+	}
+	if _, err := cs.open(records[1].epochSeq + 1, records[1].recordType, records[1].fragment); err == nil {
+		t.Fatal("record opened with another sequence number")
+	}
+	if _, err := parseRecords(datagram[:len(datagram) - 1]); err == nil {
+		t.Fatal("truncated record parsed")
+	}
+}
+
+// A handshake message is put back together from fragments arriving out of order, and more than once
+func TestFragments(t *testing.T) {
+	body := []byte("a handshake message split into fragments")
+	fragment := func(offset int, length int) []byte {
+		header := handshakeMessage(typeServerKeyExchange, 3, nil)
+		putUint24(header[1:], len(body))
+		putUint24(header[6:], offset)
+		putUint24(header[9:], length)
+		return append(header, body[offset : offset + length]...)
+	}
+	pending := make(map[uint16]*pendingMessage)
+	for _, f := range [][]byte{fragment(20, len(body) - 20), fragment(0, 10), fragment(20, 5)} {
+		if err := addFragments(pending, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending[3].missing != 10 {
+		t.Fatalf("%d bytes missing, want 10", pending[3].missing)
+	}
+	if err := addFragments(pending, append(fragment(5, 15), fragment(0, 1)...)); err != nil {
+		t.Fatal(err)
+	}
+	if pending[3].missing != 0 || !bytes.Equal(pending[3].body, body) {
+		t.Fatalf("put back together %q with %d bytes missing", pending[3].body, pending[3].missing)
+	}
+	if err := addFragments(pending, fragment(0, 10)[:15]); err == nil {
+		t.Fatal("truncated fragment accepted")
+	}
+}
+
+// Starts OpenSSL's DTLS server with a pre-shared key on a loopback port, skipping the test without OpenSSL
+// Returns the server's address, its standard input, and the lines it prints
+func startOpenSSL(t *testing.T, psk string) (*net.UDPAddr, io.Writer, <-chan string) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is not installed")
+	}
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.LocalAddr().(*net.UDPAddr)
+	listener.Close()
+
+	cmd := exec.Command("openssl", "s_server", "-dtls1_2", "-accept", addr.String(), "-nocert", "-psk", psk, "-psk_identity", "client", "-cipher", "PSK-AES128-GCM-SHA256")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	lines := make(chan string, 64)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	waitForLine(t, lines, "ACCEPT")
+	return addr, stdin, lines
+}
+
+// Waits for the server to print a line
+func waitForLine(t *testing.T, lines <-chan string, want string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("openssl exited before printing %q", want)
+			}
+			if strings.TrimSpace(line) == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("openssl did not print %q", want)
+		}
+	}
+}
+
+// A session set up with OpenSSL's server, cookie exchange and all, carries packets both ways
+func TestOpenSSLServer(t *testing.T) {
+	addr, stdin, lines := startOpenSSL(t, "0102030405060708")
+	network := Secure(netsim.UDP, Config{PSK: []byte{1, 2, 3, 4, 5, 6, 7, 8}, Identity: "client"})
+	conn, err := network.DialUDP("udp4", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("from the client\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitForLine(t, lines, "from the client")
+	fmt.Fprintln(stdin, "from the server")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 100)
+	n, err := conn.Read(buffer)
+	if err != nil || string(buffer[:n]) != "from the server\n" {
+		t.Fatalf("read %q, %v", buffer[:n], err)
+	}
+	if stats := network.Stats(); stats.Handshakes != 1 || stats.Rejected != 0 {
+		t.Fatalf("counted %+v", stats)
+	}
+	if _, err := conn.Write(make([]byte, MaxPacketSize + 1)); err == nil {
+		t.Fatal("packet too large for a record was sent")
+	}
+}
+
+// A server with another pre-shared key never answers the client's Finished message
+func TestOpenSSLServerWrongKey(t *testing.T) {
+	addr, _, _ := startOpenSSL(t, "0a0b0c0d")
+	network := Secure(netsim.UDP, Config{PSK: []byte{1, 2, 3, 4}, Identity: "client", HandshakeTimeout: 200 * time.Millisecond, HandshakeAttempts: 2})
+	conn, err := network.DialUDP("udp4", nil, addr)
+	if err == nil {
+		conn.Close()
+		t.Fatal("handshake succeeded with the wrong key")
+	}
+	if !strings.Contains(err.Error(), "Finished") {
+		t.Fatalf("handshake failed with %v, want no answer to the Finished message", err)
+	}
+}
@@ -0,0 +1,465 @@
+// Package dtls secures the packets of the client with DTLS 1.2 (RFC 6347) sessions set up with a pre-shared key, so the
+// client can benchmark an encrypted path to a DTLS server or proxy in front of the UDP server: the first datagrams of a
+// connection are the handshake, and every packet after it is sent and received as an application data record
+// The only cipher suite is TLS_PSK_WITH_AES_128_GCM_SHA256 (RFC 4279, RFC 5487), and only the client side is implemented
+package dtls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version of DTLS 1.2 on the wire, the ones' complement of 1.2
+const version = 0xfefd
+
+// Version of DTLS 1.0, which servers may put on the records of a HelloVerifyRequest whatever version they go on with
+// (RFC 6347, section 4.2.1)
+const versionHelloVerify = 0xfeff
+
+// Types of the records
+const (
+	recordChangeCipherSpec = 20
+	recordAlert = 21
+	recordHandshake = 22
+	recordApplicationData = 23
+)
+
+// Types of the handshake messages
+const (
+	typeClientHello = 1
+	typeServerHello = 2
+	typeHelloVerifyRequest = 3
+	typeServerKeyExchange = 12
+	typeServerHelloDone = 14
+	typeClientKeyExchange = 16
+	typeFinished = 20
+)
+
+// TLS_PSK_WITH_AES_128_GCM_SHA256
+const cipherSuite = 0x00a8
+
+// Extensions the client sends: the empty renegotiation_info (RFC 5746), since the client never renegotiates, and the
+// extended master secret (RFC 7627), which binds the keys to the whole handshake if the server agrees to it
+const (
+	extensionExtendedMasterSecret = 0x0017
+	extensionRenegotiationInfo = 0xff01
+)
+
+// Sizes of a record header (type, version, epoch, sequence number, and length) and a handshake message header (type,
+// length, message sequence number, fragment offset, and fragment length)
+const recordHeaderSize = 13
+const handshakeHeaderSize = 12
+
+// Sizes of the AES-128-GCM keys, the implicit part of the nonce derived with them, the explicit part sent in each record,
+// and the authentication tag
+const keySize = 16
+const implicitNonceSize = 4
+const explicitNonceSize = 8
+const tagSize = 16
+
+// Number of bytes an encrypted record is larger than the packet it carries
+const Overhead = recordHeaderSize + explicitNonceSize + tagSize
+
+// Largest packet a record can carry (RFC 6347, section 4.1)
+const MaxPacketSize = 1 << 14
+
+// Size of the master secret and of the verify data of a Finished message
+const masterSecretSize = 48
+const verifyDataSize = 12
+
+// Expands a secret with the TLS 1.2 pseudorandom function over HMAC-SHA256 (RFC 5246, section 5)
+func prf(secret []byte, label string, seed []byte, size int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	out := make([]byte, 0, size + sha256.Size)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(labelSeed)
+	a := mac.Sum(nil)
+	for len(out) < size {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		out = mac.Sum(out)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:size]
+}
+
+// Key of a single direction of an epoch, with the implicit part of its nonces
+type cipherState struct {
+	aead	cipher.AEAD
+	nonce	[implicitNonceSize]byte
+}
+
+// Creates the state of a key
+func newCipherState(key []byte, nonce []byte) *cipherState {
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	cs := &cipherState{aead: aead}
+	copy(cs.nonce[:], nonce)
+	return cs
+}
+
+// Returns the additional data a record is authenticated with: its epoch and sequence number, type, version, and the
+// length of its plaintext
+func additionalData(epochSeq uint64, recordType byte, length int) []byte {
+	var ad [13]byte
+	binary.BigEndian.PutUint64(ad[:], epochSeq)
+	ad[8] = recordType
+	binary.BigEndian.PutUint16(ad[9:], version)
+	binary.BigEndian.PutUint16(ad[11:], uint16(length))
+	return ad[:]
+}
+
+// Appends an encrypted record holding the plaintext, numbered with its epoch (in the top 16 bits) and sequence number
+// The explicit part of the nonce is the epoch and sequence number, which are never used twice with a key
+func (cs *cipherState) seal(dst []byte, epochSeq uint64, recordType byte, plaintext []byte) []byte {
+	dst = appendRecordHeader(dst, recordType, epochSeq, explicitNonceSize + len(plaintext) + tagSize)
+	var nonce [implicitNonceSize + explicitNonceSize]byte
+	copy(nonce[:], cs.nonce[:])
+	binary.BigEndian.PutUint64(nonce[implicitNonceSize:], epochSeq)
+	dst = append(dst, nonce[implicitNonceSize:]...)
+	return cs.aead.Seal(dst, nonce[:], plaintext, additionalData(epochSeq, recordType, len(plaintext)))
+}
+
+// Decrypts the fragment of a record in place, failing if it or its header were tampered with
+func (cs *cipherState) open(epochSeq uint64, recordType byte, fragment []byte) ([]byte, error) {
+	if len(fragment) < explicitNonceSize + tagSize {
+		return nil, errors.New("record is too short to be encrypted")
+	}
+	var nonce [implicitNonceSize + explicitNonceSize]byte
+	copy(nonce[:], cs.nonce[:])
+	copy(nonce[implicitNonceSize:], fragment[:explicitNonceSize])
+	ciphertext := fragment[explicitNonceSize:]
+	return cs.aead.Open(ciphertext[:0], nonce[:], ciphertext, additionalData(epochSeq, recordType, len(ciphertext) - tagSize))
+}
+
+// Appends the header of a record with a fragment of the given length
+func appendRecordHeader(dst []byte, recordType byte, epochSeq uint64, length int) []byte {
+	var header [recordHeaderSize]byte
+	header[0] = recordType
+	binary.BigEndian.PutUint16(header[1:], version)
+	binary.BigEndian.PutUint64(header[3:], epochSeq)
+	binary.BigEndian.PutUint16(header[11:], uint16(length))
+	return append(dst, header[:]...)
+}
+
+// A record read from a datagram, whose fragment shares the memory of the datagram
+type record struct {
+	recordType	byte
+	epochSeq	uint64
+	fragment	[]byte
+}
+
+// Splits a datagram into its records
+func parseRecords(datagram []byte) ([]record, error) {
+	var records []record
+	for len(datagram) > 0 {
+		if len(datagram) < recordHeaderSize {
+			return nil, errors.New("truncated record header")
+		}
+		if v := binary.BigEndian.Uint16(datagram[1:]); v != version && v != versionHelloVerify {
+			return nil, fmt.Errorf("record has version %#04x instead of DTLS 1.2", v)
+		}
+		length := int(binary.BigEndian.Uint16(datagram[11:]))
+		if len(datagram) < recordHeaderSize + length {
+			return nil, errors.New("truncated record")
+		}
+		records = append(records, record{
+			recordType: datagram[0],
+			epochSeq: binary.BigEndian.Uint64(datagram[3:]),
+			fragment: datagram[recordHeaderSize : recordHeaderSize + length],
+		})
+		datagram = datagram[recordHeaderSize + length:]
+	}
+	return records, nil
+}
+
+// Returns the epoch of a record's epoch and sequence number
+func epochOf(epochSeq uint64) uint16 {
+	return uint16(epochSeq >> 48)
+}
+
+// Returns a whole handshake message, with a header as if it was sent in a single fragment, which is also the form the
+// handshake's transcript hashes it in
+func handshakeMessage(msgType byte, seq uint16, body []byte) []byte {
+	message := make([]byte, handshakeHeaderSize, handshakeHeaderSize + len(body))
+	message[0] = msgType
+	putUint24(message[1:], len(body))
+	binary.BigEndian.PutUint16(message[4:], seq)
+	putUint24(message[9:], len(body))
+	return append(message, body...)
+}
+
+func putUint24(b []byte, n int) {
+	b[0], b[1], b[2] = byte(n >> 16), byte(n >> 8), byte(n)
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) << 16 | int(b[1]) << 8 | int(b[2])
+}
+
+// A handshake message of the server being put back together from its fragments
+// have: which bytes of the body have arrived
+type pendingMessage struct {
+	msgType	byte
+	body	[]byte
+	have	[]bool
+	missing	int
+}
+
+// Adds the handshake message fragments of a record to the messages being put back together, by message sequence number
+func addFragments(pending map[uint16]*pendingMessage, fragment []byte) error {
+	for len(fragment) > 0 {
+		if len(fragment) < handshakeHeaderSize {
+			return errors.New("truncated handshake header")
+		}
+		length := uint24(fragment[1:])
+		seq := binary.BigEndian.Uint16(fragment[4:])
+		offset := uint24(fragment[6:])
+		fragmentLength := uint24(fragment[9:])
+		if len(fragment) < handshakeHeaderSize + fragmentLength || offset + fragmentLength > length || length > MaxPacketSize {
+			return errors.New("malformed handshake fragment")
+		}
+		message := pending[seq]
+		if message == nil {
+			message = &pendingMessage{msgType: fragment[0], body: make([]byte, length), have: make([]bool, length), missing: length}
+			pending[seq] = message
+		}
+		if message.msgType != fragment[0] || len(message.body) != length {
+			return errors.New("handshake fragments of a message disagree")
+		}
+		for i := 0; i < fragmentLength; i++ {
+			if !message.have[offset + i] {
+				message.have[offset + i] = true
+				message.missing--
+			}
+		}
+		copy(message.body[offset:], fragment[handshakeHeaderSize : handshakeHeaderSize + fragmentLength])
+		fragment = fragment[handshakeHeaderSize + fragmentLength:]
+	}
+	return nil
+}
+
+// Handshake of the client, which knows the pre-shared key and the identity the server knows it by
+// transcript: every handshake message from the ClientHello the server answered with a ServerHello on, which the
+// Finished messages authenticate
+// sendSeq: the message sequence number of the client's next handshake message
+// recvSeq: the message sequence number of the server's next handshake message, once its ServerHello arrived
+// serverHello, serverHelloDone: whether the server's ServerHello and ServerHelloDone arrived
+type clientHandshake struct {
+	psk						[]byte
+	identity				string
+	clientRandom			[32]byte
+	serverRandom			[32]byte
+	cookie					[]byte
+	transcript				[]byte
+	sendSeq					uint16
+	recvSeq					uint16
+	serverHello				bool
+	serverHelloDone			bool
+	extendedMasterSecret	bool
+	masterSecret			[]byte
+}
+
+// Starts a handshake with a new client random
+func newClientHandshake(psk []byte, identity string) (*clientHandshake, error) {
+	hs := &clientHandshake{psk: psk, identity: identity}
+	if _, err := rand.Read(hs.clientRandom[:]); err != nil {
+		return nil, err
+	}
+	return hs, nil
+}
+
+// Returns the next ClientHello, with the cookie of the last HelloVerifyRequest if there was one
+// It starts the transcript over, as only the ClientHello the server goes on with is part of it
+func (hs *clientHandshake) clientHello() []byte {
+	// The version, the random, an empty session ID, the cookie, the only cipher suite, no compression, and the extensions
+	body := make([]byte, 0, 64 + len(hs.cookie))
+	body = binary.BigEndian.AppendUint16(body, version)
+	body = append(body, hs.clientRandom[:]...)
+	body = append(body, 0)
+	body = append(body, byte(len(hs.cookie)))
+	body = append(body, hs.cookie...)
+	body = binary.BigEndian.AppendUint16(body, 2)
+	body = binary.BigEndian.AppendUint16(body, cipherSuite)
+	body = append(body, 1, 0)
+	body = binary.BigEndian.AppendUint16(body, 9)
+	body = binary.BigEndian.AppendUint16(body, extensionRenegotiationInfo)
+	body = binary.BigEndian.AppendUint16(body, 1)
+	body = append(body, 0)
+	body = binary.BigEndian.AppendUint16(body, extensionExtendedMasterSecret)
+	body = binary.BigEndian.AppendUint16(body, 0)
+	message := handshakeMessage(typeClientHello, hs.sendSeq, body)
+	hs.sendSeq++
+	hs.transcript = append(hs.transcript[:0], message...)
+	return message
+}
+
+// Reads a HelloVerifyRequest, keeping its cookie for the next ClientHello
+func (hs *clientHandshake) readHelloVerifyRequest(body []byte) error {
+	if len(body) < 3 || len(body) < 3 + int(body[2]) {
+		return errors.New("malformed HelloVerifyRequest")
+	}
+	hs.cookie = append([]byte(nil), body[3 : 3 + int(body[2])]...)
+	return nil
+}
+
+// Reads a ServerHello, which must pick DTLS 1.2 and the client's only cipher suite
+func (hs *clientHandshake) readServerHello(body []byte) error {
+	if len(body) < 2 + 32 + 1 {
+		return errors.New("malformed ServerHello")
+	}
+	if binary.BigEndian.Uint16(body) != version {
+		return fmt.Errorf("server chose version %#04x instead of DTLS 1.2", binary.BigEndian.Uint16(body))
+	}
+	copy(hs.serverRandom[:], body[2:])
+	rest := body[2 + 32:]
+	sessionIDSize := int(rest[0])
+	if len(rest) < 1 + sessionIDSize + 3 {
+		return errors.New("malformed ServerHello")
+	}
+	rest = rest[1 + sessionIDSize:]
+	if suite := binary.BigEndian.Uint16(rest); suite != cipherSuite {
+		return fmt.Errorf("server chose cipher suite %#04x instead of TLS_PSK_WITH_AES_128_GCM_SHA256", suite)
+	}
+	if rest[2] != 0 {
+		return errors.New("server chose compression")
+	}
+	rest = rest[3:]
+	if len(rest) == 0 {
+		return nil
+	}
+	if len(rest) < 2 || len(rest) != 2 + int(binary.BigEndian.Uint16(rest)) {
+		return errors.New("malformed ServerHello extensions")
+	}
+	for rest = rest[2:]; len(rest) > 0; {
+		if len(rest) < 4 || len(rest) < 4 + int(binary.BigEndian.Uint16(rest[2:])) {
+			return errors.New("malformed ServerHello extensions")
+		}
+		if binary.BigEndian.Uint16(rest) == extensionExtendedMasterSecret {
+			hs.extendedMasterSecret = true
+		}
+		rest = rest[4 + int(binary.BigEndian.Uint16(rest[2:])):]
+	}
+	return nil
+}
+
+// Reads a handshake message of the server, in the order of their message sequence numbers
+// A ServerKeyExchange only holds an identity hint, which is ignored since the identity is configured
+func (hs *clientHandshake) readMessage(msgType byte, seq uint16, body []byte) error {
+	switch msgType {
+	case typeServerHello:
+		if err := hs.readServerHello(body); err != nil {
+			return err
+		}
+	case typeServerKeyExchange:
+		if len(body) < 2 || len(body) != 2 + int(binary.BigEndian.Uint16(body)) {
+			return errors.New("malformed ServerKeyExchange")
+		}
+	case typeServerHelloDone:
+		hs.serverHelloDone = true
+	default:
+		return fmt.Errorf("unexpected handshake message of type %d, for a cipher suite other than PSK", msgType)
+	}
+	hs.transcript = append(hs.transcript, handshakeMessage(msgType, seq, body)...)
+	return nil
+}
+
+// Reads the server's handshake messages that have arrived whole, in the order of their message sequence numbers
+// Returns whether the server asked for the ClientHello again with a cookie, which it only does once
+func (hs *clientHandshake) readMessages(pending map[uint16]*pendingMessage) (bool, error) {
+	if !hs.serverHello {
+		for seq, message := range pending {
+			if message.missing > 0 {
+				continue
+			}
+			if message.msgType == typeHelloVerifyRequest && hs.cookie == nil {
+				for seq := range pending {
+					delete(pending, seq)
+				}
+				if err := hs.readHelloVerifyRequest(message.body); err != nil {
+					return false, err
+				}
+				return true, nil
+			}
+			if message.msgType == typeServerHello {
+				hs.serverHello = true
+				hs.recvSeq = seq
+			}
+		}
+		if !hs.serverHello {
+			return false, nil
+		}
+	}
+	for {
+		message := pending[hs.recvSeq]
+		if message == nil || message.missing > 0 {
+			break
+		}
+		if err := hs.readMessage(message.msgType, hs.recvSeq, message.body); err != nil {
+			return false, err
+		}
+		hs.recvSeq++
+	}
+	// Forget retransmissions of the messages already read
+	for seq := range pending {
+		if seq < hs.recvSeq {
+			delete(pending, seq)
+		}
+	}
+	return false, nil
+}
+
+// Returns the ClientKeyExchange naming the client's identity, and the client's Finished message, once the server's
+// hello is done, along with the keys the client sends and receives with
+// The premaster secret of a pre-shared key is as many zero bytes as the key is long followed by the key, each preceded
+// by its length (RFC 4279, section 2)
+func (hs *clientHandshake) finish() ([]byte, []byte, *cipherState, *cipherState) {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(hs.identity)))
+	body = append(body, hs.identity...)
+	keyExchange := handshakeMessage(typeClientKeyExchange, hs.sendSeq, body)
+	hs.sendSeq++
+	hs.transcript = append(hs.transcript, keyExchange...)
+
+	premaster := binary.BigEndian.AppendUint16(nil, uint16(len(hs.psk)))
+	premaster = append(premaster, make([]byte, len(hs.psk))...)
+	premaster = binary.BigEndian.AppendUint16(premaster, uint16(len(hs.psk)))
+	premaster = append(premaster, hs.psk...)
+	if hs.extendedMasterSecret {
+		sessionHash := sha256.Sum256(hs.transcript)
+		hs.masterSecret = prf(premaster, "extended master secret", sessionHash[:], masterSecretSize)
+	} else {
+		hs.masterSecret = prf(premaster, "master secret", append(hs.clientRandom[:], hs.serverRandom[:]...), masterSecretSize)
+	}
+
+	keys := prf(hs.masterSecret, "key expansion", append(hs.serverRandom[:], hs.clientRandom[:]...), 2 * keySize + 2 * implicitNonceSize)
+	send := newCipherState(keys[:keySize], keys[2 * keySize:])
+	recv := newCipherState(keys[keySize : 2 * keySize], keys[2 * keySize + implicitNonceSize:])
+
+	finished := handshakeMessage(typeFinished, hs.sendSeq, hs.verifyData("client finished"))
+	hs.sendSeq++
+	hs.transcript = append(hs.transcript, finished...)
+	return keyExchange, finished, send, recv
+}
+
+// Returns the verify data of a Finished message, which authenticates the transcript so far with the master secret
+func (hs *clientHandshake) verifyData(label string) []byte {
+	transcriptHash := sha256.Sum256(hs.transcript)
+	return prf(hs.masterSecret, label, transcriptHash[:], verifyDataSize)
+}
+
+// Checks the server's Finished message, which proves it knows the pre-shared key and saw the same handshake
+func (hs *clientHandshake) readFinished(body []byte) error {
+	if !hmac.Equal(body, hs.verifyData("server finished")) {
+		return errors.New("server's Finished message does not verify, so it has another pre-shared key")
+	}
+	return nil
+}
@@ -0,0 +1,2910 @@
+// Package hashsvc is the HTTP backend of http_backend, whose handlers hash the payloads of the UDP server's packets,
+// for embedding in other programs and test harnesses
+package hashsvc
+
+import (
+	"log"
+	"net/http"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+	"flag"
+	"strings"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"bytes"
+	"os"
+	"syscall"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"container/list"
+	"errors"
+	"encoding/binary"
+	"net"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/nbopardi/udp_client_server/internal/backendwire"
+	"github.com/nbopardi/udp_client_server/internal/digest"
+	"github.com/nbopardi/udp_client_server/pkg/pb"
+)
+
+// Size of the cache lines written in the memory buffer of a request
+const cacheLineSize = 64
+
+// Burns CPU with rounds of sha256 seeded by the payload, returning the last digest so the work cannot be optimized away
+func burnCPU(payload []byte, iterations int) [sha256.Size]byte {
+	sum := sha256.Sum256(payload)
+	for i := 1; i < iterations; i++ {
+		sum = sha256.Sum256(sum[:])
+	}
+	return sum
+}
+
+// Allocates a buffer and writes every cache line of it, which commits its pages and uses memory bandwidth like a memory-bound service
+// Returns a checksum of the buffer so the work cannot be optimized away
+func touchMemory(size int) byte {
+	buffer := make([]byte, size)
+	for i := 0; i < size; i += cacheLineSize {
+		buffer[i] = byte(i >> 6)
+	}
+	var checksum byte
+	for i := 0; i < size; i += cacheLineSize {
+		checksum ^= buffer[i]
+	}
+	return checksum
+}
+
+// Faults injected into the responses of hash requests
+const (
+	faultNone = iota
+	faultError
+	faultTruncate
+	faultDribble
+)
+
+// Draws the fault to inject into a hash request with the current rates
+// Only HTTP requests can be truncated or dribbled, so the other transports only act on faultError
+func (s *Service) drawFault() int {
+	s.paramsMutex.RLock()
+	errorShare, truncateShare, dribbleShare := s.errorRate, s.truncateRate, s.dribbleRate
+	s.paramsMutex.RUnlock()
+	if errorShare + truncateShare + dribbleShare == 0 {
+		return faultNone
+	}
+	r := rand.Float64()
+	switch {
+	case r < errorShare:
+		return faultError
+	case r < errorShare + truncateShare:
+		return faultTruncate
+	case r < errorShare + truncateShare + dribbleShare:
+		return faultDribble
+	}
+	return faultNone
+}
+
+// Checks that the rates of the faults are fractions that add up to at most 1
+func validateFaultRates(errorShare float64, truncateShare float64, dribbleShare float64) error {
+	if errorShare < 0 || truncateShare < 0 || dribbleShare < 0 {
+		return fmt.Errorf("error_rate, truncate_rate, and dribble_rate cannot be negative")
+	}
+	if errorShare + truncateShare + dribbleShare > 1 {
+		return fmt.Errorf("error_rate, truncate_rate, and dribble_rate add up to more than 1")
+	}
+	return nil
+}
+
+// Writes the body of a hash response, cut short or dribbled if the fault asks for it
+func (s *Service) writeHashResponse(w http.ResponseWriter, contentType string, body []byte, fault int) {
+	w.Header().Set("Content-Type", contentType)
+	switch fault {
+	case faultTruncate:
+		// Declaring the full length makes the server close the connection once the handler returns short of it
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body[:len(body) / 2])
+	case faultDribble:
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		flusher, _ := w.(http.Flusher)
+		for i := range body {
+			if i > 0 {
+				time.Sleep(s.dribbleInterval)
+			}
+			w.Write(body[i : i + 1])
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	default:
+		w.Write(body)
+	}
+}
+
+// Distribution of the artificial processing delay
+// kind: fixed, uniform, normal, pareto, or none
+// low, high: the delay of fixed, the bounds of uniform, the mean and standard deviation of normal, or the scale (minimum) of pareto
+// shape: the shape (alpha) of pareto, where smaller values have heavier tails
+type delayDistribution struct {
+	kind	string
+	low		time.Duration
+	high	time.Duration
+	shape	float64
+}
+
+// Parses a delay distribution given as kind:parameters (i.e. fixed:250ms, uniform:100ms-400ms, normal:250ms/50ms, pareto:100ms/1.5),
+// or as 0 or none for no delay
+func parseDelay(spec string) (delayDistribution, error) {
+	if spec == "0" || spec == "none" {
+		return delayDistribution{kind: "none"}, nil
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return delayDistribution{}, fmt.Errorf("delay %q is not in the form kind:parameters", spec)
+	}
+	kind, params := parts[0], parts[1]
+
+	// Parses two parameters separated by sep, the first of which is a duration
+	parsePair := func(sep string) (time.Duration, string, error) {
+		pair := strings.SplitN(params, sep, 2)
+		if len(pair) != 2 {
+			return 0, "", fmt.Errorf("%s delay %q needs two parameters separated by %s", kind, params, sep)
+		}
+		first, err := time.ParseDuration(pair[0])
+		if err != nil || first < 0 {
+			return 0, "", fmt.Errorf("%s delay %q does not start with a non-negative duration", kind, params)
+		}
+		return first, pair[1], nil
+	}
+
+	switch kind {
+	case "fixed":
+		delay, err := time.ParseDuration(params)
+		if err != nil || delay < 0 {
+			return delayDistribution{}, fmt.Errorf("fixed delay %q is not a non-negative duration", params)
+		}
+		return delayDistribution{kind: kind, low: delay}, nil
+	case "uniform", "normal":
+		sep := "-"
+		if kind == "normal" {
+			sep = "/"
+		}
+		low, rest, err := parsePair(sep)
+		if err != nil {
+			return delayDistribution{}, err
+		}
+		high, err := time.ParseDuration(rest)
+		if err != nil || high < 0 || (kind == "uniform" && high < low) {
+			return delayDistribution{}, fmt.Errorf("%s delay %q does not end with a valid duration", kind, params)
+		}
+		return delayDistribution{kind: kind, low: low, high: high}, nil
+	case "pareto":
+		scale, rest, err := parsePair("/")
+		if err != nil {
+			return delayDistribution{}, err
+		}
+		shape, err := strconv.ParseFloat(rest, 64)
+		if err != nil || shape <= 0 {
+			return delayDistribution{}, fmt.Errorf("pareto delay %q does not end with a positive shape", params)
+		}
+		return delayDistribution{kind: kind, low: scale, shape: shape}, nil
+	}
+	return delayDistribution{}, fmt.Errorf("delay kind %q must be one of fixed, uniform, normal, pareto, or none", kind)
+}
+
+// Draws a delay from the distribution, which is never negative
+// The global random source is safe for concurrent requests
+func (d delayDistribution) sample() time.Duration {
+	switch d.kind {
+	case "fixed":
+		return d.low
+	case "uniform":
+		return d.low + time.Duration(rand.Int63n(int64(d.high - d.low) + 1))
+	case "normal":
+		delay := time.Duration(float64(d.low) + rand.NormFloat64() * float64(d.high))
+		if delay < 0 {
+			return 0
+		}
+		return delay
+	case "pareto":
+		// Inverse transform sampling, with 1 - rand.Float64() in (0, 1] so the power never divides by zero
+		return time.Duration(float64(d.low) / math.Pow(1 - rand.Float64(), 1 / d.shape))
+	}
+	return 0
+}
+
+// Handler for any requests with the /hash endpoint, or the /hash/{algo} endpoint of a specific hash algorithm
+// Either endpoint followed by /batch hashes a JSON array of payloads into a JSON array of hashes in a single request
+// Either endpoint followed by /stream hashes the raw body as it is read, without buffering it
+// The /hash endpoint with an algos query parameter answers with the digests of every algorithm it lists
+func (s *Service) hashHandler(w http.ResponseWriter, req *http.Request) {
+	// Check if this handler got the correct endpoint, which algorithm it asks for, and whether it is a batch or a stream
+	path := strings.TrimPrefix(req.URL.Path, "/hash")
+	batch := strings.HasSuffix(path, "/batch")
+	path = strings.TrimSuffix(path, "/batch")
+	stream := !batch && isStreamPath(path)
+	path = strings.TrimSuffix(path, "/stream")
+	algo := s.defaultAlgo
+	if path != "" {
+		var err error
+		algo, err = digest.Lookup(strings.TrimPrefix(path, "/"))
+		if err != nil {
+			http.Error(w, "404 not found.", http.StatusNotFound)
+			return
+		}
+	}
+
+	// Several algorithms can be asked for at once on /hash, to get several digests of a single payload
+	var algos []digest.Algorithm
+	if names := req.URL.Query().Get("algos"); names != "" {
+		if path != "" || batch || stream {
+			http.Error(w, "algos can only be asked for on /hash itself.", http.StatusBadRequest)
+			return
+		}
+		var err error
+		algos, err = lookupDigestAlgorithms(names)
+		if err != nil {
+			http.Error(w, err.Error() + ".", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Only satisfy GET and POST requests, with a body in any of the supported encodings
+	if req.Method == "GET" || req.Method == "POST" {
+		fault := s.drawFault()
+		if fault == faultError {
+			http.Error(w, "Injected error.", s.errorStatus)
+			return
+		}
+
+		// Wait for a free worker if their number is limited, giving up if the client goes away first
+		if !s.acquireWorker(req.Context()) {
+			http.Error(w, "Request canceled while waiting for a worker.", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.releaseWorker()
+
+		if stream {
+			s.hashStream(w, req, algo, fault)
+			return
+		}
+
+		// First read the resquest's body into a byte slice
+		reqBody, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			bodyReadError(w, req, err)
+			return
+		}
+
+		// Pick the encoding of the body from its content type, and the encoding of the response from the Accept header
+		reqEncoding := requestEncoding(req)
+		respEncoding, ok := responseEncoding(req, reqEncoding)
+		if !ok {
+			http.Error(w, "None of the accepted encodings are supported.", http.StatusNotAcceptable)
+			return
+		}
+		if batch {
+			s.hashBatch(w, req, reqBody, algo, reqEncoding, respEncoding, fault)
+			return
+		}
+
+		// Next decode the byte slice into the buffer
+		// The buffer is sized by the payload, so payloads of any length can be hashed
+		buffer, err := reqEncoding.decode(reqBody)
+		if err != nil {
+			http.Error(w, "Payload is not valid " + reqEncoding.contentType + ".", http.StatusBadRequest)
+			return
+		}
+		size := len(buffer)
+		if algos != nil {
+			s.hashDigests(w, req, algos, buffer, fault)
+			return
+		}
+
+		// Get the digest of the packet, whose length depends on the algorithm
+		buffer = s.hashPayloads(algo, [][]byte{buffer})[0]
+		s.recordAudit(remoteClient(req), endpointOf(req.URL.Path), algo.Name(), []int{size}, [][]byte{buffer})
+
+		// Finally write the hash back to the recipient in the response encoding
+		s.writeHashResponse(w, respEncoding.contentType, respEncoding.encode(buffer), fault)
+		return
+	} else {
+		// Handle all unsuported request types
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+}
+
+// Hashes an array of payloads and writes back the array of their hashes in the same order
+// The processing delay is applied once for the whole batch, as for a single payload
+func (s *Service) hashBatch(w http.ResponseWriter, req *http.Request, reqBody []byte, algo digest.Algorithm, reqEncoding *bodyEncoding, respEncoding *bodyEncoding, fault int) {
+	if reqEncoding.decodeBatch == nil || respEncoding.encodeBatch == nil {
+		http.Error(w, "Batches cannot be raw bytes.", http.StatusBadRequest)
+		return
+	}
+	payloads, err := reqEncoding.decodeBatch(reqBody)
+	if err != nil {
+		http.Error(w, "Batch is not an array of payloads in " + reqEncoding.contentType + ".", http.StatusBadRequest)
+		return
+	}
+
+	hashes := s.hashPayloads(algo, payloads)
+	s.recordAudit(remoteClient(req), endpointOf(req.URL.Path), algo.Name(), payloadSizes(payloads), hashes)
+	s.writeHashResponse(w, respEncoding.contentType, respEncoding.encodeBatch(hashes), fault)
+}
+
+// Returns the IP of the client of a request, or its whole remote address if it has no port (i.e. over a Unix domain socket)
+func remoteClient(req *http.Request) string {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return client
+}
+
+// Environment variable holding the keys of the /hmac endpoint when they are not given as a flag
+const tagKeysEnv = "BACKEND_TAG_KEYS"
+
+// Parses comma separated ID:key pairs of the /hmac endpoint, returning the keys by ID and the ID of the first one
+func parseTagKeys(spec string) (map[string][]byte, string, error) {
+	keys := make(map[string][]byte)
+	var first string
+	for _, pair := range strings.Split(spec, ",") {
+		colon := strings.Index(pair, ":")
+		if colon <= 0 || colon == len(pair) - 1 {
+			return nil, "", fmt.Errorf("tag key %q is not in the form id:key", pair)
+		}
+		id := pair[:colon]
+		if _, ok := keys[id]; ok {
+			return nil, "", fmt.Errorf("tag key id %q is given more than once", id)
+		}
+		keys[id] = []byte(pair[colon + 1:])
+		if first == "" {
+			first = id
+		}
+	}
+	return keys, first, nil
+}
+
+// Handler for requests with the /hmac endpoint, tagging the payload with the HMAC-SHA256 of the current key, or the
+// /hmac/{id} endpoint of a specific key, so the tag proves the payload went through a backend holding the key
+// The payload and tag are in the same encodings as /hash, and the ID of the key is sent back in the X-Key-ID header
+func (s *Service) hmacHandler(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/hmac"), "/")
+	if id == "" {
+		s.paramsMutex.RLock()
+		id = s.tagKeyID
+		s.paramsMutex.RUnlock()
+	}
+	key, ok := s.tagKeys[id]
+	if !ok {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	fault := s.drawFault()
+	if fault == faultError {
+		http.Error(w, "Injected error.", s.errorStatus)
+		return
+	}
+	if !s.acquireWorker(req.Context()) {
+		http.Error(w, "Request canceled while waiting for a worker.", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.releaseWorker()
+
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		bodyReadError(w, req, err)
+		return
+	}
+	reqEncoding := requestEncoding(req)
+	respEncoding, ok := responseEncoding(req, reqEncoding)
+	if !ok {
+		http.Error(w, "None of the accepted encodings are supported.", http.StatusNotAcceptable)
+		return
+	}
+	payload, err := reqEncoding.decode(reqBody)
+	if err != nil {
+		http.Error(w, "Payload is not valid " + reqEncoding.contentType + ".", http.StatusBadRequest)
+		return
+	}
+
+	s.stats.record("hmac-sha256", 1, int64(len(payload)))
+	s.simulateProcessing()
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	tag := mac.Sum(nil)
+	s.recordAudit(remoteClient(req), endpointOf(req.URL.Path), "hmac-sha256:" + id, []int{len(payload)}, [][]byte{tag})
+	w.Header().Set("X-Key-ID", id)
+	s.writeHashResponse(w, respEncoding.contentType, respEncoding.encode(tag), fault)
+}
+
+// Looks up comma separated hash algorithms, each of which can only be given once
+func lookupDigestAlgorithms(names string) ([]digest.Algorithm, error) {
+	var algos []digest.Algorithm
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if seen[name] {
+			return nil, fmt.Errorf("hash algorithm %q is given more than once", name)
+		}
+		seen[name] = true
+		algo, err := digest.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		algos = append(algos, algo)
+	}
+	return algos, nil
+}
+
+// Hashes a payload with several algorithms and writes back a JSON object of the base64 encoded digests by algorithm name,
+// whatever the Accept header, so clients can check a payload with stronger hashes than the one they reflect
+// The processing delay is applied once for all the digests, as for a batch
+func (s *Service) hashDigests(w http.ResponseWriter, req *http.Request, algos []digest.Algorithm, payload []byte, fault int) {
+	payloads := make([][]byte, len(algos))
+	for i := range payloads {
+		payloads[i] = payload
+	}
+	hashes := s.hashEach(algos, payloads)
+
+	digests := make(map[string][]byte, len(algos))
+	for i, algo := range algos {
+		digests[algo.Name()] = hashes[i]
+		s.recordAudit(remoteClient(req), endpointOf(req.URL.Path), algo.Name(), []int{len(payload)}, hashes[i:i + 1])
+	}
+	body, err := json.Marshal(digests)
+	if err != nil {
+		http.Error(w, "Could not encode the digests.", http.StatusInternalServerError)
+		return
+	}
+	s.writeHashResponse(w, jsonEncoding.contentType, body, fault)
+}
+
+// Encoding of the request and response bodies of the hash endpoints, holding either a single payload or hash, or an array of them for a batch
+// decodeBatch, encodeBatch: nil for encodings that cannot hold an array, like raw bytes
+type bodyEncoding struct {
+	contentType	string
+	decode		func([]byte) ([]byte, error)
+	encode		func([]byte) []byte
+	decodeBatch	func([]byte) ([][]byte, error)
+	encodeBatch	func([][]byte) []byte
+}
+
+var jsonEncoding = &bodyEncoding{
+	contentType: "application/json",
+	decode: func(body []byte) ([]byte, error) {
+		// A payload must be a base64 string, so null is rejected like any other malformed body instead of hashed as nothing
+		var payload []byte
+		err := json.Unmarshal(body, &payload)
+		if err == nil && payload == nil {
+			err = errors.New("payload is null")
+		}
+		return payload, err
+	},
+	encode: func(hash []byte) []byte {
+		body, _ := json.Marshal(hash)
+		return append(body, '\n')
+	},
+	decodeBatch: func(body []byte) ([][]byte, error) {
+		var payloads [][]byte
+		err := json.Unmarshal(body, &payloads)
+		if err != nil {
+			return nil, err
+		}
+		if payloads == nil {
+			return nil, errors.New("batch is null")
+		}
+		for _, payload := range payloads {
+			if payload == nil {
+				return nil, errors.New("payload is null")
+			}
+		}
+		return payloads, nil
+	},
+	encodeBatch: func(hashes [][]byte) []byte {
+		body, _ := json.Marshal(hashes)
+		return append(body, '\n')
+	},
+}
+
+var rawEncoding = &bodyEncoding{
+	contentType: "application/octet-stream",
+	decode: func(body []byte) ([]byte, error) { return body, nil },
+	encode: func(hash []byte) []byte { return hash },
+}
+
+// MessagePack, where payloads and hashes are bin values and batches are arrays of them
+var msgpackEncoding = &bodyEncoding{
+	contentType: "application/msgpack",
+	decode: func(body []byte) ([]byte, error) {
+		value, rest, err := decodeMsgpackBin(body)
+		if err == nil && len(rest) > 0 {
+			err = errors.New("trailing bytes")
+		}
+		return value, err
+	},
+	encode: func(hash []byte) []byte {
+		return appendMsgpackBin(nil, hash)
+	},
+	decodeBatch: func(body []byte) ([][]byte, error) {
+		if len(body) == 0 {
+			return nil, errors.New("empty body")
+		}
+		var count uint64
+		switch {
+		case body[0] & 0xf0 == 0x90:
+			count, body = uint64(body[0] & 0x0f), body[1:]
+		case body[0] == 0xdc && len(body) >= 3:
+			count, body = uint64(binary.BigEndian.Uint16(body[1:])), body[3:]
+		case body[0] == 0xdd && len(body) >= 5:
+			count, body = uint64(binary.BigEndian.Uint32(body[1:])), body[5:]
+		default:
+			return nil, errors.New("not an array")
+		}
+		return decodeArray(body, count, decodeMsgpackBin)
+	},
+	encodeBatch: func(hashes [][]byte) []byte {
+		var body []byte
+		switch n := len(hashes); {
+		case n < 16:
+			body = append(body, 0x90 | byte(n))
+		case n <= math.MaxUint16:
+			body = append(body, 0xdc, byte(n >> 8), byte(n))
+		default:
+			body = append(body, 0xdd, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n))
+		}
+		for _, hash := range hashes {
+			body = appendMsgpackBin(body, hash)
+		}
+		return body
+	},
+}
+
+// CBOR (RFC 8949), where payloads and hashes are byte strings and batches are arrays of them
+var cborEncoding = &bodyEncoding{
+	contentType: "application/cbor",
+	decode: func(body []byte) ([]byte, error) {
+		value, rest, err := decodeCBORBytes(body)
+		if err == nil && len(rest) > 0 {
+			err = errors.New("trailing bytes")
+		}
+		return value, err
+	},
+	encode: func(hash []byte) []byte {
+		return append(appendCBORHead(nil, 2, uint64(len(hash))), hash...)
+	},
+	decodeBatch: func(body []byte) ([][]byte, error) {
+		major, count, body, err := decodeCBORHead(body)
+		if err != nil {
+			return nil, err
+		}
+		if major != 4 {
+			return nil, errors.New("not an array")
+		}
+		return decodeArray(body, count, decodeCBORBytes)
+	},
+	encodeBatch: func(hashes [][]byte) []byte {
+		body := appendCBORHead(nil, 4, uint64(len(hashes)))
+		for _, hash := range hashes {
+			body = append(appendCBORHead(body, 2, uint64(len(hash))), hash...)
+		}
+		return body
+	},
+}
+
+// Protobuf, with the HashRequest, HashResponse, HashBatchRequest, and HashStreamResponse messages of hash.proto
+// The algorithm comes from the endpoint, so the algo field of a HashRequest is ignored
+var protobufEncoding = &bodyEncoding{
+	contentType: "application/x-protobuf",
+	decode: func(body []byte) ([]byte, error) {
+		// A request without a payload field is rejected like a JSON null, so an empty payload must be written explicitly
+		var request pb.HashRequest
+		err := request.Unmarshal(body)
+		if err == nil && request.Payload == nil {
+			err = errors.New("payload is missing")
+		}
+		return request.Payload, err
+	},
+	encode: func(hash []byte) []byte {
+		return (&pb.HashResponse{Hash: hash}).Marshal()
+	},
+	decodeBatch: func(body []byte) ([][]byte, error) {
+		var request pb.HashBatchRequest
+		err := request.Unmarshal(body)
+		return request.Payloads, err
+	},
+	encodeBatch: func(hashes [][]byte) []byte {
+		return (&pb.HashStreamResponse{Hashes: hashes}).Marshal()
+	},
+}
+
+// Encodings of the hash endpoints by media type, including the common aliases
+var bodyEncodings = map[string]*bodyEncoding{
+	"application/json": jsonEncoding,
+	"application/octet-stream": rawEncoding,
+	"application/msgpack": msgpackEncoding,
+	"application/x-msgpack": msgpackEncoding,
+	"application/vnd.msgpack": msgpackEncoding,
+	"application/cbor": cborEncoding,
+	"application/x-protobuf": protobufEncoding,
+	"application/protobuf": protobufEncoding,
+	"application/vnd.google.protobuf": protobufEncoding,
+}
+
+// Returns the media type of a Content-Type or Accept entry, without its parameters
+func mediaType(value string) string {
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// Returns the encoding of a request's body from its content type, which is JSON unless another supported encoding is given
+func requestEncoding(req *http.Request) *bodyEncoding {
+	if encoding, ok := bodyEncodings[mediaType(req.Header.Get("Content-Type"))]; ok {
+		return encoding
+	}
+	return jsonEncoding
+}
+
+// Returns the first supported encoding in a request's Accept header, or the request's own encoding if it accepts anything
+// Returns false if the request only accepts unsupported encodings
+func responseEncoding(req *http.Request, reqEncoding *bodyEncoding) (*bodyEncoding, bool) {
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return reqEncoding, true
+	}
+	for _, entry := range strings.Split(accept, ",") {
+		accepted := mediaType(entry)
+		if accepted == "*/*" || accepted == "application/*" {
+			return reqEncoding, true
+		}
+		if encoding, ok := bodyEncodings[accepted]; ok {
+			return encoding, true
+		}
+	}
+	return nil, false
+}
+
+// Decodes count values of an array with decodeValue, which must use up the rest of the body
+func decodeArray(body []byte, count uint64, decodeValue func([]byte) ([]byte, []byte, error)) ([][]byte, error) {
+	// Every value takes at least a byte, which bounds the allocation for a forged count
+	if count > uint64(len(body)) {
+		return nil, errors.New("array is longer than the body")
+	}
+	values := make([][]byte, count)
+	for i := range values {
+		var err error
+		values[i], body, err = decodeValue(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(body) > 0 {
+		return nil, errors.New("trailing bytes")
+	}
+	return values, nil
+}
+
+// Appends a MessagePack bin value
+func appendMsgpackBin(body []byte, value []byte) []byte {
+	switch n := len(value); {
+	case n <= math.MaxUint8:
+		body = append(body, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		body = append(body, 0xc5, byte(n >> 8), byte(n))
+	default:
+		body = append(body, 0xc6, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n))
+	}
+	return append(body, value...)
+}
+
+// Decodes a MessagePack bin or str value, returning it and the rest of the body
+func decodeMsgpackBin(body []byte) ([]byte, []byte, error) {
+	if len(body) == 0 {
+		return nil, nil, errors.New("missing value")
+	}
+	var length uint64
+	var header int
+	switch {
+	case body[0] & 0xe0 == 0xa0:
+		length, header = uint64(body[0] & 0x1f), 1
+	case (body[0] == 0xc4 || body[0] == 0xd9) && len(body) >= 2:
+		length, header = uint64(body[1]), 2
+	case (body[0] == 0xc5 || body[0] == 0xda) && len(body) >= 3:
+		length, header = uint64(binary.BigEndian.Uint16(body[1:])), 3
+	case (body[0] == 0xc6 || body[0] == 0xdb) && len(body) >= 5:
+		length, header = uint64(binary.BigEndian.Uint32(body[1:])), 5
+	default:
+		return nil, nil, errors.New("not a bin value")
+	}
+	body = body[header:]
+	if length > uint64(len(body)) {
+		return nil, nil, errors.New("truncated value")
+	}
+	return body[:length], body[length:], nil
+}
+
+// Appends the head of a CBOR data item, which is its major type and its argument (a length for byte strings and arrays)
+func appendCBORHead(body []byte, major byte, argument uint64) []byte {
+	major <<= 5
+	switch {
+	case argument < 24:
+		return append(body, major | byte(argument))
+	case argument <= math.MaxUint8:
+		return append(body, major | 24, byte(argument))
+	case argument <= math.MaxUint16:
+		return append(body, major | 25, byte(argument >> 8), byte(argument))
+	case argument <= math.MaxUint32:
+		return append(body, major | 26, byte(argument >> 24), byte(argument >> 16), byte(argument >> 8), byte(argument))
+	}
+	body = append(body, major | 27)
+	var argumentBytes [8]byte
+	binary.BigEndian.PutUint64(argumentBytes[:], argument)
+	return append(body, argumentBytes[:]...)
+}
+
+// Decodes the head of a CBOR data item, returning its major type, its argument, and the rest of the body
+// Indefinite lengths are not supported
+func decodeCBORHead(body []byte) (byte, uint64, []byte, error) {
+	if len(body) == 0 {
+		return 0, 0, nil, errors.New("missing value")
+	}
+	major, info := body[0] >> 5, body[0] & 0x1f
+	body = body[1:]
+	if info < 24 {
+		return major, uint64(info), body, nil
+	}
+	if info > 27 {
+		return 0, 0, nil, errors.New("indefinite or reserved length")
+	}
+	size := 1 << (info - 24)
+	if len(body) < size {
+		return 0, 0, nil, errors.New("truncated head")
+	}
+	var argument uint64
+	for _, b := range body[:size] {
+		argument = argument << 8 | uint64(b)
+	}
+	return major, argument, body[size:], nil
+}
+
+// Decodes a CBOR byte or text string, returning it and the rest of the body
+func decodeCBORBytes(body []byte) ([]byte, []byte, error) {
+	major, length, body, err := decodeCBORHead(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if major != 2 && major != 3 {
+		return nil, nil, errors.New("not a byte string")
+	}
+	if length > uint64(len(body)) {
+		return nil, nil, errors.New("truncated value")
+	}
+	return body[:length], body[length:], nil
+}
+
+// Waits for a free worker if their number is limited, returning false if the context is done first
+func (s *Service) acquireWorker(ctx context.Context) bool {
+	if s.workerTokens == nil {
+		return true
+	}
+	select {
+	case s.workerTokens <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Frees the worker taken by acquireWorker
+func (s *Service) releaseWorker() {
+	if s.workerTokens != nil {
+		<-s.workerTokens
+	}
+}
+
+// Hashes payloads with an algorithm, as the hashing core shared by every endpoint and transport of the backend
+func (s *Service) hashPayloads(algo digest.Algorithm, payloads [][]byte) [][]byte {
+	algos := make([]digest.Algorithm, len(payloads))
+	for i := range algos {
+		algos[i] = algo
+	}
+	return s.hashEach(algos, payloads)
+}
+
+// Hashes each payload with the algorithm at the same index after sleeping for the artificial processing delay and touching
+// the simulated memory once, with the simulated CPU work done for each hash
+// With a response cache, hashes computed before are answered from it, and the delay and work are skipped if every hash was
+func (s *Service) hashEach(algos []digest.Algorithm, payloads [][]byte) [][]byte {
+	hashes := make([][]byte, len(payloads))
+	var keys []cacheKey
+	misses := len(payloads)
+	if s.cache != nil {
+		keys = make([]cacheKey, len(payloads))
+		for i, payload := range payloads {
+			keys[i] = newCacheKey(algos[i], payload)
+			if hash, ok := s.cache.get(keys[i]); ok {
+				hashes[i] = hash
+				misses--
+			}
+		}
+	}
+	for i, payload := range payloads {
+		s.stats.record(algos[i].Name(), 1, int64(len(payload)))
+	}
+	if misses == 0 {
+		return hashes
+	}
+
+	s.simulateProcessing()
+	for i, payload := range payloads {
+		if hashes[i] != nil {
+			continue
+		}
+		if s.cpuIterations > 0 {
+			burnCPU(payload, s.cpuIterations)
+		}
+		hashes[i] = algos[i].Sum(payload)
+		if s.cache != nil {
+			s.cache.add(keys[i], hashes[i])
+		}
+	}
+	return hashes
+}
+
+// Sleeps for the artificial processing delay and touches the simulated memory of a request
+func (s *Service) simulateProcessing() {
+	s.paramsMutex.RLock()
+	delay := s.processingDelay.sample()
+	s.paramsMutex.RUnlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if s.memoryBytes > 0 {
+		touchMemory(s.memoryBytes)
+	}
+}
+
+// Returns whether the path of a hash request, after /hash, asks for the streaming endpoint
+func isStreamPath(path string) bool {
+	return strings.HasSuffix(path, "/stream")
+}
+
+// Hashes a request body incrementally as it streams in, so multi-megabyte payloads are never buffered in full, and writes back the hash
+// The body is the raw payload whatever its content type, and the hash is raw unless the Accept header asks for another encoding
+// The processing delay and simulated work are applied once the body is read, with the CPU work seeded by the hash, and the
+// response cache is skipped since the payload is never held to look it up
+func (s *Service) hashStream(w http.ResponseWriter, req *http.Request, algo digest.Algorithm, fault int) {
+	respEncoding, ok := responseEncoding(req, rawEncoding)
+	if !ok {
+		http.Error(w, "None of the accepted encodings are supported.", http.StatusNotAcceptable)
+		return
+	}
+	body := &countingBody{ReadCloser: req.Body}
+	hash, err := algo.SumReader(body)
+	if err != nil {
+		bodyReadError(w, req, err)
+		return
+	}
+	s.stats.record(algo.Name(), 1, body.read)
+	s.recordAudit(remoteClient(req), endpointOf(req.URL.Path), algo.Name(), []int{int(body.read)}, [][]byte{hash})
+
+	s.simulateProcessing()
+	if s.cpuIterations > 0 {
+		burnCPU(hash, s.cpuIterations)
+	}
+	s.writeHashResponse(w, respEncoding.contentType, respEncoding.encode(hash), fault)
+}
+
+// Key of the response cache, which is the SHA-256 digest of the algorithm's name and the payload
+// The digest must be collision resistant, or a payload crafted to collide with another would be answered with the other's
+// cached hash, even by the algorithms callers trust to tell payloads apart
+type cacheKey [sha256.Size]byte
+
+func newCacheKey(algo digest.Algorithm, payload []byte) cacheKey {
+	h := sha256.New()
+	// The name is followed by a byte no name has, so a name and payload cannot be read as another name and payload
+	h.Write([]byte(algo.Name()))
+	h.Write([]byte{0})
+	h.Write(payload)
+	var key cacheKey
+	h.Sum(key[:0])
+	return key
+}
+
+// Entry of the response cache, kept in a list from the most to the least recently used
+type cacheEntry struct {
+	key		cacheKey
+	hash	[]byte
+}
+
+// LRU cache of the hashes of recent payloads, so repeated payloads skip the processing delay and hashing like a cache-accelerated service
+// hits, misses, evictions: counters exposed on /metrics
+type lruCache struct {
+	mutex		sync.Mutex
+	capacity	int
+	entries		map[cacheKey]*list.Element
+	order		*list.List
+	hits		int64
+	misses		int64
+	evictions	int64
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{capacity: capacity, entries: make(map[cacheKey]*list.Element), order: list.New()}
+}
+
+// Returns the hash cached for a key, marking it as the most recently used
+func (c *lruCache) get(key cacheKey) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).hash, true
+}
+
+// Caches the hash of a key, evicting the least recently used entry if the cache is full
+func (c *lruCache) add(key cacheKey, hash []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.evictions++
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, hash: hash})
+}
+
+// Writes the metrics of the cache in the Prometheus text exposition format
+func (c *lruCache) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP http_backend_cache_hits_total Payloads whose hash was answered from the response cache.\n# TYPE http_backend_cache_hits_total counter\n")
+	fmt.Fprintf(w, "http_backend_cache_hits_total %d\n", c.hits)
+	fmt.Fprintf(w, "# HELP http_backend_cache_misses_total Payloads that were not in the response cache.\n# TYPE http_backend_cache_misses_total counter\n")
+	fmt.Fprintf(w, "http_backend_cache_misses_total %d\n", c.misses)
+	fmt.Fprintf(w, "# HELP http_backend_cache_evictions_total Entries evicted from the full response cache.\n# TYPE http_backend_cache_evictions_total counter\n")
+	fmt.Fprintf(w, "http_backend_cache_evictions_total %d\n", c.evictions)
+	fmt.Fprintf(w, "# HELP http_backend_cache_entries Entries in the response cache.\n# TYPE http_backend_cache_entries gauge\n")
+	fmt.Fprintf(w, "http_backend_cache_entries %d\n", c.order.Len())
+	hitRatio := 0.0
+	if c.hits + c.misses > 0 {
+		hitRatio = float64(c.hits) / float64(c.hits + c.misses)
+	}
+	fmt.Fprintf(w, "# HELP http_backend_cache_hit_ratio Share of payloads answered from the response cache since the start.\n# TYPE http_backend_cache_hit_ratio gauge\n")
+	fmt.Fprintf(w, "http_backend_cache_hit_ratio %g\n", hitRatio)
+}
+
+// gRPC status codes sent back by the Hash service
+const (
+	grpcOK = 0
+	grpcCanceled = 1
+	grpcInvalidArgument = 3
+	grpcNotFound = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented = 12
+	grpcInternal = 13
+	grpcUnavailable = 14
+	grpcUnauthenticated = 16
+)
+
+// Path prefix of the methods of the Hash gRPC service, as defined in hash.proto
+const grpcServicePrefix = "/hash.Hash/"
+
+// Largest gRPC message accepted from a caller
+const maxGRPCMessageSize = 4 << 20
+
+// Reads one length-prefixed gRPC message from a request body, returning io.EOF once the caller has sent all of them
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if errors.Is(err, errBodyTooLarge) {
+			return nil, errBodyTooLarge
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated message prefix")
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is larger than %d bytes", size, maxGRPCMessageSize)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		// A body cut off by max_stream_body is too large rather than truncated
+		if errors.Is(err, errBodyTooLarge) {
+			return nil, errBodyTooLarge
+		}
+		return nil, errors.New("truncated message")
+	}
+	return message, nil
+}
+
+// Writes one length-prefixed, uncompressed gRPC message
+func writeGRPCMessage(w io.Writer, message []byte) {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	w.Write(prefix[:])
+	w.Write(message)
+}
+
+// Ends a gRPC response with its status, and a message if it is not empty, in the trailers
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix + "Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix + "Grpc-Message", message)
+	}
+}
+
+// Handler for the Hash gRPC service defined in hash.proto, served over HTTP/2 next to the HTTP endpoints
+// The unary Hash method hashes a single payload, and the client-streaming HashStream method hashes every payload the
+// caller streams with a single processing delay, like a batch, answering with all the hashes in order once the stream ends
+func (s *Service) grpcHandler(w http.ResponseWriter, req *http.Request) {
+	if req.ProtoMajor != 2 || req.Method != "POST" || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests must be HTTP/2 POST requests with an application/grpc content type.", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	finish := func(code int, message string) {
+		writeGRPCStatus(w, code, message)
+	}
+
+	method := strings.TrimPrefix(req.URL.Path, grpcServicePrefix)
+	if method != "Hash" && method != "HashStream" {
+		finish(grpcUnimplemented, "unknown method " + method)
+		return
+	}
+	if s.drawFault() == faultError {
+		finish(grpcInternal, "injected error")
+		return
+	}
+
+	// Read every request message, of which the unary method takes exactly one
+	var payloads [][]byte
+	algoName := ""
+	for {
+		message, err := readGRPCMessage(req.Body)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errBodyTooLarge) {
+			finish(grpcResourceExhausted, err.Error())
+			return
+		}
+		if err != nil {
+			finish(grpcInternal, err.Error())
+			return
+		}
+		var request pb.HashRequest
+		if err := request.Unmarshal(message); err != nil {
+			finish(grpcInvalidArgument, err.Error())
+			return
+		}
+		// The algorithm of a stream is the one named by its first request
+		if len(payloads) == 0 {
+			algoName = request.Algo
+		}
+		payloads = append(payloads, request.Payload)
+	}
+	if method == "Hash" && len(payloads) != 1 {
+		finish(grpcInvalidArgument, "Hash takes exactly one request")
+		return
+	}
+
+	algo := s.defaultAlgo
+	if algoName != "" {
+		var err error
+		algo, err = digest.Lookup(algoName)
+		if err != nil {
+			finish(grpcNotFound, err.Error())
+			return
+		}
+	}
+
+	// Wait for a free worker if their number is limited, giving up if the caller goes away first
+	if !s.acquireWorker(req.Context()) {
+		finish(grpcCanceled, "canceled while waiting for a worker")
+		return
+	}
+	defer s.releaseWorker()
+
+	hashes := s.hashPayloads(algo, payloads)
+	s.recordAudit(remoteClient(req), endpointOf(req.URL.Path), algo.Name(), payloadSizes(payloads), hashes)
+	if method == "Hash" {
+		writeGRPCMessage(w, (&pb.HashResponse{Hash: hashes[0]}).Marshal())
+	} else {
+		writeGRPCMessage(w, (&pb.HashStreamResponse{Hashes: hashes}).Marshal())
+	}
+	finish(grpcOK, "")
+}
+
+// Error of a request body read beyond the max body size
+var errBodyTooLarge = errors.New("request body is larger than the max body size")
+
+// Request body that fails with errBodyTooLarge once more than max bytes are read from it
+type limitedBody struct {
+	io.ReadCloser
+	remaining	int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// Read one byte more than allowed, to tell a body of exactly the max size from a larger one
+	if int64(len(p)) > b.remaining + 1 {
+		p = p[:b.remaining + 1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), errBodyTooLarge
+	}
+	return n, err
+}
+
+// Wraps a handler so request bodies larger than maxBody bytes, or maxStreamBody bytes for the streaming endpoint, are answered
+// 413 Request Entity Too Large, right away if the request declares its length, and otherwise once the handler reads past the limit
+// A limit of 0 means no limit
+func limitBody(maxBody int64, maxStreamBody int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		limit := maxBody
+		if isStreamPath(req.URL.Path) {
+			limit = maxStreamBody
+		}
+		if limit == 0 {
+			next(w, req)
+			return
+		}
+		if req.ContentLength > limit {
+			reject(w, req, "Request body is too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = &limitedBody{ReadCloser: req.Body, remaining: limit}
+		next(w, req)
+	}
+}
+
+// Answers a request whose body could not be read, with 413 if it was too large and 400 otherwise
+func bodyReadError(w http.ResponseWriter, req *http.Request, err error) {
+	if err == errBodyTooLarge {
+		reject(w, req, "Request body is too large.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	reject(w, req, "Could not read the request body.", http.StatusBadRequest)
+}
+
+// Answers a request the middlewares turn away with an HTTP status, or a gRPC call with the matching gRPC status in a 200
+// response, since gRPC clients take any other HTTP status for a failure of the transport rather than of the call
+func reject(w http.ResponseWriter, req *http.Request, message string, status int) {
+	if !strings.HasPrefix(req.URL.Path, grpcServicePrefix) {
+		http.Error(w, message, status)
+		return
+	}
+	code := grpcInternal
+	switch status {
+	case http.StatusUnauthorized:
+		code = grpcUnauthenticated
+	case http.StatusTooManyRequests, http.StatusRequestEntityTooLarge:
+		code = grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = grpcUnavailable
+	case http.StatusBadRequest:
+		code = grpcInvalidArgument
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	writeGRPCStatus(w, code, message)
+}
+
+// Max difference between the time a request was signed at and the time it arrives, beyond which it may be a replay
+const maxSignatureAge = 5 * time.Minute
+
+// Wraps a handler so it only serves requests that authenticate with the bearer token and the HMAC signature,
+// whichever of the two are configured, and rejects the rest with 401 Unauthorized
+func requireAuth(token string, hmacKey []byte, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if token != "" {
+			authorization := req.Header.Get("Authorization")
+			given := strings.TrimPrefix(authorization, "Bearer ")
+			if given == authorization || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				reject(w, req, "401 unauthorized.", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		if len(hmacKey) > 0 {
+			// Turn away a missing or stale signing time before reading anything, so an unsigned request costs no body
+			timestamp := req.Header.Get(backendwire.TimestampHeader)
+			signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+			age := time.Since(time.Unix(signedAt, 0))
+			if err != nil || age > maxSignatureAge || age < -maxSignatureAge {
+				reject(w, req, "401 unauthorized.", http.StatusUnauthorized)
+				return
+			}
+
+			// The signature covers the body, so read it and put it back for the handler
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				bodyReadError(w, req, err)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			expected := backendwire.SignRequest(hmacKey, req.Method, req.URL.Path, timestamp, body)
+			if !hmac.Equal([]byte(req.Header.Get(backendwire.SignatureHeader)), []byte(expected)) {
+				reject(w, req, "401 unauthorized.", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		next(w, req)
+	}
+}
+
+// Upper bounds of the buckets of the handler latency histogram, in seconds
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Upper bounds of the buckets of the request size histogram, in bytes
+var sizeBuckets = []float64{64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536, 131072}
+
+// Histogram with fixed bucket bounds, as exposed to Prometheus
+// counts: the number of observations in each bucket, which is not cumulative until written
+type metricsHistogram struct {
+	bounds	[]float64
+	counts	[]int64
+	sum		float64
+	count	int64
+}
+
+func newMetricsHistogram(bounds []float64) *metricsHistogram {
+	return &metricsHistogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *metricsHistogram) observe(value float64) {
+	h.sum += value
+	h.count++
+	i := sort.SearchFloat64s(h.bounds, value)
+	if i < len(h.bounds) {
+		h.counts[i]++
+	}
+}
+
+// Writes the cumulative buckets, sum, and count of the histogram with the given labels
+func (h *metricsHistogram) write(w io.Writer, name string, labels string) {
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// Metrics of the requests to a single endpoint
+// requests: the number of requests answered with each status code
+// errors: the number of requests answered with a 4xx or 5xx status code
+type endpointMetrics struct {
+	requests	map[int]int64
+	errors		int64
+	size		*metricsHistogram
+	latency		*metricsHistogram
+}
+
+// Metrics of all the requests the backend has served, exposed on /metrics for Prometheus to scrape
+// inFlight: the number of requests being handled right now, kept with atomics
+// limiter: the admission limiter whose limit and queue are reported
+// rateLimiter: the per client rate limiter whose rejections are reported, or nil if rates are not limited
+// cache: the response cache whose counters are reported, or nil if caching is off
+// mutex: guards the metrics of the endpoints
+type backendMetrics struct {
+	inFlight	int64
+	limiter		*admissionLimiter
+	rateLimiter	*rateLimiter
+	cache		*lruCache
+	mutex		sync.Mutex
+	endpoints	map[string]*endpointMetrics
+}
+
+func newBackendMetrics() *backendMetrics {
+	return &backendMetrics{endpoints: make(map[string]*endpointMetrics)}
+}
+
+// Records a finished request to an endpoint
+func (m *backendMetrics) record(endpoint string, status int, size int64, latency time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	metrics, ok := m.endpoints[endpoint]
+	if !ok {
+		metrics = &endpointMetrics{
+			requests: make(map[int]int64),
+			size: newMetricsHistogram(sizeBuckets),
+			latency: newMetricsHistogram(latencyBuckets),
+		}
+		m.endpoints[endpoint] = metrics
+	}
+	metrics.requests[status]++
+	if status >= 400 {
+		metrics.errors++
+	}
+	metrics.size.observe(float64(size))
+	metrics.latency.observe(latency.Seconds())
+}
+
+// Writes the metrics in the Prometheus text exposition format, with each series labelled with its endpoint
+func (m *backendMetrics) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP http_backend_requests_in_flight Requests being handled right now.\n# TYPE http_backend_requests_in_flight gauge\n")
+	fmt.Fprintf(w, "http_backend_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+	if m.limiter != nil {
+		maxConcurrent, _, queued, rejected := m.limiter.stats()
+		fmt.Fprintf(w, "# HELP http_backend_max_concurrent Max number of hash requests handled at the same time, or 0 for no limit.\n# TYPE http_backend_max_concurrent gauge\n")
+		fmt.Fprintf(w, "http_backend_max_concurrent %d\n", maxConcurrent)
+		fmt.Fprintf(w, "# HELP http_backend_queue_depth Hash requests waiting for a free slot.\n# TYPE http_backend_queue_depth gauge\n")
+		fmt.Fprintf(w, "http_backend_queue_depth %d\n", queued)
+		fmt.Fprintf(w, "# HELP http_backend_queue_rejected_total Hash requests answered 429 because the queue was full.\n# TYPE http_backend_queue_rejected_total counter\n")
+		fmt.Fprintf(w, "http_backend_queue_rejected_total %d\n", rejected)
+	}
+	if m.cache != nil {
+		m.cache.write(w)
+	}
+	if m.rateLimiter != nil {
+		fmt.Fprintf(w, "# HELP http_backend_rate_limited_total Requests answered 429 because their client exceeded its rate limit.\n# TYPE http_backend_rate_limited_total counter\n")
+		fmt.Fprintf(w, "http_backend_rate_limited_total %d\n", atomic.LoadInt64(&m.rateLimiter.limited))
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	endpoints := make([]string, 0, len(m.endpoints))
+	for endpoint := range m.endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	fmt.Fprintf(w, "# HELP http_backend_requests_total Requests handled, by endpoint and status code.\n# TYPE http_backend_requests_total counter\n")
+	for _, endpoint := range endpoints {
+		codes := make([]int, 0, len(m.endpoints[endpoint].requests))
+		for code := range m.endpoints[endpoint].requests {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "http_backend_requests_total{endpoint=%q,code=\"%d\"} %d\n", endpoint, code, m.endpoints[endpoint].requests[code])
+		}
+	}
+	fmt.Fprintf(w, "# HELP http_backend_errors_total Requests answered with a 4xx or 5xx status code.\n# TYPE http_backend_errors_total counter\n")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "http_backend_errors_total{endpoint=%q} %d\n", endpoint, m.endpoints[endpoint].errors)
+	}
+	fmt.Fprintf(w, "# HELP http_backend_request_size_bytes Size of request bodies.\n# TYPE http_backend_request_size_bytes histogram\n")
+	for _, endpoint := range endpoints {
+		m.endpoints[endpoint].size.write(w, "http_backend_request_size_bytes", fmt.Sprintf("endpoint=%q", endpoint))
+	}
+	fmt.Fprintf(w, "# HELP http_backend_request_duration_seconds Time taken to handle requests, including waiting for a worker and the processing delay.\n# TYPE http_backend_request_duration_seconds histogram\n")
+	for _, endpoint := range endpoints {
+		m.endpoints[endpoint].latency.write(w, "http_backend_request_duration_seconds", fmt.Sprintf("endpoint=%q", endpoint))
+	}
+}
+
+// Sums up the requests to every endpoint, with their total handler latency in seconds
+func (m *backendMetrics) totals() (requests int64, failed int64, latency float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, metrics := range m.endpoints {
+		requests += metrics.latency.count
+		failed += metrics.errors
+		latency += metrics.latency.sum
+	}
+	return requests, failed, latency
+}
+
+// Cumulative counters of the hashing done by the backend since it started, reported on /stats
+// payloads: the number of payloads hashed with each algorithm, by its name
+// bytes: the total size of the payloads hashed
+type backendStats struct {
+	started		time.Time
+	mutex		sync.Mutex
+	payloads	map[string]int64
+	bytes		int64
+}
+
+func newBackendStats() *backendStats {
+	return &backendStats{started: time.Now(), payloads: make(map[string]int64)}
+}
+
+// Records count payloads of size bytes in total hashed with an algorithm, by its name
+func (s *backendStats) record(name string, count int64, size int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.payloads[name] += count
+	s.bytes += size
+}
+
+// Body of the /stats endpoint
+type statsReport struct {
+	UptimeSeconds		float64				`json:"uptime_seconds"`
+	Requests			int64				`json:"requests"`
+	Errors				int64				`json:"errors"`
+	AverageLatencyMs	float64				`json:"average_latency_ms"`
+	PayloadsHashed		int64				`json:"payloads_hashed"`
+	BytesHashed			int64				`json:"bytes_hashed"`
+	Algorithms			map[string]int64	`json:"algorithms"`
+}
+
+// Handler of the /stats endpoint, answering with the JSON encoded counters of the requests served and the payloads hashed
+func (s *Service) statsHandler(metrics *backendMetrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		report := statsReport{UptimeSeconds: time.Since(s.stats.started).Seconds(), Algorithms: make(map[string]int64)}
+		var latency float64
+		report.Requests, report.Errors, latency = metrics.totals()
+		if report.Requests > 0 {
+			report.AverageLatencyMs = latency * 1000 / float64(report.Requests)
+		}
+		s.stats.mutex.Lock()
+		for name, count := range s.stats.payloads {
+			report.Algorithms[name] = count
+			report.PayloadsHashed += count
+		}
+		report.BytesHashed = s.stats.bytes
+		s.stats.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// Writes the Go runtime's goroutine, heap, and garbage collector metrics in the Prometheus text exposition format
+// Reading them stops the world briefly, which is why they are only served on the debug port
+func writeRuntimeMetrics(w io.Writer) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	lastPause := mem.PauseNs[(mem.NumGC + 255) % 256]
+	fmt.Fprintf(w, "# HELP go_goroutines Goroutines that currently exist.\n# TYPE go_goroutines gauge\n")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "# HELP go_memstats_heap_alloc_bytes Bytes of allocated heap objects.\n# TYPE go_memstats_heap_alloc_bytes gauge\n")
+	fmt.Fprintf(w, "go_memstats_heap_alloc_bytes %d\n", mem.HeapAlloc)
+	fmt.Fprintf(w, "# HELP go_memstats_heap_inuse_bytes Bytes in in-use heap spans.\n# TYPE go_memstats_heap_inuse_bytes gauge\n")
+	fmt.Fprintf(w, "go_memstats_heap_inuse_bytes %d\n", mem.HeapInuse)
+	fmt.Fprintf(w, "# HELP go_memstats_heap_objects Allocated heap objects.\n# TYPE go_memstats_heap_objects gauge\n")
+	fmt.Fprintf(w, "go_memstats_heap_objects %d\n", mem.HeapObjects)
+	fmt.Fprintf(w, "# HELP go_memstats_sys_bytes Bytes of memory obtained from the OS.\n# TYPE go_memstats_sys_bytes gauge\n")
+	fmt.Fprintf(w, "go_memstats_sys_bytes %d\n", mem.Sys)
+	fmt.Fprintf(w, "# HELP go_memstats_alloc_bytes_total Bytes allocated for heap objects, even if freed.\n# TYPE go_memstats_alloc_bytes_total counter\n")
+	fmt.Fprintf(w, "go_memstats_alloc_bytes_total %d\n", mem.TotalAlloc)
+	fmt.Fprintf(w, "# HELP go_gc_cycles_total Completed garbage collection cycles.\n# TYPE go_gc_cycles_total counter\n")
+	fmt.Fprintf(w, "go_gc_cycles_total %d\n", mem.NumGC)
+	fmt.Fprintf(w, "# HELP go_gc_pause_seconds_total Time the world was stopped for garbage collection.\n# TYPE go_gc_pause_seconds_total counter\n")
+	fmt.Fprintf(w, "go_gc_pause_seconds_total %g\n", float64(mem.PauseTotalNs) / 1e9)
+	fmt.Fprintf(w, "# HELP go_gc_last_pause_seconds Time the world was stopped by the last garbage collection.\n# TYPE go_gc_last_pause_seconds gauge\n")
+	fmt.Fprintf(w, "go_gc_last_pause_seconds %g\n", float64(lastPause) / 1e9)
+	fmt.Fprintf(w, "# HELP go_gc_cpu_fraction Fraction of the CPU time used by garbage collection since the program started.\n# TYPE go_gc_cpu_fraction gauge\n")
+	fmt.Fprintf(w, "go_gc_cpu_fraction %g\n", mem.GCCPUFraction)
+}
+
+// Creates the mux of the debug port, serving the pprof profiles under /debug/pprof/ and the runtime metrics on /metrics
+// The profiles are registered by hand, since the backend's own mux is not the default one that net/http/pprof registers with
+func newDebugMux() *http.ServeMux {
+	m := http.NewServeMux()
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	m.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeRuntimeMetrics(w)
+	})
+	return m
+}
+
+// Entry of the audit log for a single payload hashed by the backend
+// client: the IP of the requester
+// digest: the hex encoded hash (or tag) the payload was answered with
+type auditEntry struct {
+	Time		time.Time	`json:"time"`
+	Client		string		`json:"client"`
+	Endpoint	string		`json:"endpoint"`
+	Algo		string		`json:"algo"`
+	Size		int			`json:"size"`
+	Digest		string		`json:"digest"`
+}
+
+// Append-only log of every payload hashed, kept as JSON lines in a file, for auditing what traffic actually reached the backend
+// The file is appended to across runs, and queried on /audit by scanning it
+// mutex: serializes appends, so the entries of a batch are never interleaved with others
+type auditLog struct {
+	path	string
+	mutex	sync.Mutex
+	file	*os.File
+}
+
+// Opens the audit log at a path for appending, creating it if needed
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path, file: file}, nil
+}
+
+// Appends entries to the log with a single write
+func (l *auditLog) append(entries []auditEntry) error {
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, entry := range entries {
+		encoder.Encode(entry)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err := l.file.Write(lines.Bytes())
+	return err
+}
+
+func (l *auditLog) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+// Records payloads of the given sizes hashed for a client into the audit log, if requests are audited
+func (s *Service) recordAudit(client string, endpoint string, algo string, sizes []int, hashes [][]byte) {
+	if s.audit == nil {
+		return
+	}
+	now := time.Now().UTC()
+	entries := make([]auditEntry, len(hashes))
+	for i, hash := range hashes {
+		entries[i] = auditEntry{Time: now, Client: client, Endpoint: endpoint, Algo: algo, Size: sizes[i], Digest: hex.EncodeToString(hash)}
+	}
+	if err := s.audit.append(entries); err != nil {
+		log.Printf("Could not append to the audit log: %v\n", err)
+	}
+}
+
+// Returns the size of every payload
+func payloadSizes(payloads [][]byte) []int {
+	sizes := make([]int, len(payloads))
+	for i, payload := range payloads {
+		sizes[i] = len(payload)
+	}
+	return sizes
+}
+
+// Number of entries the /audit endpoint answers with when the query sets no limit
+const defaultAuditLimit = 1000
+
+// Handler of the /audit endpoint, answering with a JSON array of the entries of the audit log in the order they were
+// recorded, filtered by the client, endpoint, algo, digest, since, and until (RFC 3339 times) query parameters given,
+// and cut off after the limit parameter's number of entries
+func (l *auditLog) query(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+	query := req.URL.Query()
+	var since, until time.Time
+	var err error
+	if value := query.Get("since"); value != "" {
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "since is not an RFC 3339 time.", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		if until, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "until is not an RFC 3339 time.", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultAuditLimit
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			http.Error(w, "limit is not a positive number.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		http.Error(w, "Could not open the audit log.", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	entries := []auditEntry{}
+	decoder := json.NewDecoder(file)
+	for len(entries) < limit {
+		var entry auditEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, "Audit log is corrupt.", http.StatusInternalServerError)
+			return
+		}
+		if (query.Get("client") != "" && entry.Client != query.Get("client")) ||
+			(query.Get("endpoint") != "" && entry.Endpoint != query.Get("endpoint")) ||
+			(query.Get("algo") != "" && entry.Algo != query.Get("algo")) ||
+			(query.Get("digest") != "" && entry.Digest != strings.ToLower(query.Get("digest"))) ||
+			(!since.IsZero() && entry.Time.Before(since)) || (!until.IsZero() && entry.Time.After(until)) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// Response writer that remembers the status code and the size of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status	int
+	size	int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flushes the response if the wrapped writer can, so dribbled responses are sent byte by byte
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Request body that counts the bytes read from it, for bodies whose length is not known up front
+type countingBody struct {
+	io.ReadCloser
+	read	int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// Returns the endpoint a request path belongs to, so every algorithm's endpoint shares the series of its route
+func endpointOf(path string) string {
+	switch {
+	case path == "/shutdown" || path == "/admin/params" || path == "/audit":
+		return path
+	case path == grpcServicePrefix + "Hash" || path == grpcServicePrefix + "HashStream":
+		return path
+	case strings.HasSuffix(path, "/batch"):
+		return "/hash/batch"
+	case strings.HasSuffix(path, "/stream"):
+		return "/hash/stream"
+	case path == "/hash" || strings.HasPrefix(path, "/hash/"):
+		return "/hash"
+	case path == "/hmac" || strings.HasPrefix(path, "/hmac/"):
+		return "/hmac"
+	}
+	return "other"
+}
+
+// Wraps a handler so every request it handles is recorded in the metrics
+func instrument(metrics *backendMetrics, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		atomic.AddInt64(&metrics.inFlight, 1)
+		defer atomic.AddInt64(&metrics.inFlight, -1)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		body := &countingBody{ReadCloser: req.Body}
+		req.Body = body
+		next(recorder, req)
+
+		size := req.ContentLength
+		if size < 0 {
+			size = body.read
+		}
+		metrics.record(endpointOf(req.URL.Path), recorder.status, size, time.Since(start))
+	}
+}
+
+// Levels of the backend's access log, from the most to the least verbose
+const (
+	logDebug = iota
+	logInfo
+	logWarn
+	logError
+	logNone
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error", "none"}
+
+// Parses the name of a log level
+func parseLogLevel(name string) (int, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (expected one of %s)", name, strings.Join(logLevelNames, ", "))
+}
+
+// Wraps a handler to log one structured line per request, in logfmt
+// Requests answered with a 5xx status are logged at error level, other 4xx answers at warn level, metrics scrapes at debug level, and the rest at info level, so
+// a higher minLevel keeps the failures while silencing the normal traffic at high request rates
+func logRequests(minLevel int, next http.Handler) http.Handler {
+	if minLevel >= logNone {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		body := &countingBody{ReadCloser: req.Body}
+		req.Body = body
+		next.ServeHTTP(recorder, req)
+
+		level := logInfo
+		switch {
+		case recorder.status >= 500:
+			level = logError
+		case recorder.status >= 400:
+			level = logWarn
+		case req.URL.Path == "/metrics":
+			level = logDebug
+		}
+		if level < minLevel {
+			return
+		}
+		size := req.ContentLength
+		if size < 0 {
+			size = body.read
+		}
+		line := fmt.Sprintf("level=%s method=%s path=%q size=%d status=%d resp_size=%d latency=%s remote=%s",
+			logLevelNames[level], req.Method, req.URL.Path, size, recorder.status, recorder.size, time.Since(start), req.RemoteAddr)
+		if id := requestID(req); id != "" {
+			line += fmt.Sprintf(" request_id=%q", id)
+		}
+		log.Printf("%s\n", line)
+	})
+}
+
+// Header carrying the correlation ID of a request, which the UDP server sets to the flow and sequence number of its packet
+const requestIDHeader = "X-Request-ID"
+
+// Longest correlation ID that is logged and echoed, so clients cannot flood the log
+const maxRequestIDLength = 128
+
+// Returns the correlation ID of a request, or empty if it has none or it is too long
+func requestID(req *http.Request) string {
+	id := req.Header.Get(requestIDHeader)
+	if len(id) > maxRequestIDLength {
+		return ""
+	}
+	return id
+}
+
+// Wraps a handler so the correlation ID of every request is echoed in its response, linking the response to the request
+func echoRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if id := requestID(req); id != "" {
+			w.Header().Set(requestIDHeader, id)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Limits the number of requests handled at the same time, queueing a bounded number of the rest and rejecting the others
+// The limits can be changed while requests are waiting, which is why the slots are counted instead of held in a channel
+// maxConcurrent: the max number of requests handled at the same time, or 0 for no limit
+// maxQueue: the max number of requests waiting for a slot, or -1 for no bound
+// waiting: the channel of each queued request, closed to hand it a slot, from the first queued to the last
+// rejected: the number of requests rejected so far
+type admissionLimiter struct {
+	mutex			sync.Mutex
+	maxConcurrent	int
+	maxQueue		int
+	active			int
+	waiting			*list.List
+	rejected		int64
+}
+
+func newAdmissionLimiter(maxConcurrent int, maxQueue int) *admissionLimiter {
+	return &admissionLimiter{maxConcurrent: maxConcurrent, maxQueue: maxQueue, waiting: list.New()}
+}
+
+// Takes a slot, waiting in the queue if all of them are busy
+// Returns the status code to reject the request with if the queue is full or the request is canceled while queued, and 0 otherwise
+func (l *admissionLimiter) acquire(ctx context.Context) int {
+	l.mutex.Lock()
+	if l.maxConcurrent == 0 || l.active < l.maxConcurrent {
+		l.active++
+		l.mutex.Unlock()
+		return 0
+	}
+	if l.maxQueue >= 0 && l.waiting.Len() >= l.maxQueue {
+		l.rejected++
+		l.mutex.Unlock()
+		return http.StatusTooManyRequests
+	}
+	ready := make(chan struct{})
+	element := l.waiting.PushBack(ready)
+	l.mutex.Unlock()
+
+	select {
+	case <-ready:
+		return 0
+	case <-ctx.Done():
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		select {
+		case <-ready:
+			// The slot was handed over just as the request was canceled, so pass it on
+			l.active--
+			l.admit()
+		default:
+			l.waiting.Remove(element)
+		}
+		return http.StatusServiceUnavailable
+	}
+}
+
+// Takes a slot only if one is free right away, for requests that cannot wait in the queue
+// Returns whether a slot was taken, counting the request as rejected if not
+func (l *admissionLimiter) tryAcquire() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxConcurrent == 0 || l.active < l.maxConcurrent {
+		l.active++
+		return true
+	}
+	l.rejected++
+	return false
+}
+
+// Frees a slot taken by acquire or tryAcquire
+func (l *admissionLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active--
+	l.admit()
+}
+
+// Hands the free slots to the requests queued first, with the mutex held
+func (l *admissionLimiter) admit() {
+	for l.waiting.Len() > 0 && (l.maxConcurrent == 0 || l.active < l.maxConcurrent) {
+		close(l.waiting.Remove(l.waiting.Front()).(chan struct{}))
+		l.active++
+	}
+}
+
+// Changes the limits, admitting queued requests right away if there are more slots
+// Requests already handled beyond a lowered limit finish, and already queued requests stay queued beyond a lowered max queue
+func (l *admissionLimiter) setLimits(maxConcurrent int, maxQueue int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.maxConcurrent = maxConcurrent
+	l.maxQueue = maxQueue
+	l.admit()
+}
+
+// Returns the limits, the number of requests queued, and the number rejected so far
+func (l *admissionLimiter) stats() (maxConcurrent int, maxQueue int, queued int, rejected int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.maxConcurrent, l.maxQueue, l.waiting.Len(), l.rejected
+}
+
+// Returns whether a request arriving now would be rejected, because every slot is busy and the queue is full
+func (l *admissionLimiter) full() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.maxConcurrent > 0 && l.active >= l.maxConcurrent && l.maxQueue >= 0 && l.waiting.Len() >= l.maxQueue
+}
+
+// Handler of the /readyz endpoint, answering 200 while the backend accepts work, and 503 Service Unavailable once it
+// starts shutting down, or while its queue is full or has readyQueue requests or more in it, so orchestration stops
+// routing to an overloaded backend before its requests start timing out
+// A readyQueue of 0 only reports the backend unready when its queue is full
+func (s *Service) readyHandler(limiter *admissionLimiter, readyQueue int) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&s.draining) != 0 {
+			http.Error(w, "Shutting down.", http.StatusServiceUnavailable)
+			return
+		}
+		_, _, queued, _ := limiter.stats()
+		if limiter.full() || (readyQueue > 0 && queued >= readyQueue) {
+			http.Error(w, "Overloaded with " + strconv.Itoa(queued) + " queued requests.", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// Wraps a handler so it only runs once a slot is free, answering 429 Too Many Requests when the queue is full
+func (l *admissionLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch l.acquire(req.Context()) {
+		case http.StatusTooManyRequests:
+			w.Header().Set("Retry-After", "1")
+			reject(w, req, "Too many requests.", http.StatusTooManyRequests)
+			return
+		case http.StatusServiceUnavailable:
+			reject(w, req, "Request canceled while queued.", http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+		next(w, req)
+	}
+}
+
+// Token bucket of a single client
+// tokens: the number of requests the client can make right away, refilled at the limiter's rate up to its burst
+type tokenBucket struct {
+	tokens	float64
+	last	time.Time
+}
+
+// Limits the rate of requests from each client IP with a token bucket, so one client cannot starve the others sharing the backend
+// rate: the number of requests per second each client is allowed on average
+// burst: the number of requests a client is allowed at once after being idle
+// limited: the number of requests rejected so far, kept with atomics
+type rateLimiter struct {
+	rate		float64
+	burst		float64
+	mutex		sync.Mutex
+	buckets		map[string]*tokenBucket
+	lastSweep	time.Time
+	limited		int64
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// Takes a token from the bucket of a client, returning false if it has none left
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Every minute, forget the clients whose buckets have refilled, so the map does not grow with every address ever seen
+	if now.Sub(l.lastSweep) > time.Minute {
+		for key, bucket := range l.buckets {
+			if bucket.tokens + now.Sub(bucket.last).Seconds() * l.rate >= l.burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Wraps a handler so requests beyond their client's rate are answered 429 Too Many Requests
+func (l *rateLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !l.allow(remoteClient(req), time.Now()) {
+			atomic.AddInt64(&l.limited, 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(1 / l.rate))))
+			reject(w, req, "Rate limit exceeded.", http.StatusTooManyRequests)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// Hands the backend the sockets it inherits from the backend it replaces, which Run serves on instead of opening new ones
+// They are taken in the order Run opens its sockets: the listeners, then the debug server's, then the UDP hash service's
+func (s *Service) Inherit(sockets []*os.File) {
+	s.inherited = append(s.inherited, sockets...)
+}
+
+// Takes the next inherited socket, or returns nil if there are none left
+func (s *Service) takeInheritedSocket() *os.File {
+	if len(s.inherited) == 0 {
+		return nil
+	}
+	inherited := s.inherited[0]
+	s.inherited = s.inherited[1:]
+	return inherited
+}
+
+// Creates the configuration of the TCP and UDP sockets, which sets SO_REUSEPORT on them if asked to, so a new backend
+// can bind the same ports while the old one drains, with the kernel spreading new connections and datagrams between them
+func newListenConfig(reusePort bool) *net.ListenConfig {
+	config := &net.ListenConfig{}
+	if reusePort {
+		config.Control = func(network string, address string, conn syscall.RawConn) error {
+			var sockErr error
+			err := conn.Control(func(fd uintptr) {
+				sockErr = setReusePort(fd)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return config
+}
+
+// Socket whose file can be handed down to a new backend, which every listener and the UDP connection are
+type fileSocket interface {
+	File() (*os.File, error)
+}
+
+// Hands the sockets of the running backend over to a new backend that takes over from it, by calling start with them
+// as files in the order Run opens them: the listeners, then the debug server's, then the UDP hash service's
+// Once start has passed the files on (i.e. as the extra files of a new process), the caller ends the context of Run,
+// so this backend drains its in-flight requests while the new one accepts the connections that keep arriving
+func (s *Service) Handover(start func(files []*os.File) error) error {
+	s.socketsMutex.Lock()
+	defer s.socketsMutex.Unlock()
+	if s.sockets == nil {
+		return errors.New("backend is not running")
+	}
+	files := make([]*os.File, 0, len(s.sockets))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, socket := range s.sockets {
+		file, err := socket.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	if err := start(files); err != nil {
+		return err
+	}
+	// The new backend now serves the Unix domain sockets, so closing them here must not remove their paths
+	for _, socket := range s.sockets {
+		if listener, ok := socket.(*net.UnixListener); ok {
+			listener.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+// Opens a listener for each address, where an address starting with unix: is the path of a Unix domain socket and any other is a TCP address
+// Inherited sockets are used instead of opening new ones, in the same order
+func (s *Service) openListeners(addresses []string, config *net.ListenConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, address := range addresses {
+		var listener net.Listener
+		var err error
+		if inherited := s.takeInheritedSocket(); inherited != nil {
+			listener, err = net.FileListener(inherited)
+			inherited.Close()
+		} else if strings.HasPrefix(address, "unix:") {
+			path := strings.TrimPrefix(address, "unix:")
+			// Remove a socket left behind by a backend that did not shut down cleanly, but never any other kind of file
+			if info, statErr := os.Stat(path); statErr == nil && info.Mode() & os.ModeSocket != 0 {
+				os.Remove(path)
+			}
+			listener, err = net.Listen("unix", path)
+		} else {
+			listener, err = config.Listen(context.Background(), "tcp", address)
+		}
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// HTTP status codes the UDP hash service's statuses are recorded as in the metrics
+var udpHashStatusCodes = []int{http.StatusOK, http.StatusBadRequest, http.StatusNotFound, http.StatusTooManyRequests, http.StatusInternalServerError}
+
+// Most UDP hash requests handled at the same time when max_concurrent does not limit them, beyond which datagrams are dropped
+const maxUDPHashInFlight = 1024
+
+// Serves the UDP hash service until the connection's read deadline expires, tracking the requests still being handled in wg
+// Every request is hashed in its own goroutine with the same workers, processing delay, admission limits, and per client
+// rate limit as /hash
+// A datagram cannot wait in the queue of the admission limiter, so it is dropped if no slot is free when it arrives
+// Closes stopped once it no longer reads requests
+func (s *Service) serveUDPHash(conn *net.UDPConn, limiter *admissionLimiter, clientLimiter *rateLimiter, metrics *backendMetrics, wg *sync.WaitGroup, stopped chan<- struct{}) {
+	defer close(stopped)
+	buffer := make([]byte, backendwire.MaxUDPHashDatagram)
+	inFlight := make(chan struct{}, maxUDPHashInFlight)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
+			}
+			log.Printf("Could not read a UDP hash request: %v\n", err)
+			continue
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			metrics.record("udp", http.StatusTooManyRequests, int64(n), 0)
+			continue
+		}
+		if !limiter.tryAcquire() {
+			<-inFlight
+			metrics.record("udp", http.StatusTooManyRequests, int64(n), 0)
+			continue
+		}
+		wg.Add(1)
+		go func(request []byte, addr *net.UDPAddr) {
+			defer wg.Done()
+			defer func() {
+				limiter.release()
+				<-inFlight
+			}()
+			start := time.Now()
+			atomic.AddInt64(&metrics.inFlight, 1)
+			defer atomic.AddInt64(&metrics.inFlight, -1)
+
+			status, body := s.handleUDPHash(request, addr, clientLimiter)
+			response := backendwire.AppendUDPHashResponse(make([]byte, 0, backendwire.UDPHashHeaderSize + len(body)), backendwire.RequestID(request), uint8(status), body)
+			conn.WriteToUDP(response, addr)
+			metrics.record("udp", udpHashStatusCodes[status], int64(len(request)), time.Since(start))
+		}(append([]byte(nil), buffer[:n]...), addr)
+	}
+}
+
+// Handles a single request of the UDP hash service, returning the status and body of its response
+func (s *Service) handleUDPHash(request []byte, addr *net.UDPAddr, clientLimiter *rateLimiter) (int, []byte) {
+	if clientLimiter != nil && !clientLimiter.allow(addr.IP.String(), time.Now()) {
+		atomic.AddInt64(&clientLimiter.limited, 1)
+		return backendwire.UDPHashRateLimited, []byte("rate limit exceeded")
+	}
+	if s.drawFault() == faultError {
+		return backendwire.UDPHashInjectedError, []byte("injected error")
+	}
+	algoName, payload, err := backendwire.ParseUDPHashRequest(request)
+	if err != nil {
+		return backendwire.UDPHashMalformed, []byte(err.Error())
+	}
+	algo := s.defaultAlgo
+	if algoName != "" {
+		algo, err = digest.Lookup(algoName)
+		if err != nil {
+			return backendwire.UDPHashUnknownAlgo, []byte(err.Error())
+		}
+	}
+
+	s.acquireWorker(context.Background())
+	defer s.releaseWorker()
+	hash := s.hashPayloads(algo, [][]byte{payload})[0]
+	s.recordAudit(addr.IP.String(), "udp", algo.Name(), []int{len(payload)}, [][]byte{hash})
+	return backendwire.UDPHashOK, hash
+}
+
+// Environment variable holding the token of the admin endpoint when it is not given as a flag
+const adminTokenEnv = "BACKEND_ADMIN_TOKEN"
+
+// Parameters of the admin endpoint, of which a request only changes the ones it gives
+type adminParams struct {
+	Delay			*string		`json:"delay,omitempty"`
+	ErrorRate		*float64	`json:"error_rate,omitempty"`
+	TruncateRate	*float64	`json:"truncate_rate,omitempty"`
+	DribbleRate		*float64	`json:"dribble_rate,omitempty"`
+	MaxConcurrent	*int		`json:"max_concurrent,omitempty"`
+	MaxQueue		*int		`json:"max_queue,omitempty"`
+	TagKeyID		*string		`json:"tag_key_id,omitempty"`
+}
+
+// Handler for the admin endpoint, which answers a GET with the current parameters, and changes them with a POST or PUT of a
+// JSON object of the parameters to change before answering with the new ones
+// Nothing is changed unless every given parameter is valid
+func (s *Service) adminHandler(limiter *admissionLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" || req.Method == "PUT" {
+			var params adminParams
+			err := json.NewDecoder(req.Body).Decode(&params)
+			if err != nil {
+				http.Error(w, "Parameters are not a valid JSON object.", http.StatusBadRequest)
+				return
+			}
+
+			var delay delayDistribution
+			if params.Delay != nil {
+				delay, err = parseDelay(*params.Delay)
+				if err != nil {
+					http.Error(w, "Could not parse delay: " + err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			// The fault rates are checked together with the current values of the ones not given
+			s.paramsMutex.RLock()
+			errorShare, truncateShare, dribbleShare := s.errorRate, s.truncateRate, s.dribbleRate
+			s.paramsMutex.RUnlock()
+			if params.ErrorRate != nil {
+				errorShare = *params.ErrorRate
+			}
+			if params.TruncateRate != nil {
+				truncateShare = *params.TruncateRate
+			}
+			if params.DribbleRate != nil {
+				dribbleShare = *params.DribbleRate
+			}
+			if err := validateFaultRates(errorShare, truncateShare, dribbleShare); err != nil {
+				http.Error(w, err.Error() + ".", http.StatusBadRequest)
+				return
+			}
+			if params.MaxConcurrent != nil && *params.MaxConcurrent < 0 {
+				http.Error(w, "max_concurrent cannot be negative.", http.StatusBadRequest)
+				return
+			}
+			if params.MaxQueue != nil && *params.MaxQueue < -1 {
+				http.Error(w, "max_queue must be -1 (no bound) or more.", http.StatusBadRequest)
+				return
+			}
+			if params.TagKeyID != nil {
+				if _, ok := s.tagKeys[*params.TagKeyID]; !ok {
+					http.Error(w, "tag_key_id is not the ID of one of the tag_keys.", http.StatusBadRequest)
+					return
+				}
+			}
+
+			s.paramsMutex.Lock()
+			if params.Delay != nil {
+				s.processingDelay = delay
+				s.delaySpec = *params.Delay
+			}
+			s.errorRate, s.truncateRate, s.dribbleRate = errorShare, truncateShare, dribbleShare
+			if params.TagKeyID != nil {
+				s.tagKeyID = *params.TagKeyID
+			}
+			s.paramsMutex.Unlock()
+			if params.MaxConcurrent != nil || params.MaxQueue != nil {
+				maxConcurrent, maxQueue, _, _ := limiter.stats()
+				if params.MaxConcurrent != nil {
+					maxConcurrent = *params.MaxConcurrent
+				}
+				if params.MaxQueue != nil {
+					maxQueue = *params.MaxQueue
+				}
+				limiter.setLimits(maxConcurrent, maxQueue)
+			}
+		} else if req.Method != "GET" {
+			http.Error(w, "Method is not supported.", http.StatusNotFound)
+			return
+		}
+
+		// Answer with the current parameters
+		var current adminParams
+		s.paramsMutex.RLock()
+		spec, errorShare, truncateShare, dribbleShare := s.delaySpec, s.errorRate, s.truncateRate, s.dribbleRate
+		keyID := s.tagKeyID
+		s.paramsMutex.RUnlock()
+		maxConcurrent, maxQueue, _, _ := limiter.stats()
+		current.Delay, current.MaxConcurrent, current.MaxQueue = &spec, &maxConcurrent, &maxQueue
+		current.ErrorRate, current.TruncateRate, current.DribbleRate = &errorShare, &truncateShare, &dribbleShare
+		if s.tagKeys != nil {
+			current.TagKeyID = &keyID
+		}
+		if req.Method != "GET" {
+			log.Printf("Parameters changed: delay=%s error_rate=%g truncate_rate=%g dribble_rate=%g max_concurrent=%d max_queue=%d tag_key_id=%s\n",
+				spec, errorShare, truncateShare, dribbleShare, maxConcurrent, maxQueue, keyID)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(current)
+	}
+}
+
+// Creates the TLS configuration of the HTTP backend server, which requires and verifies client certificates
+// signed by the CAs in the clientCAFile for mutual authentication, or accepts any client if it is empty
+func newTLSConfig(clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	config.ClientCAs = clientCAs
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// Options of the backend, one for each command line flag of http_backend, named after the flag in its tag
+// The help text of each flag in RegisterFlags describes its option
+type Options struct {
+	Port			string			`flag:"port"`
+	ReadHeaderTime	int				`flag:"rh_time"`
+	WriteTime		int				`flag:"w_time"`
+	Algo			string			`flag:"algo"`
+	Delay			string			`flag:"delay"`
+	TLSCert			string			`flag:"tls_cert"`
+	TLSKey			string			`flag:"tls_key"`
+	TLSClientCA		string			`flag:"tls_client_ca"`
+	AuthToken		string			`flag:"auth_token"`
+	HMACKey			string			`flag:"hmac_key"`
+	LogLevel		string			`flag:"log_level"`
+	DrainTimeout	time.Duration	`flag:"drain_timeout"`
+	MaxConcurrent	int				`flag:"max_concurrent"`
+	MaxQueue		int				`flag:"max_queue"`
+	RateLimit		float64			`flag:"rate_limit"`
+	RateBurst		int				`flag:"rate_burst"`
+	Listen			string			`flag:"listen"`
+	UDPPort			string			`flag:"udp_port"`
+	CacheSize		int				`flag:"cache_size"`
+	ErrorRate		float64			`flag:"error_rate"`
+	ErrorStatus		int				`flag:"error_status"`
+	TruncateRate	float64			`flag:"truncate_rate"`
+	DribbleRate		float64			`flag:"dribble_rate"`
+	DribbleInterval	time.Duration	`flag:"dribble_interval"`
+	AdminToken		string			`flag:"admin_token"`
+	CPUIterations	int				`flag:"cpu_iterations"`
+	MemBytes		int				`flag:"mem_bytes"`
+	MaxBody			int64			`flag:"max_body"`
+	MaxStreamBody	int64			`flag:"max_stream_body"`
+	TagKeys			string			`flag:"tag_keys"`
+	TagKeyID		string			`flag:"tag_key_id"`
+	AuditLog		string			`flag:"audit_log"`
+	DebugAddr		string			`flag:"debug_addr"`
+	ReusePort		bool			`flag:"reuse_port"`
+	ReadyQueue		int				`flag:"ready_queue"`
+	Workers			int				`flag:"workers"`
+}
+
+// Registers a command line flag for every option on the flag set, with the option's default as the flag's default
+func (options *Options) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&options.Port, "port", "80", "Port number of the HTTP backend server (i.e. 80)")
+	flags.IntVar(&options.ReadHeaderTime, "rh_time", 20, "Max number of seconds the HTTP backend server entire will spend reading the headers of the request (i.e. 20)")
+	flags.IntVar(&options.WriteTime, "w_time", 20, "Max number of seconds the HTTP backend server will wait before timing out writes of the response (i.e. 20)")
+	flags.StringVar(&options.Algo, "algo", digest.Default, "Hash algorithm of the /hash endpoint: " + strings.Join(digest.Names(), ", ") + " (i.e. sha256)")
+	flags.StringVar(&options.Delay, "delay", "fixed:250ms", "Distribution of the artificial processing delay of each hash request: fixed:D, uniform:MIN-MAX, normal:MEAN/STDDEV, pareto:SCALE/SHAPE, or 0 (i.e. pareto:100ms/1.5)")
+	flags.StringVar(&options.TLSCert, "tls_cert", "", "Certificate file (PEM) to serve HTTPS with instead of HTTP, along with tls_key (i.e. backend.crt)")
+	flags.StringVar(&options.TLSKey, "tls_key", "", "Private key file (PEM) of the tls_cert (i.e. backend.key)")
+	flags.StringVar(&options.TLSClientCA, "tls_client_ca", "", "CA certificate file (PEM) that client certificates must be signed by, requiring mutual TLS, or empty to not verify clients (i.e. ca.crt)")
+	flags.StringVar(&options.AuthToken, "auth_token", "", "Bearer token that requests must carry in their Authorization header, or empty to read it from " + backendwire.AuthTokenEnv + " (i.e. s3cret)")
+	flags.StringVar(&options.HMACKey, "hmac_key", "", "Key that requests must be signed with (HMAC-SHA256 of the method, path, timestamp, and body), or empty to read it from " + backendwire.HMACKeyEnv + " (i.e. s3cret)")
+	flags.StringVar(&options.LogLevel, "log_level", "info", "Minimum level of the access log lines: debug (also logs metrics scrapes), info (every request), warn (4xx and 5xx answers), error (5xx answers), or none (i.e. warn)")
+	flags.DurationVar(&options.DrainTimeout, "drain_timeout", 30 * time.Second, "Max time to wait for in-flight requests to finish when shutting down, after which their connections are closed (i.e. 10s)")
+	flags.IntVar(&options.MaxConcurrent, "max_concurrent", 0, "Max number of hash requests handled at the same time, with the rest queued up to max_queue and answered 429 beyond it, or 0 for no limit (i.e. 64)")
+	flags.IntVar(&options.MaxQueue, "max_queue", 0, "Max number of hash requests waiting for one of the max_concurrent slots, or -1 for no bound (i.e. 128)")
+	flags.Float64Var(&options.RateLimit, "rate_limit", 0, "Max average number of hash requests per second from each client IP, with the rest answered 429, or 0 for no limit (i.e. 5000)")
+	flags.IntVar(&options.RateBurst, "rate_burst", 0, "Number of hash requests a client IP can make at once on top of its rate_limit, or 0 for one second's worth (i.e. 500)")
+	flags.StringVar(&options.Listen, "listen", "", "Comma separated addresses to listen on instead of the port, each a TCP address or unix: followed by the path of a Unix domain socket (i.e. :8080,unix:/run/backend.sock)")
+	flags.StringVar(&options.UDPPort, "udp_port", "", "Port number to also serve hash requests on over UDP, with a tiny binary protocol instead of HTTP, or empty to not serve UDP (i.e. 8081)")
+	flags.IntVar(&options.CacheSize, "cache_size", 0, "Max number of hashes kept in an LRU cache keyed by the payload's digest, so repeated payloads skip the processing delay and hashing, or 0 for no cache (i.e. 100000)")
+	flags.Float64Var(&options.ErrorRate, "error_rate", 0, "Fraction of hash requests answered with an injected error_status, to test how callers handle a failing backend (i.e. 0.05)")
+	flags.IntVar(&options.ErrorStatus, "error_status", http.StatusInternalServerError, "HTTP status code of the injected errors, from 500 to 599 (i.e. 503)")
+	flags.Float64Var(&options.TruncateRate, "truncate_rate", 0, "Fraction of HTTP hash requests answered with only the first half of the body before the connection is closed (i.e. 0.05)")
+	flags.Float64Var(&options.DribbleRate, "dribble_rate", 0, "Fraction of HTTP hash requests answered one byte at a time, every dribble_interval (i.e. 0.05)")
+	flags.DurationVar(&options.DribbleInterval, "dribble_interval", 100 * time.Millisecond, "Time between the bytes of a dribbled response (i.e. 500ms)")
+	flags.StringVar(&options.AdminToken, "admin_token", "", "Bearer token of the /admin/params endpoint that changes the delay, error_rate, max_concurrent, and max_queue at runtime, or empty to read it from " + adminTokenEnv + ", with the endpoint off if neither is set (i.e. s3cret)")
+	flags.IntVar(&options.CPUIterations, "cpu_iterations", 0, "Number of extra sha256 rounds each payload goes through before its hash, to emulate a CPU-bound service, or 0 for none (i.e. 10000)")
+	flags.IntVar(&options.MemBytes, "mem_bytes", 0, "Size in bytes of a buffer allocated and written for each hash request, to emulate a memory-bound service, or 0 for none (i.e. 16777216)")
+	flags.Int64Var(&options.MaxBody, "max_body", 4 << 20, "Max size in bytes of the body of a hash request, with larger ones answered 413, or 0 for no limit (i.e. 65536)")
+	flags.Int64Var(&options.MaxStreamBody, "max_stream_body", 1 << 28, "Max size in bytes of the body of a request to the streaming hash endpoint, with larger ones answered 413, or 0 for no limit (i.e. 268435456)")
+	flags.StringVar(&options.TagKeys, "tag_keys", "", "Comma separated id:key pairs of the /hmac endpoint, which tags payloads with the HMAC-SHA256 of a key, or empty to read them from " + tagKeysEnv + ", with the endpoint off if neither is set (i.e. k2:n3wer,k1:0lder)")
+	flags.StringVar(&options.TagKeyID, "tag_key_id", "", "ID of the key of tag_keys that tags requests to /hmac, or empty for the first one (i.e. k2)")
+	flags.StringVar(&options.AuditLog, "audit_log", "", "File to append a JSON line to for every payload hashed, with its digest, time, and requester, queried on /audit, or empty to not audit requests (i.e. audit.jsonl)")
+	flags.StringVar(&options.DebugAddr, "debug_addr", "", "Address of a separate port serving pprof profiles and Go runtime metrics, without authentication, or empty to not serve them (i.e. localhost:6060)")
+	flags.BoolVar(&options.ReusePort, "reuse_port", false, "Set SO_REUSEPORT on the TCP and UDP sockets, so a new backend can start on the same ports before this one is stopped")
+	flags.IntVar(&options.ReadyQueue, "ready_queue", 0, "Number of queued hash requests at which /readyz reports the backend unready, or 0 to only report it once the max_queue is full (i.e. 32)")
+	flags.IntVar(&options.Workers, "workers", 0, "Max number of hash requests processed at the same time, with the rest waiting for a free worker, or 0 for no limit (i.e. 8)")
+}
+
+// Returns the options with every option at its default, as http_backend runs without flags
+func DefaultOptions() Options {
+	var options Options
+	options.RegisterFlags(flag.NewFlagSet("http_backend", flag.ContinueOnError))
+	return options
+}
+
+// Backend set up from its options, with the handlers of every endpoint ready to be served
+// Every backend keeps its own state, so several can be set up in a process without sharing their caches, limits, or logs
+// Handler: serves every endpoint, including /shutdown, which stops Run
+// shutdown: done once /shutdown is requested
+// defaultAlgo: the hash algorithm of the /hash endpoint, while /hash/{algo} picks its own
+// workerTokens: counting semaphore limiting the number of requests processed at the same time, or nil for no limit
+// cpuIterations: the number of extra sha256 rounds each payload goes through before its real hash, modeling a CPU-bound service
+// memoryBytes: the size of a buffer allocated and written cache line by cache line for each request, modeling a memory-bound service
+// errorStatus: the status code of the injected errors of HTTP requests
+// dribbleInterval: the time between the bytes of a dribbled response
+// tagKeys: the keys of the /hmac endpoint by their ID, or nil if the endpoint is off; rotating keys means adding a new one and
+// making it current, while the old ones stay usable at /hmac/{id} to check old tags
+// audit: the audit log of every payload hashed, or nil if requests are not audited
+// cache: the response cache of the hash endpoints, or nil if caching is off
+// stats: the counters of the hashing done, reported on /stats
+// draining: set to 1 with atomics once the backend starts shutting down, so it reports that it is no longer ready
+// paramsMutex: guards the parameters the admin endpoint can change while the backend runs, which follow it
+// processingDelay: the artificial processing delay of each hash request, modeling the service time of a real backend
+// delaySpec: the specification processingDelay was parsed from
+// errorRate: the fraction of hash requests answered with an injected error
+// truncateRate: the fraction of HTTP hash requests answered with only the first half of the body before the connection is closed
+// dribbleRate: the fraction of HTTP hash requests answered one byte at a time, every dribbleInterval
+// tagKeyID: the ID of the key that tags requests to /hmac, which the admin endpoint can change to rotate keys
+// inherited: the sockets inherited from the backend this one replaces that Run has not taken yet
+// sockets: every socket Run serves on, in the order it opens them, or nil while it is not running; guarded by socketsMutex
+type Service struct {
+	Handler			http.Handler
+	options			Options
+	tlsConfig		*tls.Config
+	clientLimiter	*rateLimiter
+	metrics			*backendMetrics
+	shutdown		context.Context
+	defaultAlgo		digest.Algorithm
+	workerTokens	chan struct{}
+	cpuIterations	int
+	memoryBytes		int
+	errorStatus		int
+	dribbleInterval	time.Duration
+	tagKeys			map[string][]byte
+	audit			*auditLog
+	cache			*lruCache
+	stats			*backendStats
+	draining		int32
+	paramsMutex		sync.RWMutex
+	processingDelay	delayDistribution
+	delaySpec		string
+	errorRate		float64
+	truncateRate	float64
+	dribbleRate		float64
+	tagKeyID		string
+	inherited		[]*os.File
+	socketsMutex	sync.Mutex
+	sockets			[]fileSocket
+}
+
+// Sets up the backend from its options, creating the handlers of every endpoint without listening on anything yet
+func New(options Options) (*Service, error) {
+	s := &Service{stats: newBackendStats()}
+
+	// Look up the hash algorithm of the /hash endpoint
+	var err error
+	s.defaultAlgo, err = digest.Lookup(options.Algo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the distribution of the processing delay
+	s.processingDelay, err = parseDelay(options.Delay)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse delay: %v", err)
+	}
+	s.delaySpec = options.Delay
+
+	// Inject faults into the requested fractions of hash requests
+	if err := validateFaultRates(options.ErrorRate, options.TruncateRate, options.DribbleRate); err != nil {
+		return nil, err
+	}
+	if options.ErrorStatus < 500 || options.ErrorStatus > 599 {
+		return nil, errors.New("error_status must be a 5xx status code")
+	}
+	if options.DribbleInterval < 0 {
+		return nil, errors.New("dribble_interval cannot be negative")
+	}
+	s.errorRate, s.truncateRate, s.dribbleRate = options.ErrorRate, options.TruncateRate, options.DribbleRate
+	s.errorStatus, s.dribbleInterval = options.ErrorStatus, options.DribbleInterval
+
+	// Parse the minimum level of the access log
+	logLevel, err := parseLogLevel(options.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	// Simulate CPU-bound and memory-bound work if requested
+	if options.CPUIterations < 0 || options.MemBytes < 0 {
+		return nil, errors.New("cpu_iterations and mem_bytes cannot be negative")
+	}
+	s.cpuIterations, s.memoryBytes = options.CPUIterations, options.MemBytes
+
+	if options.ReadyQueue < 0 {
+		return nil, errors.New("ready_queue cannot be negative")
+	}
+	if options.MaxBody < 0 || options.MaxStreamBody < 0 {
+		return nil, errors.New("max_body and max_stream_body cannot be negative")
+	}
+
+	// Tag payloads on the /hmac endpoint if any keys are given
+	if options.TagKeys == "" {
+		options.TagKeys = os.Getenv(tagKeysEnv)
+	}
+	if options.TagKeys != "" {
+		s.tagKeys, s.tagKeyID, err = parseTagKeys(options.TagKeys)
+		if err != nil {
+			return nil, err
+		}
+		if options.TagKeyID != "" {
+			if _, ok := s.tagKeys[options.TagKeyID]; !ok {
+				return nil, errors.New("tag_key_id is not the ID of one of the tag_keys")
+			}
+			s.tagKeyID = options.TagKeyID
+		}
+	} else if options.TagKeyID != "" {
+		return nil, errors.New("tag_key_id needs tag_keys")
+	}
+
+	// Audit every payload hashed if requested
+	if options.AuditLog != "" {
+		s.audit, err = openAuditLog(options.AuditLog)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open the audit log: %v", err)
+		}
+	}
+
+	// Cache the hashes of recent payloads if requested
+	if options.CacheSize < 0 {
+		return nil, errors.New("cache_size cannot be negative")
+	}
+	if options.CacheSize > 0 {
+		s.cache = newLRUCache(options.CacheSize)
+	}
+
+	// Limit the number of requests processed at the same time if requested
+	if options.Workers < 0 {
+		return nil, errors.New("workers cannot be negative")
+	}
+	if options.Workers > 0 {
+		s.workerTokens = make(chan struct{}, options.Workers)
+	}
+
+	// Bound the number of requests admitted at the same time and queued, if requested
+	if options.MaxConcurrent < 0 {
+		return nil, errors.New("max_concurrent cannot be negative")
+	}
+	if options.MaxQueue < -1 {
+		return nil, errors.New("max_queue must be -1 (no bound) or more")
+	}
+	// The limiter is there even without a limit, so the admin endpoint can set one later
+	limiter := newAdmissionLimiter(options.MaxConcurrent, options.MaxQueue)
+
+	// Limit the rate of requests from each client IP, if requested
+	if options.RateLimit < 0 || options.RateBurst < 0 {
+		return nil, errors.New("rate_limit and rate_burst cannot be negative")
+	}
+	var clientLimiter *rateLimiter
+	if options.RateLimit > 0 {
+		if options.RateBurst == 0 {
+			options.RateBurst = int(math.Ceil(options.RateLimit))
+		}
+		clientLimiter = newRateLimiter(options.RateLimit, options.RateBurst)
+	}
+
+	// Serve HTTPS if a certificate is given, with mutual authentication if a client CA is given too
+	if (options.TLSCert == "") != (options.TLSKey == "") {
+		return nil, errors.New("tls_cert and tls_key must be given together")
+	}
+	if options.TLSClientCA != "" && options.TLSCert == "" {
+		return nil, errors.New("tls_client_ca needs tls_cert and tls_key")
+	}
+	var tlsConfig *tls.Config
+	if options.TLSCert != "" {
+		tlsConfig, err = newTLSConfig(options.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Could not configure TLS: %v", err)
+		}
+	}
+
+	// Require authentication on every endpoint that hashes, shuts down, or changes the backend if a token or an HMAC key is configured
+	if options.AuthToken == "" {
+		options.AuthToken = os.Getenv(backendwire.AuthTokenEnv)
+	}
+	if options.HMACKey == "" {
+		options.HMACKey = os.Getenv(backendwire.HMACKeyEnv)
+	}
+	if options.AuthToken != "" || options.HMACKey != "" {
+		log.Println("Requiring authentication on all endpoints but /metrics, /stats, /livez, and /readyz")
+		if options.UDPPort != "" {
+			return nil, errors.New("udp_port cannot authenticate requests, so it cannot be combined with auth_token or hmac_key")
+		}
+	}
+
+	// Keep metrics of every request for the /metrics endpoint
+	metrics := newBackendMetrics()
+	metrics.limiter = limiter
+	metrics.rateLimiter = clientLimiter
+	metrics.cache = s.cache
+
+	// Create new HTTP request multiplexer for server
+	m := http.NewServeMux()
+
+	// Add specific context to allow for graceful shutdown
+	// Using the context's cancel function prevents shutdown from being called multiple times
+	shutdown, cancel := context.WithCancel(context.Background())
+	// Add the handler for the shutdown endpoint
+	// Its body is limited like the hashing endpoints', since authenticating it with an HMAC key reads the body
+	m.HandleFunc("/shutdown", instrument(metrics, limitBody(options.MaxBody, options.MaxStreamBody, requireAuth(options.AuthToken, []byte(options.HMACKey), func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/shutdown" {
+			http.Error(w, "404 not found.", http.StatusNotFound)
+			return
+		}
+
+		w.Write([]byte("Shutdown HTTP server"))
+		// Cancel the context on request
+		cancel()
+	}))))
+
+	// Wraps a hashing handler to admit requests through the limiters, and authenticate them
+	protect := func(handler http.HandlerFunc) http.HandlerFunc {
+		handler = limiter.limit(handler)
+		handler = requireAuth(options.AuthToken, []byte(options.HMACKey), handler)
+		handler = limitBody(options.MaxBody, options.MaxStreamBody, handler)
+		// Check the rate of the client before anything else, so floods of unauthenticated requests are limited too
+		if clientLimiter != nil {
+			handler = clientLimiter.limit(handler)
+		}
+		return instrument(metrics, handler)
+	}
+
+	// Add the handler for the hash endpoint
+	m.HandleFunc("/hash", protect(s.hashHandler))
+	m.HandleFunc("/hash/", protect(s.hashHandler))
+
+	// Add the handler for the HMAC endpoint, only if it has keys to tag with
+	if s.tagKeys != nil {
+		m.HandleFunc("/hmac", protect(s.hmacHandler))
+		m.HandleFunc("/hmac/", protect(s.hmacHandler))
+	}
+
+	// Add the handler for the Hash gRPC service, which needs HTTP/2 and so is only reachable over TLS
+	m.HandleFunc(grpcServicePrefix, protect(s.grpcHandler))
+
+	// Add the handler for the admin endpoint, only if it has a token to authenticate with
+	if options.AdminToken == "" {
+		options.AdminToken = os.Getenv(adminTokenEnv)
+	}
+	if options.AdminToken != "" {
+		m.HandleFunc("/admin/params", instrument(metrics, limitBody(options.MaxBody, options.MaxStreamBody, requireAuth(options.AdminToken, []byte(options.HMACKey), s.adminHandler(limiter)))))
+	}
+
+	// Add the handler for the metrics endpoint, which is left unauthenticated like most scrape targets
+	m.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+
+	// Add the handler for the audit log's query endpoint, which needs the same authentication as the hash endpoints
+	if s.audit != nil {
+		m.HandleFunc("/audit", instrument(metrics, limitBody(options.MaxBody, options.MaxStreamBody, requireAuth(options.AuthToken, []byte(options.HMACKey), s.audit.query))))
+	}
+
+	// Add the handlers of the liveness and readiness probes, which are left unauthenticated for orchestrators
+	// The backend is alive as long as it answers at all, and ready only while it can take more work
+	m.HandleFunc("/livez", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	m.HandleFunc("/readyz", s.readyHandler(limiter, options.ReadyQueue))
+
+	// Add the handler for the stats endpoint, which the UDP server scrapes for its end-of-run report
+	m.HandleFunc("/stats", s.statsHandler(metrics))
+
+	// Log every request, with the correlation ID of each echoed back to its caller
+	handler := logRequests(logLevel, echoRequestID(m))
+	s.Handler, s.options, s.tlsConfig, s.clientLimiter, s.metrics, s.shutdown = handler, options, tlsConfig, clientLimiter, metrics, shutdown
+	return s, nil
+}
+
+// Listens on the port or addresses of the options and serves every endpoint until /shutdown is requested or the context is done,
+// then lets the in-flight requests finish
+func (s *Service) Run(ctx context.Context) error {
+	options, tlsConfig, clientLimiter, metrics := s.options, s.tlsConfig, s.clientLimiter, s.metrics
+	var err error
+	atomic.StoreInt32(&s.draining, 0)
+
+	// Create the HTTP server
+	service := ":" + options.Port
+	serv := http.Server {   Addr: service,
+							Handler: s.Handler,
+							ReadHeaderTimeout: time.Duration(options.ReadHeaderTime) * time.Second,
+							WriteTimeout: time.Duration(options.WriteTime) * time.Second,
+							TLSConfig: tlsConfig,
+	}
+
+	// Listen on the port, or on every address given
+	addresses := []string{serv.Addr}
+	if options.Listen != "" {
+		addresses = strings.Split(options.Listen, ",")
+	}
+	listenConfig := newListenConfig(options.ReusePort)
+	listeners, err := s.openListeners(addresses, listenConfig)
+	if err != nil {
+		return err
+	}
+
+	// Serve each listener through a goroutine to allow for graceful shutdown
+	// A server that stops serving for any other reason than shutting down sends its error, which stops Run with it
+	serveErrors := make(chan error, len(listeners) + 1)
+	for _, listener := range listeners {
+		if tlsConfig != nil {
+			log.Printf("Started HTTPS server at %v\n", listener.Addr())
+		} else {
+			log.Printf("Started HTTP server at %v\n", listener.Addr())
+		}
+		go func(listener net.Listener) {
+			var err error
+			if tlsConfig != nil {
+				err = serv.ServeTLS(listener, options.TLSCert, options.TLSKey)
+			} else {
+				err = serv.Serve(listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				serveErrors <- err
+			}
+		}(listener)
+	}
+
+	// Serve the profiles and runtime metrics on their own port if requested, so they are never exposed with the hash endpoints
+	var debugServ *http.Server
+	var debugListener net.Listener
+	if options.DebugAddr != "" {
+		if inherited := s.takeInheritedSocket(); inherited != nil {
+			debugListener, err = net.FileListener(inherited)
+			inherited.Close()
+		} else {
+			debugListener, err = listenConfig.Listen(context.Background(), "tcp", options.DebugAddr)
+		}
+		if err != nil {
+			serv.Close()
+			return err
+		}
+		debugServ = &http.Server{Handler: newDebugMux(), ReadHeaderTimeout: serv.ReadHeaderTimeout}
+		log.Printf("Started debug server at %v\n", debugListener.Addr())
+		go func() {
+			if err := debugServ.Serve(debugListener); err != nil && err != http.ErrServerClosed {
+				serveErrors <- fmt.Errorf("debug server: %v", err)
+			}
+		}()
+	}
+
+	// Serve the UDP hash service if requested, which has no way to authenticate its callers
+	var udpConn *net.UDPConn
+	var wgUDP sync.WaitGroup
+	udpStopped := make(chan struct{})
+	if options.UDPPort != "" {
+		var packetConn net.PacketConn
+		if inherited := s.takeInheritedSocket(); inherited != nil {
+			packetConn, err = net.FilePacketConn(inherited)
+			inherited.Close()
+		} else {
+			packetConn, err = listenConfig.ListenPacket(context.Background(), "udp", ":" + options.UDPPort)
+		}
+		if err != nil {
+			serv.Close()
+			if debugServ != nil {
+				debugServ.Close()
+			}
+			return err
+		}
+		udpConn = packetConn.(*net.UDPConn)
+		log.Printf("Started UDP hash service at %v\n", udpConn.LocalAddr())
+		go s.serveUDPHash(udpConn, metrics.limiter, clientLimiter, metrics, &wgUDP, udpStopped)
+	}
+
+	// Keep the sockets in the order they were opened, so they can be handed over to a new backend
+	var sockets []fileSocket
+	for _, listener := range listeners {
+		sockets = append(sockets, listener.(fileSocket))
+	}
+	if debugListener != nil {
+		sockets = append(sockets, debugListener.(fileSocket))
+	}
+	if udpConn != nil {
+		sockets = append(sockets, udpConn)
+	}
+	s.socketsMutex.Lock()
+	s.sockets = sockets
+	s.socketsMutex.Unlock()
+
+	var serveErr error
+	waitLoop:
+		for {
+			select {
+			case serveErr = <-serveErrors:
+				log.Printf("Could not serve: %v, shutting down\n", serveErr)
+				break waitLoop
+			case <-s.shutdown.Done():
+				log.Printf("Shutdown requested\n")
+				break waitLoop
+			case <-ctx.Done():
+				log.Printf("Stopped by the caller, shutting down\n")
+				break waitLoop
+			}
+		}
+	s.socketsMutex.Lock()
+	s.sockets = nil
+	s.socketsMutex.Unlock()
+
+	// Stop accepting requests and let the in-flight ones finish, up to the drain timeout
+	atomic.StoreInt32(&s.draining, 1)
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), options.DrainTimeout)
+	defer drainCancel()
+	if err := serv.Shutdown(drainCtx); err != nil {
+		log.Printf("In-flight requests did not finish within %v: %v\n", options.DrainTimeout, err)
+		serv.Close()
+	}
+
+	// Stop reading UDP hash requests and let the ones being handled finish, up to the same drain timeout
+	if udpConn != nil {
+		udpConn.SetReadDeadline(time.Now())
+		<-udpStopped
+		udpDone := make(chan struct{})
+		go func() {
+			wgUDP.Wait()
+			close(udpDone)
+		}()
+		select {
+		case <-udpDone:
+		case <-drainCtx.Done():
+			log.Printf("UDP hash requests did not finish within %v\n", options.DrainTimeout)
+		}
+		udpConn.Close()
+	}
+
+	// Stop the debug server right away, cutting short any profile being taken
+	if debugServ != nil {
+		debugServ.Close()
+	}
+
+	// Close the audit log once nothing more can be hashed
+	if s.audit != nil {
+		s.audit.close()
+	}
+
+	log.Printf("HTTP server has been shutdown")
+	return serveErr
+}
+
+// Sets up the backend from its options and runs it until it is shut down, as http_backend does
+func Run(ctx context.Context, options Options) error {
+	service, err := New(options)
+	if err != nil {
+		return err
+	}
+	return service.Run(ctx)
+}
@@ -0,0 +1,416 @@
+package hashsvc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbopardi/udp_client_server/internal/backendwire"
+	"github.com/nbopardi/udp_client_server/internal/digest"
+	"github.com/nbopardi/udp_client_server/pkg/pb"
+)
+
+// Backend shared by the benchmarks and fuzz tests, so it is not set up again for every input
+var testService *Service
+var testServiceOnce sync.Once
+
+// Sets up the backend without any processing delay or access log, so the benchmarks time the handlers alone
+func setupTestService(tb testing.TB) *Service {
+	testServiceOnce.Do(func() {
+		options := DefaultOptions()
+		options.Delay = "0"
+		options.LogLevel = "none"
+		service, err := New(options)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		testService = service
+	})
+	if testService == nil {
+		tb.Fatal("could not set up the backend")
+	}
+	return testService
+}
+
+// Posts a payload to /hash in each encoding the UDP server can send it in, as the server does for every packet it reflects
+func BenchmarkHashHandler(b *testing.B) {
+	service := setupTestService(b)
+	payload := bytes.Repeat([]byte{0xab}, 100)
+	jsonBody, _ := json.Marshal(payload)
+	encodings := []struct {
+		name		string
+		contentType	string
+		body		[]byte
+	}{
+		{"json", "application/json", jsonBody},
+		{"binary", "application/octet-stream", payload},
+		{"protobuf", "application/x-protobuf", (&pb.HashRequest{Payload: payload}).Marshal()},
+	}
+	for _, encoding := range encodings {
+		encoding := encoding
+		b.Run(encoding.name, func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("POST", "/hash", bytes.NewReader(encoding.body))
+				req.Header.Set("Content-Type", encoding.contentType)
+				resp := httptest.NewRecorder()
+				service.Handler.ServeHTTP(resp, req)
+				if resp.Code != http.StatusOK {
+					b.Fatalf("backend responded with %d: %s", resp.Code, resp.Body)
+				}
+			}
+		})
+	}
+}
+
+// Content types of the bodies the fuzz tests post to /hash, one for each supported encoding
+var fuzzContentTypes = []string{"application/json", "application/octet-stream", "application/msgpack", "application/cbor", "application/x-protobuf"}
+
+// Paths of the hash endpoint the fuzz tests post bodies to
+var fuzzHashPaths = []string{"/hash", "/hash/batch", "/hash/stream", "/hash/sha256", "/hash?algos=sha256,fnv1a64"}
+
+// Any body in any encoding must be answered without panicking, and never with a server error since no faults are injected
+// A raw body posted to /hash itself is a payload of its own, so it must always be answered with its digest
+func FuzzHashHandler(f *testing.F) {
+	payload := []byte("payload")
+	jsonBody, _ := json.Marshal(payload)
+	f.Add(jsonBody, uint8(0), uint8(0))
+	f.Add(payload, uint8(1), uint8(0))
+	f.Add(append([]byte{0xc4, byte(len(payload))}, payload...), uint8(2), uint8(0))
+	f.Add(append([]byte{0x40 | byte(len(payload))}, payload...), uint8(3), uint8(0))
+	f.Add((&pb.HashRequest{Payload: payload}).Marshal(), uint8(4), uint8(0))
+	f.Add([]byte(`["cGF5bG9hZA==","eA=="]`), uint8(0), uint8(1))
+	f.Add((&pb.HashBatchRequest{Payloads: [][]byte{payload, nil}}).Marshal(), uint8(4), uint8(1))
+	f.Add([]byte{0x92, 0xc4, 0x01, 'x', 0xc4, 0x00}, uint8(2), uint8(1))
+	f.Add([]byte{0x82, 0x41, 'x', 0x40}, uint8(3), uint8(1))
+	f.Add(payload, uint8(1), uint8(2))
+	f.Add([]byte("null"), uint8(0), uint8(4))
+	f.Fuzz(func(t *testing.T, body []byte, contentType uint8, path uint8) {
+		service := setupTestService(t)
+		req := httptest.NewRequest("POST", fuzzHashPaths[int(path) % len(fuzzHashPaths)], bytes.NewReader(body))
+		req.Header.Set("Content-Type", fuzzContentTypes[int(contentType) % len(fuzzContentTypes)])
+		resp := httptest.NewRecorder()
+		service.Handler.ServeHTTP(resp, req)
+		if resp.Code >= 500 {
+			t.Fatalf("backend responded with %d: %s", resp.Code, resp.Body)
+		}
+		if req.URL.Path == "/hash" && req.URL.RawQuery == "" && req.Header.Get("Content-Type") == "application/octet-stream" {
+			if resp.Code != http.StatusOK || !bytes.Equal(resp.Body.Bytes(), service.defaultAlgo.Sum(body)) {
+				t.Fatalf("backend responded to the raw payload %x with %d: %x", body, resp.Code, resp.Body)
+			}
+		}
+	})
+}
+
+// Any request body must be answered with a gRPC status without panicking, and never with an internal error unless the
+// body is not a sequence of whole messages
+func FuzzGRPCHandler(f *testing.F) {
+	message := (&pb.HashRequest{Payload: []byte("payload"), Algo: "sha256"}).Marshal()
+	var body bytes.Buffer
+	writeGRPCMessage(&body, message)
+	f.Add(body.Bytes(), false)
+	writeGRPCMessage(&body, message)
+	f.Add(body.Bytes(), true)
+	f.Add([]byte{0, 0, 0, 0, 0}, false)
+	f.Add([]byte{0, 0, 0, 0, 9, 0x0a}, false)
+	f.Add([]byte{1, 0, 0, 0, 0}, true)
+	f.Fuzz(func(t *testing.T, body []byte, stream bool) {
+		service := setupTestService(t)
+		method := "Hash"
+		if stream {
+			method = "HashStream"
+		}
+		req := httptest.NewRequest("POST", grpcServicePrefix + method, bytes.NewReader(body))
+		req.ProtoMajor, req.ProtoMinor = 2, 0
+		req.Header.Set("Content-Type", "application/grpc")
+		resp := httptest.NewRecorder()
+		service.Handler.ServeHTTP(resp, req)
+		status := resp.Result().Trailer.Get("Grpc-Status")
+		if status == "" {
+			t.Fatalf("backend responded with %d without a gRPC status: %s", resp.Code, resp.Body)
+		}
+		if status == strconv.Itoa(grpcInternal) {
+			for rest := bytes.NewReader(body); ; {
+				if _, err := readGRPCMessage(rest); err == io.EOF {
+					t.Fatalf("backend failed on a body of whole messages: %s", resp.Result().Trailer.Get("Grpc-Message"))
+				} else if err != nil {
+					break
+				}
+			}
+		}
+	})
+}
+
+// Any datagram must be answered with a status without panicking, and one long enough for its header and algorithm name
+// must never be called malformed
+func FuzzUDPHashRequest(f *testing.F) {
+	request := make([]byte, backendwire.UDPHashHeaderSize)
+	request[8] = byte(len("sha256"))
+	f.Add(append(append(request, "sha256"...), "payload"...))
+	f.Add(append(make([]byte, backendwire.UDPHashHeaderSize), "payload"...))
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0xff, 'x'})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+	f.Fuzz(func(t *testing.T, request []byte) {
+		service := setupTestService(t)
+		status, body := service.handleUDPHash(request, addr, nil)
+		wellFormed := len(request) >= backendwire.UDPHashHeaderSize && len(request) >= backendwire.UDPHashHeaderSize + int(request[8])
+		if (status == backendwire.UDPHashMalformed) == wellFormed {
+			t.Fatalf("request %x got status %d: %s", request, status, body)
+		}
+	})
+}
+
+// A payload that is absent is rejected in every encoding, while an empty one is hashed
+func TestMissingPayload(t *testing.T) {
+	service := setupTestService(t)
+	for _, test := range []struct {
+		contentType	string
+		body		[]byte
+		code		int
+	}{
+		{"application/json", []byte("null"), http.StatusBadRequest},
+		{"application/json", []byte(`""`), http.StatusOK},
+		{"application/x-protobuf", nil, http.StatusBadRequest},
+		{"application/x-protobuf", (&pb.HashRequest{Algo: "sha256"}).Marshal(), http.StatusBadRequest},
+		{"application/x-protobuf", []byte{0x0a, 0x00}, http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/hash", bytes.NewReader(test.body))
+		req.Header.Set("Content-Type", test.contentType)
+		resp := httptest.NewRecorder()
+		service.Handler.ServeHTTP(resp, req)
+		if resp.Code != test.code {
+			t.Errorf("%s body %q got %d, want %d", test.contentType, test.body, resp.Code, test.code)
+		}
+	}
+}
+
+// gRPC calls turned away by the authentication and rate limiting middlewares must be answered with a gRPC status, as
+// gRPC clients take any other HTTP status for a transport error, while the HTTP endpoints keep their HTTP statuses
+func TestGRPCRejections(t *testing.T) {
+	ok := func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		writeGRPCStatus(w, grpcOK, "")
+	}
+	handlers := []struct {
+		name	string
+		handler	http.HandlerFunc
+		status	int
+		code	int
+	}{
+		{"auth", requireAuth("s3cret", nil, ok), http.StatusUnauthorized, grpcUnauthenticated},
+		{"rate limit", newRateLimiter(0.001, 1).limit(ok), http.StatusTooManyRequests, grpcResourceExhausted},
+	}
+	for _, h := range handlers {
+		// The first request uses up the rate limiter's only token
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("POST", grpcServicePrefix + "Hash", nil)
+			req.ProtoMajor, req.ProtoMinor = 2, 0
+			req.Header.Set("Content-Type", "application/grpc")
+			resp := httptest.NewRecorder()
+			h.handler(resp, req)
+			if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != "application/grpc" {
+				t.Fatalf("%s answered a gRPC call with %d and content type %q", h.name, resp.Code, resp.Header().Get("Content-Type"))
+			}
+			if status := resp.Result().Trailer.Get("Grpc-Status"); i == 1 && status != strconv.Itoa(h.code) {
+				t.Fatalf("%s answered a gRPC call with status %q, want %d", h.name, status, h.code)
+			}
+		}
+		resp := httptest.NewRecorder()
+		h.handler(resp, httptest.NewRequest("POST", "/hash", nil))
+		if resp.Code != h.status {
+			t.Fatalf("%s answered an HTTP request with %d, want %d", h.name, resp.Code, h.status)
+		}
+	}
+}
+
+// Keys of the response cache must tell apart every algorithm and payload, and be the same for the same ones
+func TestCacheKey(t *testing.T) {
+	sha256, _ := digest.Lookup("sha256")
+	fnv1a64, _ := digest.Lookup("fnv1a64")
+	keys := map[cacheKey]string{}
+	for _, k := range []struct {
+		algo	digest.Algorithm
+		payload	string
+	}{{sha256, ""}, {sha256, "payload"}, {sha256, "payloae"}, {fnv1a64, "payload"}, {fnv1a64, ""}} {
+		key := newCacheKey(k.algo, []byte(k.payload))
+		if other, ok := keys[key]; ok {
+			t.Fatalf("%s of %q has the same cache key as %s", k.algo.Name(), k.payload, other)
+		}
+		keys[key] = k.algo.Name() + " of " + strconv.Quote(k.payload)
+		if newCacheKey(k.algo, []byte(k.payload)) != key {
+			t.Fatalf("%s of %q has a different cache key every time", k.algo.Name(), k.payload)
+		}
+	}
+}
+
+// Backends set up in the same process keep their own state, so none inherits the cache, limits, keys, or counters of another
+func TestIndependentServices(t *testing.T) {
+	options := DefaultOptions()
+	options.Delay, options.LogLevel = "0", "none"
+	options.Algo, options.CacheSize, options.Workers, options.TagKeys = "sha256", 10, 1, "k1:s3cret"
+	first, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := New(DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(service *Service, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte("payload")))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp := httptest.NewRecorder()
+		service.Handler.ServeHTTP(resp, req)
+		return resp
+	}
+	sha256, _ := digest.Lookup("sha256")
+	if resp := post(first, "/hash"); !bytes.Equal(resp.Body.Bytes(), sha256.Sum([]byte("payload"))) {
+		t.Fatalf("first backend answered %d: %x", resp.Code, resp.Body)
+	}
+	if resp := post(first, "/hmac"); resp.Code != http.StatusOK {
+		t.Fatalf("first backend answered /hmac with %d", resp.Code)
+	}
+	if second.defaultAlgo.Name() != digest.Default || second.cache != nil || second.workerTokens != nil || second.tagKeys != nil {
+		t.Fatalf("second backend took on the first one's algorithm %s, cache, workers, or tag keys", second.defaultAlgo.Name())
+	}
+	if resp := post(second, "/hmac"); resp.Code != http.StatusNotFound {
+		t.Fatalf("second backend answered /hmac with %d", resp.Code)
+	}
+
+	resp := httptest.NewRecorder()
+	second.Handler.ServeHTTP(resp, httptest.NewRequest("GET", "/stats", nil))
+	var report statsReport
+	if err := json.Unmarshal(resp.Body.Bytes(), &report); err != nil || report.PayloadsHashed != 0 {
+		t.Fatalf("second backend reported %+v (%v) before hashing anything", report, err)
+	}
+	atomic.StoreInt32(&first.draining, 1)
+	resp = httptest.NewRecorder()
+	second.Handler.ServeHTTP(resp, httptest.NewRequest("GET", "/readyz", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("second backend is not ready while the first one drains: %d", resp.Code)
+	}
+}
+
+// Body that records whether anything read it
+type watchedBody struct {
+	io.Reader
+	read	bool
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.Reader.Read(p)
+}
+
+// Requests with a missing or stale signing time are turned away before their body is read, and bodies over max_body
+// are turned away on every authenticated endpoint, including the ones that do not hash
+func TestAuthRejectsBeforeReading(t *testing.T) {
+	options := DefaultOptions()
+	options.Delay, options.LogLevel = "0", "none"
+	options.HMACKey, options.AdminToken, options.MaxBody = "k3y", "adm1n", 16
+	service, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, timestamp := range []string{"", "0", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)} {
+		body := &watchedBody{Reader: bytes.NewReader([]byte("payload"))}
+		req := httptest.NewRequest("POST", "/hash", body)
+		if timestamp != "" {
+			req.Header.Set(backendwire.TimestampHeader, timestamp)
+		}
+		resp := httptest.NewRecorder()
+		service.Handler.ServeHTTP(resp, req)
+		if resp.Code != http.StatusUnauthorized || body.read {
+			t.Errorf("signing time %q answered %d, with the body read: %v", timestamp, resp.Code, body.read)
+		}
+	}
+
+	for _, path := range []string{"/shutdown", "/admin/params"} {
+		req := httptest.NewRequest("POST", path, bytes.NewReader(bytes.Repeat([]byte{'x'}, 64)))
+		req.Header.Set(backendwire.TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+		resp := httptest.NewRecorder()
+		service.Handler.ServeHTTP(resp, req)
+		if resp.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s answered a body over max_body with %d", path, resp.Code)
+		}
+	}
+}
+
+// A gRPC message cut off by max_body is answered RESOURCE_EXHAUSTED, like any other body that is too large
+func TestGRPCMessageTooLarge(t *testing.T) {
+	options := DefaultOptions()
+	options.Delay, options.LogLevel, options.MaxBody = "0", "none", 64
+	service, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	writeGRPCMessage(&body, (&pb.HashRequest{Payload: bytes.Repeat([]byte{0xab}, 100)}).Marshal())
+	// Hide the length of the body, so it is only found too large once it is read
+	req := httptest.NewRequest("POST", grpcServicePrefix + "Hash", io.MultiReader(&body))
+	req.ProtoMajor, req.ProtoMinor = 2, 0
+	req.Header.Set("Content-Type", "application/grpc")
+	resp := httptest.NewRecorder()
+	service.Handler.ServeHTTP(resp, req)
+	if status := resp.Result().Trailer.Get("Grpc-Status"); status != strconv.Itoa(grpcResourceExhausted) {
+		t.Fatalf("message over max_body answered with gRPC status %q, want %d", status, grpcResourceExhausted)
+	}
+}
+
+// UDP hash requests beyond max_concurrent are dropped as they arrive instead of each waiting in a goroutine of its own
+func TestUDPHashAdmission(t *testing.T) {
+	options := DefaultOptions()
+	options.Delay, options.LogLevel = "fixed:200ms", "none"
+	service, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	metrics := newBackendMetrics()
+	var wg sync.WaitGroup
+	stopped := make(chan struct{})
+	go service.serveUDPHash(conn, newAdmissionLimiter(1, 0), nil, metrics, &wg, stopped)
+
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for id := uint64(1); id <= 3; id++ {
+		client.Write(backendwire.AppendUDPHashRequest(nil, id, "", []byte("payload")))
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	responses := 0
+	buffer := make([]byte, backendwire.MaxUDPHashDatagram)
+	for {
+		if _, err := client.Read(buffer); err != nil {
+			break
+		}
+		responses++
+	}
+	conn.SetReadDeadline(time.Now())
+	<-stopped
+	wg.Wait()
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	if dropped := metrics.endpoints["udp"].requests[http.StatusTooManyRequests]; responses != 1 || dropped != 2 {
+		t.Fatalf("answered %d requests and dropped %d with one slot, want 1 and 2", responses, dropped)
+	}
+}
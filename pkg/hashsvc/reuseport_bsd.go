@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package hashsvc
+
+import (
+	"syscall"
+)
+
+// Value of the SO_REUSEPORT socket option on macOS and the BSDs (i.e. 0x200), which differs from the Linux one
+const soReusePort = syscall.SO_REUSEPORT
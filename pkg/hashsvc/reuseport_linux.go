@@ -0,0 +1,4 @@
+package hashsvc
+
+// Value of the SO_REUSEPORT socket option on Linux, which the syscall package does not define
+const soReusePort = 0xf
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package hashsvc
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Reports that SO_REUSEPORT cannot be set, since only Linux, macOS, and the BSDs have it
+func setReusePort(fd uintptr) error {
+	return fmt.Errorf("reuse_port is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,669 @@
+// Package netsim abstracts the UDP sockets of the client and server behind the PacketConn interface, with an in-memory
+// network whose loss, latency, and reordering can be set, so the whole pipeline can run in go test without real sockets
+package netsim
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Socket that sends and receives datagrams, which a *net.UDPConn is
+// A socket opened with DialUDP is connected, so Read and Write exchange datagrams with its remote address only
+type PacketConn interface {
+	net.PacketConn
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	RemoteAddr() net.Addr
+}
+
+// Network that sockets are opened on, taking the same arguments as the functions of the net package
+type Network interface {
+	ListenUDP(network string, laddr *net.UDPAddr) (PacketConn, error)
+	DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (PacketConn, error)
+}
+
+// The host's UDP network, whose sockets are real *net.UDPConn sockets
+var UDP Network = udpNetwork{}
+
+type udpNetwork struct{}
+
+func (udpNetwork) ListenUDP(network string, laddr *net.UDPAddr) (PacketConn, error) {
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (udpNetwork) DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (PacketConn, error) {
+	conn, err := net.DialUDP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Impairments of a simulated network, applied to every datagram on its own
+// Loss: the probability of a datagram being dropped (i.e. 0.01)
+// Latency: how long every datagram takes to arrive
+// Reorder, ReorderDelay: the probability of a datagram being held back by ReorderDelay on top of the latency, so the
+// datagrams sent after it overtake it
+// Seed: seeds the random choices of every link (the datagrams from one address to another), so a link drops and holds
+// back the same datagrams in every run with the same seed
+// QueueSize: the number of datagrams each socket holds before dropping the ones that arrive, or 0 for 4096
+type Config struct {
+	Loss			float64
+	Latency			time.Duration
+	Reorder			float64
+	ReorderDelay	time.Duration
+	Seed			int64
+	QueueSize		int
+}
+
+// Counters of the datagrams a simulated network carried
+// Sent: every datagram written to a socket
+// Lost: the datagrams dropped by the loss probability
+// Reordered: the datagrams held back by the reorder probability
+// Delivered: the datagrams that reached a socket
+// Overflowed: the datagrams dropped because their socket was full
+// Unroutable: the datagrams dropped because no socket had their address once they arrived
+type Stats struct {
+	Sent		int64
+	Lost		int64
+	Reordered	int64
+	Delivered	int64
+	Overflowed	int64
+	Unroutable	int64
+}
+
+// First port handed out to sockets opened without one
+const firstPort = 10000
+
+// In-memory network, whose sockets exchange datagrams without touching the host's network
+// Addresses without an IP are given 127.0.0.1, and ports of 0 are given the lowest free port from firstPort
+type Sim struct {
+	config		Config
+	mutex		sync.Mutex
+	conns		map[string]*simConn
+	links		map[string]*rand.Rand
+	scheduled	datagramQueue
+	nextSeq		uint64
+	stats		Stats
+	wake		chan struct{}
+	done		chan struct{}
+	closeOnce	sync.Once
+}
+
+// Creates a simulated network with the impairments of the config, which delivers datagrams until it is closed
+func NewSim(config Config) *Sim {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 4096
+	}
+	s := &Sim{
+		config: config,
+		conns: make(map[string]*simConn),
+		links: make(map[string]*rand.Rand),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go s.deliver()
+	return s
+}
+
+// Stops delivering datagrams, which leaves the sockets still open unable to receive anything more
+func (s *Sim) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// Returns the counters of the datagrams the network carried so far
+func (s *Sim) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats
+}
+
+func (s *Sim) ListenUDP(network string, laddr *net.UDPAddr) (PacketConn, error) {
+	return s.open(laddr, nil)
+}
+
+func (s *Sim) DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (PacketConn, error) {
+	if raddr == nil {
+		return nil, errors.New("missing remote address")
+	}
+	return s.open(laddr, s.address(raddr))
+}
+
+// Returns the address as it is known on the network, with 127.0.0.1 for a missing or unspecified IP
+func (s *Sim) address(addr *net.UDPAddr) *net.UDPAddr {
+	resolved := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	if addr != nil {
+		resolved.Port = addr.Port
+		if addr.IP != nil && !addr.IP.IsUnspecified() {
+			resolved.IP = addr.IP
+		}
+	}
+	return resolved
+}
+
+// Opens a socket on the local address, which is connected to the remote address if one is given
+func (s *Sim) open(laddr *net.UDPAddr, raddr *net.UDPAddr) (PacketConn, error) {
+	local := s.address(laddr)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if local.Port == 0 {
+		for local.Port = firstPort; s.conns[local.String()] != nil; local.Port++ {
+		}
+	} else if s.conns[local.String()] != nil {
+		return nil, fmt.Errorf("listen udp %s: address already in use", local)
+	}
+	c := &simConn{
+		sim: s,
+		local: local,
+		remote: raddr,
+		queue: make(chan datagram, s.config.QueueSize),
+		closed: make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	s.conns[local.String()] = c
+	return c, nil
+}
+
+// Sends a copy of a datagram from one address to another, unless the link drops it
+func (s *Sim) send(from *net.UDPAddr, to *net.UDPAddr, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.Sent++
+
+	// Every link draws from its own source, so the datagrams of other links do not change which of its datagrams are impaired
+	link := from.String() + ">" + to.String()
+	random := s.links[link]
+	if random == nil {
+		key := fnv.New64a()
+		key.Write([]byte(link))
+		random = rand.New(rand.NewSource(s.config.Seed ^ int64(key.Sum64())))
+		s.links[link] = random
+	}
+	if s.config.Loss > 0 && random.Float64() < s.config.Loss {
+		s.stats.Lost++
+		return
+	}
+	at := time.Now().Add(s.config.Latency)
+	if s.config.Reorder > 0 && random.Float64() < s.config.Reorder {
+		s.stats.Reordered++
+		at = at.Add(s.config.ReorderDelay)
+	}
+
+	heap.Push(&s.scheduled, &scheduledDatagram{
+		at: at,
+		seq: s.nextSeq,
+		to: to.String(),
+		datagram: datagram{from: from, data: append([]byte(nil), data...)},
+	})
+	s.nextSeq++
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Hands every scheduled datagram to its socket once it is due, in the order they are due and then in the order they were sent
+func (s *Sim) deliver() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.mutex.Lock()
+		now := time.Now()
+		for len(s.scheduled) > 0 && !s.scheduled[0].at.After(now) {
+			next := heap.Pop(&s.scheduled).(*scheduledDatagram)
+			c := s.conns[next.to]
+			if c == nil {
+				s.stats.Unroutable++
+				continue
+			}
+			select {
+			case c.queue <- next.datagram:
+				s.stats.Delivered++
+			default:
+				s.stats.Overflowed++
+			}
+		}
+		wait := time.Hour
+		if len(s.scheduled) > 0 {
+			wait = s.scheduled[0].at.Sub(now)
+		}
+		s.mutex.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// A datagram and the address it came from
+type datagram struct {
+	from	*net.UDPAddr
+	data	[]byte
+}
+
+// A datagram on its way to the socket of an address, due at a time
+// seq: the order the datagram was sent in, which breaks ties between datagrams due at the same time
+type scheduledDatagram struct {
+	at			time.Time
+	seq			uint64
+	to			string
+	datagram
+}
+
+// Datagrams on their way, as a heap of the earliest due first
+type datagramQueue []*scheduledDatagram
+
+func (q datagramQueue) Len() int {
+	return len(q)
+}
+
+func (q datagramQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q datagramQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *datagramQueue) Push(x interface{}) {
+	*q = append(*q, x.(*scheduledDatagram))
+}
+
+func (q *datagramQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old) - 1]
+	*q = old[:len(old) - 1]
+	return x
+}
+
+// Error of an operation past its deadline, which is a timeout like the net package's
+type timeoutError struct{}
+
+func (timeoutError) Error() string {
+	return "i/o timeout"
+}
+
+func (timeoutError) Timeout() bool {
+	return true
+}
+
+func (timeoutError) Temporary() bool {
+	return true
+}
+
+// Error of an operation on a closed socket, with the same message as the net package's
+var errClosed = errors.New("use of closed network connection")
+
+// Socket of a simulated network
+// remote: the address the socket is connected to, or nil if it is not connected
+// deadlineChanged: closed and replaced whenever a deadline is set, so blocked reads pick up the new deadline
+type simConn struct {
+	sim				*Sim
+	local			*net.UDPAddr
+	remote			*net.UDPAddr
+	queue			chan datagram
+	closed			chan struct{}
+	closeOnce		sync.Once
+	mutex			sync.Mutex
+	readDeadline	time.Time
+	writeDeadline	time.Time
+	deadlineChanged	chan struct{}
+}
+
+// Returns the error of an operation on the socket as a *net.OpError, like the errors of a *net.UDPConn
+func (c *simConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: c.local, Addr: addr, Err: err}
+}
+
+func (c *simConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err, done := c.readOnce(b)
+		if done {
+			return n, addr, err
+		}
+	}
+}
+
+// Waits for a datagram until the read deadline
+// Returns whether the read is done, which it is not if the deadline changed or a connected socket got a stray datagram
+func (c *simConn) readOnce(b []byte) (int, net.Addr, error, bool) {
+	c.mutex.Lock()
+	deadline, deadlineChanged := c.readDeadline, c.deadlineChanged
+	c.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, nil, c.opError("read", nil, timeoutError{}), true
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case received := <-c.queue:
+		// A connected socket only receives from its remote address
+		if c.remote != nil && received.from.String() != c.remote.String() {
+			return 0, nil, nil, false
+		}
+		return copy(b, received.data), received.from, nil, true
+	case <-c.closed:
+		return 0, nil, c.opError("read", nil, errClosed), true
+	case <-timeout:
+		return 0, nil, c.opError("read", nil, timeoutError{}), true
+	case <-deadlineChanged:
+		return 0, nil, nil, false
+	}
+}
+
+func (c *simConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *simConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, c.opError("write", addr, fmt.Errorf("address %v is not a UDP address", addr))
+	}
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", addr, errClosed)
+	default:
+	}
+	c.mutex.Lock()
+	deadline := c.writeDeadline
+	c.mutex.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, c.opError("write", addr, timeoutError{})
+	}
+	c.sim.send(c.local, c.sim.address(udpAddr), b)
+	return len(b), nil
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	if c.remote == nil {
+		return 0, c.opError("write", nil, errors.New("destination address required"))
+	}
+	return c.WriteTo(b, c.remote)
+}
+
+func (c *simConn) Close() error {
+	err := c.opError("close", nil, errClosed)
+	c.closeOnce.Do(func() {
+		err = nil
+		close(c.closed)
+		c.sim.mutex.Lock()
+		delete(c.sim.conns, c.local.String())
+		c.sim.mutex.Unlock()
+	})
+	return err
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// Returns the address the socket is connected to, or nil if it is not connected
+func (c *simConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return nil
+	}
+	return c.remote
+}
+
+func (c *simConn) SetDeadline(t time.Time) error {
+	c.setDeadlines(&t, &t)
+	return nil
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.setDeadlines(&t, nil)
+	return nil
+}
+
+func (c *simConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadlines(nil, &t)
+	return nil
+}
+
+// Sets the deadlines given, waking any blocked read so it waits for the new deadline instead
+func (c *simConn) setDeadlines(read *time.Time, write *time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if read != nil {
+		c.readDeadline = *read
+	}
+	if write != nil {
+		c.writeDeadline = *write
+	}
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+}
+
+// Network whose sockets are those of another network, such as UDP, with the impairments of a config applied to the
+// datagrams they send, so a run over a real network can add loss, latency, and reordering of its own
+// Only sending is impaired, so on the client it impairs the path to the server and not the way back
+// Datagrams are held back by the sockets themselves and sent once due, and ones that do not fit in the QueueSize of a
+// socket are dropped and counted as overflowed, while ones the base network fails to send count as lost; Unroutable is
+// never counted
+type Impaired struct {
+	base	Network
+	config	Config
+	mutex	sync.Mutex
+	random	*rand.Rand
+	stats	Stats
+}
+
+// Creates a network impairing the datagrams sent on the sockets of the base network with the config
+// The random choices are drawn from the config's Seed in the order datagrams are sent, over every socket
+func Impair(base Network, config Config) *Impaired {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 4096
+	}
+	return &Impaired{base: base, config: config, random: rand.New(rand.NewSource(config.Seed))}
+}
+
+// Returns the counters of the datagrams sent on the network's sockets so far
+func (n *Impaired) Stats() Stats {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.stats
+}
+
+func (n *Impaired) ListenUDP(network string, laddr *net.UDPAddr) (PacketConn, error) {
+	conn, err := n.base.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return n.wrap(conn), nil
+}
+
+func (n *Impaired) DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (PacketConn, error) {
+	conn, err := n.base.DialUDP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return n.wrap(conn), nil
+}
+
+// Wraps a socket of the base network, starting the goroutines that send its delayed datagrams
+func (n *Impaired) wrap(conn PacketConn) *impairedConn {
+	c := &impairedConn{
+		PacketConn: conn,
+		network: n,
+		onTime: make(chan delayedDatagram, n.config.QueueSize),
+		heldBack: make(chan delayedDatagram, n.config.QueueSize),
+		closed: make(chan struct{}),
+	}
+	go c.sendDue(c.onTime)
+	go c.sendDue(c.heldBack)
+	return c
+}
+
+// Draws the fate of a datagram, returning whether it is lost and whether it is held back
+func (n *Impaired) draw() (bool, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.stats.Sent++
+	if n.config.Loss > 0 && n.random.Float64() < n.config.Loss {
+		n.stats.Lost++
+		return true, false
+	}
+	if n.config.Reorder > 0 && n.random.Float64() < n.config.Reorder {
+		n.stats.Reordered++
+		return false, true
+	}
+	return false, false
+}
+
+// Counts a datagram as delivered if it was sent on the base network and as lost if the base network could not send it
+func (n *Impaired) count(err error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if err == nil {
+		n.stats.Delivered++
+	} else {
+		n.stats.Lost++
+	}
+}
+
+// A datagram waiting to be sent to an address, or to the remote address of a connected socket if addr is nil
+type delayedDatagram struct {
+	at		time.Time
+	addr	net.Addr
+	data	[]byte
+}
+
+// Socket of an impaired network
+// onTime, heldBack: the datagrams delayed by the latency, and those held back by the reorder delay on top of it, each
+// in the order they are due since every datagram of a queue is delayed by the same time
+// writeDeadline: the write deadline in nanoseconds since the Unix epoch, or 0 for none, which the socket checks itself
+// rather than setting it on the base socket, so datagrams already sent are still delivered once due
+type impairedConn struct {
+	PacketConn
+	network			*Impaired
+	onTime			chan delayedDatagram
+	heldBack		chan delayedDatagram
+	closed			chan struct{}
+	closeOnce		sync.Once
+	writeDeadline	int64
+}
+
+func (c *impairedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.send(b, addr)
+}
+
+func (c *impairedConn) Write(b []byte) (int, error) {
+	return c.send(b, nil)
+}
+
+// Sends a datagram right away if it is not delayed at all, and otherwise queues it to be sent once it is due
+// Lost and delayed datagrams are reported as written, like datagrams lost or delayed further along a real network
+func (c *impairedConn) send(b []byte, addr net.Addr) (int, error) {
+	if deadline := atomic.LoadInt64(&c.writeDeadline); deadline != 0 && time.Now().UnixNano() >= deadline {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: timeoutError{}}
+	}
+	lost, heldBack := c.network.draw()
+	if lost {
+		return len(b), nil
+	}
+	delay := c.network.config.Latency
+	queue := c.onTime
+	if heldBack {
+		delay += c.network.config.ReorderDelay
+		queue = c.heldBack
+	}
+	if delay <= 0 {
+		n, err := c.write(b, addr)
+		c.network.count(err)
+		return n, err
+	}
+	select {
+	case queue <- delayedDatagram{at: time.Now().Add(delay), addr: addr, data: append([]byte(nil), b...)}:
+	default:
+		c.network.mutex.Lock()
+		c.network.stats.Overflowed++
+		c.network.mutex.Unlock()
+	}
+	return len(b), nil
+}
+
+func (c *impairedConn) write(b []byte, addr net.Addr) (int, error) {
+	if addr == nil {
+		return c.PacketConn.Write(b)
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// Sends the datagrams of a queue as they fall due, until the socket is closed
+func (c *impairedConn) sendDue(queue <-chan delayedDatagram) {
+	for {
+		select {
+		case next := <-queue:
+			if wait := time.Until(next.at); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-c.closed:
+					timer.Stop()
+					return
+				}
+			}
+			_, err := c.write(next.data, next.addr)
+			c.network.count(err)
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *impairedConn) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+func (c *impairedConn) SetWriteDeadline(t time.Time) error {
+	var deadline int64
+	if !t.IsZero() {
+		deadline = t.UnixNano()
+	}
+	atomic.StoreInt64(&c.writeDeadline, deadline)
+	return nil
+}
+
+// Closes the socket, dropping the datagrams still waiting to be sent
+func (c *impairedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,275 @@
+package netsim
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Opens a socket listening on the simulated network, failing the test if it cannot
+func listen(t *testing.T, sim *Sim, port int) PacketConn {
+	conn, err := sim.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Sends count numbered datagrams from one socket to another, then returns the numbers received in the order they arrived
+func exchange(t *testing.T, from PacketConn, to PacketConn, count int, wait time.Duration) []uint32 {
+	for i := 0; i < count; i++ {
+		var datagram [4]byte
+		binary.LittleEndian.PutUint32(datagram[:], uint32(i))
+		if _, err := from.WriteTo(datagram[:], to.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var received []uint32
+	to.SetReadDeadline(time.Now().Add(wait))
+	buffer := make([]byte, 16)
+	for {
+		n, _, err := to.ReadFrom(buffer)
+		if err != nil {
+			break
+		}
+		if n != 4 {
+			t.Fatalf("received a datagram of %d bytes, want 4", n)
+		}
+		received = append(received, binary.LittleEndian.Uint32(buffer))
+	}
+	return received
+}
+
+func TestDelivery(t *testing.T) {
+	sim := NewSim(Config{})
+	defer sim.Close()
+	a, b := listen(t, sim, 0), listen(t, sim, 0)
+	if a.LocalAddr().String() != "127.0.0.1:10000" || b.LocalAddr().String() != "127.0.0.1:10001" {
+		t.Fatalf("sockets got addresses %v and %v", a.LocalAddr(), b.LocalAddr())
+	}
+	if _, err := sim.ListenUDP("udp4", &net.UDPAddr{Port: 10000}); err == nil {
+		t.Fatal("opened a second socket on a port in use")
+	}
+
+	received := exchange(t, a, b, 1000, 100 * time.Millisecond)
+	if len(received) != 1000 {
+		t.Fatalf("received %d of 1000 datagrams", len(received))
+	}
+	for i, n := range received {
+		if n != uint32(i) {
+			t.Fatalf("datagram %d arrived in position %d without any reordering", n, i)
+		}
+	}
+	if stats := sim.Stats(); stats.Sent != 1000 || stats.Delivered != 1000 {
+		t.Fatalf("stats are %+v, want 1000 sent and delivered", stats)
+	}
+}
+
+// The same seed must drop the same datagrams, and other seeds other datagrams at about the same rate
+func TestLossDeterministic(t *testing.T) {
+	lost := func(seed int64) map[uint32]bool {
+		sim := NewSim(Config{Loss: 0.1, Seed: seed})
+		defer sim.Close()
+		a, b := listen(t, sim, 0), listen(t, sim, 0)
+		missing := make(map[uint32]bool)
+		for i := 0; i < 2000; i++ {
+			missing[uint32(i)] = true
+		}
+		for _, n := range exchange(t, a, b, 2000, 100 * time.Millisecond) {
+			delete(missing, n)
+		}
+		if stats := sim.Stats(); stats.Lost != int64(len(missing)) {
+			t.Fatalf("%d datagrams missing but %d counted as lost", len(missing), stats.Lost)
+		}
+		return missing
+	}
+
+	first, again, other := lost(1), lost(1), lost(2)
+	if len(first) < 140 || len(first) > 260 {
+		t.Fatalf("lost %d of 2000 datagrams with a loss of 10%%", len(first))
+	}
+	if len(again) != len(first) {
+		t.Fatalf("lost %d datagrams with the same seed, then %d", len(first), len(again))
+	}
+	for n := range first {
+		if !again[n] {
+			t.Fatalf("datagram %d was lost with a seed only once", n)
+		}
+	}
+	same := 0
+	for n := range other {
+		if first[n] {
+			same++
+		}
+	}
+	if same == len(first) {
+		t.Fatal("another seed lost the same datagrams")
+	}
+}
+
+func TestLatency(t *testing.T) {
+	sim := NewSim(Config{Latency: 50 * time.Millisecond})
+	defer sim.Close()
+	a, b := listen(t, sim, 0), listen(t, sim, 0)
+
+	start := time.Now()
+	a.WriteTo([]byte("ping"), b.LocalAddr())
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 16)
+	n, from, err := b.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50 * time.Millisecond {
+		t.Fatalf("datagram arrived after %v, before the latency of 50ms", elapsed)
+	}
+	if string(buffer[:n]) != "ping" || from.String() != a.LocalAddr().String() {
+		t.Fatalf("received %q from %v", buffer[:n], from)
+	}
+}
+
+// Held back datagrams must be overtaken by the ones after them, without any being lost
+func TestReorder(t *testing.T) {
+	sim := NewSim(Config{Reorder: 0.2, ReorderDelay: 20 * time.Millisecond, Seed: 1})
+	defer sim.Close()
+	a, b := listen(t, sim, 0), listen(t, sim, 0)
+
+	received := exchange(t, a, b, 500, 200 * time.Millisecond)
+	if len(received) != 500 {
+		t.Fatalf("received %d of 500 datagrams", len(received))
+	}
+	late := 0
+	for i := 1; i < len(received); i++ {
+		if received[i] < received[i - 1] {
+			late++
+		}
+	}
+	reordered := sim.Stats().Reordered
+	if reordered == 0 || late == 0 {
+		t.Fatalf("%d datagrams were held back and %d arrived after a later one", reordered, late)
+	}
+}
+
+// A connected socket exchanges datagrams with its remote address only
+func TestDialUDP(t *testing.T) {
+	sim := NewSim(Config{})
+	defer sim.Close()
+	server, stranger := listen(t, sim, 40000), listen(t, sim, 0)
+	client, err := sim.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.RemoteAddr().String() != "127.0.0.1:40000" {
+		t.Fatalf("connected socket has remote address %v", client.RemoteAddr())
+	}
+
+	client.Write([]byte("request"))
+	buffer := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := server.ReadFrom(buffer)
+	if err != nil || string(buffer[:n]) != "request" {
+		t.Fatalf("server read %q, %v", buffer[:n], err)
+	}
+	stranger.WriteTo([]byte("stray"), client.LocalAddr())
+	server.WriteTo([]byte("reply"), from)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = client.Read(buffer)
+	if err != nil || string(buffer[:n]) != "reply" {
+		t.Fatalf("client read %q, %v instead of the reply", buffer[:n], err)
+	}
+}
+
+// Reads must stop at their deadline, as soon as the deadline is moved, and once the socket is closed, with the errors
+// the client and server look for on real sockets
+func TestDeadlinesAndClose(t *testing.T) {
+	sim := NewSim(Config{})
+	defer sim.Close()
+	conn := listen(t, sim, 0)
+	buffer := make([]byte, 16)
+
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, _, err := conn.ReadFrom(buffer)
+	if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+		t.Fatalf("read past its deadline returned %v, want a timeout", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.SetReadDeadline(time.Now())
+	}()
+	_, _, err = conn.ReadFrom(buffer)
+	if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+		t.Fatalf("read whose deadline moved to now returned %v, want a timeout", err)
+	}
+
+	conn.SetWriteDeadline(time.Now())
+	_, err = conn.WriteTo([]byte("late"), conn.LocalAddr())
+	if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+		t.Fatalf("write past its deadline returned %v, want a timeout", err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+	}()
+	_, _, err = conn.ReadFrom(buffer)
+	if err == nil || !strings.Contains(err.Error(), "use of closed network connection") {
+		t.Fatalf("read from a closed socket returned %v", err)
+	}
+	if err := conn.Close(); err == nil {
+		t.Fatal("closed a socket twice without an error")
+	}
+
+	// The port is free again once closed
+	listen(t, sim, 10000).Close()
+}
+
+// Datagrams sent on an impaired network must be lost and delayed like on a simulated one, over real sockets
+func TestImpair(t *testing.T) {
+	impaired := Impair(UDP, Config{Loss: 0.1, Latency: 20 * time.Millisecond, Seed: 1})
+	a, err := impaired.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := UDP.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	start := time.Now()
+	a.WriteTo([]byte("ping"), b.LocalAddr())
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 16)
+	if _, _, err := b.ReadFrom(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20 * time.Millisecond {
+		t.Fatalf("datagram arrived after %v, before the latency of 20ms", elapsed)
+	}
+
+	received := exchange(t, a, b, 200, 200 * time.Millisecond)
+	stats := impaired.Stats()
+	if stats.Sent != 201 || stats.Lost == 0 || stats.Delivered != 201 - stats.Lost || stats.Overflowed != 0 {
+		t.Fatalf("stats are %+v, want 201 sent with some lost and the rest delivered", stats)
+	}
+	if len(received) != int(stats.Delivered) - 1 {
+		t.Fatalf("received %d of the 200 datagrams, but %d were delivered besides the ping", len(received), stats.Delivered - 1)
+	}
+
+	// Only the sending socket is impaired
+	b.WriteTo([]byte("reply"), a.LocalAddr())
+	a.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := a.ReadFrom(buffer); err != nil || string(buffer[:n]) != "reply" {
+		t.Fatalf("impaired socket read %q, %v", buffer[:n], err)
+	}
+	if impaired.Stats().Sent != 201 {
+		t.Fatal("a datagram received by the impaired socket was counted as sent")
+	}
+}
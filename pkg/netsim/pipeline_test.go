@@ -0,0 +1,196 @@
+package netsim_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nbopardi/udp_client_server/internal/digest"
+	"github.com/nbopardi/udp_client_server/internal/protocol"
+	"github.com/nbopardi/udp_client_server/pkg/netsim"
+	"github.com/nbopardi/udp_client_server/pkg/udpclient"
+	"github.com/nbopardi/udp_client_server/pkg/udpserver"
+)
+
+// Processor hashing each payload itself, standing in for the HTTP backend
+type localProcessor struct {
+	algo	digest.Algorithm
+}
+
+func (p localProcessor) Process(payload []byte, requestID string) ([]byte, error) {
+	return p.algo.Sum(payload), nil
+}
+
+// Starts a server on a loopback port of the network, returning it along with a channel receiving its counters once it stops
+// The server stops a second after the client goes quiet, or once it is closed
+func startServer(tb testing.TB, network netsim.Network) (*udpserver.Server, <-chan udpserver.Report) {
+	conn, err := network.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	algo, err := digest.Lookup(digest.Default)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	options := udpserver.DefaultOptions()
+	options.ReadTime = 1
+	server, err := udpserver.NewServer(conn, options, localProcessor{algo: algo})
+	if err != nil {
+		conn.Close()
+		tb.Fatal(err)
+	}
+	serverDone := make(chan udpserver.Report, 1)
+	go func() {
+		report, err := server.Serve()
+		if err != nil {
+			tb.Error(err)
+		}
+		serverDone <- report
+	}()
+	return server, serverDone
+}
+
+// Returns the options of a client sending count packets at a steady rate to a server over the network
+func clientOptions(network netsim.Network, server *udpserver.Server, count int) udpclient.Options {
+	options := udpclient.DefaultOptions()
+	options.Host = "127.0.0.1"
+	options.Port = fmt.Sprint(server.LocalAddr().(*net.UDPAddr).Port)
+	options.Count = count
+	options.PPS = 2000
+	options.ConnTime = "10s"
+	options.Drain = 300 * time.Millisecond
+	options.StatsInterval = 0
+	options.Network = network
+	return options
+}
+
+// Runs the client against a server over a simulated network, returning the results of the client, the counters of the
+// server, and those of the network
+func runPipeline(t *testing.T, config netsim.Config, count int) (*udpclient.Results, udpserver.Report, netsim.Stats) {
+	sim := netsim.NewSim(config)
+	defer sim.Close()
+	server, serverDone := startServer(t, sim)
+	defer server.Close()
+
+	results, err := udpclient.Run(context.Background(), clientOptions(sim, server, count))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results, <-serverDone, sim.Stats()
+}
+
+// Every packet must be reflected over a clean network
+func TestPipeline(t *testing.T) {
+	results, report, stats := runPipeline(t, netsim.Config{Latency: time.Millisecond}, 300)
+	if results.Sent != 300 || results.Received != 300 || results.Duplicates != 0 {
+		t.Fatalf("client sent %d and received %d with %d duplicates, want 300 each", results.Sent, results.Received, results.Duplicates)
+	}
+	if report.Received != 300 || report.Sent != 300 || report.Invalid != 0 {
+		t.Fatalf("server received %d and reflected %d with %d invalid, want 300 each", report.Received, report.Sent, report.Invalid)
+	}
+	if stats.Sent != 600 || stats.Delivered != 600 {
+		t.Fatalf("network stats are %+v, want 600 datagrams sent and delivered", stats)
+	}
+	if results.RTT.MinNs < int64(2 * time.Millisecond) {
+		t.Fatalf("min RTT is %v, less than the 2ms of latency there and back", time.Duration(results.RTT.MinNs))
+	}
+}
+
+// The loss the client reports must be exactly what the network dropped, and the same in every run with the same seed
+func TestPipelineLossDeterministic(t *testing.T) {
+	config := netsim.Config{Loss: 0.05, Latency: time.Millisecond, Reorder: 0.05, ReorderDelay: 2 * time.Millisecond, Seed: 42}
+	var received []int
+	for run := 0; run < 2; run++ {
+		results, report, stats := runPipeline(t, config, 400)
+		if stats.Overflowed != 0 || stats.Unroutable != 0 {
+			t.Fatalf("network stats are %+v, with datagrams dropped other than by loss", stats)
+		}
+		if stats.Lost == 0 {
+			t.Fatalf("network stats are %+v, with nothing lost at a loss of 5%%", stats)
+		}
+		if results.Sent != 400 || results.Received != 400 - int(stats.Lost) {
+			t.Fatalf("client sent %d and received %d, want 400 and %d after the network lost %d", results.Sent, results.Received, 400 - int(stats.Lost), stats.Lost)
+		}
+		if report.Received != report.Sent {
+			t.Fatalf("server received %d but reflected %d", report.Received, report.Sent)
+		}
+		received = append(received, results.Received)
+	}
+	if received[0] != received[1] {
+		t.Fatalf("client received %d packets, then %d with the same seed", received[0], received[1])
+	}
+}
+
+// Measures how fast packets make it through the server and back, over real sockets on loopback and over the simulated
+// network, with a bare sender instead of the client so its rate limiting and drain period stay out of the timings
+func BenchmarkPipeline(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	b.Run("loopback", func(b *testing.B) {
+		benchmarkPipeline(b, netsim.UDP)
+	})
+	b.Run("simulated", func(b *testing.B) {
+		sim := netsim.NewSim(netsim.Config{})
+		defer sim.Close()
+		benchmarkPipeline(b, sim)
+	})
+}
+
+// Number of packets the benchmark keeps outstanding, few enough to fit in the default socket buffers
+const benchmarkWindow = 64
+
+// Sends b.N packets to a server over the network as fast as a window of outstanding packets allows, timing until the
+// last reflection comes back or none has for a second, and reporting the share of packets that never did
+func benchmarkPipeline(b *testing.B, network netsim.Network) {
+	server, _ := startServer(b, network)
+	defer server.Close()
+	conn, err := network.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Every reflection frees a slot of the window, and the sender gives up once the receiver has
+	window := make(chan struct{}, benchmarkWindow)
+	receiverDone := make(chan struct{})
+	received := make(chan int, 1)
+	go func() {
+		defer close(receiverDone)
+		buffer := make([]byte, protocol.MaxDatagramSize)
+		count := 0
+		for count < b.N {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Read(buffer); err != nil {
+				break
+			}
+			count++
+			<-window
+		}
+		received <- count
+	}()
+
+	b.ResetTimer()
+	packet := protocol.Packet{Body: make([]byte, 100)}
+	sendLoop:
+		for i := 0; i < b.N; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-receiverDone:
+				break sendLoop
+			}
+			packet.Seq = uint64(i)
+			packet.Timestamp = time.Now().UnixNano()
+			if _, err := conn.Write(packet.Marshal()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	count := <-received
+	b.StopTimer()
+	b.ReportMetric(100 * float64(b.N - count) / float64(b.N), "loss%")
+}
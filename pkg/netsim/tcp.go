@@ -0,0 +1,368 @@
+package netsim
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest datagram a frame can carry, as its length is sent in 2 bytes
+const maxFrameSize = 0xFFFF
+
+// Number of frames from clients a listening TCP socket holds before it stops reading from their connections
+const tcpQueueSize = 4096
+
+// The host's TCP network, so the same packets can be sent over TCP as over UDP to compare the two on a path
+// Each datagram is carried on a TCP stream as a frame: its length as a 2 byte big endian integer followed by its bytes
+// A socket opened with DialUDP is a TCP connection to the remote address, and one opened with ListenUDP accepts the
+// connections of every client, receiving their frames as datagrams from their addresses and sending each datagram back
+// over the connection of the address it is sent to
+var TCP Network = tcpNetwork{}
+
+// Returns the network of a transport: udp or tcp
+func Transport(name string) (Network, error) {
+	switch name {
+	case "udp":
+		return UDP, nil
+	case "tcp":
+		return TCP, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q, expected udp or tcp", name)
+}
+
+type tcpNetwork struct{}
+
+func (tcpNetwork) ListenUDP(network string, laddr *net.UDPAddr) (PacketConn, error) {
+	listener, err := net.ListenTCP(tcpNetworkName(network), tcpAddr(laddr))
+	if err != nil {
+		return nil, err
+	}
+	l := &tcpListenerConn{
+		listener: listener,
+		local: udpAddr(listener.Addr()),
+		queue: make(chan datagram, tcpQueueSize),
+		streams: make(map[string]*tcpStreamConn),
+		closed: make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	go l.accept()
+	return l, nil
+}
+
+func (tcpNetwork) DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (PacketConn, error) {
+	if raddr == nil {
+		return nil, errors.New("missing remote address")
+	}
+	conn, err := net.DialTCP(tcpNetworkName(network), tcpAddr(laddr), tcpAddr(raddr))
+	if err != nil {
+		return nil, err
+	}
+	return newTCPStreamConn(conn), nil
+}
+
+// Returns the name of the TCP network matching a UDP one (i.e. tcp4 for udp4)
+func tcpNetworkName(network string) string {
+	return strings.Replace(network, "udp", "tcp", 1)
+}
+
+// Returns the TCP address with the IP and port of a UDP address, or nil for a nil address
+func tcpAddr(addr *net.UDPAddr) *net.TCPAddr {
+	if addr == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+}
+
+// Returns the UDP address with the IP and port of a TCP address, since the client and server only deal in UDP addresses
+func udpAddr(addr net.Addr) *net.UDPAddr {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return &net.UDPAddr{IP: tcp.IP, Port: tcp.Port, Zone: tcp.Zone}
+}
+
+// A TCP connection carrying datagrams as frames
+// reader: buffers a whole frame, so a read that times out partway through a frame leaves it to be read in full later
+type tcpStreamConn struct {
+	conn		*net.TCPConn
+	local		*net.UDPAddr
+	remote		*net.UDPAddr
+	reader		*bufio.Reader
+	readMutex	sync.Mutex
+	writeMutex	sync.Mutex
+}
+
+// Wraps a TCP connection to carry datagrams, with Nagle's algorithm off so every datagram is sent as soon as it is written
+func newTCPStreamConn(conn *net.TCPConn) *tcpStreamConn {
+	conn.SetNoDelay(true)
+	return &tcpStreamConn{
+		conn: conn,
+		local: udpAddr(conn.LocalAddr()),
+		remote: udpAddr(conn.RemoteAddr()),
+		reader: bufio.NewReaderSize(conn, 2 + maxFrameSize),
+	}
+}
+
+// Returns the error of an operation on the connection as a *net.OpError, like the errors of a *net.TCPConn
+func (c *tcpStreamConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: c.local, Addr: c.remote, Err: err}
+}
+
+// Reads the next frame, returning its datagram, which is only valid until the next read
+// Peeking leaves a frame in the buffer until all of it has arrived, so a deadline cannot split it
+func (c *tcpStreamConn) readFrame() ([]byte, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	header, err := c.reader.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	size := 2 + int(binary.BigEndian.Uint16(header))
+	frame, err := c.reader.Peek(size)
+	if err != nil {
+		return nil, err
+	}
+	c.reader.Discard(size)
+	return frame[2:], nil
+}
+
+func (c *tcpStreamConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	data, err := c.readFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	// A buffer too small for the datagram gets the start of it, as with UDP
+	return copy(b, data), c.remote, nil
+}
+
+func (c *tcpStreamConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *tcpStreamConn) Write(b []byte) (int, error) {
+	if len(b) > maxFrameSize {
+		return 0, c.opError("write", fmt.Errorf("datagram of %d bytes is larger than the max of %d", len(b), maxFrameSize))
+	}
+	frame := make([]byte, 2 + len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	// Frames of concurrent writes must not be interleaved
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if _, err := c.conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Writes to the remote address, which is the only address a TCP connection can reach
+func (c *tcpStreamConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *tcpStreamConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *tcpStreamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *tcpStreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *tcpStreamConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *tcpStreamConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *tcpStreamConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// Listening TCP socket, which receives the frames of every connection accepted from a client as datagrams
+// streams: the connection of every client, by its address
+// deadlineChanged: closed and replaced whenever a read deadline is set, so blocked reads pick up the new deadline
+type tcpListenerConn struct {
+	listener		*net.TCPListener
+	local			*net.UDPAddr
+	queue			chan datagram
+	mutex			sync.Mutex
+	streams			map[string]*tcpStreamConn
+	readDeadline	time.Time
+	writeDeadline	time.Time
+	deadlineChanged	chan struct{}
+	closed			chan struct{}
+	closeOnce		sync.Once
+}
+
+// Returns the error of an operation on the socket as a *net.OpError, like the errors of a *net.TCPConn
+func (l *tcpListenerConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: l.local, Addr: addr, Err: err}
+}
+
+// Accepts connections from clients until the socket is closed
+func (l *tcpListenerConn) accept() {
+	for {
+		conn, err := l.listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		stream := newTCPStreamConn(conn)
+		l.mutex.Lock()
+		select {
+		case <-l.closed:
+			l.mutex.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		l.streams[stream.remote.String()] = stream
+		l.mutex.Unlock()
+		go l.receive(stream)
+	}
+}
+
+// Queues the frames of a client's connection as datagrams until the client closes it or the socket is closed
+// A full queue holds up reading from the connection instead of dropping frames, so TCP slows the client down
+func (l *tcpListenerConn) receive(stream *tcpStreamConn) {
+	defer func() {
+		// A new connection from the same address may have taken the stream's place, and must be left in it
+		key := stream.remote.String()
+		l.mutex.Lock()
+		if l.streams[key] == stream {
+			delete(l.streams, key)
+		}
+		l.mutex.Unlock()
+		stream.Close()
+	}()
+	for {
+		data, err := stream.readFrame()
+		if err != nil {
+			return
+		}
+		select {
+		case l.queue <- datagram{from: stream.remote, data: append([]byte(nil), data...)}:
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *tcpListenerConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err, done := l.readOnce(b)
+		if done {
+			return n, addr, err
+		}
+	}
+}
+
+// Waits for a datagram until the read deadline
+// Returns whether the read is done, which it is not if the deadline changed
+func (l *tcpListenerConn) readOnce(b []byte) (int, net.Addr, error, bool) {
+	l.mutex.Lock()
+	deadline, deadlineChanged := l.readDeadline, l.deadlineChanged
+	l.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, nil, l.opError("read", nil, timeoutError{}), true
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case received := <-l.queue:
+		return copy(b, received.data), received.from, nil, true
+	case <-l.closed:
+		return 0, nil, l.opError("read", nil, errClosed), true
+	case <-timeout:
+		return 0, nil, l.opError("read", nil, timeoutError{}), true
+	case <-deadlineChanged:
+		return 0, nil, nil, false
+	}
+}
+
+func (l *tcpListenerConn) Read(b []byte) (int, error) {
+	n, _, err := l.ReadFrom(b)
+	return n, err
+}
+
+// Sends a datagram over the connection of the client with the address, by the socket's write deadline
+func (l *tcpListenerConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.mutex.Lock()
+	stream := l.streams[addr.String()]
+	deadline := l.writeDeadline
+	l.mutex.Unlock()
+	if stream == nil {
+		return 0, l.opError("write", addr, errors.New("no connection from the address"))
+	}
+	stream.SetWriteDeadline(deadline)
+	return stream.Write(b)
+}
+
+func (l *tcpListenerConn) Write(b []byte) (int, error) {
+	return 0, l.opError("write", nil, errors.New("destination address required"))
+}
+
+// Stops accepting connections and closes the connection of every client
+func (l *tcpListenerConn) Close() error {
+	err := l.opError("close", nil, errClosed)
+	l.closeOnce.Do(func() {
+		err = l.listener.Close()
+		l.mutex.Lock()
+		close(l.closed)
+		for _, stream := range l.streams {
+			stream.Close()
+		}
+		l.mutex.Unlock()
+	})
+	return err
+}
+
+func (l *tcpListenerConn) LocalAddr() net.Addr {
+	return l.local
+}
+
+// A listening socket is not connected to any one address
+func (l *tcpListenerConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (l *tcpListenerConn) SetDeadline(t time.Time) error {
+	l.SetWriteDeadline(t)
+	return l.SetReadDeadline(t)
+}
+
+func (l *tcpListenerConn) SetReadDeadline(t time.Time) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.readDeadline = t
+	close(l.deadlineChanged)
+	l.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (l *tcpListenerConn) SetWriteDeadline(t time.Time) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.writeDeadline = t
+	return nil
+}
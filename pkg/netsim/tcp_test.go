@@ -0,0 +1,174 @@
+package netsim
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Every client's datagrams reach the listening socket whole and in order, and are sent back over the client's own connection
+func TestTCPReflect(t *testing.T) {
+	server, err := TCP.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, ok := server.LocalAddr().(*net.UDPAddr); !ok {
+		t.Fatalf("listening socket has address %T, want a UDP address", server.LocalAddr())
+	}
+
+	// Reflect every datagram back to where it came from
+	go func() {
+		buffer := make([]byte, maxFrameSize)
+		for {
+			n, from, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buffer[:n], from)
+		}
+	}()
+
+	var clients []PacketConn
+	for i := 0; i < 2; i++ {
+		client, err := TCP.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	for i := 0; i < 100; i++ {
+		for c, client := range clients {
+			if _, err := client.Write([]byte(fmt.Sprintf("%d:%d:%s", c, i, strings.Repeat("x", i * 10)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	buffer := make([]byte, maxFrameSize)
+	for c, client := range clients {
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for i := 0; i < 100; i++ {
+			n, err := client.Read(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("%d:%d:%s", c, i, strings.Repeat("x", i * 10)); string(buffer[:n]) != want {
+				t.Fatalf("client %d got %q as datagram %d", c, buffer[:n], i)
+			}
+		}
+	}
+	if _, err := clients[0].Write(make([]byte, maxFrameSize + 1)); err == nil {
+		t.Fatal("wrote a datagram too large for a frame")
+	}
+}
+
+// A read that times out partway through a frame leaves the frame to be read whole once the rest of it arrives
+func TestTCPPartialFrame(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := TCP.DialUDP("udp4", nil, udpAddr(listener.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{0, 5, 'h', 'e'})
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buffer := make([]byte, 16)
+	if _, err := client.Read(buffer); err == nil || !err.(net.Error).Timeout() {
+		t.Fatalf("read of a partial frame returned %v, want a timeout", err)
+	}
+	conn.Write([]byte("llo"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := client.Read(buffer)
+	if err != nil || string(buffer[:n]) != "hello" {
+		t.Fatalf("read %q and %v once the frame arrived", buffer[:n], err)
+	}
+}
+
+// A connection that ends after a new one from the same address took its place leaves the new one in place
+func TestTCPStreamReplaced(t *testing.T) {
+	server, err := TCP.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	l := server.(*tcpListenerConn)
+
+	// Two connections outside of the listening socket, so that the receive of the old one can be run here
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var clients []net.Conn
+	var streams []*tcpStreamConn
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp4", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+		streams = append(streams, newTCPStreamConn(conn.(*net.TCPConn)))
+	}
+
+	// The second connection takes the place of the first, as if it came from the same address
+	old, replacement := streams[0], streams[1]
+	key := old.remote.String()
+	l.mutex.Lock()
+	l.streams[key] = replacement
+	l.mutex.Unlock()
+
+	clients[0].Close()
+	l.receive(old)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.streams[key] != replacement {
+		t.Fatal("the old connection removed the new one from the same address")
+	}
+}
+
+func TestTCPDeadlinesAndClose(t *testing.T) {
+	server, err := TCP.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buffer := make([]byte, 16)
+	_, _, err = server.ReadFrom(buffer)
+	if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+		t.Fatalf("read past the deadline returned %v", err)
+	}
+	if _, err := server.WriteTo(buffer, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}); err == nil {
+		t.Fatal("wrote to an address with no connection")
+	}
+
+	server.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		server.Close()
+	}()
+	_, _, err = server.ReadFrom(buffer)
+	if err == nil || !strings.Contains(err.Error(), "use of closed network connection") {
+		t.Fatalf("read on a closed socket returned %v", err)
+	}
+	if _, err := Transport("quic"); err == nil {
+		t.Fatal("unknown transport accepted")
+	}
+}
@@ -0,0 +1,647 @@
+package noise
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbopardi/udp_client_server/pkg/netsim"
+)
+
+// Type of every datagram, in its first byte
+// Initiation: the first handshake message, from a client
+// Response: the second handshake message, from the server
+// Data: a packet encrypted with the keys of a session, after the type and the packet's number (uint64) in little endian
+const (
+	typeInitiation = 1
+	typeResponse = 2
+	typeData = 3
+)
+
+// Number of bytes before the ciphertext of a data datagram
+const dataHeaderSize = 1 + 8
+
+// Number of bytes an encrypted packet is larger than the packet itself
+const Overhead = dataHeaderSize + tagSize
+
+// Size of the payload of an initiation: the rekey interval (uint64) and the time it was sent (int64) in little endian
+const initiationPayloadSize = 16
+
+// Largest number of keys a received packet can be ahead of the session by, as it has to be rekeyed to that many times
+// before knowing whether the packet is genuine
+const maxEpochSkip = 4
+
+// Size of the buffers datagrams are received into before they are decrypted
+const maxDatagramSize = 65535 + Overhead
+
+// Max difference between the time a handshake was sent at and the time it arrives, beyond which it is refused as a possible
+// replay, so a server only needs to remember the last handshake of each client for that long
+const maxInitiationAge = 5 * time.Minute
+
+// Settings of the sessions of a network
+// Key: the static key pair of this side
+// PeerKey: the static public key of the server, which a client must know ahead of time to dial it
+// Peers: the static public keys of the clients a server accepts, or nil to accept any client
+// RekeyAfter: the number of packets each direction of a session sends with a key before replacing it, which the client
+// sets for both directions of its sessions, or 0 to never rekey
+// HandshakeTimeout: how long a client waits for the server to answer a handshake before sending a new one, or 0 for 1s
+// HandshakeAttempts: the number of handshakes a client sends before giving up, or 0 for 5
+// ReplayWindow: the number of packet numbers below the highest one received that each session keeps track of, rejecting
+// a packet whose number it has seen or that is older than that, or 0 to accept every packet that decrypts
+// MaxSessions: the number of client sessions a server keeps at most, forgetting the one idle the longest to make room
+// for a new one, or 0 for 4096
+// SessionTimeout: how long a server keeps a session that no packet arrives on, or 0 for 3 minutes
+type Config struct {
+	Key					*ecdh.PrivateKey
+	PeerKey				*ecdh.PublicKey
+	Peers				[]*ecdh.PublicKey
+	RekeyAfter			uint64
+	HandshakeTimeout	time.Duration
+	HandshakeAttempts	int
+	ReplayWindow		int
+	MaxSessions			int
+	SessionTimeout		time.Duration
+}
+
+// Counters of the sessions of a network
+// Handshakes: the handshakes completed
+// Rekeys: the times a direction of a session replaced its key
+// Refused: the handshakes refused, for being invalid, sent too long ago, older than the last one of their client, or from
+// a client that is not accepted
+// Rejected: the datagrams dropped for not belonging to a session or failing to decrypt
+// Replays: the packets dropped by the replay window, for having a number already received or too old to tell
+type Stats struct {
+	Handshakes	int64
+	Rekeys		int64
+	Refused		int64
+	Rejected	int64
+	Replays		int64
+}
+
+// Logs the counters
+func (s Stats) Log() {
+	log.Printf("Noise handshakes: %d, rekeys: %d, refused handshakes: %d, rejected datagrams: %d, replays rejected: %d\n", s.Handshakes, s.Rekeys, s.Refused, s.Rejected, s.Replays)
+}
+
+// Network whose sockets encrypt every datagram with the keys of a session set up by a handshake, over the sockets of a
+// base network
+// A socket opened with DialUDP is a client, which completes a handshake with the server before it is returned, and one
+// opened with ListenUDP is a server, which answers the handshakes of any number of clients
+type Network struct {
+	base	netsim.Network
+	config	Config
+	stats	Stats
+}
+
+// Creates a network securing the sockets of the base network with the config
+func Secure(base netsim.Network, config Config) *Network {
+	if config.HandshakeTimeout <= 0 {
+		config.HandshakeTimeout = time.Second
+	}
+	if config.HandshakeAttempts <= 0 {
+		config.HandshakeAttempts = 5
+	}
+	if config.MaxSessions <= 0 {
+		config.MaxSessions = 4096
+	}
+	if config.SessionTimeout <= 0 {
+		config.SessionTimeout = 3 * time.Minute
+	}
+	return &Network{base: base, config: config}
+}
+
+// Returns the counters of the network's sessions so far
+func (n *Network) Stats() Stats {
+	return Stats{
+		Handshakes: atomic.LoadInt64(&n.stats.Handshakes),
+		Rekeys: atomic.LoadInt64(&n.stats.Rekeys),
+		Refused: atomic.LoadInt64(&n.stats.Refused),
+		Rejected: atomic.LoadInt64(&n.stats.Rejected),
+		Replays: atomic.LoadInt64(&n.stats.Replays),
+	}
+}
+
+func (n *Network) ListenUDP(network string, laddr *net.UDPAddr) (netsim.PacketConn, error) {
+	if n.config.Key == nil {
+		return nil, errors.New("missing static key")
+	}
+	conn, err := n.base.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return &serverConn{
+		PacketConn: conn,
+		network: n,
+		sessions: make(map[string]*session),
+		lastInitiation: make(map[string]int64),
+	}, nil
+}
+
+func (n *Network) DialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (netsim.PacketConn, error) {
+	if n.config.Key == nil || n.config.PeerKey == nil {
+		return nil, errors.New("missing static key or server key")
+	}
+	conn, err := n.base.DialUDP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := n.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &clientConn{PacketConn: conn, network: n, session: s}, nil
+}
+
+// Sends handshakes to the server of a connected socket until one is answered, returning the session it sets up
+func (n *Network) handshake(conn netsim.PacketConn) (*session, error) {
+	buffer := make([]byte, maxDatagramSize)
+	for attempt := 0; attempt < n.config.HandshakeAttempts; attempt++ {
+		payload := make([]byte, initiationPayloadSize)
+		binary.LittleEndian.PutUint64(payload, n.config.RekeyAfter)
+		binary.LittleEndian.PutUint64(payload[8:], uint64(time.Now().UnixNano()))
+		hs, message, err := initiate(n.config.Key, n.config.PeerKey, payload)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(append([]byte{typeInitiation}, message...)); err != nil {
+			return nil, err
+		}
+
+		// Wait for the answer to this handshake, ignoring anything else, such as the answers to earlier ones
+		conn.SetReadDeadline(time.Now().Add(n.config.HandshakeTimeout))
+		for {
+			size, err := conn.Read(buffer)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if size == 0 || buffer[0] != typeResponse {
+				continue
+			}
+			send, recv, _, err := hs.finish(buffer[1:size])
+			if err != nil {
+				continue
+			}
+			conn.SetReadDeadline(time.Time{})
+			atomic.AddInt64(&n.stats.Handshakes, 1)
+			return newSession(n, send, recv, n.config.RekeyAfter), nil
+		}
+	}
+	return nil, fmt.Errorf("no answer to %d Noise handshakes from %v", n.config.HandshakeAttempts, conn.RemoteAddr())
+}
+
+// Whether a server accepts the static key of a client
+func (n *Network) accepts(key *ecdh.PublicKey) bool {
+	if n.config.Peers == nil {
+		return true
+	}
+	for _, peer := range n.config.Peers {
+		if peer.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sliding window of the packet numbers a session received, as IPsec keeps (RFC 6479), with a bit for each number in
+// words used round robin
+// The word of the highest number received may share its slot with the oldest one, so only the numbers of the other
+// words are kept track of
+// next: one more than the highest number received, or 0 if none was
+type replayWindow struct {
+	bits	[]uint64
+	next	uint64
+}
+
+// Creates a window of at least size numbers
+func newReplayWindow(size int) *replayWindow {
+	return &replayWindow{bits: make([]uint64, (size + 63) / 64 + 1)}
+}
+
+// Returns the number of packet numbers the window keeps track of
+func (w *replayWindow) size() uint64 {
+	return uint64(len(w.bits) - 1) * 64
+}
+
+// Whether a packet number was already received, or is too far below the highest one received to tell
+func (w *replayWindow) seen(n uint64) bool {
+	if n >= w.next {
+		return false
+	}
+	if w.next - 1 - n > w.size() {
+		return true
+	}
+	return w.bits[n / 64 % uint64(len(w.bits))] & (1 << (n % 64)) != 0
+}
+
+// Records a packet number as received, sliding the window up to it if it is the highest one yet
+func (w *replayWindow) mark(n uint64) {
+	if n >= w.next {
+		// The words of the numbers the window slides past are reused for the numbers it slides onto, so clear them
+		// The word holding the highest number so far is kept, as it still holds numbers below it
+		first := w.next / 64
+		if w.next % 64 != 0 {
+			first++
+		}
+		for word := first; word <= n / 64 && word < first + uint64(len(w.bits)); word++ {
+			w.bits[word % uint64(len(w.bits))] = 0
+		}
+		w.next = n + 1
+	}
+	w.bits[n / 64 % uint64(len(w.bits))] |= 1 << (n % 64)
+}
+
+// Keys of one direction of a session, replaced every rekeyAfter packets
+// epoch: the number of times the key was replaced, which is the number of the packet divided by rekeyAfter
+// previous: the key before the current one, which a receiver keeps for packets that arrive late
+// next: the number of the next packet to send
+// replays: the numbers a receiver received, if it rejects replays
+type keyChain struct {
+	mutex		sync.Mutex
+	current		*cipherState
+	previous	*cipherState
+	epoch		uint64
+	next		uint64
+	replays		*replayWindow
+}
+
+// The keys a client and server share, set up by a handshake
+// active: when the session was set up or last received a packet, in nanoseconds since the Unix epoch, which a server
+// uses to forget idle sessions
+type session struct {
+	network		*Network
+	send		keyChain
+	recv		keyChain
+	rekeyAfter	uint64
+	active		int64
+}
+
+// Creates a session with the keys of a handshake
+func newSession(network *Network, send *cipherState, recv *cipherState, rekeyAfter uint64) *session {
+	s := &session{network: network, rekeyAfter: rekeyAfter, active: time.Now().UnixNano()}
+	s.send.current = send
+	s.recv.current = recv
+	if network.config.ReplayWindow > 0 {
+		s.recv.replays = newReplayWindow(network.config.ReplayWindow)
+	}
+	return s
+}
+
+// Returns the number of times the keys are replaced before the packet with a number is sent
+func (s *session) epoch(n uint64) uint64 {
+	if s.rekeyAfter == 0 {
+		return 0
+	}
+	return n / s.rekeyAfter
+}
+
+// Returns a packet as a data datagram, encrypted with the key of the next packet number
+func (s *session) seal(packet []byte) []byte {
+	s.send.mutex.Lock()
+	defer s.send.mutex.Unlock()
+	n := s.send.next
+	s.send.next++
+	for epoch := s.epoch(n); s.send.epoch < epoch; s.send.epoch++ {
+		s.send.current = s.send.current.rekey()
+		atomic.AddInt64(&s.network.stats.Rekeys, 1)
+	}
+	datagram := make([]byte, dataHeaderSize, dataHeaderSize + len(packet) + tagSize)
+	datagram[0] = typeData
+	binary.LittleEndian.PutUint64(datagram[1:], n)
+	return s.send.current.seal(datagram, n, datagram[:dataHeaderSize], packet)
+}
+
+// Error of a packet rejected by the replay window
+var errReplay = errors.New("packet number was already received or is too old")
+
+// Decrypts a data datagram in place, returning its packet
+// A packet is only recorded in the replay window once it decrypts, so forged numbers cannot slide the window
+func (s *session) open(datagram []byte) ([]byte, error) {
+	if len(datagram) < dataHeaderSize + tagSize || datagram[0] != typeData {
+		return nil, errors.New("not a data datagram")
+	}
+	n := binary.LittleEndian.Uint64(datagram[1:])
+
+	s.recv.mutex.Lock()
+	defer s.recv.mutex.Unlock()
+	if s.recv.replays != nil && s.recv.replays.seen(n) {
+		atomic.AddInt64(&s.network.stats.Replays, 1)
+		return nil, errReplay
+	}
+	packet, err := s.decrypt(n, datagram[:dataHeaderSize], datagram[dataHeaderSize:])
+	if err == nil && s.recv.replays != nil {
+		s.recv.replays.mark(n)
+	}
+	return packet, err
+}
+
+// Decrypts the ciphertext of a packet in place with the key of its number, which the receive lock must be held for
+// A packet up to maxEpochSkip keys ahead moves the session on to its key once it decrypts with it
+func (s *session) decrypt(n uint64, header []byte, ciphertext []byte) ([]byte, error) {
+	epoch := s.epoch(n)
+	switch {
+	case epoch == s.recv.epoch:
+		return s.recv.current.open(ciphertext[:0], n, header, ciphertext)
+	case epoch + 1 == s.recv.epoch && s.recv.previous != nil:
+		return s.recv.previous.open(ciphertext[:0], n, header, ciphertext)
+	case epoch > s.recv.epoch && epoch - s.recv.epoch <= maxEpochSkip:
+		previous, current := s.recv.current, s.recv.current.rekey()
+		for step := s.recv.epoch + 1; step < epoch; step++ {
+			previous, current = current, current.rekey()
+		}
+		packet, err := current.open(ciphertext[:0], n, header, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&s.network.stats.Rekeys, int64(epoch - s.recv.epoch))
+		s.recv.previous, s.recv.current, s.recv.epoch = previous, current, epoch
+		return packet, nil
+	}
+	return nil, errors.New("packet's key has expired or is too far ahead")
+}
+
+// Buffers datagrams are received into
+var bufferPool = sync.Pool{New: func() interface{} {
+	buffer := make([]byte, maxDatagramSize)
+	return &buffer
+}}
+
+// Client socket, connected to a server it completed a handshake with
+type clientConn struct {
+	netsim.PacketConn
+	network	*Network
+	session	*session
+}
+
+func (c *clientConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buffer := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buffer)
+	for {
+		size, addr, err := c.PacketConn.ReadFrom(*buffer)
+		if err != nil {
+			return 0, addr, err
+		}
+		packet, err := c.session.open((*buffer)[:size])
+		if err != nil {
+			// Replays are counted apart from the datagrams that do not decrypt
+			if err != errReplay {
+				atomic.AddInt64(&c.network.stats.Rejected, 1)
+			}
+			continue
+		}
+		return copy(b, packet), addr, nil
+	}
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	if _, err := c.PacketConn.Write(c.session.seal(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *clientConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if _, err := c.PacketConn.WriteTo(c.session.seal(b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Server socket, with a session for the address of every client that completed a handshake with it
+// lastInitiation: the time the last accepted handshake of every client's static key was sent at, so a handshake
+// recorded and replayed later cannot reset its session, kept until handshakes sent then are refused for their age
+// lastSweep: when the idle sessions and old handshakes were last forgotten
+type serverConn struct {
+	netsim.PacketConn
+	network			*Network
+	mutex			sync.Mutex
+	sessions		map[string]*session
+	lastInitiation	map[string]int64
+	lastSweep		time.Time
+}
+
+// Receives the packets of the clients' sessions, answering their handshakes along the way
+func (c *serverConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buffer := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buffer)
+	for {
+		size, addr, err := c.PacketConn.ReadFrom(*buffer)
+		if err != nil {
+			return 0, addr, err
+		}
+		if size == 0 {
+			atomic.AddInt64(&c.network.stats.Rejected, 1)
+			continue
+		}
+		if (*buffer)[0] == typeInitiation {
+			c.answer((*buffer)[1:size], addr)
+			continue
+		}
+		now := time.Now()
+		c.mutex.Lock()
+		c.sweep(now)
+		s := c.sessions[addr.String()]
+		c.mutex.Unlock()
+		if s == nil {
+			atomic.AddInt64(&c.network.stats.Rejected, 1)
+			continue
+		}
+		packet, err := s.open((*buffer)[:size])
+		if err != nil {
+			// Replays are counted apart from the datagrams that do not decrypt
+			if err != errReplay {
+				atomic.AddInt64(&c.network.stats.Rejected, 1)
+			}
+			continue
+		}
+		atomic.StoreInt64(&s.active, now.UnixNano())
+		return copy(b, packet), addr, nil
+	}
+}
+
+// Forgets the sessions that no packet arrived on within the session timeout, and the handshakes too old to be accepted again,
+// at most every quarter of the session timeout; the mutex must be held
+func (c *serverConn) sweep(now time.Time) {
+	timeout := c.network.config.SessionTimeout
+	if now.Sub(c.lastSweep) < timeout / 4 {
+		return
+	}
+	c.lastSweep = now
+	idleSince := now.Add(-timeout).UnixNano()
+	for addr, s := range c.sessions {
+		if atomic.LoadInt64(&s.active) < idleSince {
+			delete(c.sessions, addr)
+		}
+	}
+	sentSince := now.Add(-maxInitiationAge).UnixNano()
+	for peer, sentAt := range c.lastInitiation {
+		if sentAt < sentSince {
+			delete(c.lastInitiation, peer)
+		}
+	}
+}
+
+// Makes room for the session and handshake of a client once the server keeps as many as it can,
+// by forgetting the session idle the longest and the handshake sent the longest ago; the mutex must be held
+func (c *serverConn) makeRoom(addr string, peer string) {
+	if _, ok := c.sessions[addr]; !ok && len(c.sessions) >= c.network.config.MaxSessions {
+		var idlest string
+		var idleSince int64
+		for addr, s := range c.sessions {
+			if active := atomic.LoadInt64(&s.active); idlest == "" || active < idleSince {
+				idlest, idleSince = addr, active
+			}
+		}
+		delete(c.sessions, idlest)
+	}
+	if _, ok := c.lastInitiation[peer]; !ok && len(c.lastInitiation) >= c.network.config.MaxSessions {
+		var oldest string
+		var oldestSentAt int64
+		for peer, sentAt := range c.lastInitiation {
+			if oldest == "" || sentAt < oldestSentAt {
+				oldest, oldestSentAt = peer, sentAt
+			}
+		}
+		delete(c.lastInitiation, oldest)
+	}
+}
+
+// Answers a client's handshake, replacing the session of its address with the one the handshake sets up
+func (c *serverConn) answer(message []byte, addr net.Addr) {
+	hs, remote, payload, err := respond(c.network.config.Key, message)
+	if err != nil || len(payload) != initiationPayloadSize || !c.network.accepts(remote) {
+		atomic.AddInt64(&c.network.stats.Refused, 1)
+		return
+	}
+	rekeyAfter := binary.LittleEndian.Uint64(payload)
+	sentAt := int64(binary.LittleEndian.Uint64(payload[8:]))
+	peer := hex.EncodeToString(remote.Bytes())
+	now := time.Now()
+	age := now.Sub(time.Unix(0, sentAt))
+	if age > maxInitiationAge || age < -maxInitiationAge {
+		atomic.AddInt64(&c.network.stats.Refused, 1)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sweep(now)
+	if sentAt <= c.lastInitiation[peer] {
+		atomic.AddInt64(&c.network.stats.Refused, 1)
+		return
+	}
+	response, send, recv, err := hs.answer(nil)
+	if err != nil {
+		atomic.AddInt64(&c.network.stats.Refused, 1)
+		return
+	}
+	if _, err := c.PacketConn.WriteTo(append([]byte{typeResponse}, response...), addr); err != nil {
+		return
+	}
+	c.makeRoom(addr.String(), peer)
+	c.lastInitiation[peer] = sentAt
+	c.sessions[addr.String()] = newSession(c.network, send, recv, rekeyAfter)
+	atomic.AddInt64(&c.network.stats.Handshakes, 1)
+}
+
+func (c *serverConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// Sends a packet to a client over its session, which it must have set up with a handshake
+func (c *serverConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	s := c.sessions[addr.String()]
+	c.mutex.Unlock()
+	if s == nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: errors.New("no Noise session with the address")}
+	}
+	if _, err := c.PacketConn.WriteTo(s.seal(b), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// A server socket is not connected, so packets must be sent to a client's address with WriteTo
+func (c *serverConn) Write(b []byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Err: errors.New("destination address required")}
+}
+
+// Returns the key pair in a file holding the private key in hex, generating one and writing it to the file if it does not exist
+func LoadOrGenerateKey(fileName string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(fileName, []byte(hex.EncodeToString(key.Bytes()) + "\n"), 0600)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Generated a new Noise key in %s\n", fileName)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Noise key in %s is not hex: %v", fileName, err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// Generates a key pair that only lasts as long as the process, for a client whose key the server does not need to know
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// Parses a public key in hex, as PublicKeyString formats it
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("Noise public key %q is not hex: %v", s, err)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// Parses a comma separated list of public keys in hex, returning nil for an empty list
+func ParsePublicKeys(s string) ([]*ecdh.PublicKey, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var keys []*ecdh.PublicKey
+	for _, field := range strings.Split(s, ",") {
+		key, err := ParsePublicKey(field)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Formats the public key of a key pair in hex, to be given to the other side
+func PublicKeyString(key *ecdh.PrivateKey) string {
+	return hex.EncodeToString(key.PublicKey().Bytes())
+}
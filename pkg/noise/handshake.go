@@ -0,0 +1,291 @@
+// Package noise secures the packets of the client and server with sessions set up by a Noise IK handshake
+// (Noise_IK_25519_AESGCM_SHA256, see https://noiseprotocol.org/noise.html), the way WireGuard secures UDP: the client
+// knows the server's static public key ahead of time, the first packets of a connection are the handshake, and every
+// packet after it is encrypted with the session's keys, which are replaced after a number of packets (rekeyed)
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Full name of the protocol, which is hashed into every handshake so both sides must agree on it
+const protocolName = "Noise_IK_25519_AESGCM_SHA256"
+
+// Prologue mixed into every handshake, so a handshake of another application using the same protocol cannot be replayed
+const prologue = "udp_client_server"
+
+// Sizes of a hash, a public key, and an authentication tag
+const hashSize = 32
+const keySize = 32
+const tagSize = 16
+
+// Size of the first handshake message before its payload: the ephemeral key and the encrypted static key
+const initiationSize = keySize + keySize + tagSize
+
+// Size of the second handshake message before its payload: the ephemeral key
+const responseSize = keySize
+
+// Key of a single direction of a session or of a step of a handshake, and the number of the next message of the handshake
+// A key is only ever used with a nonce once, as the AES-GCM nonce is the message number
+type cipherState struct {
+	aead	cipher.AEAD
+	nonce	uint64
+}
+
+// Creates the state of a key, which is used with nonces from 0
+func newCipherState(key [keySize]byte) *cipherState {
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &cipherState{aead: aead}
+}
+
+// Returns the AES-GCM nonce of a message number: 4 zero bytes followed by the number in big endian
+func gcmNonce(n uint64) []byte {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	return nonce[:]
+}
+
+// Encrypts a message with the given number, authenticating the associated data along with it
+func (cs *cipherState) seal(dst []byte, n uint64, ad []byte, plaintext []byte) []byte {
+	return cs.aead.Seal(dst, gcmNonce(n), plaintext, ad)
+}
+
+// Decrypts a message with the given number, failing if it or its associated data were tampered with
+func (cs *cipherState) open(dst []byte, n uint64, ad []byte, ciphertext []byte) ([]byte, error) {
+	return cs.aead.Open(dst, gcmNonce(n), ciphertext, ad)
+}
+
+// Returns the state of the next key, derived from this one as Noise's Rekey function does: the first 32 bytes of
+// encrypting 32 zero bytes with the largest nonce
+func (cs *cipherState) rekey() *cipherState {
+	var next [keySize]byte
+	copy(next[:], cs.seal(nil, math.MaxUint64, nil, make([]byte, keySize)))
+	return newCipherState(next)
+}
+
+// Derives two keys from a chaining key and input key material with HKDF (RFC 5869) over HMAC-SHA256
+func hkdf(chainingKey []byte, input []byte) ([hashSize]byte, [hashSize]byte) {
+	mac := hmac.New(sha256.New, chainingKey)
+	mac.Write(input)
+	temp := mac.Sum(nil)
+
+	var out1, out2 [hashSize]byte
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	copy(out1[:], mac.Sum(nil))
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1[:])
+	mac.Write([]byte{2})
+	copy(out2[:], mac.Sum(nil))
+	return out1, out2
+}
+
+// State hashed over the whole handshake: the chaining key the session keys are derived from, the hash of everything
+// sent so far, which every encrypted message authenticates, and the current key, if the handshake has one yet
+type symmetricState struct {
+	chainingKey	[hashSize]byte
+	hash		[hashSize]byte
+	cipher		*cipherState
+}
+
+// Starts the state of a handshake of the protocol with the prologue
+func newSymmetricState() *symmetricState {
+	s := &symmetricState{}
+	// A protocol name no longer than a hash is used as is, padded with zeros
+	copy(s.hash[:], protocolName)
+	s.chainingKey = s.hash
+	s.mixHash([]byte(prologue))
+	return s
+}
+
+// Mixes data into the handshake hash
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.hash[:])
+	h.Write(data)
+	copy(s.hash[:], h.Sum(nil))
+}
+
+// Mixes the result of a Diffie-Hellman into the chaining key, and starts using the key derived along with it
+func (s *symmetricState) mixKey(input []byte) {
+	var key [keySize]byte
+	s.chainingKey, key = hkdf(s.chainingKey[:], input)
+	s.cipher = newCipherState(key)
+}
+
+// Encrypts data with the current key, authenticating the handshake hash, and mixes the ciphertext into the hash
+func (s *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := s.cipher.seal(nil, s.cipher.nonce, s.hash[:], plaintext)
+	s.cipher.nonce++
+	s.mixHash(ciphertext)
+	return ciphertext
+}
+
+// Decrypts data with the current key, authenticating the handshake hash, and mixes the ciphertext into the hash
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.cipher.open(nil, s.cipher.nonce, s.hash[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.cipher.nonce++
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// Derives the keys of the session once the handshake is done: the first for messages from the initiator, the second for
+// messages from the responder
+func (s *symmetricState) split() (*cipherState, *cipherState) {
+	initiatorKey, responderKey := hkdf(s.chainingKey[:], nil)
+	return newCipherState(initiatorKey), newCipherState(responderKey)
+}
+
+// Returns the shared secret of a private and a public key
+func dh(private *ecdh.PrivateKey, public *ecdh.PublicKey) ([]byte, error) {
+	return private.ECDH(public)
+}
+
+// Handshake of the initiator (the client), which already knows the responder's static public key
+// ephemeral: the key pair generated for this handshake alone, which gives the session forward secrecy
+type initiatorHandshake struct {
+	state		*symmetricState
+	static		*ecdh.PrivateKey
+	remote		*ecdh.PublicKey
+	ephemeral	*ecdh.PrivateKey
+}
+
+// Returns the first message of a handshake with the responder, carrying the initiator's static key and the payload:
+// -> e, es, s, ss
+func initiate(static *ecdh.PrivateKey, remote *ecdh.PublicKey, payload []byte) (*initiatorHandshake, []byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	hs := &initiatorHandshake{state: newSymmetricState(), static: static, remote: remote, ephemeral: ephemeral}
+	hs.state.mixHash(remote.Bytes())
+
+	message := append([]byte(nil), ephemeral.PublicKey().Bytes()...)
+	hs.state.mixHash(ephemeral.PublicKey().Bytes())
+	secret, err := dh(ephemeral, remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.state.mixKey(secret)
+	message = append(message, hs.state.encryptAndHash(static.PublicKey().Bytes())...)
+	secret, err = dh(static, remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.state.mixKey(secret)
+	message = append(message, hs.state.encryptAndHash(payload)...)
+	return hs, message, nil
+}
+
+// Reads the responder's answer to the first message, returning the keys to send and receive with and its payload:
+// <- e, ee, se
+func (hs *initiatorHandshake) finish(message []byte) (*cipherState, *cipherState, []byte, error) {
+	if len(message) < responseSize + tagSize {
+		return nil, nil, nil, errors.New("handshake response is too short")
+	}
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(message[:keySize])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	state := *hs.state
+	state.mixHash(remoteEphemeral.Bytes())
+	secret, err := dh(hs.ephemeral, remoteEphemeral)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	state.mixKey(secret)
+	secret, err = dh(hs.static, remoteEphemeral)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	state.mixKey(secret)
+	payload, err := state.decryptAndHash(message[keySize:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	send, recv := state.split()
+	return send, recv, payload, nil
+}
+
+// Handshake of the responder (the server), which learns the initiator's static key from the first message
+type responderHandshake struct {
+	state			*symmetricState
+	remoteStatic	*ecdh.PublicKey
+	remoteEphemeral	*ecdh.PublicKey
+}
+
+// Reads the first message of a handshake as the responder, returning the initiator's static key and payload:
+// <- e, es, s, ss
+func respond(static *ecdh.PrivateKey, message []byte) (*responderHandshake, *ecdh.PublicKey, []byte, error) {
+	if len(message) < initiationSize + tagSize {
+		return nil, nil, nil, errors.New("handshake initiation is too short")
+	}
+	hs := &responderHandshake{state: newSymmetricState()}
+	hs.state.mixHash(static.PublicKey().Bytes())
+
+	var err error
+	hs.remoteEphemeral, err = ecdh.X25519().NewPublicKey(message[:keySize])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hs.state.mixHash(hs.remoteEphemeral.Bytes())
+	secret, err := dh(static, hs.remoteEphemeral)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hs.state.mixKey(secret)
+	remoteStatic, err := hs.state.decryptAndHash(message[keySize:initiationSize])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hs.remoteStatic, err = ecdh.X25519().NewPublicKey(remoteStatic)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	secret, err = dh(static, hs.remoteStatic)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hs.state.mixKey(secret)
+	payload, err := hs.state.decryptAndHash(message[initiationSize:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return hs, hs.remoteStatic, payload, nil
+}
+
+// Answers the first message with the payload, returning the answer and the keys to send and receive with:
+// -> e, ee, se
+func (hs *responderHandshake) answer(payload []byte) ([]byte, *cipherState, *cipherState, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	message := append([]byte(nil), ephemeral.PublicKey().Bytes()...)
+	hs.state.mixHash(ephemeral.PublicKey().Bytes())
+	secret, err := dh(ephemeral, hs.remoteEphemeral)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hs.state.mixKey(secret)
+	secret, err = dh(ephemeral, hs.remoteStatic)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hs.state.mixKey(secret)
+	message = append(message, hs.state.encryptAndHash(payload)...)
+	recv, send := hs.state.split()
+	return message, send, recv, nil
+}
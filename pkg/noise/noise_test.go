@@ -0,0 +1,369 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nbopardi/udp_client_server/pkg/netsim"
+)
+
+// Generates a key pair, failing the test if it cannot
+func generate(t testing.TB) *ecdh.PrivateKey {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Both sides of a handshake end up with the same keys, in opposite directions, and the server learns the client's key
+func TestHandshake(t *testing.T) {
+	client, server := generate(t), generate(t)
+	hs, initiation, err := initiate(client, server.PublicKey(), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(initiation) != initiationSize + len("hello") + tagSize {
+		t.Fatalf("initiation is %d bytes", len(initiation))
+	}
+
+	// Any change to the initiation, or the wrong server, makes it fail
+	tampered := append([]byte(nil), initiation...)
+	tampered[len(tampered) - 1] ^= 1
+	if _, _, _, err := respond(server, tampered); err == nil {
+		t.Fatal("tampered initiation accepted")
+	}
+	if _, _, _, err := respond(generate(t), initiation); err == nil {
+		t.Fatal("initiation for another server accepted")
+	}
+
+	rs, remote, payload, err := respond(server, initiation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !remote.Equal(client.PublicKey()) || string(payload) != "hello" {
+		t.Fatalf("server got key %x and payload %q", remote.Bytes(), payload)
+	}
+	response, serverSend, serverRecv, err := rs.answer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSend, clientRecv, _, err := hs.finish(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range [][2]*cipherState{{clientSend, serverRecv}, {serverSend, clientRecv}} {
+		sealed := pair[0].seal(nil, 7, []byte("ad"), []byte("packet"))
+		if opened, err := pair[1].open(nil, 7, []byte("ad"), sealed); err != nil || string(opened) != "packet" {
+			t.Fatalf("opened %q with %v", opened, err)
+		}
+	}
+	if sealed := clientSend.seal(nil, 0, nil, []byte("packet")); bytes.Equal(sealed, serverSend.seal(nil, 0, nil, []byte("packet"))) {
+		t.Fatal("both directions use the same key")
+	}
+}
+
+// Returns the two ends of a session, as a client and server would have after a handshake
+func sessionPair(t *testing.T, network *Network, rekeyAfter uint64) (*session, *session) {
+	client, server := generate(t), generate(t)
+	hs, initiation, _ := initiate(client, server.PublicKey(), nil)
+	rs, _, _, err := respond(server, initiation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, serverSend, serverRecv, _ := rs.answer(nil)
+	clientSend, clientRecv, _, err := hs.finish(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSession(network, clientSend, clientRecv, rekeyAfter), newSession(network, serverSend, serverRecv, rekeyAfter)
+}
+
+// Packets decrypt across rekeys even when they arrive out of order around them, but not once their key is too old or too
+// far ahead
+func TestRekey(t *testing.T) {
+	network := Secure(netsim.UDP, Config{})
+	client, server := sessionPair(t, network, 10)
+	var datagrams [][]byte
+	for i := 0; i < 100; i++ {
+		datagrams = append(datagrams, client.seal([]byte(fmt.Sprintf("packet %d", i))))
+	}
+	if rekeys := network.Stats().Rekeys; rekeys != 9 {
+		t.Fatalf("sender rekeyed %d times for 100 packets, want 9", rekeys)
+	}
+
+	// Swap the packets on either side of every rekey
+	for i := 10; i < 100; i += 10 {
+		datagrams[i - 1], datagrams[i] = datagrams[i], datagrams[i - 1]
+	}
+	for i, datagram := range datagrams {
+		packet, err := server.open(append([]byte(nil), datagram...))
+		if err != nil {
+			t.Fatalf("datagram %d did not decrypt: %v", i, err)
+		}
+		n := binary.LittleEndian.Uint64(datagram[1:])
+		if string(packet) != fmt.Sprintf("packet %d", n) {
+			t.Fatalf("datagram %d decrypted to %q", i, packet)
+		}
+	}
+	if rekeys := network.Stats().Rekeys; rekeys != 18 {
+		t.Fatalf("sender and receiver rekeyed %d times, want 18", rekeys)
+	}
+
+	if _, err := server.open(append([]byte(nil), datagrams[75]...)); err == nil {
+		t.Fatal("packet with an expired key decrypted")
+	}
+	for i := 0; i < 60; i++ {
+		client.seal(nil)
+	}
+	if _, err := server.open(client.seal([]byte("far ahead"))); err == nil {
+		t.Fatal("packet 6 keys ahead decrypted")
+	}
+	tampered := client.seal([]byte("tampered"))
+	tampered[1]++
+	if _, err := server.open(tampered); err == nil {
+		t.Fatal("packet with a changed number decrypted")
+	}
+}
+
+// Opens a secured server on the simulated network that reflects every packet back to its client
+func reflector(t *testing.T, sim *netsim.Sim, config Config) (*Network, netsim.PacketConn) {
+	network := Secure(sim, config)
+	conn, err := network.ListenUDP("udp4", &net.UDPAddr{Port: 40000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buffer[:n], from)
+		}
+	}()
+	return network, conn
+}
+
+// A client completes a handshake through loss, and exchanges packets with the server over its session
+func TestSecureNetwork(t *testing.T) {
+	sim := netsim.NewSim(netsim.Config{Loss: 0.2, Seed: 3})
+	defer sim.Close()
+	clientKey, serverKey := generate(t), generate(t)
+	serverNetwork, server := reflector(t, sim, Config{Key: serverKey, Peers: []*ecdh.PublicKey{clientKey.PublicKey()}})
+	defer server.Close()
+
+	clientNetwork := Secure(sim, Config{Key: clientKey, PeerKey: serverKey.PublicKey(), RekeyAfter: 16, HandshakeTimeout: 50 * time.Millisecond, HandshakeAttempts: 20})
+	client, err := clientNetwork.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 200; i++ {
+		if _, err := client.Write([]byte(fmt.Sprintf("packet %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buffer := make([]byte, 64)
+	received := 0
+	for {
+		n, err := client.Read(buffer)
+		if err != nil {
+			break
+		}
+		if !bytes.HasPrefix(buffer[:n], []byte("packet ")) {
+			t.Fatalf("received %q", buffer[:n])
+		}
+		received++
+	}
+	// Each packet crosses the network twice, so about 64% of them make it back
+	if received < 90 || received > 170 {
+		t.Fatalf("received %d of 200 packets", received)
+	}
+	if stats := serverNetwork.Stats(); stats.Handshakes < 1 || stats.Rekeys == 0 || stats.Rejected != 0 {
+		t.Fatalf("server counted %+v", stats)
+	}
+	if stats := clientNetwork.Stats(); stats.Handshakes != 1 || stats.Rekeys == 0 {
+		t.Fatalf("client counted %+v", stats)
+	}
+}
+
+// Clients whose key is not accepted, replayed handshakes, and packets outside a session are all turned away
+func TestSecureNetworkRefusals(t *testing.T) {
+	sim := netsim.NewSim(netsim.Config{})
+	defer sim.Close()
+	clientKey, serverKey := generate(t), generate(t)
+	serverNetwork, server := reflector(t, sim, Config{Key: serverKey, Peers: []*ecdh.PublicKey{clientKey.PublicKey()}})
+	defer server.Close()
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+
+	stranger := Secure(sim, Config{Key: generate(t), PeerKey: serverKey.PublicKey(), HandshakeTimeout: 20 * time.Millisecond, HandshakeAttempts: 2})
+	if _, err := stranger.DialUDP("udp4", nil, serverAddr); err == nil {
+		t.Fatal("client with a key the server does not accept completed a handshake")
+	}
+	if refused := serverNetwork.Stats().Refused; refused != 2 {
+		t.Fatalf("server refused %d handshakes, want 2", refused)
+	}
+
+	// Send the same handshake twice from a raw socket, as an attacker replaying a recording of it would
+	raw, err := sim.DialUDP("udp4", nil, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	payload := make([]byte, initiationPayloadSize)
+	binary.LittleEndian.PutUint64(payload[8:], uint64(time.Now().UnixNano()))
+	_, initiation, _ := initiate(clientKey, serverKey.PublicKey(), payload)
+	for i := 0; i < 2; i++ {
+		raw.Write(append([]byte{typeInitiation}, initiation...))
+	}
+	raw.Write([]byte{typeData, 1, 2, 3})
+	time.Sleep(50 * time.Millisecond)
+	if stats := serverNetwork.Stats(); stats.Handshakes != 1 || stats.Refused != 3 || stats.Rejected != 1 {
+		t.Fatalf("server counted %+v after a replayed handshake and a bad packet", stats)
+	}
+}
+
+// The window accepts every number once, in any order within it, and rejects numbers too far below the highest one
+func TestReplayWindow(t *testing.T) {
+	w := newReplayWindow(128)
+	if w.size() != 128 {
+		t.Fatalf("window of 128 keeps track of %d numbers", w.size())
+	}
+	accept := func(n uint64, want bool) {
+		t.Helper()
+		if seen := w.seen(n); seen == want {
+			t.Fatalf("number %d seen: %t, want %t", n, seen, !want)
+		}
+		if want {
+			w.mark(n)
+		}
+	}
+	for n := uint64(0); n < 10; n++ {
+		accept(n, true)
+	}
+	accept(5, false)
+	accept(20, true)
+	accept(15, true)
+	accept(15, false)
+	accept(20, false)
+
+	// Sliding the window far ahead forgets the numbers it slid past, without taking them for received
+	accept(1000, true)
+	accept(1000 - 128, true)
+	accept(1000 - 129, false)
+	accept(999, true)
+	accept(15, false)
+	for n := uint64(1001); n < 1300; n += 7 {
+		accept(n, true)
+		accept(n - 3, true)
+	}
+	accept(1295, false)
+	accept(1296, true)
+}
+
+// A data datagram sent twice, or one older than the window, is only reflected once and counted as a replay
+func TestSecureNetworkReplays(t *testing.T) {
+	sim := netsim.NewSim(netsim.Config{})
+	defer sim.Close()
+	clientKey, serverKey := generate(t), generate(t)
+	serverNetwork, server := reflector(t, sim, Config{Key: serverKey, ReplayWindow: 64})
+	defer server.Close()
+
+	clientNetwork := Secure(sim, Config{Key: clientKey, PeerKey: serverKey.PublicKey(), HandshakeTimeout: 50 * time.Millisecond})
+	conn, err := clientNetwork.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := conn.(*clientConn)
+
+	// Send each datagram from below the session, so the same one can be sent again
+	old := client.session.seal([]byte("old"))
+	duplicated := client.session.seal([]byte("duplicated"))
+	for i := 0; i < 3; i++ {
+		client.PacketConn.Write(duplicated)
+	}
+	for i := 0; i < 200; i++ {
+		client.session.seal(nil)
+	}
+	client.PacketConn.Write(client.session.seal([]byte("latest")))
+	client.PacketConn.Write(old)
+
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buffer := make([]byte, 64)
+	var received []string
+	for {
+		n, err := client.Read(buffer)
+		if err != nil {
+			break
+		}
+		received = append(received, string(buffer[:n]))
+	}
+	if len(received) != 2 || received[0] != "duplicated" || received[1] != "latest" {
+		t.Fatalf("received %q back", received)
+	}
+	if stats := serverNetwork.Stats(); stats.Replays != 3 || stats.Rejected != 0 {
+		t.Fatalf("server counted %+v", stats)
+	}
+	if stats := clientNetwork.Stats(); stats.Replays != 0 {
+		t.Fatalf("client without a window counted %+v", stats)
+	}
+}
+
+// A server keeps at most MaxSessions sessions and handshakes, forgets the sessions that go idle, and refuses handshakes
+// sent too long ago to still remember them
+func TestServerSessionLimits(t *testing.T) {
+	sim := netsim.NewSim(netsim.Config{})
+	defer sim.Close()
+	serverKey := generate(t)
+	serverNetwork, server := reflector(t, sim, Config{Key: serverKey, MaxSessions: 2, SessionTimeout: 200 * time.Millisecond})
+	defer server.Close()
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+	counts := func() (int, int) {
+		conn := server.(*serverConn)
+		conn.mutex.Lock()
+		defer conn.mutex.Unlock()
+		return len(conn.sessions), len(conn.lastInitiation)
+	}
+
+	for i := 0; i < 3; i++ {
+		client, err := Secure(sim, Config{Key: generate(t), PeerKey: serverKey.PublicKey(), HandshakeTimeout: 50 * time.Millisecond}).DialUDP("udp4", nil, serverAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+	if sessions, handshakes := counts(); sessions != 2 || handshakes != 2 {
+		t.Fatalf("server kept %d sessions and %d handshakes, want 2 of each", sessions, handshakes)
+	}
+
+	raw, err := sim.DialUDP("udp4", nil, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	payload := make([]byte, initiationPayloadSize)
+	binary.LittleEndian.PutUint64(payload[8:], uint64(time.Now().Add(-2 * maxInitiationAge).UnixNano()))
+	_, initiation, _ := initiate(generate(t), serverKey.PublicKey(), payload)
+	raw.Write(append([]byte{typeInitiation}, initiation...))
+
+	// Any datagram arriving once the sessions went idle has them forgotten
+	time.Sleep(300 * time.Millisecond)
+	raw.Write([]byte{typeData, 1, 2, 3})
+	time.Sleep(50 * time.Millisecond)
+	if sessions, _ := counts(); sessions != 0 {
+		t.Fatalf("server kept %d idle sessions", sessions)
+	}
+	if stats := serverNetwork.Stats(); stats.Handshakes != 3 || stats.Refused != 1 {
+		t.Fatalf("server counted %+v after a handshake sent too long ago", stats)
+	}
+}
@@ -0,0 +1,267 @@
+// Package pb holds Go types for the protobuf messages of hash.proto and packet.proto, so Go programs can speak the same
+// encoding as tools in other languages that generate their types from the .proto files
+// The types are written against the protobuf wire format, and their tests check them against the .proto files
+package pb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protobuf wire types used by the messages
+const (
+	wireVarint = 0
+	wireFixed64 = 1
+	wireBytes = 2
+	wireFixed32 = 5
+)
+
+// A hash.HashRequest: the payload to hash, and the hash algorithm (i.e. sha256), or empty for the backend's default
+type HashRequest struct {
+	Payload	[]byte
+	Algo	string
+}
+
+// A hash.HashResponse: the hash of a single payload
+type HashResponse struct {
+	Hash	[]byte
+}
+
+// A hash.HashStreamResponse: the hashes of every payload of a stream or batch, in order
+type HashStreamResponse struct {
+	Hashes	[][]byte
+}
+
+// A hash.HashBatchRequest: the payloads of a batch, hashed with a single processing delay
+type HashBatchRequest struct {
+	Payloads	[][]byte
+}
+
+// A packet.PacketHeader: the fields of the fixed header at the start of each packet, for tools that record packets
+// Timestamp: the send time in nanoseconds since the Unix epoch
+type PacketHeader struct {
+	Flags		uint32
+	ConnID		uint32
+	Seq			uint64
+	Timestamp	int64
+}
+
+// A packet.PacketMetadata: the extension area a client can put after the header of a packet
+// RequestID: the correlation ID the server sends the HTTP backend with the packet's hash request, instead of its own
+type PacketMetadata struct {
+	RequestID	string
+}
+
+// Encodes the message in the protobuf wire format
+func (m *HashRequest) Marshal() []byte {
+	message := appendBytesField(nil, 1, m.Payload)
+	return appendBytesField(message, 2, []byte(m.Algo))
+}
+
+// Decodes the message from the protobuf wire format, skipping unknown fields
+func (m *HashRequest) Unmarshal(message []byte) error {
+	*m = HashRequest{}
+	return walkFields(message, func(field uint64, wireType uint64, _ uint64, value []byte) error {
+		switch field {
+		case 1:
+			m.Payload = value
+		case 2:
+			m.Algo = string(value)
+		default:
+			return nil
+		}
+		return expectWireType(field, wireType, wireBytes)
+	})
+}
+
+// Encodes the message in the protobuf wire format
+func (m *HashResponse) Marshal() []byte {
+	return appendBytesField(nil, 1, m.Hash)
+}
+
+// Decodes the message from the protobuf wire format, skipping unknown fields
+func (m *HashResponse) Unmarshal(message []byte) error {
+	*m = HashResponse{}
+	return walkFields(message, func(field uint64, wireType uint64, _ uint64, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		m.Hash = value
+		return expectWireType(field, wireType, wireBytes)
+	})
+}
+
+// Encodes the message in the protobuf wire format
+func (m *HashStreamResponse) Marshal() []byte {
+	return appendRepeatedBytes(nil, 1, m.Hashes)
+}
+
+// Decodes the message from the protobuf wire format, skipping unknown fields
+func (m *HashStreamResponse) Unmarshal(message []byte) error {
+	*m = HashStreamResponse{}
+	return walkFields(message, func(field uint64, wireType uint64, _ uint64, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		m.Hashes = append(m.Hashes, value)
+		return expectWireType(field, wireType, wireBytes)
+	})
+}
+
+// Encodes the message in the protobuf wire format
+func (m *HashBatchRequest) Marshal() []byte {
+	return appendRepeatedBytes(nil, 1, m.Payloads)
+}
+
+// Decodes the message from the protobuf wire format, skipping unknown fields
+func (m *HashBatchRequest) Unmarshal(message []byte) error {
+	*m = HashBatchRequest{}
+	return walkFields(message, func(field uint64, wireType uint64, _ uint64, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		m.Payloads = append(m.Payloads, value)
+		return expectWireType(field, wireType, wireBytes)
+	})
+}
+
+// Encodes the message in the protobuf wire format
+func (m *PacketHeader) Marshal() []byte {
+	message := appendVarintField(nil, 1, uint64(m.Flags))
+	message = appendVarintField(message, 2, uint64(m.ConnID))
+	message = appendVarintField(message, 3, m.Seq)
+	return appendVarintField(message, 4, uint64(m.Timestamp))
+}
+
+// Decodes the message from the protobuf wire format, skipping unknown fields
+func (m *PacketHeader) Unmarshal(message []byte) error {
+	*m = PacketHeader{}
+	return walkFields(message, func(field uint64, wireType uint64, varint uint64, _ []byte) error {
+		switch field {
+		case 1:
+			m.Flags = uint32(varint)
+		case 2:
+			m.ConnID = uint32(varint)
+		case 3:
+			m.Seq = varint
+		case 4:
+			m.Timestamp = int64(varint)
+		default:
+			return nil
+		}
+		return expectWireType(field, wireType, wireVarint)
+	})
+}
+
+// Encodes the message in the protobuf wire format
+func (m *PacketMetadata) Marshal() []byte {
+	return appendBytesField(nil, 1, []byte(m.RequestID))
+}
+
+// Decodes the message from the protobuf wire format, skipping unknown fields
+func (m *PacketMetadata) Unmarshal(message []byte) error {
+	*m = PacketMetadata{}
+	return walkFields(message, func(field uint64, wireType uint64, _ uint64, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		m.RequestID = string(value)
+		return expectWireType(field, wireType, wireBytes)
+	})
+}
+
+// Appends a varint field, which proto3 leaves out when it is zero
+func appendVarintField(message []byte, field uint64, value uint64) []byte {
+	if value == 0 {
+		return message
+	}
+	message = appendVarint(message, field << 3 | wireVarint)
+	return appendVarint(message, value)
+}
+
+// Appends a length-delimited field, which proto3 leaves out when it is empty
+func appendBytesField(message []byte, field uint64, value []byte) []byte {
+	if len(value) == 0 {
+		return message
+	}
+	return appendBytes(message, field, value)
+}
+
+// Appends every value of a repeated length-delimited field, including the empty ones
+func appendRepeatedBytes(message []byte, field uint64, values [][]byte) []byte {
+	for _, value := range values {
+		message = appendBytes(message, field, value)
+	}
+	return message
+}
+
+// Appends the key, length, and value of a length-delimited field
+func appendBytes(message []byte, field uint64, value []byte) []byte {
+	message = appendVarint(message, field << 3 | wireBytes)
+	message = appendVarint(message, uint64(len(value)))
+	return append(message, value...)
+}
+
+func appendVarint(message []byte, value uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	return append(message, varint[:binary.PutUvarint(varint[:], value)]...)
+}
+
+// Returns an error if a known field was encoded with another wire type than its declared type
+func expectWireType(field uint64, wireType uint64, want uint64) error {
+	if wireType != want {
+		return fmt.Errorf("field %d has wire type %d instead of %d", field, wireType, want)
+	}
+	return nil
+}
+
+// Calls visit with the number, wire type, and value of every field of a protobuf message, stopping at the first error
+// Varint fields are passed in varint and length-delimited fields in value, which shares the memory of the message
+// Fixed-size fields are skipped, since none of the messages have them
+func walkFields(message []byte, visit func(field uint64, wireType uint64, varint uint64, value []byte) error) error {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return errors.New("malformed field key")
+		}
+		message = message[n:]
+		field, wireType := key >> 3, key & 7
+		if field == 0 {
+			return errors.New("invalid field number 0")
+		}
+		var varint uint64
+		var value []byte
+		switch wireType {
+		case wireVarint:
+			varint, n = binary.Uvarint(message)
+			if n <= 0 {
+				return errors.New("malformed varint")
+			}
+			message = message[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wireType == wireFixed32 {
+				size = 4
+			}
+			if len(message) < size {
+				return errors.New("truncated fixed field")
+			}
+			message = message[size:]
+			continue
+		case wireBytes:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || length > uint64(len(message) - n) {
+				return errors.New("truncated length-delimited field")
+			}
+			value = message[n : n + int(length)]
+			message = message[n + int(length):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wireType)
+		}
+		if err := visit(field, wireType, varint, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package pb
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Message that the hand-written types implement
+type message interface {
+	Marshal() []byte
+	Unmarshal(message []byte) error
+}
+
+// Go type of every message of the .proto files
+var messages = map[string]message{
+	"HashRequest": &HashRequest{},
+	"HashResponse": &HashResponse{},
+	"HashStreamResponse": &HashStreamResponse{},
+	"HashBatchRequest": &HashBatchRequest{},
+	"PacketHeader": &PacketHeader{},
+	"PacketMetadata": &PacketMetadata{},
+}
+
+// A field declared in a .proto file
+type protoField struct {
+	repeated	bool
+	kind		string
+	name		string
+	number		uint64
+}
+
+var (
+	messageLine = regexp.MustCompile(`^message (\w+) \{$`)
+	fieldLine = regexp.MustCompile(`^(repeated )?(\w+) (\w+) = (\d+);$`)
+)
+
+// Reads the fields of every message of a .proto file
+func parseProto(t *testing.T, fileName string) map[string][]protoField {
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fields := make(map[string][]protoField)
+	current := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if match := messageLine.FindStringSubmatch(line); match != nil {
+			current = match[1]
+			fields[current] = nil
+		} else if line == "}" {
+			current = ""
+		} else if match := fieldLine.FindStringSubmatch(line); match != nil && current != "" {
+			number, _ := strconv.ParseUint(match[4], 10, 64)
+			fields[current] = append(fields[current], protoField{match[1] != "", match[2], match[3], number})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+// Name of the Go field of a .proto field, with ID written in capitals like the rest of the module (i.e. conn_id is ConnID)
+func goFieldName(name string) string {
+	var goName strings.Builder
+	for _, word := range strings.Split(name, "_") {
+		if word == "id" {
+			goName.WriteString("ID")
+		} else {
+			goName.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return goName.String()
+}
+
+// Go type, wire type, and a non-zero sample value of each .proto type the messages use
+var protoTypes = map[string]struct {
+	goType		reflect.Type
+	wireType	uint64
+	sample		interface{}
+}{
+	"bytes": {reflect.TypeOf([]byte(nil)), wireBytes, []byte{0, 1, 2}},
+	"string": {reflect.TypeOf(""), wireBytes, "sample"},
+	"uint32": {reflect.TypeOf(uint32(0)), wireVarint, uint32(1 << 31)},
+	"uint64": {reflect.TypeOf(uint64(0)), wireVarint, uint64(1 << 63)},
+	"int64": {reflect.TypeOf(int64(0)), wireVarint, int64(-2)},
+}
+
+// The hand-written types must have exactly the fields of the .proto files, and encode each with its declared number and
+// wire type, so they keep speaking the same encoding as types generated from the .proto files
+func TestMatchesProtoFiles(t *testing.T) {
+	declared := parseProto(t, "../../hash.proto")
+	for name, fields := range parseProto(t, "../../packet.proto") {
+		declared[name] = fields
+	}
+	for name := range messages {
+		if _, ok := declared[name]; !ok {
+			t.Errorf("%s is not declared in any .proto file", name)
+		}
+	}
+
+	for name, fields := range declared {
+		m, ok := messages[name]
+		if !ok {
+			t.Errorf("message %s has no Go type", name)
+			continue
+		}
+		value := reflect.ValueOf(m).Elem()
+		if value.NumField() != len(fields) {
+			t.Errorf("%s has %d fields, but the .proto file declares %d", name, value.NumField(), len(fields))
+		}
+
+		// Fill every field, then check that each is encoded under its number with its wire type, and decodes back
+		value.Set(reflect.Zero(value.Type()))
+		for _, field := range fields {
+			protoType, ok := protoTypes[field.kind]
+			if !ok {
+				t.Fatalf("%s.%s has type %s, which the test does not know", name, field.name, field.kind)
+			}
+			goField := value.FieldByName(goFieldName(field.name))
+			want := protoType.goType
+			if field.repeated {
+				want = reflect.SliceOf(want)
+			}
+			if !goField.IsValid() || goField.Type() != want {
+				t.Errorf("%s.%s should be the Go field %s of type %v", name, field.name, goFieldName(field.name), want)
+				continue
+			}
+			sample := reflect.ValueOf(protoType.sample)
+			if field.repeated {
+				sample = reflect.Append(reflect.MakeSlice(want, 0, 2), sample, sample)
+			}
+			goField.Set(sample)
+		}
+		filled := reflect.ValueOf(m).Elem().Interface()
+
+		encoded := make(map[uint64]uint64)
+		err := walkFields(m.Marshal(), func(field uint64, wireType uint64, _ uint64, _ []byte) error {
+			encoded[field] = wireType
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, field := range fields {
+			if wireType, ok := encoded[field.number]; !ok || wireType != protoTypes[field.kind].wireType {
+				t.Errorf("%s.%s is not encoded as field %d with wire type %d", name, field.name, field.number, protoTypes[field.kind].wireType)
+			}
+		}
+		if len(encoded) != len(fields) {
+			t.Errorf("%s encodes fields %v, but the .proto file declares %d", name, encoded, len(fields))
+		}
+
+		if err := m.Unmarshal(m.Marshal()); err != nil || !reflect.DeepEqual(reflect.ValueOf(m).Elem().Interface(), filled) {
+			t.Errorf("%s decoded as %+v (%v), want %+v", name, m, err, filled)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+//go:build linux
+// +build linux
+
+package udpclient
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/nbopardi/udp_client_server/internal/protocol"
+)
+
+// Origin of an extended socket error that came from an ICMP message (i.e. SO_EE_ORIGIN_ICMP)
+const errOriginICMP = 2
+
+// Number of bytes of the kernel's extended socket error in front of the address of the node that sent the ICMP message
+const extendedErrSize = 16
+
+// Asks the kernel to queue the ICMP errors for the connection's packets, with the address of the node that sent each,
+// so they can be read from the socket's error queue
+func setRecvErr(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Sets the TTL of every packet sent through the connection from now on
+func setTTL(conn *net.UDPConn, ttl int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Parses the control messages read with an entry of the socket's error queue
+// Returns the ICMP type and code, and the address of the node that sent it, or false if the entry did not come from an ICMP message
+func parseICMPError(oob []byte) (int, int, net.IP, bool) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, 0, nil, false
+	}
+	for _, message := range messages {
+		if message.Header.Level != syscall.IPPROTO_IP || message.Header.Type != syscall.IP_RECVERR {
+			continue
+		}
+		// The address follows the extended error as a sockaddr_in, whose IPv4 address starts 4 bytes in
+		if len(message.Data) < extendedErrSize + 8 || message.Data[4] != errOriginICMP {
+			continue
+		}
+		addr := message.Data[extendedErrSize + 4 : extendedErrSize + 8]
+		return int(message.Data[5]), int(message.Data[6]), net.IPv4(addr[0], addr[1], addr[2], addr[3]), true
+	}
+	return 0, 0, nil, false
+}
+
+// Sends a probe with the given TTL and waits for either its reflection by the server or an ICMP error about it
+// The error queue holds the probe that caused each ICMP error, so answers to earlier probes are told apart by their sequence number
+// Returns a reply with a nil address if nothing answered within the timeout
+func probeHop(conn *net.UDPConn, ttl int, seq uint64, timeout time.Duration) (hopReply, error) {
+	err := setTTL(conn, ttl)
+	if err != nil {
+		return hopReply{}, err
+	}
+
+	payload := make([]byte, minPayloadSize)
+	protocol.PutHeader(payload, protocol.Header{Seq: seq, Timestamp: time.Now().UnixNano()})
+	start := time.Now()
+	_, err = conn.Write(payload)
+	if err != nil {
+		return hopReply{}, err
+	}
+
+	err = conn.SetReadDeadline(start.Add(timeout))
+	if err != nil {
+		return hopReply{}, err
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return hopReply{}, err
+	}
+
+	buffer := make([]byte, protocol.MaxDatagramSize + protocol.ServerTimestampsSize)
+	oob := make([]byte, 512)
+	var reply hopReply
+	var readErr error
+	err = rawConn.Read(func(fd uintptr) bool {
+		for {
+			// ICMP errors come first, since a pending one also fails ordinary reads
+			n, oobn, _, _, err := syscall.Recvmsg(int(fd), buffer, oob, syscall.MSG_ERRQUEUE)
+			if err == nil {
+				header, err := protocol.ParseHeader(buffer[:n])
+				icmpType, icmpCode, addr, ok := parseICMPError(oob[:oobn])
+				if err != nil || header.Seq != seq || !ok {
+					continue
+				}
+				reply = hopReply{addr: addr, rtt: time.Since(start)}
+				if icmpType == icmpDestUnreachable {
+					reply.unreachable = true
+					reply.reached = icmpCode == icmpPortUnreachable
+				}
+				return true
+			}
+
+			n, from, err := syscall.Recvfrom(int(fd), buffer, 0)
+			if err == syscall.EAGAIN {
+				return false
+			}
+			if err != nil {
+				readErr = err
+				return true
+			}
+			header, err := protocol.ParseHeader(buffer[:n])
+			if err != nil || header.Seq != seq {
+				continue
+			}
+			reply = hopReply{rtt: time.Since(start), reached: true}
+			if from, ok := from.(*syscall.SockaddrInet4); ok {
+				reply.addr = net.IPv4(from.Addr[0], from.Addr[1], from.Addr[2], from.Addr[3])
+			}
+			return true
+		}
+	})
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return hopReply{}, nil
+		}
+		return hopReply{}, err
+	}
+	return reply, readErr
+}
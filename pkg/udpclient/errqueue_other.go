@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package udpclient
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Traceroute reads the ICMP errors about its probes from the socket's error queue, which only Linux has
+var errTracerouteUnsupported = errors.New("traceroute is only supported on Linux")
+
+// Reports that the ICMP errors cannot be queued, since there is no error queue to read them from
+func setRecvErr(conn *net.UDPConn) error {
+	return errTracerouteUnsupported
+}
+
+// Reports that the probe cannot be sent, since the ICMP errors about it cannot be read
+func probeHop(conn *net.UDPConn, ttl int, seq uint64, timeout time.Duration) (hopReply, error) {
+	return hopReply{}, errTracerouteUnsupported
+}
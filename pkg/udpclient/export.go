@@ -0,0 +1,205 @@
+package udpclient
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest statsd datagram sent, which fits in the MTU of an Ethernet path without fragmenting
+const statsdPacketSize = 1432
+
+// How long to wait to connect and write to a Graphite server before giving up on a flush
+const graphiteTimeout = 5 * time.Second
+
+// A value of a connection to push, named by its path under the prefix
+// counter: whether the value only grows, in which case statsd is sent the increase since the last flush
+type exportedMetric struct {
+	path	string
+	value	float64
+	counter	bool
+}
+
+// Pushes the metrics of every connection to a statsd daemon over UDP or a Graphite server over TCP
+// kind: statsd or graphite
+// addr: the address of the daemon or server (i.e. localhost:8125)
+// conn: the connection to the daemon or server, which is reopened on the next flush if a Graphite write fails
+// last: the value of every counter at the last flush
+type metricsExporter struct {
+	kind	string
+	addr	string
+	prefix	string
+	conn	net.Conn
+	last	map[string]float64
+}
+
+// Creates an exporter to the statsd daemon or Graphite server of a URL (i.e. statsd://localhost:8125)
+// Metric names start with the given prefix
+func newMetricsExporter(rawURL string, prefix string) (*metricsExporter, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "statsd" && parsed.Scheme != "graphite" {
+		return nil, fmt.Errorf("unknown metrics export %q, expected statsd://host:port or graphite://host:port", rawURL)
+	}
+	if parsed.Host == "" || parsed.Port() == "" {
+		return nil, fmt.Errorf("metrics export %q has no host and port", rawURL)
+	}
+	exporter := &metricsExporter{kind: parsed.Scheme, addr: parsed.Host, prefix: strings.Trim(prefix, "."), last: make(map[string]float64)}
+
+	// statsd is sent datagrams, so its socket can be set up before anything listens on it
+	if exporter.kind == "statsd" {
+		exporter.conn, err = net.Dial("udp", exporter.addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return exporter, nil
+}
+
+// Replaces the characters that separate or end the components of a metric name (i.e. localhost:9000 becomes localhost_9000)
+func sanitizeMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Collects the metrics of every connection, named <prefix>.<target>.conn<n>.<metric>
+func (exporter *metricsExporter) metrics(all []*clientStats, targets []string) []exportedMetric {
+	var metrics []exportedMetric
+	for i, stats := range all {
+		base := fmt.Sprintf("%s.%s.conn%d.", exporter.prefix, sanitizeMetricName(targets[i % len(targets)]), i)
+		if exporter.prefix == "" {
+			base = base[1:]
+		}
+		for _, counter := range metricCounters {
+			name := strings.TrimSuffix(strings.TrimPrefix(counter.name, "udp_client_"), "_total")
+			metrics = append(metrics, exportedMetric{base + name, float64(counter.value(stats)), true})
+		}
+
+		stats.mutex.Lock()
+		metrics = append(metrics, exportedMetric{base + "out_of_order", float64(stats.reorder.count), true})
+		metrics = append(metrics, exportedMetric{base + "jitter_ms", float64(stats.jitter.value()) / float64(time.Millisecond), false})
+		// An RTT of 0 would drag down averages of the gauges, so they are left out until a reflection arrives
+		if stats.rtt.count > 0 {
+			metrics = append(metrics, exportedMetric{base + "rtt_avg_ms", float64(stats.rtt.avg()) / float64(time.Millisecond), false})
+			for _, p := range []float64{50, 90, 99} {
+				rtt := stats.rtt.hist.percentile(p)
+				metrics = append(metrics, exportedMetric{fmt.Sprintf("%srtt_p%g_ms", base, p), float64(rtt) / float64(time.Millisecond), false})
+			}
+		}
+		stats.mutex.Unlock()
+	}
+	return metrics
+}
+
+// Formats the metrics as lines of the exporter's protocol
+// statsd counters are sent the increase since the last flush, and are left out if they did not change
+func (exporter *metricsExporter) lines(metrics []exportedMetric, now time.Time) []string {
+	var lines []string
+	for _, metric := range metrics {
+		value := strconv.FormatFloat(metric.value, 'f', -1, 64)
+		if exporter.kind == "graphite" {
+			lines = append(lines, fmt.Sprintf("%s %s %d", metric.path, value, now.Unix()))
+			continue
+		}
+		if !metric.counter {
+			lines = append(lines, fmt.Sprintf("%s:%s|g", metric.path, value))
+			continue
+		}
+		delta := metric.value - exporter.last[metric.path]
+		exporter.last[metric.path] = metric.value
+		if delta != 0 {
+			lines = append(lines, fmt.Sprintf("%s:%s|c", metric.path, strconv.FormatFloat(delta, 'f', -1, 64)))
+		}
+	}
+	return lines
+}
+
+// Pushes the current metrics of every connection
+func (exporter *metricsExporter) flush(all []*clientStats, targets []string) error {
+	lines := exporter.lines(exporter.metrics(all, targets), time.Now())
+	if exporter.kind == "statsd" {
+		return exporter.sendStatsd(lines)
+	}
+	return exporter.sendGraphite(lines)
+}
+
+// Sends lines to statsd, packing as many into each datagram as fit
+func (exporter *metricsExporter) sendStatsd(lines []string) error {
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet) + 1 + len(line) > statsdPacketSize {
+			if _, err := exporter.conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		if _, err := exporter.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends lines to Graphite, connecting first if there is no connection yet or the last write failed
+func (exporter *metricsExporter) sendGraphite(lines []string) error {
+	if exporter.conn == nil {
+		conn, err := net.DialTimeout("tcp", exporter.addr, graphiteTimeout)
+		if err != nil {
+			return err
+		}
+		exporter.conn = conn
+	}
+	exporter.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	_, err := exporter.conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	if err != nil {
+		exporter.conn.Close()
+		exporter.conn = nil
+	}
+	return err
+}
+
+// Closes the connection to the statsd daemon or Graphite server, if there is one
+func (exporter *metricsExporter) close() {
+	if exporter.conn != nil {
+		exporter.conn.Close()
+		exporter.conn = nil
+	}
+}
+
+// Pushes the metrics to statsd or Graphite every interval until the done channel is closed
+func runMetricsExport(exporter *metricsExporter, all []*clientStats, targets []string, interval time.Duration, doneChan <-chan struct{}, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneChan:
+			return
+		case <-ticker.C:
+			err := exporter.flush(all, targets)
+			if err != nil {
+				log.Println("Could not export metrics: ", err)
+			}
+		}
+	}
+}
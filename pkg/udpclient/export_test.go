@@ -0,0 +1,111 @@
+package udpclient
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns statistics of a connection that sent 10 packets and had 8 of them reflected with an RTT of 2ms
+func exportTestStats() *clientStats {
+	stats := newClientStats(time.Second, time.Unix(0, 0))
+	stats.sent = 10
+	for seq := uint64(0); seq < 8; seq++ {
+		stats.received++
+		stats.recordReflection(seq, int64(seq) * int64(time.Millisecond), int64(seq + 2) * int64(time.Millisecond), true)
+	}
+	return stats
+}
+
+// statsd gets the increase of each counter since the last flush, and gauges as they are
+func TestExportStatsd(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	exporter, err := newMetricsExporter("statsd://" + listener.LocalAddr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.close()
+
+	stats := exportTestStats()
+	read := func() string {
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buffer := make([]byte, statsdPacketSize)
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buffer[:n])
+	}
+	if err := exporter.flush([]*clientStats{stats}, []string{"localhost:9000"}); err != nil {
+		t.Fatal(err)
+	}
+	packet := read()
+	for _, line := range []string{"test.localhost_9000.conn0.packets_sent:10|c", "test.localhost_9000.conn0.packets_received:8|c", "test.localhost_9000.conn0.rtt_p50_ms:2|g"} {
+		if !strings.Contains(packet, line + "\n") {
+			t.Fatalf("first flush is missing %q:\n%s", line, packet)
+		}
+	}
+
+	stats.sent += 5
+	if err := exporter.flush([]*clientStats{stats}, []string{"localhost:9000"}); err != nil {
+		t.Fatal(err)
+	}
+	packet = read()
+	if !strings.Contains(packet, "test.localhost_9000.conn0.packets_sent:5|c") || strings.Contains(packet, "packets_received") {
+		t.Fatalf("second flush does not send only the increase of the counters:\n%s", packet)
+	}
+}
+
+// Graphite gets the totals of every connection as timestamped lines, over a connection that is reopened after it drops
+func TestExportGraphite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	exporter, err := newMetricsExporter("graphite://" + listener.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.close()
+
+	all := []*clientStats{exportTestStats(), exportTestStats()}
+	for flush := 0; flush < 2; flush++ {
+		if err := exporter.flush(all, []string{"a", "b"}); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "a.conn0.packets_sent" || fields[1] != "10" {
+			t.Fatalf("flush %d started with %q", flush, line)
+		}
+		// Drop the connection, which the exporter notices on a later write
+		conn.Close()
+		for exporter.conn != nil {
+			exporter.flush(all, []string{"a", "b"})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestMetricsExportURL(t *testing.T) {
+	for _, rawURL := range []string{"localhost:8125", "http://localhost:8125", "statsd://localhost", "graphite://"} {
+		if _, err := newMetricsExporter(rawURL, "udp_client"); err == nil {
+			t.Fatalf("%q accepted", rawURL)
+		}
+	}
+}
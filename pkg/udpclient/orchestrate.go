@@ -0,0 +1,607 @@
+package udpclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Environment variable holding the token of the agent and the orchestrator when it is not given as a flag
+const agentTokenEnv = "UDP_CLIENT_AGENT_TOKEN"
+
+// Flags of a run that an agent refuses, since they read or write files on the agent's host, or draw on its terminal
+// The orchestrator gathers the results and RTT histograms of the agents itself
+var agentRefusedFlags = []string{"out", "trace", "hist_file", "gap_file", "checkpoint", "payload_file", "transfer_file", "transfer_out", "noise_key", "tui"}
+
+// Longest an agent waits for the start of a run, so a bad start time cannot tie it up
+const maxAgentWait = time.Minute
+
+// Request to an agent, sent as JSON over HTTP or as one line of JSON over stdio
+// Op: clock to read the agent's clock, or run to run a test
+// Args: the command line flags of the run, as udp_client takes them
+// StartNs: when to start the run by the agent's clock, in nanoseconds since the Unix epoch, or 0 to start it right away
+type agentRequest struct {
+	Op		string		`json:"op"`
+	Args	[]string	`json:"args,omitempty"`
+	StartNs	int64		`json:"start_ns,omitempty"`
+}
+
+// Response of an agent
+// NowNs: the agent's clock when it answered, in nanoseconds since the Unix epoch
+// Histogram: the lower bound, upper bound, and count of every non-empty bucket of the run's RTT histogram, as hist_file writes them
+// Error: why the run could not be done, or the error it ended with (i.e. threshold exceeded) along with its results
+type agentResponse struct {
+	NowNs		int64			`json:"now_ns"`
+	Results		*Results		`json:"results,omitempty"`
+	Histogram	[][3]uint64		`json:"histogram,omitempty"`
+	Error		string			`json:"error,omitempty"`
+}
+
+// Whether an agent is running a test, since runs in progress at the same time would compete for the host's network
+var agentBusy int32
+
+// Parses the command line flags of a run for an agent, refusing the flags in agentRefusedFlags
+func parseAgentArgs(args []string) (Options, error) {
+	var options Options
+	flags := flag.NewFlagSet("udp_client", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	options.RegisterFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return options, err
+	}
+	if flags.NArg() != 0 {
+		return options, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	var refused []string
+	flags.Visit(func(f *flag.Flag) {
+		for _, name := range agentRefusedFlags {
+			if f.Name == name {
+				refused = append(refused, "-" + name)
+			}
+		}
+	})
+	if len(refused) > 0 {
+		return options, fmt.Errorf("agents do not take %s", strings.Join(refused, ", "))
+	}
+	return options, nil
+}
+
+// Handles a request to an agent
+func handleAgentRequest(request agentRequest) agentResponse {
+	switch request.Op {
+	case "clock":
+		return agentResponse{NowNs: time.Now().UnixNano()}
+	case "run":
+		response := runAgentRequest(request)
+		response.NowNs = time.Now().UnixNano()
+		return response
+	}
+	return agentResponse{NowNs: time.Now().UnixNano(), Error: fmt.Sprintf("unknown op %q", request.Op)}
+}
+
+// Runs the test of a request once its start time comes, returning its results along with its RTT histogram
+func runAgentRequest(request agentRequest) agentResponse {
+	options, err := parseAgentArgs(request.Args)
+	if err != nil {
+		return agentResponse{Error: err.Error()}
+	}
+	var wait time.Duration
+	if request.StartNs != 0 {
+		wait = time.Until(time.Unix(0, request.StartNs))
+		if wait > maxAgentWait {
+			return agentResponse{Error: fmt.Sprintf("start time is %v away, more than the max of %v", wait.Round(time.Millisecond), maxAgentWait)}
+		}
+	}
+	if !atomic.CompareAndSwapInt32(&agentBusy, 0, 1) {
+		return agentResponse{Error: "another run is in progress"}
+	}
+	defer atomic.StoreInt32(&agentBusy, 0)
+
+	// The run writes its histogram to a temporary file, which is read back for the orchestrator
+	hist, err := ioutil.TempFile("", "agent-hist-*.csv")
+	if err != nil {
+		return agentResponse{Error: err.Error()}
+	}
+	hist.Close()
+	defer os.Remove(hist.Name())
+	options.HistFile = hist.Name()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	log.Printf("Starting a run with %s\n", strings.Join(request.Args, " "))
+	results, err := Run(context.Background(), options)
+	if results == nil {
+		return agentResponse{Error: err.Error()}
+	}
+	response := agentResponse{Results: results}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	response.Histogram, err = readHistogram(hist.Name())
+	if err != nil {
+		log.Println("Could not read RTT histogram: ", err)
+	}
+	return response
+}
+
+// Reads the buckets of an RTT histogram written by hist_file
+func readHistogram(fileName string) ([][3]uint64, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var buckets [][3]uint64
+	scanner := bufio.NewScanner(file)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed histogram row %q", scanner.Text())
+		}
+		var bucket [3]uint64
+		for i, field := range fields {
+			bucket[i], err = strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed histogram row %q", scanner.Text())
+			}
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, scanner.Err()
+}
+
+// Checks the bearer token of a request to an agent in constant time
+func agentAuthorized(req *http.Request, token string) bool {
+	given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// Handler of an agent's HTTP endpoints, /clock and /run, each taking a POST of an agentRequest without its op
+func agentHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	for _, op := range []string{"clock", "run"} {
+		op := op
+		mux.HandleFunc("/" + op, func(w http.ResponseWriter, req *http.Request) {
+			if !agentAuthorized(req, token) {
+				http.Error(w, "Missing or wrong bearer token.", http.StatusUnauthorized)
+				return
+			}
+			if req.Method != "POST" {
+				http.Error(w, "Method is not supported.", http.StatusMethodNotAllowed)
+				return
+			}
+			var request agentRequest
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				http.Error(w, "Request is not valid JSON.", http.StatusBadRequest)
+				return
+			}
+			request.Op = op
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(handleAgentRequest(request))
+		})
+	}
+	return mux
+}
+
+// Serves agent requests over stdin and stdout, one line of JSON each, until stdin is closed
+// This is how the orchestrator talks to an agent it starts over SSH
+func serveAgentStdio(in io.Reader, out io.Writer) error {
+	decoder := json.NewDecoder(in)
+	encoder := json.NewEncoder(out)
+	for {
+		var request agentRequest
+		err := decoder.Decode(&request)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(handleAgentRequest(request)); err != nil {
+			return err
+		}
+	}
+}
+
+// Runs the agent subcommand with its command line args, running the tests an orchestrator asks for
+// Returns the exit code: 0 once stdin is closed with stdio, 1 if the agent cannot serve, and 2 for bad usage
+func Agent(args []string) int {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	var listen = flags.String("listen", ":7070", "Address to serve the agent's HTTP endpoints on (i.e. 10.0.0.5:7070)")
+	var token = flags.String("token", "", "Bearer token the orchestrator must send, or empty to read it from " + agentTokenEnv + " (i.e. s3cret)")
+	var stdio = flags.Bool("stdio", false, "Take requests on stdin and answer on stdout instead of over HTTP, as the orchestrator does over SSH")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: udp_client agent [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	// Over stdio the agent is only reachable by whoever started it, so it needs no token
+	if *stdio {
+		if err := serveAgentStdio(os.Stdin, os.Stdout); err != nil {
+			log.Println("Could not serve requests over stdio: ", err)
+			return 1
+		}
+		return 0
+	}
+
+	// Anyone who can reach the agent over HTTP could otherwise aim its load at any host
+	if *token == "" {
+		*token = os.Getenv(agentTokenEnv)
+	}
+	if *token == "" {
+		log.Printf("A token must be given, or set in %s, to serve the agent over HTTP\n", agentTokenEnv)
+		return 2
+	}
+	log.Printf("Agent listening on %s\n", *listen)
+	if err := http.ListenAndServe(*listen, agentHandler(*token)); err != nil {
+		log.Println("Could not serve the agent: ", err)
+		return 1
+	}
+	return 0
+}
+
+// Connection from the orchestrator to an agent
+type agentConn interface {
+	call(request agentRequest) (agentResponse, error)
+	close() error
+}
+
+// Agent reached over HTTP at its base URL
+type httpAgent struct {
+	url		string
+	token	string
+}
+
+func (a *httpAgent) call(request agentRequest) (agentResponse, error) {
+	var response agentResponse
+	body, err := json.Marshal(request)
+	if err != nil {
+		return response, err
+	}
+	req, err := http.NewRequest("POST", a.url + "/" + request.Op, bytes.NewReader(body))
+	if err != nil {
+		return response, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer " + a.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return response, fmt.Errorf("agent responded with %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func (a *httpAgent) close() error {
+	return nil
+}
+
+// Agent started over SSH, answering on the standard input and output of the ssh command
+type sshAgent struct {
+	cmd		*exec.Cmd
+	stdin	io.WriteCloser
+	encoder	*json.Encoder
+	decoder	*json.Decoder
+}
+
+func (a *sshAgent) call(request agentRequest) (agentResponse, error) {
+	var response agentResponse
+	if err := a.encoder.Encode(request); err != nil {
+		return response, err
+	}
+	if err := a.decoder.Decode(&response); err != nil {
+		if err == io.EOF {
+			err = errors.New("agent exited without answering")
+		}
+		return response, err
+	}
+	return response, nil
+}
+
+func (a *sshAgent) close() error {
+	a.stdin.Close()
+	return a.cmd.Wait()
+}
+
+// Connects to an agent by its address: host:port or a URL for an agent serving HTTP, or ssh://[user@]host[:port] to
+// start one with the command over SSH, in batch mode so it never stops to prompt for a password
+func dialAgent(address string, token string, command string) (agentConn, error) {
+	if !strings.HasPrefix(address, "ssh://") {
+		if !strings.Contains(address, "://") {
+			address = "http://" + address
+		}
+		return &httpAgent{url: strings.TrimSuffix(address, "/"), token: token}, nil
+	}
+
+	sshArgs, err := sshAgentArgs(address, command)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("ssh", sshArgs...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &sshAgent{cmd: cmd, stdin: stdin, encoder: json.NewEncoder(stdin), decoder: json.NewDecoder(stdout)}, nil
+}
+
+// Builds the args of the ssh command that starts an agent at an ssh:// address
+// The target follows "--" and may not start with "-", so no part of the address can be taken by ssh as an option
+func sshAgentArgs(address string, command string) ([]string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	target := u.Hostname()
+	if target == "" {
+		return nil, fmt.Errorf("no host in agent address %q", address)
+	}
+	if u.User != nil {
+		target = u.User.Username() + "@" + target
+	}
+	if strings.HasPrefix(target, "-") {
+		return nil, fmt.Errorf("ssh target %q of agent address %q starts with \"-\"", target, address)
+	}
+	sshArgs := []string{"-o", "BatchMode=yes"}
+	if u.Port() != "" {
+		sshArgs = append(sshArgs, "-p", u.Port())
+	}
+	return append(append(sshArgs, "--", target), strings.Fields(command)...), nil
+}
+
+// Estimates how far an agent's clock is ahead of the local one, from the exchange with the shortest round trip of a few
+func agentClockOffset(conn agentConn) (time.Duration, error) {
+	var offset time.Duration
+	best := time.Duration(-1)
+	for i := 0; i < 5; i++ {
+		sent := time.Now()
+		response, err := conn.call(agentRequest{Op: "clock"})
+		received := time.Now()
+		if err != nil {
+			return 0, err
+		}
+		if rtt := received.Sub(sent); best < 0 || rtt < best {
+			best = rtt
+			offset = time.Unix(0, response.NowNs).Sub(sent.Add(rtt / 2))
+		}
+	}
+	return offset, nil
+}
+
+// Combines the results of every agent into the results of the whole orchestrated run
+// Counts and bandwidths are summed, and the RTT percentiles come from the merged histograms, so they are as exact as a
+// single client's; the jitter is the worst agent's, since jitter estimates of separate paths cannot be combined
+func aggregateAgentResults(agents []Results, histograms [][][3]uint64) Results {
+	total := Results{Start: agents[0].Start, Target: agents[0].Target, Config: agents[0].Config, ServerNotListening: true, Agents: agents}
+	hist := newLatencyHistogram()
+	var rttSum float64
+	for i, results := range agents {
+		if results.Start.Before(total.Start) {
+			total.Start = results.Start
+		}
+		if results.DurationSeconds > total.DurationSeconds {
+			total.DurationSeconds = results.DurationSeconds
+		}
+		total.Sent += results.Sent
+		total.Received += results.Received
+		total.Duplicates += results.Duplicates
+		total.OutOfOrder += results.OutOfOrder
+		if results.MaxReorderDistance > total.MaxReorderDistance {
+			total.MaxReorderDistance = results.MaxReorderDistance
+		}
+		if results.Received > 0 {
+			if total.RTT.MinNs == 0 || results.RTT.MinNs < total.RTT.MinNs {
+				total.RTT.MinNs = results.RTT.MinNs
+			}
+			if results.RTT.MaxNs > total.RTT.MaxNs {
+				total.RTT.MaxNs = results.RTT.MaxNs
+			}
+			rttSum += float64(results.RTT.AvgNs) * float64(results.Received)
+		}
+		if results.JitterNs > total.JitterNs {
+			total.JitterNs = results.JitterNs
+		}
+		total.SentMbps += results.SentMbps
+		total.SentPayloadMbps += results.SentPayloadMbps
+		total.ReceivedMbps += results.ReceivedMbps
+		total.GoodputMbps += results.GoodputMbps
+		total.WindowTimeouts += results.WindowTimeouts
+		total.Heartbeats += results.Heartbeats
+		total.Misattributed += results.Misattributed
+		total.PortUnreachable += results.PortUnreachable
+		total.ServerNotListening = total.ServerNotListening && results.ServerNotListening
+		for _, bucket := range histograms[i] {
+			hist.counts[histBucketIndex(bucket[0])] += bucket[2]
+			hist.total += bucket[2]
+		}
+	}
+	total.LossPercent = lossPercent(total.Sent, total.Received)
+	if total.Received > 0 {
+		total.RTT.AvgNs = int64(rttSum / float64(total.Received))
+	}
+	hist.max = uint64(total.RTT.MaxNs)
+	total.RTT.P50Ns = int64(hist.percentile(50))
+	total.RTT.P90Ns = int64(hist.percentile(90))
+	total.RTT.P99Ns = int64(hist.percentile(99))
+	total.RTT.P999Ns = int64(hist.percentile(99.9))
+	return total
+}
+
+// Runs the orchestrate subcommand with its command line args, running the same test on every agent at the same time
+// and printing the aggregated loss and latency
+// The flags of the test follow the orchestrator's own flags (i.e. udp_client orchestrate -agents a:7070,b:7070 -- -host server -pps 10000)
+// Returns the exit code: 0 on success, 1 if any agent failed, ExitThresholdExceeded or ExitServerNotListening for the
+// aggregated results as for a single client, and 2 for bad usage
+func Orchestrate(args []string) int {
+	flags := flag.NewFlagSet("orchestrate", flag.ExitOnError)
+	var agentList = flags.String("agents", "", "Comma separated agents, each host:port of an agent serving HTTP or ssh://[user@]host[:port] to start one over SSH (i.e. 10.0.0.5:7070,ssh://load@10.0.0.6)")
+	var token = flags.String("token", "", "Bearer token of the agents serving HTTP, or empty to read it from " + agentTokenEnv + " (i.e. s3cret)")
+	var command = flags.String("agent_command", "udp_client agent -stdio", "Command starting an agent on the hosts reached over SSH (i.e. /opt/bin/udp_client agent -stdio)")
+	var lead = flags.Duration("lead", 2 * time.Second, "How far ahead to schedule the start of the run, so every agent has it before it starts (i.e. 5s)")
+	var out = flags.String("out", "", "File to write the aggregated results to, with the results of each agent, as CSV if it ends in .csv and as JSON otherwise (i.e. results.json)")
+	var maxLoss = flags.Float64("max_loss", -1, "Max aggregated packet loss percentage, exiting with code 3 when exceeded, or negative to disable (i.e. 0.5)")
+	var maxP99 = flags.Duration("max_p99", 0, "Max aggregated RTT p99, exiting with code 3 when exceeded, or 0 to disable (i.e. 50ms)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: udp_client orchestrate -agents AGENTS [flags] -- [udp_client flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	runArgs := flags.Args()
+	if *agentList == "" {
+		flags.Usage()
+		return 2
+	}
+	if _, err := parseAgentArgs(runArgs); err != nil {
+		log.Println("Invalid flags for the run: ", err)
+		return 2
+	}
+	if *token == "" {
+		*token = os.Getenv(agentTokenEnv)
+	}
+	addresses := strings.Split(*agentList, ",")
+
+	// Connect to every agent and find its clock offset, so the start time can be given by each agent's own clock
+	conns := make([]agentConn, len(addresses))
+	offsets := make([]time.Duration, len(addresses))
+	errs := make([]error, len(addresses))
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			conns[i], errs[i] = dialAgent(address, *token, *command)
+			if errs[i] == nil {
+				offsets[i], errs[i] = agentClockOffset(conns[i])
+			}
+		}(i, address)
+	}
+	wg.Wait()
+	defer func() {
+		for _, conn := range conns {
+			if conn != nil {
+				conn.close()
+			}
+		}
+	}()
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("Could not reach agent %s: %v\n", addresses[i], err)
+			return 1
+		}
+		log.Printf("Agent %s: clock offset %v\n", addresses[i], offsets[i])
+	}
+
+	// Start the run on every agent at the same moment, and wait for all of them to finish
+	start := time.Now().Add(*lead)
+	log.Printf("Starting the run on %d agents at %s\n", len(addresses), start.Format(time.RFC3339Nano))
+	responses := make([]agentResponse, len(addresses))
+	for i := range addresses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request := agentRequest{Op: "run", Args: runArgs, StartNs: start.Add(offsets[i]).UnixNano()}
+			responses[i], errs[i] = conns[i].call(request)
+		}(i)
+	}
+	wg.Wait()
+
+	// Report every agent, then the aggregate of those that finished
+	failed := 0
+	var agents []Results
+	var histograms [][][3]uint64
+	for i, response := range responses {
+		if errs[i] == nil && response.Results == nil {
+			errs[i] = errors.New(response.Error)
+		}
+		if errs[i] != nil {
+			log.Printf("Agent %s failed: %v\n", addresses[i], errs[i])
+			failed++
+			continue
+		}
+		results := *response.Results
+		results.Agent = addresses[i]
+		log.Printf("Agent %s: sent %d, received %d, loss %.2f%%, RTT p50/p99 %v / %v\n", addresses[i], results.Sent, results.Received,
+			results.LossPercent, time.Duration(results.RTT.P50Ns), time.Duration(results.RTT.P99Ns))
+		if response.Error != "" {
+			log.Printf("Agent %s: %s\n", addresses[i], response.Error)
+		}
+		agents = append(agents, results)
+		histograms = append(histograms, response.Histogram)
+	}
+	if len(agents) == 0 {
+		log.Println("No agent finished the run")
+		return 1
+	}
+	results := aggregateAgentResults(agents, histograms)
+	log.Printf("Aggregated over %d agents:\n", len(agents))
+	log.Println("Packets Sent: ", strconv.Itoa(results.Sent))
+	log.Println("Packets Received: ", strconv.Itoa(results.Received))
+	log.Println("Duplicate Packets Received: ", strconv.Itoa(results.Duplicates))
+	log.Printf("Packet loss: %.2f%%\n", results.LossPercent)
+	log.Printf("RTT min/avg/max: %v / %v / %v\n", time.Duration(results.RTT.MinNs), time.Duration(results.RTT.AvgNs), time.Duration(results.RTT.MaxNs))
+	log.Printf("RTT p50/p90/p99/p999: %v / %v / %v / %v\n", time.Duration(results.RTT.P50Ns), time.Duration(results.RTT.P90Ns), time.Duration(results.RTT.P99Ns), time.Duration(results.RTT.P999Ns))
+	log.Printf("Worst jitter (RFC 3550): %v\n", time.Duration(results.JitterNs))
+	log.Printf("Bandwidth sent: %.3f Mbps (payload %.3f Mbps), received: %.3f Mbps (goodput %.3f Mbps)\n",
+		results.SentMbps, results.SentPayloadMbps, results.ReceivedMbps, results.GoodputMbps)
+
+	if *out != "" {
+		if err := writeResults(*out, results); err != nil {
+			log.Println("Could not write results: ", err)
+		} else {
+			log.Printf("Wrote results to %s\n", *out)
+		}
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	if results.ServerNotListening {
+		log.Println("Server not listening")
+		return ExitServerNotListening
+	}
+	exceeded := checkThresholds(results, *maxLoss, *maxP99)
+	for _, reason := range exceeded {
+		log.Printf("Threshold exceeded: %s\n", reason)
+	}
+	if len(exceeded) > 0 {
+		return ExitThresholdExceeded
+	}
+	return 0
+}
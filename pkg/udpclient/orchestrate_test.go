@@ -0,0 +1,72 @@
+package udpclient
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Aggregating agents must give the same percentiles as a single client that recorded every agent's RTTs
+func TestAggregateAgentResults(t *testing.T) {
+	dir := t.TempDir()
+	all := &rttStats{hist: newLatencyHistogram()}
+	var agents []Results
+	var histograms [][][3]uint64
+	for i, step := range []time.Duration{time.Millisecond, 3 * time.Millisecond} {
+		stats := &rttStats{hist: newLatencyHistogram()}
+		for n := 1; n <= 1000; n++ {
+			stats.add(time.Duration(n) * step)
+			all.add(time.Duration(n) * step)
+		}
+		fileName := filepath.Join(dir, "hist.csv")
+		if err := stats.hist.dump(fileName); err != nil {
+			t.Fatal(err)
+		}
+		buckets, err := readHistogram(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(fileName)
+		agents = append(agents, Results{Sent: 1000 + i, Received: 1000, JitterNs: int64(step), RTT: stats.summary()})
+		histograms = append(histograms, buckets)
+	}
+
+	total := aggregateAgentResults(agents, histograms)
+	if total.Sent != 2001 || total.Received != 2000 || total.LossPercent != lossPercent(2001, 2000) {
+		t.Fatalf("aggregated %d sent and %d received with %.4f%% loss", total.Sent, total.Received, total.LossPercent)
+	}
+	if want := all.summary(); total.RTT != want {
+		t.Fatalf("aggregated RTT %+v, want %+v", total.RTT, want)
+	}
+	if total.JitterNs != int64(3 * time.Millisecond) || len(total.Agents) != 2 {
+		t.Fatalf("aggregated jitter %v over %d agents", time.Duration(total.JitterNs), len(total.Agents))
+	}
+}
+
+func TestParseAgentArgs(t *testing.T) {
+	options, err := parseAgentArgs([]string{"-host", "server", "-pps", "5000"})
+	if err != nil || options.Host != "server" || options.PPS != 5000 || options.Drain != 5 * time.Second {
+		t.Fatalf("parsed %+v, %v", options, err)
+	}
+	for _, args := range [][]string{{"-out", "results.json"}, {"-tui"}, {"-payload_file", "-"}, {"-noise_key", "/etc/shadow"}, {"-nope"}, {"server"}} {
+		if _, err := parseAgentArgs(args); err == nil {
+			t.Fatalf("accepted %q", args)
+		}
+	}
+}
+
+// Nothing in an ssh:// address can be taken by ssh as an option
+func TestSSHAgentArgs(t *testing.T) {
+	args, err := sshAgentArgs("ssh://load@10.0.0.6:2222", "udp_client agent -stdio")
+	want := []string{"-o", "BatchMode=yes", "-p", "2222", "--", "load@10.0.0.6", "udp_client", "agent", "-stdio"}
+	if err != nil || strings.Join(args, " ") != strings.Join(want, " ") {
+		t.Fatalf("built %q, %v, want %q", args, err, want)
+	}
+	for _, address := range []string{"ssh://-oProxyCommand=sh", "ssh://-oProxyCommand=x@host", "ssh://", "ssh://user@"} {
+		if args, err := sshAgentArgs(address, "udp_client agent -stdio"); err == nil {
+			t.Fatalf("accepted %s as %q", address, args)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package udpclient
+
+import (
+	"net"
+	"syscall"
+)
+
+// Sets the don't-fragment bit on every packet sent through the connection
+// Packets larger than the path MTU known to the kernel then fail to send instead of being fragmented
+func setDontFragment(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Gets the path MTU that the kernel currently knows for the connection's remote address
+func kernelPathMTU(conn *net.UDPConn) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var mtu int
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		mtu, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return mtu, sockErr
+}
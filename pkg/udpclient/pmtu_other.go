@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package udpclient
+
+import (
+	"errors"
+	"net"
+)
+
+// Path MTU probing needs socket options that only Linux has
+var errPMTUUnsupported = errors.New("path MTU probing is only supported on Linux")
+
+// Reports that the don't-fragment bit cannot be set, since path MTU probing is unsupported
+func setDontFragment(conn *net.UDPConn) error {
+	return errPMTUUnsupported
+}
+
+// Reports that the kernel's path MTU cannot be read, since path MTU probing is unsupported
+func kernelPathMTU(conn *net.UDPConn) (int, error) {
+	return 0, errPMTUUnsupported
+}
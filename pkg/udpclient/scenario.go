@@ -0,0 +1,367 @@
+package udpclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbopardi/udp_client_server/pkg/netsim"
+)
+
+// Keys of a scenario phase naming an option by something other than its flag
+var scenarioAliases = map[string]string{
+	"rate": "pps",
+	"duration": "c_time",
+}
+
+// Flags a scenario cannot set, since the scenario writes its own report, and the rest end a run without any results
+var scenarioRefusedFlags = []string{"out", "tui", "pmtu", "traceroute", "transfer_file", "transfer_out"}
+
+// A key and value of a scenario file, with the line it is on for error messages
+type scenarioSetting struct {
+	key		string
+	value	string
+	line	int
+}
+
+// A phase of a scenario, run with the scenario's settings and then its own
+type scenarioPhase struct {
+	name		string
+	settings	[]scenarioSetting
+}
+
+// A scenario file: a name, settings shared by every phase, and the phases to run one after the other
+type scenario struct {
+	name		string
+	settings	[]scenarioSetting
+	phases		[]scenarioPhase
+}
+
+// Report of a scenario, with the results of every phase in the order they ran
+type scenarioReport struct {
+	Name	string					`json:"name,omitempty"`
+	Phases	[]scenarioPhaseReport	`json:"phases"`
+}
+
+// Results of a phase of a scenario
+// Impairment: the counters of the datagrams the client sent over the impaired network, if the phase had impairments
+// Error: the error the phase ended with (i.e. threshold exceeded) along with its results
+type scenarioPhaseReport struct {
+	Name		string				`json:"name"`
+	Results		Results				`json:"results"`
+	Impairment	*scenarioImpairment	`json:"impairment,omitempty"`
+	Error		string				`json:"error,omitempty"`
+}
+
+// Counters of the datagrams a phase sent over its impaired network
+type scenarioImpairment struct {
+	Sent		int64	`json:"sent"`
+	Lost		int64	`json:"lost"`
+	Reordered	int64	`json:"reordered"`
+	Delivered	int64	`json:"delivered"`
+	Overflowed	int64	`json:"overflowed"`
+}
+
+// Parses a scenario file, which is written in a small subset of YAML: comments, key: value pairs, and a phases key
+// holding a sequence of mappings, each item starting with a dash
+func parseScenario(in io.Reader) (*scenario, error) {
+	var s scenario
+	var phase *scenarioPhase
+	inPhases := false
+	phaseIndent := -1
+	scanner := bufio.NewScanner(in)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		text := stripScenarioComment(scanner.Text())
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if strings.Contains(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs cannot be used for indentation", lineNum)
+		}
+		indent := len(text) - len(strings.TrimLeft(text, " "))
+		text = strings.TrimSpace(text)
+
+		// Top level keys, one of which starts the phases
+		if indent == 0 && !strings.HasPrefix(text, "- ") && text != "-" {
+			key, value, err := splitScenarioPair(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			phase = nil
+			inPhases = false
+			switch key {
+			case "phases":
+				if value != "" {
+					return nil, fmt.Errorf("line %d: phases must be a list of mappings, one item per phase", lineNum)
+				}
+				if s.phases != nil {
+					return nil, fmt.Errorf("line %d: phases given twice", lineNum)
+				}
+				s.phases = []scenarioPhase{}
+				inPhases = true
+				phaseIndent = -1
+			case "name":
+				s.name = value
+			default:
+				s.settings = append(s.settings, scenarioSetting{key: key, value: value, line: lineNum})
+			}
+			continue
+		}
+		if !inPhases {
+			return nil, fmt.Errorf("line %d: unexpected indentation outside of phases", lineNum)
+		}
+
+		// A dash starts a phase, with its first key on the same line or the lines after
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			if phaseIndent >= 0 && indent != phaseIndent {
+				return nil, fmt.Errorf("line %d: phases must all be indented the same", lineNum)
+			}
+			phaseIndent = indent
+			s.phases = append(s.phases, scenarioPhase{})
+			phase = &s.phases[len(s.phases) - 1]
+			text = strings.TrimSpace(strings.TrimPrefix(text, "-"))
+			if text == "" {
+				continue
+			}
+		} else if phase == nil || indent <= phaseIndent {
+			return nil, fmt.Errorf("line %d: expected a phase starting with a dash", lineNum)
+		}
+		key, value, err := splitScenarioPair(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if key == "name" {
+			phase.name = value
+		} else {
+			phase.settings = append(phase.settings, scenarioSetting{key: key, value: value, line: lineNum})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(s.phases) == 0 {
+		return nil, errors.New("scenario has no phases")
+	}
+	for i := range s.phases {
+		if s.phases[i].name == "" {
+			s.phases[i].name = fmt.Sprintf("phase %d", i + 1)
+		}
+	}
+	return &s, nil
+}
+
+// Removes a comment from a line of a scenario file, which starts with a # at the start of the line or after a space,
+// outside of quotes
+func stripScenarioComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i - 1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Splits a key: value pair of a scenario file, unquoting the value if it is quoted
+func splitScenarioPair(text string) (string, string, error) {
+	colon := strings.Index(text, ":")
+	if colon <= 0 || (colon + 1 < len(text) && text[colon + 1] != ' ') {
+		return "", "", fmt.Errorf("expected key: value, got %q", text)
+	}
+	key := strings.TrimSpace(text[:colon])
+	value := strings.TrimSpace(text[colon + 1:])
+	if len(value) >= 2 && value[0] == '"' && value[len(value) - 1] == '"' {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", "", fmt.Errorf("malformed quoted value %s", value)
+		}
+		value = unquoted
+	} else if len(value) >= 2 && value[0] == '\'' && value[len(value) - 1] == '\'' {
+		value = strings.ReplaceAll(value[1:len(value) - 1], "''", "'")
+	}
+	return key, value, nil
+}
+
+// Builds the options of a phase, from the client's defaults, the scenario's settings, and then the phase's settings
+// Returns the impairments of the phase along with whether it has any, which the client applies to the packets it sends
+func (s *scenario) phaseOptions(phase scenarioPhase) (Options, netsim.Config, bool, error) {
+	var options Options
+	var config netsim.Config
+	var lossPercent, reorderPercent float64
+	impaired := false
+	flags := flag.NewFlagSet("udp_client", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	options.RegisterFlags(flags)
+	flags.Float64Var(&lossPercent, "loss_percent", 0, "")
+	flags.DurationVar(&config.Latency, "latency", 0, "")
+	flags.Float64Var(&reorderPercent, "reorder_percent", 0, "")
+	flags.DurationVar(&config.ReorderDelay, "reorder_delay", 0, "")
+	flags.Int64Var(&config.Seed, "impair_seed", 1, "")
+
+	for _, setting := range append(append([]scenarioSetting(nil), s.settings...), phase.settings...) {
+		name := setting.key
+		if alias, ok := scenarioAliases[name]; ok {
+			name = alias
+		}
+		for _, refused := range scenarioRefusedFlags {
+			if name == refused {
+				return options, config, false, fmt.Errorf("line %d: scenarios cannot set %s", setting.line, setting.key)
+			}
+		}
+		if flags.Lookup(name) == nil {
+			return options, config, false, fmt.Errorf("line %d: unknown setting %s", setting.line, setting.key)
+		}
+		if err := flags.Set(name, setting.value); err != nil {
+			return options, config, false, fmt.Errorf("line %d: invalid value %q for %s: %v", setting.line, setting.value, setting.key, err)
+		}
+		switch name {
+		case "loss_percent", "latency", "reorder_percent", "reorder_delay":
+			impaired = true
+		}
+	}
+	if lossPercent < 0 || lossPercent > 100 || reorderPercent < 0 || reorderPercent > 100 {
+		return options, config, false, errors.New("loss_percent and reorder_percent must be between 0 and 100")
+	}
+	config.Loss = lossPercent / 100
+	config.Reorder = reorderPercent / 100
+	return options, config, impaired, nil
+}
+
+// Logs a table with a row for each phase that ran
+func logScenarioReport(report scenarioReport) {
+	log.Printf("%-20s %10s %10s %10s %8s %12s %12s %12s\n", "Phase", "Duration", "Sent", "Received", "Loss", "RTT p50", "RTT p99", "Jitter")
+	for _, phase := range report.Phases {
+		results := phase.Results
+		duration := time.Duration(results.DurationSeconds * float64(time.Second)).Round(time.Millisecond)
+		log.Printf("%-20s %10v %10d %10d %7.2f%% %12v %12v %12v\n", phase.Name, duration, results.Sent, results.Received, results.LossPercent,
+			time.Duration(results.RTT.P50Ns), time.Duration(results.RTT.P99Ns), time.Duration(results.JitterNs))
+	}
+}
+
+// Runs the scenario subcommand with its command line args, running the phases of a scenario file one after the other
+// and reporting the results of each
+// Returns the exit code: 0 on success, 1 if a phase could not run, ExitThresholdExceeded or ExitServerNotListening if
+// any phase ended with them, and 2 for bad usage or an invalid scenario
+// Once the context is done, the phase in progress stops early and reports, and the remaining phases are not run
+func Scenario(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("scenario", flag.ExitOnError)
+	var out = flags.String("out", "", "File to write the results of every phase to as JSON (i.e. report.json)")
+	var keepGoing = flags.Bool("keep_going", false, "Run the remaining phases after a phase exceeds its thresholds or finds the server not listening")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: udp_client scenario [flags] scenario.yaml")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Println("Could not open scenario: ", err)
+		return 2
+	}
+	s, err := parseScenario(file)
+	file.Close()
+	if err != nil {
+		log.Printf("Invalid scenario %s: %v\n", flags.Arg(0), err)
+		return 2
+	}
+
+	// Check every phase before running any, so a typo in the last phase does not waste the ones before it
+	options := make([]Options, len(s.phases))
+	configs := make([]netsim.Config, len(s.phases))
+	impaired := make([]bool, len(s.phases))
+	for i, phase := range s.phases {
+		options[i], configs[i], impaired[i], err = s.phaseOptions(phase)
+		if err != nil {
+			log.Printf("Invalid phase %q: %v\n", phase.name, err)
+			return 2
+		}
+	}
+
+	report := scenarioReport{Name: s.name}
+	code := 0
+	for i, phase := range s.phases {
+		if ctx.Err() != nil {
+			log.Printf("Stopped early, skipping phase %q and the ones after it\n", phase.name)
+			code = 1
+			break
+		}
+		log.Printf("Starting phase %d of %d: %s\n", i + 1, len(s.phases), phase.name)
+		var network *netsim.Impaired
+		if impaired[i] {
+			network = netsim.Impair(netsim.UDP, configs[i])
+			options[i].Network = network
+		}
+		results, err := Run(ctx, options[i])
+		if results == nil {
+			if err == nil {
+				err = errors.New("run ended without results")
+			}
+			log.Printf("Phase %q failed: %v\n", phase.name, err)
+			code = 1
+			break
+		}
+		phaseReport := scenarioPhaseReport{Name: phase.name, Results: *results}
+		if network != nil {
+			stats := network.Stats()
+			phaseReport.Impairment = &scenarioImpairment{Sent: stats.Sent, Lost: stats.Lost, Reordered: stats.Reordered, Delivered: stats.Delivered, Overflowed: stats.Overflowed}
+		}
+		if err != nil {
+			phaseReport.Error = err.Error()
+		}
+		report.Phases = append(report.Phases, phaseReport)
+		if err == ErrThresholdExceeded || err == ErrServerNotListening {
+			if code == 0 {
+				code = ExitThresholdExceeded
+				if err == ErrServerNotListening {
+					code = ExitServerNotListening
+				}
+			}
+			if !*keepGoing {
+				log.Printf("Stopping after phase %q: %v\n", phase.name, err)
+				break
+			}
+		} else if err != nil {
+			log.Printf("Phase %q failed: %v\n", phase.name, err)
+			code = 1
+			break
+		}
+	}
+
+	if len(report.Phases) > 0 {
+		logScenarioReport(report)
+	}
+	if *out != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(*out, append(data, '\n'), 0644)
+		}
+		if err != nil {
+			log.Println("Could not write report: ", err)
+		} else {
+			log.Printf("Wrote report to %s\n", *out)
+		}
+	}
+	return code
+}
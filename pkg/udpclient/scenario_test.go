@@ -0,0 +1,124 @@
+package udpclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testScenario = `# Ramp up, then lose packets
+name: "ramp # and loss"
+host: server
+hash_percent: 50
+
+phases:
+  - name: warm
+    rate: 500
+    duration: 10s
+  -
+    name: 'lossy'   # phase comment
+    rate: 2000
+    duration: 30s
+    payload_size: 1200
+    hash_percent: 0
+    loss_percent: 2
+    latency: 5ms
+`
+
+func TestParseScenario(t *testing.T) {
+	s, err := parseScenario(strings.NewReader(testScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.name != "ramp # and loss" || len(s.settings) != 2 || len(s.phases) != 2 || s.phases[0].name != "warm" || s.phases[1].name != "lossy" {
+		t.Fatalf("parsed %+v", s)
+	}
+
+	warm, _, impaired, err := s.phaseOptions(s.phases[0])
+	if err != nil || impaired || warm.Host != "server" || warm.PPS != 500 || warm.ConnTime != "10s" || warm.HashPercent != 50 || warm.PayloadSize != 100 {
+		t.Fatalf("first phase has options %+v, impaired %v, %v", warm, impaired, err)
+	}
+	lossy, config, impaired, err := s.phaseOptions(s.phases[1])
+	if err != nil || !impaired || lossy.PPS != 2000 || lossy.PayloadSize != 1200 || lossy.HashPercent != 0 {
+		t.Fatalf("second phase has options %+v, impaired %v, %v", lossy, impaired, err)
+	}
+	if config.Loss != 0.02 || config.Latency != 5 * time.Millisecond || config.Reorder != 0 {
+		t.Fatalf("second phase has impairments %+v", config)
+	}
+}
+
+// Mistakes must be reported with the line they are on
+func TestParseScenarioErrors(t *testing.T) {
+	for _, test := range []struct {
+		scenario	string
+		err			string
+	}{
+		{"host: server\n", "no phases"},
+		{"phases:\n  - rate 500\n", "line 2"},
+		{"phases:\n  - rate: 500\n\tduration: 1s\n", "line 3"},
+		{"  rate: 500\n", "line 1"},
+		{"phases:\n  rate: 500\n", "line 2"},
+		{"phases:\n  - rate: 500\n  - rate: 600\n    pps: 5\n    nope: 1\n", "line 5: unknown setting nope"},
+		{"phases:\n  - out: results.json\n", "line 2: scenarios cannot set out"},
+		{"phases:\n  - rate: fast\n", "line 2: invalid value"},
+		{"phases:\n  - loss_percent: 200\n", "between 0 and 100"},
+	} {
+		s, err := parseScenario(strings.NewReader(test.scenario))
+		for i := 0; err == nil && i < len(s.phases); i++ {
+			_, _, _, err = s.phaseOptions(s.phases[i])
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("scenario %q gave error %v, want %q", test.scenario, err, test.err)
+		}
+	}
+}
+
+// Phases that serve metrics on the same address each get to serve them, and leave the address free once the scenario ends
+func TestScenarioPhasesShareMetricsAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	dir := t.TempDir()
+	scenarioFile := filepath.Join(dir, "scenario.yaml")
+	reportFile := filepath.Join(dir, "report.json")
+	scenario := fmt.Sprintf("host: 127.0.0.1\nport: %s\ncount: 20\nrate: 1000\ndrain: 200ms\nstats_interval: 0\n\nphases:\n  - name: first\n    metrics_addr: %s\n  - name: second\n    metrics_addr: %s\n",
+		startReflector(t, "sha256"), addr, addr)
+	if err := os.WriteFile(scenarioFile, []byte(scenario), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := Scenario(context.Background(), []string{"-out", reportFile, scenarioFile}); code != 0 {
+		t.Fatalf("scenario exited with %d", code)
+	}
+
+	data, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report scenarioReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Phases) != 2 {
+		t.Fatalf("report has %d phases, want 2", len(report.Phases))
+	}
+	for _, phase := range report.Phases {
+		if phase.Error != "" || phase.Results.Received != 20 {
+			t.Errorf("phase %s received %d packets with error %q", phase.Name, phase.Results.Received, phase.Error)
+		}
+	}
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("metrics address still in use after the scenario ended: %v", err)
+	}
+	listener.Close()
+}
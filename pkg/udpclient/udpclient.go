@@ -0,0 +1,4519 @@
+// Package udpclient is the load generator of udp_client, which sends sequenced packets to a UDP server and gathers
+// statistics on their reflections, for embedding in other programs and test harnesses
+package udpclient
+
+import (
+	"log"
+	"net"
+	"encoding/binary"
+	"time"
+	"sync"
+	"strconv"
+	"strings"
+	"fmt"
+	"flag"
+	"context"
+	"math/rand"
+	"encoding/hex"
+	"math"
+	"math/bits"
+	"os"
+	"bufio"
+	"sort"
+	"encoding/csv"
+	"encoding/json"
+	"sync/atomic"
+	"syscall"
+	"errors"
+	"path/filepath"
+	"crypto/sha256"
+	"net/http"
+	"io"
+	"bytes"
+	"reflect"
+
+	"github.com/nbopardi/udp_client_server/internal/digest"
+	"github.com/nbopardi/udp_client_server/internal/protocol"
+	"github.com/nbopardi/udp_client_server/pkg/dashboard"
+	"github.com/nbopardi/udp_client_server/pkg/netsim"
+	"github.com/nbopardi/udp_client_server/pkg/dtls"
+	"github.com/nbopardi/udp_client_server/pkg/noise"
+	"github.com/nbopardi/udp_client_server/pkg/pb"
+)
+
+// Exit code when the results exceed the max_loss or max_p99 thresholds, distinct from the 1 of a fatal error
+const ExitThresholdExceeded = 3
+
+// Exit code when a server was not listening, going by the ICMP port unreachable errors and the lack of any reflection
+const ExitServerNotListening = 4
+
+// Smallest payload size, which fits the header
+// The largest depends on the size of the hash, so it is worked out for each run
+const minPayloadSize = protocol.HeaderSize
+
+// State of a single run worked out from its options, so that runs in the same process share nothing
+// algo: the hash algorithm of the digest the server appends to each packet's payload, which must match the server's
+// hashSize: the number of bytes in the digest
+// maxPayloadSize: the largest payload that fits a single UDP datagram with the digest
+// config: the value of every option by the name of its command line flag, recorded with the results
+type runState struct {
+	algo			digest.Algorithm
+	hashSize		int
+	maxPayloadSize	int
+	config			map[string]string
+}
+
+// Creates the state of a run with the given options
+func newRunState(options *Options) (*runState, error) {
+	algo, err := digest.Lookup(options.Algo)
+	if err != nil {
+		return nil, err
+	}
+	return &runState{
+		algo: algo,
+		hashSize: algo.Size(),
+		maxPayloadSize: protocol.MaxDatagramSize - algo.Size(),
+		config: options.config(),
+	}, nil
+}
+
+// Token bucket used to pace the rate that packets are sent at
+// rate: the number of tokens added to the bucket per second
+// capacity: the max number of tokens the bucket can hold, which bounds the size of a burst
+// tokens: the number of tokens currently in the bucket
+// last: the time the bucket was last refilled
+type tokenBucket struct {
+	rate		float64
+	capacity	float64
+	tokens		float64
+	last		time.Time
+}
+
+// Creates a token bucket that allows rate packets per second
+// The bucket holds 10 ms worth of tokens so that sleeping between sends does not limit the rate
+func newTokenBucket(rate float64) *tokenBucket {
+	capacity := rate / 100
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: 1, last: time.Now()}
+}
+
+// Adds the tokens accumulated since the last refill to the bucket
+func (tb *tokenBucket) refill() {
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+	tb.last = now
+}
+
+// Changes the number of tokens added to the bucket per second
+func (tb *tokenBucket) setRate(rate float64) {
+	tb.refill()
+	tb.rate = rate
+	tb.capacity = rate / 100
+	if tb.capacity < 1 {
+		tb.capacity = 1
+	}
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+}
+
+// Blocks until a token is available and then takes it from the bucket
+func (tb *tokenBucket) wait() {
+	tb.refill()
+	for tb.tokens < 1 {
+		// Sleep for roughly the amount of time needed for the missing token to be added
+		time.Sleep(time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second)))
+		tb.refill()
+	}
+	tb.tokens--
+}
+
+// Paces packets so that the time between sends is drawn from a random distribution with a mean of 1/rate
+// Realistic arrivals queue up more than constant-rate traffic does
+// distribution: poisson (exponentially distributed gaps) or uniform (gaps uniformly distributed between 0 and 2/rate)
+// rate: the mean number of packets per second
+// random: the source of the random gaps
+// next: the time the next packet is due
+type randomArrivals struct {
+	distribution	string
+	rate		float64
+	random		*rand.Rand
+	next		time.Time
+}
+
+// Draws the time until the next packet from the distribution
+func (ra *randomArrivals) gap() time.Duration {
+	mean := float64(time.Second) / ra.rate
+	if ra.distribution == "uniform" {
+		return time.Duration(ra.random.Float64() * 2 * mean)
+	}
+	return time.Duration(ra.random.ExpFloat64() * mean)
+}
+
+// Changes the mean number of packets sent per second
+func (ra *randomArrivals) setRate(rate float64) {
+	ra.rate = rate
+}
+
+// Blocks until the next packet is due and then draws the time of the packet after it
+func (ra *randomArrivals) wait() {
+	now := time.Now()
+	if ra.next.After(now) {
+		time.Sleep(ra.next.Sub(now))
+	} else if now.Sub(ra.next) > 10 * time.Millisecond {
+		// Like the token bucket, only catch up on 10 ms worth of packets after falling behind
+		ra.next = now.Add(-10 * time.Millisecond)
+	}
+	ra.next = ra.next.Add(ra.gap())
+}
+
+// Paces packets sent at a rate that can change over time
+type rateLimiter interface {
+	wait()
+	setRate(rate float64)
+}
+
+// Creates a rate limiter for rate packets per second, with the time between sends following the arrival distribution
+// constant arrivals use a token bucket, and poisson or uniform arrivals draw random gaps using the seed
+func newRateLimiter(arrival string, rate float64, seed int64) rateLimiter {
+	if arrival == "poisson" || arrival == "uniform" {
+		return &randomArrivals{distribution: arrival, rate: rate, random: rand.New(rand.NewSource(seed)), next: time.Now()}
+	}
+	return newTokenBucket(rate)
+}
+
+// Paces packets in bursts of back-to-back packets, with a new burst started every interval
+// A fixed gap between packets is a burst of a single packet every gap
+// burst: the number of back-to-back packets in each burst
+// interval: the time between the starts of consecutive bursts
+// jitter: the fraction of the interval each time between bursts randomly varies by either way, or 0 for a fixed interval
+// random: source of the variations of the interval, which may be shared with other choices of the same sender
+// next: the time the next burst is due to start
+// sentInBurst: the number of packets of the current burst already sent
+type burstPacer struct {
+	burst		int
+	interval	time.Duration
+	jitter		float64
+	random		*rand.Rand
+	next		time.Time
+	sentInBurst	int
+}
+
+// Creates a burst pacer whose first burst starts right away
+// The random source is used to vary the interval when jittered
+func newBurstPacer(burst int, interval time.Duration, jitter float64, random *rand.Rand) *burstPacer {
+	return &burstPacer{burst: burst, interval: interval, jitter: jitter, random: random, next: time.Now()}
+}
+
+// Returns the time until the next burst, drawn uniformly from the interval plus or minus the jitter
+func (bp *burstPacer) nextInterval() time.Duration {
+	if bp.jitter == 0 {
+		return bp.interval
+	}
+	return time.Duration(float64(bp.interval) * (1 + bp.jitter * (2 * bp.random.Float64() - 1)))
+}
+
+// Blocks until the next packet is due
+func (bp *burstPacer) wait() {
+	// Wait for the start of the next burst once the current burst is over
+	if bp.sentInBurst == 0 {
+		now := time.Now()
+		if bp.next.After(now) {
+			time.Sleep(bp.next.Sub(now))
+		} else if now.Sub(bp.next) > bp.interval {
+			// Start over from now instead of sending the missed bursts back-to-back after falling behind
+			bp.next = now
+		}
+		bp.next = bp.next.Add(bp.nextInterval())
+	}
+
+	bp.sentInBurst++
+	if bp.sentInBurst == bp.burst {
+		bp.sentInBurst = 0
+	}
+}
+
+// Reads the messages sent as payloads (after the header) from a file or stdin, shared by every sender of every connection
+// Messages are separated by newlines, or each preceded by its length as a big endian uint32
+// When looping, the messages read are kept and sent again from the first once the input is exhausted
+// delim: how messages are separated: newline or length
+// kept: the messages read so far, when looping
+// replay: the index of the next kept message to send once the input is exhausted
+// exhausted: whether the whole input has been read
+// sentBytes, sentCount: the number of bytes and messages handed out, for working out the average payload size
+// maxSize: the largest message that fits a payload, with longer ones skipped
+type messageSource struct {
+	mutex		sync.Mutex
+	file		*os.File
+	reader		*bufio.Reader
+	delim		string
+	loop		bool
+	maxSize		int
+	kept		[][]byte
+	replay		int
+	exhausted	bool
+	sentBytes	int64
+	sentCount	int64
+}
+
+// Opens the file to read messages of up to maxSize bytes from, or stdin if the file name is -
+func newMessageSource(fileName string, delim string, loop bool, maxSize int) (*messageSource, error) {
+	if delim != "newline" && delim != "length" {
+		return nil, fmt.Errorf("payload delimiter must be newline or length")
+	}
+	file := os.Stdin
+	if fileName != "-" {
+		var err error
+		file, err = os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &messageSource{file: file, reader: bufio.NewReader(file), delim: delim, loop: loop, maxSize: maxSize}, nil
+}
+
+// Reads the next message from the input, returning io.EOF once there are no more
+func (src *messageSource) read() ([]byte, error) {
+	if src.delim == "length" {
+		var length [4]byte
+		_, err := io.ReadFull(src.reader, length[:])
+		if err != nil {
+			return nil, err
+		}
+		message := make([]byte, binary.BigEndian.Uint32(length[:]))
+		_, err = io.ReadFull(src.reader, message)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return message, err
+	}
+
+	// A last line without a newline is still a message
+	line, err := src.reader.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return bytes.TrimRight(line, "\r\n"), err
+}
+
+// Returns the next message to send, or false once every message has been sent and not looping
+// Messages too long to fit in a single datagram after the header are skipped
+func (src *messageSource) next() ([]byte, bool) {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+
+	for !src.exhausted {
+		message, err := src.read()
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Could not read payload message: ", err)
+			}
+			src.exhausted = true
+			src.file.Close()
+			break
+		}
+		if len(message) > src.maxSize {
+			log.Printf("Skipping payload message of %d bytes, which is longer than the max of %d\n", len(message), src.maxSize)
+			continue
+		}
+		if src.loop {
+			src.kept = append(src.kept, message)
+		}
+		src.sentBytes += int64(len(message))
+		src.sentCount++
+		return message, true
+	}
+
+	// Start over from the first message once the input is exhausted if looping
+	if !src.loop || len(src.kept) == 0 {
+		return nil, false
+	}
+	message := src.kept[src.replay]
+	src.replay = (src.replay + 1) % len(src.kept)
+	src.sentBytes += int64(len(message))
+	src.sentCount++
+	return message, true
+}
+
+// Returns the average number of bytes in the payloads sent so far, counting the header
+func (src *messageSource) meanPayloadSize() int {
+	src.mutex.Lock()
+	defer src.mutex.Unlock()
+	if src.sentCount == 0 {
+		return protocol.HeaderSize
+	}
+	return protocol.HeaderSize + int(src.sentBytes / src.sentCount)
+}
+
+// Generates the contents of each packet's payload after the header
+// pattern: one of zeros, incrementing, random, or hex
+// template: bytes repeated across the payload for the hex pattern
+// random: source of random bytes for the random pattern
+type payloadGenerator struct {
+	pattern		string
+	template	[]byte
+	random		*rand.Rand
+}
+
+// Creates a payload generator for the given pattern
+// The seed is used by the random pattern and the hex template by the hex pattern
+func newPayloadGenerator(pattern string, seed int64, hexTemplate string) (*payloadGenerator, error) {
+	gen := &payloadGenerator{pattern: pattern}
+	switch pattern {
+	case "zeros", "incrementing":
+	case "random":
+		gen.random = rand.New(rand.NewSource(seed))
+	case "hex":
+		template, err := hex.DecodeString(hexTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode hex template: %v", err)
+		}
+		if len(template) == 0 {
+			return nil, fmt.Errorf("hex pattern requires a non-empty template")
+		}
+		gen.template = template
+	default:
+		return nil, fmt.Errorf("unknown payload pattern %q", pattern)
+	}
+	return gen, nil
+}
+
+// Fills the part of the payload after the header according to the generator's pattern
+func (gen *payloadGenerator) fill(payload []byte) {
+	body := payload[protocol.HeaderSize:]
+	switch gen.pattern {
+	case "incrementing":
+		for i := range body {
+			body[i] = byte(i)
+		}
+	case "random":
+		gen.random.Read(body)
+	case "hex":
+		for i := range body {
+			body[i] = gen.template[i % len(gen.template)]
+		}
+	}
+}
+
+// A packet received from the server along with the time it was read from the connection
+type receivedPacket struct {
+	packet		[]byte
+	recvTime	time.Time
+}
+
+// Number of bits of linear sub-buckets in each power of two range of the latency histogram
+// 64 sub-buckets keeps the error of any recorded value under 1.6%
+const histSubBucketBits = 6
+const histSubBuckets = 1 << histSubBucketBits
+
+// HDR-style histogram of latencies in nanoseconds
+// Values are grouped into power of two ranges, each split into linear sub-buckets
+type latencyHistogram struct {
+	counts	[]uint64
+	total	uint64
+	max		uint64
+}
+
+// Creates a histogram able to hold any non-negative int64 value
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]uint64, (64 - histSubBucketBits + 1) * histSubBuckets)}
+}
+
+// Returns the index of the bucket that holds the given value
+func histBucketIndex(value uint64) int {
+	if value < histSubBuckets {
+		return int(value)
+	}
+	// Shift the value so that it lands in [histSubBuckets, 2 * histSubBuckets)
+	shift := bits.Len64(value) - histSubBucketBits - 1
+	return (shift + 1) * histSubBuckets + int(value >> uint(shift)) - histSubBuckets
+}
+
+// Returns the smallest value that falls into the bucket at the given index
+func histBucketLowerBound(index int) uint64 {
+	if index < histSubBuckets {
+		return uint64(index)
+	}
+	shift := index / histSubBuckets - 1
+	return uint64(index % histSubBuckets + histSubBuckets) << uint(shift)
+}
+
+// Returns the largest value that falls into the bucket at the given index
+func histBucketUpperBound(index int) uint64 {
+	return histBucketLowerBound(index + 1) - 1
+}
+
+// Records a single latency in the histogram
+func (hist *latencyHistogram) record(latency time.Duration) {
+	if latency < 0 {
+		latency = 0
+	}
+	hist.counts[histBucketIndex(uint64(latency))]++
+	hist.total++
+	if uint64(latency) > hist.max {
+		hist.max = uint64(latency)
+	}
+}
+
+// Returns the latency at the given percentile (i.e. 99.9)
+// The upper bound of the bucket holding the percentile is returned (capped at the largest recorded latency),
+// so the latency is never underestimated
+func (hist *latencyHistogram) percentile(p float64) time.Duration {
+	if hist.total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(p / 100 * float64(hist.total)))
+	if target < 1 {
+		target = 1
+	}
+	var seen uint64
+	for index, count := range hist.counts {
+		seen += count
+		if seen >= target {
+			if upper := histBucketUpperBound(index); upper < hist.max {
+				return time.Duration(upper)
+			}
+			break
+		}
+	}
+	return time.Duration(hist.max)
+}
+
+// Adds the latencies recorded in another histogram to this one
+func (hist *latencyHistogram) merge(other *latencyHistogram) {
+	for index, count := range other.counts {
+		hist.counts[index] += count
+	}
+	hist.total += other.total
+	if other.max > hist.max {
+		hist.max = other.max
+	}
+}
+
+// Writes every non-empty bucket of the histogram to a CSV file
+// Each row holds the bucket's lower and upper bound in nanoseconds and the number of latencies in it
+func (hist *latencyHistogram) dump(fileName string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	fmt.Fprintln(writer, "lower_ns,upper_ns,count")
+	for index, count := range hist.counts {
+		if count > 0 {
+			fmt.Fprintf(writer, "%d,%d,%d\n", histBucketLowerBound(index), histBucketUpperBound(index), count)
+		}
+	}
+	err = writer.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Round trip time statistics of the packets reflected by the server
+// hist: histogram of every round trip time, used for percentiles
+type rttStats struct {
+	count	int
+	sum		time.Duration
+	min		time.Duration
+	max		time.Duration
+	hist	*latencyHistogram
+}
+
+// Records the round trip time of a single packet
+func (stats *rttStats) add(rtt time.Duration) {
+	if stats.count == 0 || rtt < stats.min {
+		stats.min = rtt
+	}
+	if rtt > stats.max {
+		stats.max = rtt
+	}
+	stats.sum += rtt
+	stats.count++
+	stats.hist.record(rtt)
+}
+
+// Adds the round trip times recorded in other statistics to these ones
+func (stats *rttStats) merge(other *rttStats) {
+	if other.count == 0 {
+		return
+	}
+	if stats.count == 0 || other.min < stats.min {
+		stats.min = other.min
+	}
+	if other.max > stats.max {
+		stats.max = other.max
+	}
+	stats.sum += other.sum
+	stats.count += other.count
+	stats.hist.merge(other.hist)
+}
+
+// Summarizes the recorded round trip times
+func (stats *rttStats) summary() rttSummary {
+	return rttSummary{
+		MinNs: int64(stats.min),
+		AvgNs: int64(stats.avg()),
+		MaxNs: int64(stats.max),
+		P50Ns: int64(stats.hist.percentile(50)),
+		P90Ns: int64(stats.hist.percentile(90)),
+		P99Ns: int64(stats.hist.percentile(99)),
+		P999Ns: int64(stats.hist.percentile(99.9)),
+	}
+}
+
+// Returns the average round trip time of all recorded packets
+func (stats *rttStats) avg() time.Duration {
+	if stats.count == 0 {
+		return 0
+	}
+	return stats.sum / time.Duration(stats.count)
+}
+
+// Inter-arrival jitter estimator as defined in RFC 3550 section 6.4.1
+// transit: the difference between the receive and send time of the previous packet
+// jitter: the running jitter estimate in nanoseconds
+type jitterEstimator struct {
+	started	bool
+	transit	int64
+	jitter	float64
+}
+
+// Updates the jitter estimate with a packet's send and receive times in nanoseconds
+func (est *jitterEstimator) add(sendTime int64, recvTime int64) {
+	transit := recvTime - sendTime
+	if est.started {
+		d := float64(transit - est.transit)
+		est.jitter += (math.Abs(d) - est.jitter) / 16
+	}
+	est.transit = transit
+	est.started = true
+}
+
+// Returns the current jitter estimate
+func (est *jitterEstimator) value() time.Duration {
+	return time.Duration(est.jitter)
+}
+
+// Tracks reflections that arrive out of order based on their sequence numbers
+// count: number of packets that arrived after a packet with a higher sequence number
+// maxDistance: largest gap between the highest sequence number seen and a late packet's sequence number
+// highest: highest sequence number received so far
+type reorderStats struct {
+	started		bool
+	count		int
+	maxDistance	uint64
+	highest		uint64
+}
+
+// Records the sequence number of a newly received packet
+func (stats *reorderStats) add(seq uint64) {
+	if !stats.started || seq > stats.highest {
+		stats.highest = seq
+		stats.started = true
+		return
+	}
+	stats.count++
+	if distance := stats.highest - seq; distance > stats.maxDistance {
+		stats.maxDistance = distance
+	}
+}
+
+// Number of samples collected before the first estimate of a server's clock offset
+const owdEstimateSamples = 100
+
+// Raw one-way delays of a single packet, measured with the client's and the server's clocks
+// forward: server receive time minus client send time, which is off by the clock offset
+// reverse: client receive time minus server send time, which is off by minus the clock offset
+type owdSample struct {
+	forward		int64
+	reverse		int64
+}
+
+// One-way delay statistics for packets to and from a single server, whose clock can be offset from the client's
+// The server appends the times it received and reflected each packet, so the delay in each direction is known
+// up to the clock offset, which is estimated NTP style from the packet with the smallest round trip time
+// (excluding the server's processing time), assuming that packet's delays were symmetric
+// pending: raw samples held until the offset is first estimated
+// offset: the current estimate of the server's clock minus the client's clock in nanoseconds
+// bestDelay: the smallest round trip time excluding the server's processing time, from the sample the offset comes from
+// histOffset: the offset the histograms were recorded with, which later estimates are corrected against
+// forwardMin, forwardMax, forwardSum, reverseMin, reverseMax, reverseSum: raw delays in nanoseconds
+// processingSum: total time the server held the packets in nanoseconds
+type owdStats struct {
+	mutex			sync.Mutex
+	pending			[]owdSample
+	estimated		bool
+	offset			int64
+	bestDelay		int64
+	histOffset		int64
+	count			int64
+	forwardMin		int64
+	forwardMax		int64
+	forwardSum		int64
+	reverseMin		int64
+	reverseMax		int64
+	reverseSum		int64
+	processingSum	int64
+	forward			*latencyHistogram
+	reverse			*latencyHistogram
+}
+
+// Creates empty one-way delay statistics
+func newOwdStats() *owdStats {
+	return &owdStats{forward: newLatencyHistogram(), reverse: newLatencyHistogram()}
+}
+
+// Records the client send, server receive, server send, and client receive times of a packet in nanoseconds
+func (stats *owdStats) add(clientSend int64, serverRecv int64, serverSend int64, clientRecv int64) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	sample := owdSample{serverRecv - clientSend, clientRecv - serverSend}
+
+	// Estimate the clock offset from the packet with the least delay, which is least likely to be skewed by queueing
+	delay := sample.forward + sample.reverse
+	if stats.count == 0 || delay < stats.bestDelay {
+		stats.bestDelay = delay
+		stats.offset = (sample.forward - sample.reverse) / 2
+	}
+
+	if stats.count == 0 || sample.forward < stats.forwardMin {
+		stats.forwardMin = sample.forward
+	}
+	if stats.count == 0 || sample.forward > stats.forwardMax {
+		stats.forwardMax = sample.forward
+	}
+	if stats.count == 0 || sample.reverse < stats.reverseMin {
+		stats.reverseMin = sample.reverse
+	}
+	if stats.count == 0 || sample.reverse > stats.reverseMax {
+		stats.reverseMax = sample.reverse
+	}
+	stats.forwardSum += sample.forward
+	stats.reverseSum += sample.reverse
+	stats.processingSum += serverSend - serverRecv
+	stats.count++
+
+	// Hold the first samples until there are enough of them to estimate the offset
+	if !stats.estimated {
+		stats.pending = append(stats.pending, sample)
+		if len(stats.pending) >= owdEstimateSamples {
+			stats.flush()
+		}
+		return
+	}
+	stats.record(sample)
+}
+
+// Records a sample in the histograms, corrected by the offset the histograms use
+// Must be called with the mutex held
+func (stats *owdStats) record(sample owdSample) {
+	stats.forward.record(time.Duration(sample.forward - stats.histOffset))
+	stats.reverse.record(time.Duration(sample.reverse + stats.histOffset))
+}
+
+// Fixes the offset the histograms use at the current estimate and records the pending samples
+// Must be called with the mutex held
+func (stats *owdStats) flush() {
+	stats.estimated = true
+	stats.histOffset = stats.offset
+	for _, sample := range stats.pending {
+		stats.record(sample)
+	}
+	stats.pending = nil
+}
+
+// One-way delays to and from a single server in nanoseconds, corrected by the estimated clock offset
+type owdResults struct {
+	Target					string		`json:"target"`
+	Samples					int64		`json:"samples"`
+	ClockOffsetNs			int64		`json:"clock_offset_ns"`
+	ServerProcessingAvgNs	int64		`json:"server_processing_avg_ns"`
+	Forward					rttSummary	`json:"forward"`
+	Reverse					rttSummary	`json:"reverse"`
+}
+
+// Builds the one-way delay results with the final estimate of the clock offset
+// Percentiles recorded with an earlier estimate are shifted by how much the estimate changed since
+func (stats *owdStats) results(target string) owdResults {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	if !stats.estimated {
+		stats.flush()
+	}
+
+	results := owdResults{Target: target, Samples: stats.count, ClockOffsetNs: stats.offset}
+	if stats.count == 0 {
+		return results
+	}
+	shift := stats.offset - stats.histOffset
+	results.ServerProcessingAvgNs = stats.processingSum / stats.count
+	results.Forward = rttSummary{
+		MinNs: stats.forwardMin - stats.offset,
+		AvgNs: stats.forwardSum / stats.count - stats.offset,
+		MaxNs: stats.forwardMax - stats.offset,
+		P50Ns: int64(stats.forward.percentile(50)) - shift,
+		P90Ns: int64(stats.forward.percentile(90)) - shift,
+		P99Ns: int64(stats.forward.percentile(99)) - shift,
+		P999Ns: int64(stats.forward.percentile(99.9)) - shift,
+	}
+	results.Reverse = rttSummary{
+		MinNs: stats.reverseMin + stats.offset,
+		AvgNs: stats.reverseSum / stats.count + stats.offset,
+		MaxNs: stats.reverseMax + stats.offset,
+		P50Ns: int64(stats.reverse.percentile(50)) + shift,
+		P90Ns: int64(stats.reverse.percentile(90)) + shift,
+		P99Ns: int64(stats.reverse.percentile(99)) + shift,
+		P999Ns: int64(stats.reverse.percentile(99.9)) + shift,
+	}
+	return results
+}
+
+// Counts sent and received packets by the time interval they were sent in
+// Shows whether loss was spread evenly over a run or concentrated in bursts
+// sent: number of packets sent in each interval
+// received: number of packets sent in each interval that were received
+type lossTracker struct {
+	mutex		sync.Mutex
+	start		time.Time
+	interval	time.Duration
+	sent		[]int
+	received	[]int
+}
+
+// Creates a loss tracker with intervals of the given length beginning at the start time
+func newLossTracker(interval time.Duration, start time.Time) *lossTracker {
+	return &lossTracker{start: start, interval: interval}
+}
+
+// Returns the index of the interval that a send time falls into, growing the intervals as needed
+// Must be called with the mutex held
+func (lt *lossTracker) intervalIndex(sendTime time.Time) int {
+	index := 0
+	if sendTime.After(lt.start) {
+		index = int(sendTime.Sub(lt.start) / lt.interval)
+	}
+	for len(lt.sent) <= index {
+		lt.sent = append(lt.sent, 0)
+		lt.received = append(lt.received, 0)
+	}
+	return index
+}
+
+// Records a packet sent at the given time
+func (lt *lossTracker) recordSent(sendTime time.Time) {
+	if lt.interval <= 0 {
+		return
+	}
+	lt.mutex.Lock()
+	lt.sent[lt.intervalIndex(sendTime)]++
+	lt.mutex.Unlock()
+}
+
+// Records that a packet sent at the given time was received
+func (lt *lossTracker) recordReceived(sendTime time.Time) {
+	if lt.interval <= 0 {
+		return
+	}
+	lt.mutex.Lock()
+	lt.received[lt.intervalIndex(sendTime)]++
+	lt.mutex.Unlock()
+}
+
+// Adds the packets counted by another loss tracker to this one, matching intervals by their index
+func (lt *lossTracker) merge(other *lossTracker) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	other.mutex.Lock()
+	defer other.mutex.Unlock()
+	for len(lt.sent) < len(other.sent) {
+		lt.sent = append(lt.sent, 0)
+		lt.received = append(lt.received, 0)
+	}
+	for i := range other.sent {
+		lt.sent[i] += other.sent[i]
+		lt.received[i] += other.received[i]
+	}
+}
+
+// Returns the number of packets sent and received in the interval with the given index
+func (lt *lossTracker) counts(index int) (int, int) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	if index < 0 || index >= len(lt.sent) {
+		return 0, 0
+	}
+	return lt.sent[index], lt.received[index]
+}
+
+// Returns the percentage of sent packets that were lost
+func lossPercent(sent int, received int) float64 {
+	if sent == 0 {
+		return 0
+	}
+	return float64(sent - received) / float64(sent) * 100
+}
+
+// Logs the number and percentage of lost packets for each interval
+func (lt *lossTracker) report() {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	for i := range lt.sent {
+		lost := lt.sent[i] - lt.received[i]
+		log.Printf("Interval %v-%v: sent %d, lost %d (%.2f%%)\n", time.Duration(i) * lt.interval, time.Duration(i + 1) * lt.interval, lt.sent[i], lost, lossPercent(lt.sent[i], lt.received[i]))
+	}
+}
+
+// Writes one CSV record per reflected packet to a trace file
+// Each record holds the connection, sequence number, send and receive timestamps, round trip time,
+// whether the appended hash matches the payload, and whether the packet was a duplicate
+// Safe for concurrent use by the goroutines of every connection
+// fileName: the trace file, or the name the numbered parts are derived from when rotating
+// rotating: whether the records are split across numbered parts (i.e. trace.0000.csv, trace.0001.csv)
+// part: the number of the part currently written to
+type packetTracer struct {
+	mutex		sync.Mutex
+	fileName	string
+	rotating	bool
+	part		int
+	file		*os.File
+	writer		*bufio.Writer
+}
+
+// Creates a trace file and writes its header
+// When rotating, the first numbered part is created instead
+func newPacketTracer(fileName string, rotating bool) (*packetTracer, error) {
+	tracer := &packetTracer{fileName: fileName, rotating: rotating}
+	err := tracer.open()
+	if err != nil {
+		return nil, err
+	}
+	return tracer, nil
+}
+
+// Returns the name of the current trace file
+func (tracer *packetTracer) currentFileName() string {
+	if !tracer.rotating {
+		return tracer.fileName
+	}
+	ext := filepath.Ext(tracer.fileName)
+	return fmt.Sprintf("%s.%04d%s", strings.TrimSuffix(tracer.fileName, ext), tracer.part, ext)
+}
+
+// Creates the current trace file and writes its header
+func (tracer *packetTracer) open() error {
+	file, err := os.Create(tracer.currentFileName())
+	if err != nil {
+		return err
+	}
+	tracer.file = file
+	tracer.writer = bufio.NewWriter(file)
+	fmt.Fprintln(tracer.writer, "conn,seq,send_ns,recv_ns,rtt_ns,hash_ok,duplicate")
+	return nil
+}
+
+// Writes out any buffered records, so they survive the process being killed
+func (tracer *packetTracer) flush() error {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	return tracer.writer.Flush()
+}
+
+// Closes the current trace file and moves on to the next numbered part
+// If the next part cannot be created, records keep going to the current one
+func (tracer *packetTracer) rotate() error {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	err := tracer.writer.Flush()
+	if err != nil {
+		return err
+	}
+	file := tracer.file
+	writer := tracer.writer
+	tracer.part++
+	err = tracer.open()
+	if err != nil {
+		tracer.part--
+		tracer.file = file
+		tracer.writer = writer
+		return err
+	}
+	return file.Close()
+}
+
+// Rotates the trace file every interval until done, so no single file of a long run grows without bound
+func (tracer *packetTracer) rotateEvery(interval time.Duration, doneChan <-chan struct{}, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneChan:
+			return
+		case <-ticker.C:
+			err := tracer.rotate()
+			if err != nil {
+				log.Println("Could not rotate trace file: ", err)
+			}
+		}
+	}
+}
+
+// Writes the record of a single reflected packet
+func (tracer *packetTracer) record(connID int, seq uint64, sendTime int64, recvTime int64, hashOk bool, duplicate bool) {
+	tracer.mutex.Lock()
+	fmt.Fprintf(tracer.writer, "%d,%d,%d,%d,%d,%t,%t\n", connID, seq, sendTime, recvTime, recvTime - sendTime, hashOk, duplicate)
+	tracer.mutex.Unlock()
+}
+
+// Flushes any buffered records and closes the trace file
+func (tracer *packetTracer) close() error {
+	err := tracer.writer.Flush()
+	if closeErr := tracer.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Checks that the hash appended to a reflected packet is the hash of its payload
+func (rs *runState) hashMatches(packet []byte, payloadSize int) bool {
+	return bytes.Equal(packet[payloadSize:payloadSize + rs.hashSize], rs.algo.Sum(packet[:payloadSize]))
+}
+
+// All statistics gathered by the client during a run
+// The counters are updated atomically so they can be read while the run is in progress
+// sent: number of packets sent to the server
+// received: number of packets reflected by the server that were matched to a sent packet
+// receivedButNotSent: number of packets reflected before being recorded as sent
+// duplicates: number of reflections of packets that had already been received
+// retransmissions, recovered, abandoned: number of retransmissions sent, packets delivered by a retransmission, and packets given up on
+// windowTimeouts: number of times a full flow control window was presumed to hold a lost packet
+// firstMeasured: the lowest sequence number sent after the warm-up period
+// mutex: guards the round trip time, jitter, reordering, and window statistics
+// echoRTT, hashRTT: round trip times of the packets echoed by the server and of those hashed by the HTTP backend
+// window: histogram of the round trip times since the last live stats line
+// warmupEnd: packets sent before this time (in nanoseconds since the Unix epoch) are excluded from the statistics
+// gaps: the ranges of missing sequence numbers, found once the run is over
+// heartbeats: number of heartbeats sent while the connection was idle
+// misattributed: number of reflections received on the connection that carried another connection's ID
+// portUnreachable: number of sends and receives that failed because of an ICMP port unreachable from the server
+// err: the first error that stopped the connection, guarded by mutex
+type clientStats struct {
+	sent				int64
+	received			int64
+	receivedButNotSent	int64
+	duplicates			int64
+	retransmissions		int64
+	recovered			int64
+	abandoned			int64
+	windowTimeouts		int64
+	heartbeats			int64
+	misattributed		int64
+	portUnreachable		int64
+	firstMeasured		uint64
+	mutex				sync.Mutex
+	rtt					*rttStats
+	echoRTT				*rttStats
+	hashRTT				*rttStats
+	jitter				*jitterEstimator
+	loss				*lossTracker
+	reorder				*reorderStats
+	window				*latencyHistogram
+	warmupEnd			int64
+	gaps				[]seqRange
+	err					error
+}
+
+// Creates empty statistics that exclude packets sent before the end of the warm-up period
+// Packet loss is tracked in intervals of the given length starting at the end of the warm-up period
+func newClientStats(lossInterval time.Duration, warmupEnd time.Time) *clientStats {
+	return &clientStats{
+		rtt: &rttStats{hist: newLatencyHistogram()},
+		echoRTT: &rttStats{hist: newLatencyHistogram()},
+		hashRTT: &rttStats{hist: newLatencyHistogram()},
+		jitter: &jitterEstimator{},
+		loss: newLossTracker(lossInterval, warmupEnd),
+		reorder: &reorderStats{},
+		window: newLatencyHistogram(),
+		warmupEnd: warmupEnd.UnixNano(),
+		firstMeasured: math.MaxUint64,
+	}
+}
+
+// Records the error that stopped the connection, keeping the first if several goroutines fail
+// Stops the connection's sends and receives as if its time limit was reached
+func (stats *clientStats) fail(conn netsim.PacketConn, err error) {
+	stats.mutex.Lock()
+	if stats.err == nil {
+		stats.err = err
+	}
+	stats.mutex.Unlock()
+	conn.SetWriteDeadline(time.Now())
+	conn.SetReadDeadline(time.Now())
+}
+
+// Gets the error that stopped the connection, or nil if none did
+func (stats *clientStats) failure() error {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	return stats.err
+}
+
+// Keeps track of the lowest sequence number sent after the warm-up period
+func (stats *clientStats) markMeasured(seq uint64) {
+	for {
+		first := atomic.LoadUint64(&stats.firstMeasured)
+		if seq >= first || atomic.CompareAndSwapUint64(&stats.firstMeasured, first, seq) {
+			return
+		}
+	}
+}
+
+// Checks whether a packet sent at the given time (in nanoseconds since the Unix epoch) was sent during the warm-up period
+func (stats *clientStats) inWarmup(sendTime int64) bool {
+	return sendTime < stats.warmupEnd
+}
+
+// Returns the number of packets sent so far
+func (stats *clientStats) sentCount() int {
+	return int(atomic.LoadInt64(&stats.sent))
+}
+
+// Returns the number of sent packets that were reflected by the server
+// Packets received before being recorded as sent were still delivered, so they do not count as lost
+func (stats *clientStats) delivered() int {
+	return int(atomic.LoadInt64(&stats.received) + atomic.LoadInt64(&stats.receivedButNotSent))
+}
+
+// Records the first reflection of a packet with the given sequence number, send time, and receive time
+// echo tells whether the server was asked to echo the packet instead of having it hashed by the HTTP backend
+func (stats *clientStats) recordReflection(seq uint64, sendTime int64, recvTime int64, echo bool) {
+	stats.mutex.Lock()
+	// Check whether the packet arrived out of order
+	stats.reorder.add(seq)
+	// Measure the round trip time from the send timestamp
+	stats.rtt.add(time.Duration(recvTime - sendTime))
+	if echo {
+		stats.echoRTT.add(time.Duration(recvTime - sendTime))
+	} else {
+		stats.hashRTT.add(time.Duration(recvTime - sendTime))
+	}
+	stats.window.record(time.Duration(recvTime - sendTime))
+	stats.jitter.add(sendTime, recvTime)
+	stats.mutex.Unlock()
+	stats.loss.recordReceived(time.Unix(0, sendTime))
+}
+
+// Combines the statistics of every connection into statistics for the whole run
+// The jitter of the run is the average jitter of the connections
+func mergeClientStats(all []*clientStats, lossInterval time.Duration) *clientStats {
+	if len(all) == 1 {
+		return all[0]
+	}
+	merged := newClientStats(lossInterval, time.Unix(0, all[0].warmupEnd))
+	jitterSum := 0.0
+	for _, stats := range all {
+		merged.sent += atomic.LoadInt64(&stats.sent)
+		merged.received += atomic.LoadInt64(&stats.received)
+		merged.receivedButNotSent += atomic.LoadInt64(&stats.receivedButNotSent)
+		merged.duplicates += atomic.LoadInt64(&stats.duplicates)
+		merged.retransmissions += atomic.LoadInt64(&stats.retransmissions)
+		merged.recovered += atomic.LoadInt64(&stats.recovered)
+		merged.abandoned += atomic.LoadInt64(&stats.abandoned)
+		merged.windowTimeouts += atomic.LoadInt64(&stats.windowTimeouts)
+		merged.heartbeats += atomic.LoadInt64(&stats.heartbeats)
+		merged.misattributed += atomic.LoadInt64(&stats.misattributed)
+		merged.portUnreachable += atomic.LoadInt64(&stats.portUnreachable)
+		merged.loss.merge(stats.loss)
+
+		stats.mutex.Lock()
+		merged.rtt.merge(stats.rtt)
+		merged.echoRTT.merge(stats.echoRTT)
+		merged.hashRTT.merge(stats.hashRTT)
+		jitterSum += stats.jitter.jitter
+		merged.reorder.count += stats.reorder.count
+		if stats.reorder.maxDistance > merged.reorder.maxDistance {
+			merged.reorder.maxDistance = stats.reorder.maxDistance
+		}
+		stats.mutex.Unlock()
+	}
+	merged.jitter.jitter = jitterSum / float64(len(all))
+	return merged
+}
+
+// Returns the round trip time histogram since the last call and starts a new one
+func (stats *clientStats) swapWindow() *latencyHistogram {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	window := stats.window
+	stats.window = newLatencyHistogram()
+	return window
+}
+
+// Summary of round trip times in nanoseconds
+type rttSummary struct {
+	MinNs	int64	`json:"min_ns"`
+	AvgNs	int64	`json:"avg_ns"`
+	MaxNs	int64	`json:"max_ns"`
+	P50Ns	int64	`json:"p50_ns"`
+	P90Ns	int64	`json:"p90_ns"`
+	P99Ns	int64	`json:"p99_ns"`
+	P999Ns	int64	`json:"p999_ns"`
+}
+
+// Results of retransmitting packets whose reflection did not arrive in time
+// Packets delivered on any attempt count as received in the overall results
+type retransmitResults struct {
+	Retransmissions				int		`json:"retransmissions"`
+	FirstAttemptReceived		int		`json:"first_attempt_received"`
+	FirstAttemptLossPercent		float64	`json:"first_attempt_loss_percent"`
+	RetransmitReceived			int		`json:"retransmit_received"`
+	Abandoned					int		`json:"abandoned"`
+}
+
+// Machine readable results of a run, used for exporting to JSON or CSV
+// Runs with more than one connection hold the results of each connection as well
+// Runs of the orchestrate subcommand hold the results of each agent as well, named by their Agent
+type Results struct {
+	Config				map[string]string	`json:"config,omitempty"`
+	Target				string				`json:"target,omitempty"`
+	LocalAddr			string				`json:"local_addr,omitempty"`
+	Start				time.Time			`json:"start"`
+	DurationSeconds		float64				`json:"duration_seconds"`
+	Sent				int					`json:"sent"`
+	Received			int					`json:"received"`
+	Duplicates			int					`json:"duplicates"`
+	OutOfOrder			int					`json:"out_of_order"`
+	MaxReorderDistance	uint64				`json:"max_reorder_distance"`
+	LossPercent			float64				`json:"loss_percent"`
+	RTT					rttSummary			`json:"rtt"`
+	JitterNs			int64				`json:"jitter_ns"`
+	Retransmit			*retransmitResults	`json:"retransmit,omitempty"`
+	WindowTimeouts		int					`json:"window_timeouts,omitempty"`
+	Heartbeats			int					`json:"heartbeats,omitempty"`
+	Misattributed		int					`json:"misattributed,omitempty"`
+	PortUnreachable		int					`json:"port_unreachable,omitempty"`
+	ServerNotListening	bool				`json:"server_not_listening,omitempty"`
+	SustainableRate		float64				`json:"sustainable_pps,omitempty"`
+	SentMbps			float64				`json:"sent_mbps"`
+	SentPayloadMbps		float64				`json:"sent_payload_mbps"`
+	ReceivedMbps		float64				`json:"received_mbps"`
+	GoodputMbps			float64				`json:"goodput_mbps"`
+	OneWay				[]owdResults		`json:"one_way,omitempty"`
+	MOS					float64				`json:"mos,omitempty"`
+	EchoRTT				*rttSummary			`json:"echo_rtt,omitempty"`
+	HashRTT				*rttSummary			`json:"hash_rtt,omitempty"`
+	Targets				[]Results		`json:"targets,omitempty"`
+	Connections			[]Results		`json:"connections,omitempty"`
+	Agent				string			`json:"agent,omitempty"`
+	Agents				[]Results		`json:"agents,omitempty"`
+}
+
+// Builds the results of a run that started at the given time from the gathered statistics
+func (stats *clientStats) results(start time.Time) Results {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	return Results{
+		Start: start,
+		DurationSeconds: time.Since(start).Seconds(),
+		Sent: stats.sentCount(),
+		Received: stats.delivered(),
+		Duplicates: int(atomic.LoadInt64(&stats.duplicates)),
+		OutOfOrder: stats.reorder.count,
+		MaxReorderDistance: stats.reorder.maxDistance,
+		LossPercent: lossPercent(stats.sentCount(), stats.delivered()),
+		RTT: stats.rtt.summary(),
+		JitterNs: int64(stats.jitter.value()),
+		WindowTimeouts: int(atomic.LoadInt64(&stats.windowTimeouts)),
+		Heartbeats: int(atomic.LoadInt64(&stats.heartbeats)),
+		Misattributed: int(atomic.LoadInt64(&stats.misattributed)),
+		PortUnreachable: int(atomic.LoadInt64(&stats.portUnreachable)),
+		// Nothing listens on the server's port if it only ever answered with port unreachables
+		ServerNotListening: atomic.LoadInt64(&stats.portUnreachable) > 0 && stats.delivered() == 0,
+	}
+}
+
+// Fills in the bandwidth of the results over the measured interval, for packets with the given payload size
+// The header-inclusive rates count the IPv4 and UDP headers, and reflected packets also carry the hash of hashSize bytes
+// The payload-only rates count just the payloads sent and the payloads delivered (goodput)
+func (results *Results) addBandwidth(payloadSize int, hashSize int) {
+	if results.DurationSeconds <= 0 {
+		return
+	}
+	mbps := func(packets int, size int) float64 {
+		return float64(packets) * float64(size) * 8 / results.DurationSeconds / 1e6
+	}
+	results.SentMbps = mbps(results.Sent, payloadSize + ipUDPHeaderSize)
+	results.SentPayloadMbps = mbps(results.Sent, payloadSize)
+	results.ReceivedMbps = mbps(results.Received, payloadSize + hashSize + ipUDPHeaderSize)
+	results.GoodputMbps = mbps(results.Received, payloadSize)
+}
+
+// Fills in the round trip times of the echoed and the hashed packets separately, for runs that mix the two
+func (results *Results) addMixRTT(stats *clientStats) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	echoRTT := stats.echoRTT.summary()
+	hashRTT := stats.hashRTT.summary()
+	results.EchoRTT = &echoRTT
+	results.HashRTT = &hashRTT
+}
+
+// Builds the results of retransmitting packets from the gathered statistics
+func (stats *clientStats) retransmitResults() *retransmitResults {
+	recovered := int(atomic.LoadInt64(&stats.recovered))
+	firstAttempt := stats.delivered() - recovered
+	return &retransmitResults{
+		Retransmissions: int(atomic.LoadInt64(&stats.retransmissions)),
+		FirstAttemptReceived: firstAttempt,
+		FirstAttemptLossPercent: lossPercent(stats.sentCount(), firstAttempt),
+		RetransmitReceived: recovered,
+		Abandoned: int(atomic.LoadInt64(&stats.abandoned)),
+	}
+}
+
+// Writes results to a file by way of a temporary file in the same directory, so the file is never left half written
+// if the process is killed while writing it
+func writeResultsAtomic(fileName string, results Results) error {
+	// The temporary name keeps the extension, which decides between CSV and JSON
+	tmpName := filepath.Join(filepath.Dir(fileName), ".tmp-" + filepath.Base(fileName))
+	err := writeResults(tmpName, results)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+// Periodically writes the cumulative results of every connection so far to a checkpoint file, and flushes the trace file if any,
+// so a long run that is killed before it finishes still leaves usable data behind
+func runCheckpoints(rs *runState, all []*clientStats, fileName string, interval time.Duration, lossInterval time.Duration, start time.Time, payloadSize int, tracer *packetTracer, doneChan <-chan struct{}, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneChan:
+			return
+		case <-ticker.C:
+			results := mergeClientStats(all, lossInterval).results(start)
+			results.Config = rs.config
+			results.addBandwidth(payloadSize, rs.hashSize)
+			err := writeResultsAtomic(fileName, results)
+			if err != nil {
+				log.Println("Could not write checkpoint: ", err)
+			}
+			if tracer != nil {
+				err = tracer.flush()
+				if err != nil {
+					log.Println("Could not flush trace file: ", err)
+				}
+			}
+		}
+	}
+}
+
+// A single metric compared between two sets of results
+// name: what the metric is, with its unit
+// a, b: the value of the metric in each set of results
+// duration: whether the values are nanoseconds to be shown as durations
+// checked: whether a higher value in B counts as a regression when comparing results files
+// points: whether the values are percentages whose change is judged in percentage points rather than relative to A
+type comparisonRow struct {
+	name		string
+	a			float64
+	b			float64
+	duration	bool
+	checked		bool
+	points		bool
+}
+
+// Returns the loss and latency metrics of two sets of results side by side
+func compareResults(a Results, b Results) []comparisonRow {
+	return []comparisonRow{
+		{name: "Packets sent", a: float64(a.Sent), b: float64(b.Sent)},
+		{name: "Packets received", a: float64(a.Received), b: float64(b.Received)},
+		{name: "Packet loss %", a: a.LossPercent, b: b.LossPercent, checked: true, points: true},
+		{name: "RTT min", a: float64(a.RTT.MinNs), b: float64(b.RTT.MinNs), duration: true},
+		{name: "RTT avg", a: float64(a.RTT.AvgNs), b: float64(b.RTT.AvgNs), duration: true, checked: true},
+		{name: "RTT p50", a: float64(a.RTT.P50Ns), b: float64(b.RTT.P50Ns), duration: true, checked: true},
+		{name: "RTT p90", a: float64(a.RTT.P90Ns), b: float64(b.RTT.P90Ns), duration: true, checked: true},
+		{name: "RTT p99", a: float64(a.RTT.P99Ns), b: float64(b.RTT.P99Ns), duration: true, checked: true},
+		{name: "RTT p999", a: float64(a.RTT.P999Ns), b: float64(b.RTT.P999Ns), duration: true, checked: true},
+		{name: "RTT max", a: float64(a.RTT.MaxNs), b: float64(b.RTT.MaxNs), duration: true},
+		{name: "Jitter", a: float64(a.JitterNs), b: float64(b.JitterNs), duration: true, checked: true},
+	}
+}
+
+// Tells whether B is worse than A by more than the tolerance
+// Percentages are allowed to rise by pointsTolerance percentage points, and the other metrics by tolerance percent of A
+func (row comparisonRow) regressed(tolerance float64, pointsTolerance float64) bool {
+	if !row.checked {
+		return false
+	}
+	if row.points {
+		return row.b - row.a > pointsTolerance
+	}
+	return row.b > row.a * (1 + tolerance / 100)
+}
+
+// Formats a compared value, as a duration if it is one and rounded to two decimals otherwise
+func (row comparisonRow) format(value float64) string {
+	if row.duration {
+		return time.Duration(value).String()
+	}
+	return strconv.FormatFloat(math.Round(value * 100) / 100, 'f', -1, 64)
+}
+
+// Formats the difference of B from A, with the relative change if A is not zero
+func (row comparisonRow) formatDelta() string {
+	delta := row.format(row.b - row.a)
+	if row.b >= row.a {
+		delta = "+" + delta
+	}
+	if row.a != 0 {
+		delta += fmt.Sprintf(" (%+.1f%%)", (row.b - row.a) / math.Abs(row.a) * 100)
+	}
+	return delta
+}
+
+// Logs a side by side comparison of the loss and latency of two sets of results
+func logComparison(labelA string, labelB string, a Results, b Results) {
+	log.Printf("%-18s %-22s %-22s %s\n", "", "A: " + labelA, "B: " + labelB, "B - A")
+	for _, row := range compareResults(a, b) {
+		log.Printf("%-18s %-22s %-22s %s\n", row.name, row.format(row.a), row.format(row.b), row.formatDelta())
+	}
+}
+
+// Reads results written to a JSON file by -out
+func readResults(fileName string) (Results, error) {
+	var results Results
+	if strings.HasSuffix(strings.ToLower(fileName), ".csv") {
+		return results, fmt.Errorf("%s: only JSON results can be compared", fileName)
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return results, err
+	}
+	err = json.Unmarshal(data, &results)
+	if err != nil {
+		return results, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return results, nil
+}
+
+// Runs the compare subcommand, which compares two JSON results files and flags the regressions from the first to the second
+// Usage: udp_client compare [-tolerance 5] [-loss_tolerance 0.1] before.json after.json
+// Returns the exit code, which is ExitThresholdExceeded if anything regressed
+func Compare(args []string) int {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	var tolerance = flags.Float64("tolerance", 5, "Percentage by which the RTTs and jitter of the second results may exceed the first before counting as a regression (i.e. 10)")
+	var lossTolerance = flags.Float64("loss_tolerance", 0.1, "Percentage points by which the packet loss of the second results may exceed the first before counting as a regression (i.e. 0.5)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: udp_client compare [flags] before.json after.json")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	a, err := readResults(flags.Arg(0))
+	if err != nil {
+		log.Println("Could not read results: ", err)
+		return 1
+	}
+	b, err := readResults(flags.Arg(1))
+	if err != nil {
+		log.Println("Could not read results: ", err)
+		return 1
+	}
+
+	regressions := 0
+	log.Printf("%-18s %-22s %-22s %s\n", "", "A: " + flags.Arg(0), "B: " + flags.Arg(1), "B - A")
+	for _, row := range compareResults(a, b) {
+		if row.regressed(*tolerance, *lossTolerance) {
+			log.Printf("%-18s %-22s %-22s %-32s REGRESSION\n", row.name, row.format(row.a), row.format(row.b), row.formatDelta())
+			regressions++
+		} else {
+			log.Printf("%-18s %-22s %-22s %s\n", row.name, row.format(row.a), row.format(row.b), row.formatDelta())
+		}
+	}
+	if regressions > 0 {
+		log.Printf("%d regressions beyond a tolerance of %g%% (%g percentage points for loss)\n", regressions, *tolerance, *lossTolerance)
+		return ExitThresholdExceeded
+	}
+	log.Println("No regressions")
+	return 0
+}
+
+// Checks the results against the loss and p99 RTT thresholds, with a negative max loss or a zero max p99 disabling that check
+// Returns a description of each threshold exceeded
+func checkThresholds(results Results, maxLoss float64, maxP99 time.Duration) []string {
+	var exceeded []string
+	if maxLoss >= 0 && results.LossPercent > maxLoss {
+		exceeded = append(exceeded, fmt.Sprintf("packet loss %.2f%% is above the max of %.2f%%", results.LossPercent, maxLoss))
+	}
+	if maxP99 > 0 {
+		// With no responses there is no RTT to judge, which only the loss threshold can catch
+		if results.Received == 0 {
+			exceeded = append(exceeded, "no responses were received to measure the p99 RTT")
+		} else if p99 := time.Duration(results.RTT.P99Ns); p99 > maxP99 {
+			exceeded = append(exceeded, fmt.Sprintf("RTT p99 %v is above the max of %v", p99, maxP99))
+		}
+	}
+	return exceeded
+}
+
+// Writes results to a file, as CSV if the file name ends in .csv and as JSON otherwise
+// The CSV file has a header row and a single row of results for the whole run, with the configuration as one column per flag
+func writeResults(fileName string, results Results) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(strings.ToLower(fileName), ".csv") {
+		header := []string{"start", "duration_seconds", "sent", "received", "duplicates", "out_of_order", "max_reorder_distance", "loss_percent",
+			"rtt_min_ns", "rtt_avg_ns", "rtt_max_ns", "rtt_p50_ns", "rtt_p90_ns", "rtt_p99_ns", "rtt_p999_ns", "jitter_ns"}
+		row := []string{results.Start.Format(time.RFC3339Nano), strconv.FormatFloat(results.DurationSeconds, 'f', -1, 64),
+			strconv.Itoa(results.Sent), strconv.Itoa(results.Received), strconv.Itoa(results.Duplicates), strconv.Itoa(results.OutOfOrder),
+			strconv.FormatUint(results.MaxReorderDistance, 10), strconv.FormatFloat(results.LossPercent, 'f', -1, 64),
+			strconv.FormatInt(results.RTT.MinNs, 10), strconv.FormatInt(results.RTT.AvgNs, 10), strconv.FormatInt(results.RTT.MaxNs, 10),
+			strconv.FormatInt(results.RTT.P50Ns, 10), strconv.FormatInt(results.RTT.P90Ns, 10), strconv.FormatInt(results.RTT.P99Ns, 10),
+			strconv.FormatInt(results.RTT.P999Ns, 10), strconv.FormatInt(results.JitterNs, 10)}
+
+		// Add the bandwidth
+		header = append(header, "sent_mbps", "sent_payload_mbps", "received_mbps", "goodput_mbps")
+		row = append(row, strconv.FormatFloat(results.SentMbps, 'f', -1, 64), strconv.FormatFloat(results.SentPayloadMbps, 'f', -1, 64),
+			strconv.FormatFloat(results.ReceivedMbps, 'f', -1, 64), strconv.FormatFloat(results.GoodputMbps, 'f', -1, 64))
+
+		// Add the retransmission results if packets were retransmitted
+		if rt := results.Retransmit; rt != nil {
+			header = append(header, "retransmissions", "first_attempt_received", "first_attempt_loss_percent", "retransmit_received", "abandoned")
+			row = append(row, strconv.Itoa(rt.Retransmissions), strconv.Itoa(rt.FirstAttemptReceived),
+				strconv.FormatFloat(rt.FirstAttemptLossPercent, 'f', -1, 64), strconv.Itoa(rt.RetransmitReceived), strconv.Itoa(rt.Abandoned))
+		}
+
+		// Add the estimated MOS of voice calls
+		if results.MOS > 0 {
+			header = append(header, "mos")
+			row = append(row, strconv.FormatFloat(results.MOS, 'f', -1, 64))
+		}
+
+		// Add the configuration in a stable order
+		var names []string
+		for name := range results.Config {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			header = append(header, "config_" + name)
+			row = append(row, results.Config[name])
+		}
+
+		writer := csv.NewWriter(file)
+		writer.Write(header)
+		writer.Write(row)
+		writer.Flush()
+		err = writer.Error()
+	} else {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(results)
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// A built-in traffic profile emulating the packets of an application, with each connection sending one stream
+// payloadSize: the number of bytes in each packet's payload
+// interval: the time between consecutive packets of a stream
+// jitter: the fraction of the interval each time between packets randomly varies by either way
+// largePayloadSize: the number of bytes in the payload of an occasional large packet
+// largeChance: the probability of each packet being a large packet
+// voice: whether streams are voice calls, whose quality is reported as an estimated MOS
+type trafficProfile struct {
+	payloadSize			int
+	interval			time.Duration
+	jitter				float64
+	largePayloadSize	int
+	largeChance			float64
+	voice				bool
+}
+
+// Traffic profiles selectable by name
+// voip: a G.711 call, with 20ms of audio (160 bytes) in each packet
+// gaming: player inputs at about 60 ticks per second, with the odd full state update
+// telemetry: a sensor reading every 100ms or so, with a batch of buffered readings about every 10 seconds
+var trafficProfiles = map[string]trafficProfile{
+	"voip": {payloadSize: 160, interval: 20 * time.Millisecond, voice: true},
+	"gaming": {payloadSize: 64, interval: 16 * time.Millisecond, jitter: 0.25, largePayloadSize: 1200, largeChance: 0.02},
+	"telemetry": {payloadSize: 48, interval: 100 * time.Millisecond, jitter: 0.1, largePayloadSize: 1400, largeChance: 0.01},
+}
+
+// Returns the average number of bytes in a payload of the profile, counting the large packets
+func (profile trafficProfile) meanPayloadSize() int {
+	return int(math.Round(float64(profile.payloadSize) * (1 - profile.largeChance) + float64(profile.largePayloadSize) * profile.largeChance))
+}
+
+// Returns the names of the traffic profiles in a stable order
+func trafficProfileNames() []string {
+	var names []string
+	for name := range trafficProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Estimates the mean opinion score (1 to 4.5) of a G.711 call from its round trip time, jitter, and loss,
+// using the simplified E-model (ITU-T G.107) commonly used for network monitoring
+// The one-way delay is taken as half the round trip time, and jitter counts double as it sizes the jitter buffer
+func estimateMOS(rtt time.Duration, jitter time.Duration, lossPercent float64) float64 {
+	// Effective latency in milliseconds, with 10ms for the codec
+	latency := float64(rtt / 2 + 2 * jitter) / float64(time.Millisecond) + 10
+
+	// Transmission rating factor, which drops faster once the latency goes past 160ms
+	r := 93.2 - latency / 40
+	if latency >= 160 {
+		r = 93.2 - (latency - 120) / 10
+	}
+	r -= 2.5 * lossPercent
+	if r < 0 {
+		r = 0
+	} else if r > 100 {
+		r = 100
+	}
+	return 1 + 0.035 * r + 0.000007 * r * (r - 60) * (100 - r)
+}
+
+// A single step of a ramp schedule
+// rate: the number of packets per second to send during the step
+// duration: how long the step lasts
+type rampStep struct {
+	rate		float64
+	duration	time.Duration
+}
+
+// Parses a ramp schedule of comma separated rate:duration steps (i.e. 1000:30s,5000:60s,10000:30s)
+func parseRamp(schedule string) ([]rampStep, error) {
+	var steps []rampStep
+	for _, field := range strings.Split(schedule, ",") {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("ramp step %q is not in the form rate:duration", field)
+		}
+		rate, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("ramp step %q does not have a positive rate", field)
+		}
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("ramp step %q does not have a positive duration", field)
+		}
+		steps = append(steps, rampStep{rate, duration})
+	}
+	return steps, nil
+}
+
+// Parses a time limit given either as a Go duration string (i.e. 30s or 2m15s), or as a plain number of minutes (i.e. 10)
+func parseTimeLimit(value string) (time.Duration, error) {
+	minutes, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		if minutes <= 0 {
+			return 0, fmt.Errorf("time limit %q is not positive", value)
+		}
+		return time.Duration(minutes * float64(time.Minute)), nil
+	}
+	limit, err := time.ParseDuration(value)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("time limit %q is neither a positive number of minutes nor a positive duration", value)
+	}
+	return limit, nil
+}
+
+// Options that control how packets are sent to the server over a single connection
+// rate: the number of packets per second to send, or 0 to send as fast as possible
+// ramp: changes the rate at each step and stops sending after the last step
+// count: the number of packets to send after the warm-up before stopping, or 0 for no limit
+// drain: how long to keep receiving after sending stops before the time limit is reached
+// payloadSize: the number of bytes in each packet's payload
+// pattern, seed, template: configure the generator that fills each packet's payload after the header
+// senders: the number of goroutines sharing the send path, which split the rate between them
+// arrival: the distribution of the time between sends at the rate: constant, poisson, or uniform
+// aimd: adapts the rate based on the observed loss, if given
+// dest: the current address of the server if its name is re-resolved, in which case the connection is not connected
+// owd: the one-way delay statistics of the server, if the server is asked for its timestamps
+// window, windowTimeout: at most window packets are kept outstanding at a time by all senders together, if window is positive
+// retransmitTimeout, maxAttempts: packets not reflected within the timeout are retransmitted up to maxAttempts attempts in total, if the timeout is positive
+// burst, burstInterval: each sender sends bursts of this many back-to-back packets every interval instead of using the rate
+// jitter: the fraction of the burst interval each time between bursts randomly varies by either way
+// largePayloadSize, largeChance: each packet has a payload of largePayloadSize bytes instead with a probability of largeChance
+// hashPercent: the percentage of packets hashed by the HTTP backend, with the server asked to echo the rest
+// requestID: the prefix of the request ID in the metadata extension of every packet, or empty to send packets without one
+// heartbeat: a heartbeat is sent whenever the connection has sent nothing for this long, if positive
+// messages: the source of the payloads after the header, if they are read from a file instead of generated
+// connID: the ID of the connection written to the header of every packet, so reflections can be attributed to it
+type sendOptions struct {
+	rate		float64
+	ramp		[]rampStep
+	count		int
+	drain		time.Duration
+	payloadSize	int
+	pattern		string
+	seed		int64
+	template	string
+	senders		int
+	arrival		string
+	burst		int
+	burstInterval	time.Duration
+	jitter			float64
+	largePayloadSize	int
+	largeChance		float64
+	hashPercent		float64
+	requestID		string
+	heartbeat		time.Duration
+	messages		*messageSource
+	connID			uint32
+	abortUnreachable	bool
+	retransmitTimeout	time.Duration
+	maxAttempts		int
+	window			int
+	windowTimeout	time.Duration
+	aimd			*aimdController
+	dest			*destination
+	owd				*owdStats
+}
+
+// Sends packets to a server using the given UDP connection
+// Writes the packets to a channel for checking which packets have been received from the server
+// Packets are paced and limited according to the send options
+// 64-bit sequence numbers are allocated atomically from seqCounter, which is shared by every sender of the connection
+// measuredCounter, also shared, counts the packets sent after the warm-up, which are the ones the packet count limits
+// The time of the latest send is kept in lastSend, so heartbeats are only sent while the connection is idle
+// stoppedEarly is set if sending stops before the time limit is reached
+// This process stops after the connection times out, the ramp schedule finishes, or the packet count is reached
+func sendMessages(conn netsim.PacketConn, opts sendOptions, senderID int, seqCounter *uint64, measuredCounter *uint64, stoppedEarly *int32, lastSend *int64, writeOut chan<- uint64, stats *clientStats, rt *retransmitter, fw *flowWindow, wg *sync.WaitGroup) {
+	// Close the wait group once done
+	defer wg.Done()
+
+	// Create this sender's generator for the packets' payloads
+	// Each sender gets its own seed so that random payloads differ between senders
+	generator, err := newPayloadGenerator(opts.pattern, opts.seed + int64(senderID), opts.template)
+	if err != nil {
+		stats.fail(conn, err)
+		return
+	}
+
+	// Source of the sender's random choices: the jitter of the burst interval, and which packets are large or echoed
+	// Drawing them all from one source keeps the choices independent of each other
+	random := rand.New(rand.NewSource(opts.seed + int64(senderID)))
+
+	// Create a rate limiter for sending packets if a rate was given
+	// The rate is shared evenly between the senders
+	// Bursts are not shared, so every sender sends its own bursts
+	share := float64(opts.senders)
+	var limiter rateLimiter
+	var pacer *burstPacer
+	if opts.burst > 0 {
+		pacer = newBurstPacer(opts.burst, opts.burstInterval, opts.jitter, random)
+	}
+	ramp := opts.ramp
+	if len(ramp) > 0 {
+		limiter = newRateLimiter(opts.arrival, ramp[0].rate / share, opts.seed + int64(senderID))
+	} else if opts.rate > 0 {
+		limiter = newRateLimiter(opts.arrival, opts.rate / share, opts.seed + int64(senderID))
+	}
+
+	// Ask the server for its timestamps when measuring one-way delays
+	var headerFlags uint8
+	if opts.owd != nil {
+		headerFlags |= protocol.FlagServerTimestamps
+	}
+
+	// Keep track of the rate last set by the adaptive controller
+	adaptiveRate := opts.rate
+
+	// Only the first sender logs, since every sender stops for the same reasons
+	logSender := senderID == 0
+
+	// Keep track of the current step of the ramp schedule
+	rampIndex := 0
+	rampStepEnd := time.Time{}
+	if len(ramp) > 0 {
+		if logSender {
+			log.Printf("Ramp step 1: sending %v packets per second for %v\n", ramp[0].rate, ramp[0].duration)
+		}
+		rampStepEnd = time.Now().Add(ramp[0].duration)
+	}
+
+	// Loop for writing packets
+	// Exited when time limit / deadline reached
+	writeLoop:
+		for {
+			// Move on to the next step of the ramp schedule once the current step is over
+			if len(ramp) > 0 && time.Now().After(rampStepEnd) {
+				rampIndex++
+				if rampIndex == len(ramp) {
+					if logSender {
+						log.Println("From Send: Ramp schedule finished")
+					}
+					atomic.StoreInt32(stoppedEarly, 1)
+					break writeLoop
+				}
+				if logSender {
+					log.Printf("Ramp step %d: sending %v packets per second for %v\n", rampIndex + 1, ramp[rampIndex].rate, ramp[rampIndex].duration)
+				}
+				limiter.setRate(ramp[rampIndex].rate / share)
+				rampStepEnd = rampStepEnd.Add(ramp[rampIndex].duration)
+			}
+
+			// Follow the rate chosen by the adaptive controller
+			if opts.aimd != nil {
+				if rate := opts.aimd.connRate(); rate != adaptiveRate {
+					limiter.setRate(rate / share)
+					adaptiveRate = rate
+				}
+			}
+
+			// Wait for the rate limiter or the burst pacer before sending the next packet
+			if limiter != nil {
+				limiter.wait()
+			} else if pacer != nil {
+				pacer.wait()
+			}
+
+			// Wait for a free slot in the flow control window
+			// Warm-up packets take no slot, since their reflections are not counted and so free none
+			warmup := stats.inWarmup(time.Now().UnixNano())
+			if fw != nil && !warmup && fw.acquire() {
+				atomic.AddInt64(&stats.windowTimeouts, 1)
+			}
+
+			// Stop once the requested number of packets has been sent after the warm-up
+			// Warm-up packets are sent in addition to the count, since they are excluded from the statistics
+			if opts.count > 0 && !warmup && atomic.AddUint64(measuredCounter, 1) > uint64(opts.count) {
+				if logSender {
+					log.Printf("From Send: Sent all %d packets\n", opts.count)
+				}
+				atomic.StoreInt32(stoppedEarly, 1)
+				break writeLoop
+			}
+
+			// Allocate the message counter (unique identifier for sending messages)
+			messgCounter := atomic.AddUint64(seqCounter, 1) - 1
+
+			// Describe the packet in a metadata extension at the start of the body if asked to
+			var extension []byte
+			if opts.requestID != "" {
+				metadata := pb.PacketMetadata{RequestID: fmt.Sprintf("%s/%d/%d", opts.requestID, opts.connID, messgCounter)}
+				extension = protocol.AppendExtension(nil, metadata.Marshal())
+			}
+
+			// Create message by filling the payload and writing the header to the start of the byte slice
+			// The send timestamp is taken right before writing, so the round trip time can be measured
+			// The payload after the header is either the next message read from the payload file or generated, with any
+			// extension written over the start of a generated payload, which grows if it is too small to hold it
+			var messg []byte
+			if opts.messages != nil {
+				message, ok := opts.messages.next()
+				if !ok {
+					if logSender {
+						log.Println("From Send: Sent every message of the payload file")
+					}
+					atomic.StoreInt32(stoppedEarly, 1)
+					break writeLoop
+				}
+				messg = make([]byte, protocol.HeaderSize + len(extension) + len(message))
+				copy(messg[protocol.HeaderSize + len(extension):], message)
+			} else {
+				size := opts.payloadSize
+				if opts.largeChance > 0 && random.Float64() < opts.largeChance {
+					size = opts.largePayloadSize
+				}
+				if size < protocol.HeaderSize + len(extension) {
+					size = protocol.HeaderSize + len(extension)
+				}
+				messg = make([]byte, size)
+				generator.fill(messg)
+			}
+			sendTime := time.Now()
+			packetFlags := headerFlags
+			if extension != nil {
+				copy(messg[protocol.HeaderSize:], extension)
+				packetFlags |= protocol.FlagExtension
+			}
+			if opts.hashPercent < 100 && random.Float64() * 100 >= opts.hashPercent {
+				packetFlags |= protocol.FlagEcho
+			}
+			protocol.PutHeader(messg, protocol.Header{Flags: packetFlags, ConnID: opts.connID, Seq: messgCounter, Timestamp: sendTime.UnixNano()})
+
+			// Wait for the packet's reflection before writing it, so a fast reflection cannot arrive before it is tracked
+			if rt != nil {
+				rt.track(messgCounter, messg, sendTime)
+			}
+
+			// Write message
+			_, err := writePacket(conn, opts.dest, messg)
+			atomic.StoreInt64(lastSend, time.Now().UnixNano())
+
+			// Handle any errors
+			if err != nil {
+				// Exit from loop if time limit reached
+				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+					if logSender {
+						log.Println("From Send: Time limit reached")
+					}
+					break writeLoop
+				}
+				// The packet was not sent because an earlier one drew a port unreachable, so it is neither tracked nor outstanding
+				if isPortUnreachable(err) {
+					atomic.AddInt64(&stats.portUnreachable, 1)
+					if rt != nil {
+						rt.acknowledge(messgCounter)
+					}
+					if fw != nil && !warmup {
+						fw.release()
+					}
+					if opts.abortUnreachable {
+						stopUnreachable(conn)
+					}
+					continue
+				}
+				stats.fail(conn, fmt.Errorf("Could not send packet to server: %v", err))
+				break writeLoop
+			} else {
+				// Write the packet contents to out channel
+				writeOut <- messgCounter
+				// Packets sent during the warm-up period are not counted
+				if !stats.inWarmup(sendTime.UnixNano()) {
+					// Increment the packets sent counter
+					atomic.AddInt64(&stats.sent, 1)
+					stats.markMeasured(messgCounter)
+					// Record the packet in its send interval
+					stats.loss.recordSent(sendTime)
+				}
+			}
+		}
+}
+
+// Reports whether an error on a connected UDP socket was caused by an ICMP port unreachable, meaning nothing listens on the server's port
+func isPortUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// Stops a connection's sends and receives as if its time limit was reached, once its server is found not to be listening
+func stopUnreachable(conn netsim.PacketConn) {
+	log.Printf("Server %s not listening (ICMP port unreachable), stopping the connection\n", conn.RemoteAddr())
+	conn.SetWriteDeadline(time.Now())
+	conn.SetReadDeadline(time.Now())
+}
+
+// Receives packets from a server using the given UDP connection
+// Packets contain a hash of the packet's original payload appended to the end, and any server timestamps after it
+// Writes packets to a channel for checking which packets have been received from the server
+// Port unreachables from the server are counted in stats, and stop the connection if abortUnreachable is set
+// This process stops after the connection times out
+func receiveMessages(conn netsim.PacketConn, packetSize int, stats *clientStats, abortUnreachable bool, recvOut chan<- receivedPacket, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+	// Loop that runs to receive messages
+	// Exited when time limit / deadline reached
+	receiveLoop:
+		for {
+			// Create buffer to read packet into
+			// Bytes for original payload + the bytes of the hash (+ 16 bytes for any server timestamps)
+			buffer := make([]byte, packetSize)
+
+			// Read the packet and place the payload in buffer
+			n, _, err := conn.ReadFrom(buffer)
+			recvTime := time.Now()
+
+			// Handle any errors
+			if err != nil {
+				// Exit from loop if time limit reached
+				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+					log.Println("From Receive: Time limit reached")
+					break receiveLoop
+				}
+				if isPortUnreachable(err) {
+					atomic.AddInt64(&stats.portUnreachable, 1)
+					if abortUnreachable {
+						stopUnreachable(conn)
+					}
+					continue
+				}
+				stats.fail(conn, fmt.Errorf("Could not read from UDP server: %v", err))
+				break receiveLoop
+			} else {
+				// Send the packet and the time it was received to the received out channel
+				recvOut <- receivedPacket{buffer[:n], recvTime}
+			}
+		}
+
+	// Close the channel for sending out received packets
+	close(recvOut)
+}
+
+// Number of shards in a window of sequence numbers, which must be a power of two
+const seqWindowShards = 64
+
+// Default number of sequence numbers tracked by a window
+const defaultSeqWindow = 1 << 24
+
+// One shard of a window of sequence numbers, holding every seqWindowShards-th block of 64 consecutive sequence numbers
+// words: ring of bitmaps, one per block, with one bit per sequence number
+// base: the oldest block (counted within the shard) that the shard still tracks
+type seqWindowShard struct {
+	mutex	sync.Mutex
+	words	[]uint64
+	base	uint64
+}
+
+// Set of sequence numbers tracked with a sliding window of bitmaps
+// Sequence numbers are dense and increasing, so one bit per sequence number bounds memory by the size of the window
+// Adding a sequence number past the end of the window slides the window forward and forgets the oldest sequence numbers
+// Blocks of 64 consecutive sequence numbers map to different shards, each with its own mutex, so that
+// adding new sequence numbers and removing old ones rarely contend for the same lock
+type seqWindow struct {
+	shards	[seqWindowShards]seqWindowShard
+}
+
+// Creates an empty window that tracks at least size sequence numbers
+func newSeqWindow(size int) *seqWindow {
+	wordsPerShard := (size + 64 * seqWindowShards - 1) / (64 * seqWindowShards)
+	if wordsPerShard < 1 {
+		wordsPerShard = 1
+	}
+	window := &seqWindow{}
+	for i := range window.shards {
+		window.shards[i].words = make([]uint64, wordsPerShard)
+	}
+	return window
+}
+
+// Gets the shard holding the given sequence number, the block of the sequence number within the shard, and its bit in the block's word
+func (window *seqWindow) locate(seq uint64) (*seqWindowShard, uint64, uint64) {
+	block := seq / 64
+	shard := &window.shards[block & (seqWindowShards - 1)]
+	return shard, block / seqWindowShards, uint64(1) << (seq % 64)
+}
+
+// Adds a sequence number to the window, sliding the window forward if needed
+// Sequence numbers older than the window are ignored
+func (window *seqWindow) add(seq uint64) {
+	shard, block, bit := window.locate(seq)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	size := uint64(len(shard.words))
+	if block < shard.base {
+		return
+	}
+
+	// Slide the window forward, clearing the words of the blocks that leave the window so they can be reused
+	if block >= shard.base + size {
+		newBase := block - size + 1
+		for b := shard.base; b < newBase && b < shard.base + size; b++ {
+			shard.words[b % size] = 0
+		}
+		shard.base = newBase
+	}
+	shard.words[block % size] |= bit
+}
+
+// Reports whether a sequence number is in the window
+func (window *seqWindow) contains(seq uint64) bool {
+	shard, block, bit := window.locate(seq)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	size := uint64(len(shard.words))
+	if block < shard.base || block >= shard.base + size {
+		return false
+	}
+	return shard.words[block % size] & bit != 0
+}
+
+// Removes a sequence number from the window, returning whether it was in the window
+func (window *seqWindow) remove(seq uint64) bool {
+	shard, block, bit := window.locate(seq)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	size := uint64(len(shard.words))
+	if block < shard.base || block >= shard.base + size {
+		return false
+	}
+	word := &shard.words[block % size]
+	if *word & bit == 0 {
+		return false
+	}
+	*word &^= bit
+	return true
+}
+
+// Range of consecutive sequence numbers, from first to last inclusive
+type seqRange struct {
+	first	uint64
+	last	uint64
+}
+
+// Returns the ranges of sequence numbers from the given one on that are in the window but not in the other window
+// Must only be called once nothing else uses either window
+func (window *seqWindow) missingFrom(from uint64, other *seqWindow) []seqRange {
+	// Find the oldest and newest blocks the shards track
+	var minBlock, maxBlock uint64
+	for i := range window.shards {
+		shard := &window.shards[i]
+		size := uint64(len(shard.words))
+		first := shard.base * seqWindowShards + uint64(i)
+		last := (shard.base + size - 1) * seqWindowShards + uint64(i)
+		if i == 0 || first < minBlock {
+			minBlock = first
+		}
+		if i == 0 || last > maxBlock {
+			maxBlock = last
+		}
+	}
+
+	// Walk the blocks in order, joining consecutive missing sequence numbers into ranges
+	var gaps []seqRange
+	for block := minBlock; block <= maxBlock; block++ {
+		shard := &window.shards[block & (seqWindowShards - 1)]
+		local := block / seqWindowShards
+		size := uint64(len(shard.words))
+		if local < shard.base || local >= shard.base + size {
+			continue
+		}
+		word := shard.words[local % size]
+		for word != 0 {
+			seq := block * 64 + uint64(bits.TrailingZeros64(word))
+			word &= word - 1
+			if seq < from || other.contains(seq) {
+				continue
+			}
+			if n := len(gaps); n > 0 && gaps[n - 1].last + 1 == seq {
+				gaps[n - 1].last = seq
+			} else {
+				gaps = append(gaps, seqRange{seq, seq})
+			}
+		}
+	}
+	return gaps
+}
+
+// Formats ranges of sequence numbers for logging, listing at most limit of them
+func formatRanges(gaps []seqRange, limit int) string {
+	var parts []string
+	for i, gap := range gaps {
+		if i == limit {
+			parts = append(parts, fmt.Sprintf("... (%d more)", len(gaps) - limit))
+			break
+		}
+		if gap.first == gap.last {
+			parts = append(parts, strconv.FormatUint(gap.first, 10))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", gap.first, gap.last))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Returns the most common distance between the starts of consecutive ranges, and how many times it occurs
+// A regular pattern of losses (i.e. every 64th packet) shows up as a distance that accounts for most of the ranges
+func commonGapSpacing(gaps []seqRange) (uint64, int) {
+	counts := make(map[uint64]int)
+	var spacing uint64
+	best := 0
+	for i := 1; i < len(gaps); i++ {
+		distance := gaps[i].first - gaps[i - 1].first
+		counts[distance]++
+		if counts[distance] > best || (counts[distance] == best && distance < spacing) {
+			spacing = distance
+			best = counts[distance]
+		}
+	}
+	return spacing, best
+}
+
+// Writes the ranges of missing sequence numbers of every connection to a CSV file
+func writeGaps(fileName string, all []*clientStats) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"conn", "first_seq", "last_seq", "count"})
+	for connID, stats := range all {
+		for _, gap := range stats.gaps {
+			writer.Write([]string{strconv.Itoa(connID), strconv.FormatUint(gap.first, 10), strconv.FormatUint(gap.last, 10),
+				strconv.FormatUint(gap.last - gap.first + 1, 10)})
+		}
+	}
+	writer.Flush()
+	err = writer.Error()
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Server address that packets are sent to when the server's name is re-resolved while running
+// Connections to such a server are not connected to a single address, so every write names the current address
+// addr: the current *net.UDPAddr of the server
+type destination struct {
+	addr	atomic.Value
+}
+
+// Creates a destination with the given initial address
+func newDestination(addr *net.UDPAddr) *destination {
+	dest := &destination{}
+	dest.addr.Store(addr)
+	return dest
+}
+
+// Returns the current address of the server
+func (dest *destination) get() *net.UDPAddr {
+	return dest.addr.Load().(*net.UDPAddr)
+}
+
+// Switches packets over to a new address of the server
+func (dest *destination) set(addr *net.UDPAddr) {
+	dest.addr.Store(addr)
+}
+
+// Writes a packet to the connection's server, or to the current address of the destination if one is given
+func writePacket(conn netsim.PacketConn, dest *destination, packet []byte) (int, error) {
+	if dest != nil {
+		return conn.WriteTo(packet, dest.get())
+	}
+	return conn.Write(packet)
+}
+
+// Re-resolves the name of a server every interval, switching its destination over when the address changes
+// This process stops once the done channel is closed
+func reresolveTarget(networkName string, target string, dest *destination, interval time.Duration, doneChan <-chan struct{}, wg *sync.WaitGroup) {
+	// Close the wait group when done
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneChan:
+			return
+		case <-ticker.C:
+		}
+
+		addr, err := net.ResolveUDPAddr(networkName, target)
+		if err != nil {
+			// Keep sending to the last known address until the name resolves again
+			log.Printf("Could not re-resolve %s: %v\n", target, err)
+			continue
+		}
+		if old := dest.get(); addr.String() != old.String() {
+			log.Printf("%s now resolves to %s (was %s), switching destination\n", target, addr.String(), old.String())
+			dest.set(addr)
+		}
+	}
+}
+
+// A sent packet awaiting its reflection so that it can be retransmitted
+// packet: the bytes of the packet, which are resent as is apart from the retransmission flag
+// lastSend: the time of the latest attempt
+// attempts: the number of attempts made so far
+type pendingPacket struct {
+	packet		[]byte
+	lastSend	time.Time
+	attempts	int
+}
+
+// Retransmits packets whose reflection has not arrived within a timeout, up to a max number of attempts
+// timeout: how long to wait for the reflection of an attempt before retransmitting
+// maxAttempts: the max number of attempts per packet, including the first
+// pending: the packets awaiting their reflection by sequence number
+type retransmitter struct {
+	conn		netsim.PacketConn
+	dest		*destination
+	timeout		time.Duration
+	maxAttempts	int
+	mutex		sync.Mutex
+	pending		map[uint64]*pendingPacket
+}
+
+// Creates a retransmitter for packets sent over the given connection, to the destination if one is given
+func newRetransmitter(conn netsim.PacketConn, dest *destination, timeout time.Duration, maxAttempts int) *retransmitter {
+	return &retransmitter{conn: conn, dest: dest, timeout: timeout, maxAttempts: maxAttempts, pending: make(map[uint64]*pendingPacket)}
+}
+
+// Starts waiting for the reflection of a packet that is about to be sent for the first time
+func (rt *retransmitter) track(seq uint64, packet []byte, sendTime time.Time) {
+	rt.mutex.Lock()
+	rt.pending[seq] = &pendingPacket{packet: packet, lastSend: sendTime, attempts: 1}
+	rt.mutex.Unlock()
+}
+
+// Stops retransmitting a packet once any of its attempts has been reflected
+func (rt *retransmitter) acknowledge(seq uint64) {
+	rt.mutex.Lock()
+	delete(rt.pending, seq)
+	rt.mutex.Unlock()
+}
+
+// Checks for timed out packets a few times per timeout, retransmitting them or giving up on them after the last attempt
+// Packets sent during the warm-up period are retransmitted but not counted
+// This process stops once the done channel is closed or the connection times out
+func (rt *retransmitter) run(stats *clientStats, doneChan <-chan struct{}, wg *sync.WaitGroup) {
+	// Close the wait group when done
+	defer wg.Done()
+
+	checkInterval := rt.timeout / 4
+	if checkInterval < time.Millisecond {
+		checkInterval = time.Millisecond
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneChan:
+			return
+		case now := <-ticker.C:
+			// Collect the timed out packets, so the lock is not held while writing
+			var expired [][]byte
+			rt.mutex.Lock()
+			for seq, pending := range rt.pending {
+				if now.Sub(pending.lastSend) < rt.timeout {
+					continue
+				}
+				header, _ := protocol.ParseHeader(pending.packet)
+				warmup := stats.inWarmup(header.Timestamp)
+				if pending.attempts >= rt.maxAttempts {
+					delete(rt.pending, seq)
+					if !warmup {
+						atomic.AddInt64(&stats.abandoned, 1)
+					}
+					continue
+				}
+				protocol.AddFlags(pending.packet, protocol.FlagRetransmit)
+				pending.lastSend = now
+				pending.attempts++
+				expired = append(expired, pending.packet)
+				if !warmup {
+					atomic.AddInt64(&stats.retransmissions, 1)
+				}
+			}
+			rt.mutex.Unlock()
+
+			for _, packet := range expired {
+				_, err := writePacket(rt.conn, rt.dest, packet)
+				if err != nil {
+					// Exit once the time limit is reached
+					if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+						return
+					}
+					stats.fail(rt.conn, fmt.Errorf("Could not retransmit packet to server: %v", err))
+					return
+				}
+			}
+		}
+	}
+}
+
+// Flow control window that keeps at most a fixed number of packets outstanding (sent but not yet reflected)
+// Senders take a slot before each packet and reflections free them, so the send rate follows the rate of reflections
+// slots: holds one element per outstanding packet
+// timeout: how long a sender waits on a full window before presuming an outstanding packet lost and reusing its slot
+type flowWindow struct {
+	slots		chan struct{}
+	timeout		time.Duration
+}
+
+// Creates a flow control window with the given number of slots
+func newFlowWindow(size int, timeout time.Duration) *flowWindow {
+	return &flowWindow{slots: make(chan struct{}, size), timeout: timeout}
+}
+
+// Blocks until a slot is free and takes it, or reuses a slot once the timeout passes
+// Returns whether a slot had to be reused because the window stayed full
+func (fw *flowWindow) acquire() bool {
+	select {
+	case fw.slots <- struct{}{}:
+		return false
+	default:
+	}
+
+	timer := time.NewTimer(fw.timeout)
+	defer timer.Stop()
+	select {
+	case fw.slots <- struct{}{}:
+		return false
+	case <-timer.C:
+		// The packet holding the slot is presumed lost, so its slot is reused without freeing it
+		return true
+	}
+}
+
+// Frees a slot when a packet is reflected
+// Late reflections of packets whose slot was already reused are ignored once the window is empty
+func (fw *flowWindow) release() {
+	select {
+	case <-fw.slots:
+	default:
+	}
+}
+
+// Records all sent packets from the write channel into a window of outstanding sequence numbers
+// Blocks on the channel between packets and exits once the channel has been closed and drained
+func countWritten(writeIn <-chan uint64, set *seqWindow, wg *sync.WaitGroup) {
+	// Close the wait group when done
+	defer wg.Done()
+
+	for packetContent := range writeIn {
+		// Add the packet contents to the set
+		set.add(packetContent)
+	}
+}
+
+// Removes all received packets from the read channel from the window of outstanding sequence numbers
+// Blocks on the channel between packets and exits once the channel has been closed and drained
+// The round trip time and inter-arrival jitter of each packet is measured from its embedded send timestamp
+// Packets whose sequence number has already been received are counted as duplicates and otherwise ignored
+// The windows only track the most recent sequence numbers, so bookkeeping memory stays bounded on long runs
+// Packets arriving after a packet with a higher sequence number are counted as out of order
+// If a tracer is given, a record of every reflected packet is written to it
+// If one-way delay statistics are given, the server timestamps of first attempts are recorded in them
+func countWrittenRecv(rs *runState, recvIn <-chan receivedPacket, set *seqWindow, seen *seqWindow, stats *clientStats, rt *retransmitter, fw *flowWindow, owd *owdStats, tracer *packetTracer, connID int, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+	for received := range recvIn {
+		packet := received.packet
+
+		// Verify the packet is at least as long as the header and the hash
+		// The hash should be appended to the packet's original payload
+		if len(packet) < protocol.HeaderSize + rs.hashSize {
+			log.Printf("Packet is less than %d bytes in length: %v\n", protocol.HeaderSize + rs.hashSize, packet)
+			continue
+		}
+
+		// Read the header of the packet
+		header, err := protocol.ParseHeader(packet)
+		if err != nil {
+			log.Printf("Packet has an invalid header: %v\n", err)
+			continue
+		}
+
+		// Work out the size of the original payload from the packet's length, since payload sizes can vary between packets
+		// The hash follows the payload, and the server timestamps follow the hash if they were asked for
+		// Servers too old to add the timestamps leave them out, which the hash only matches without
+		payloadSize := len(packet) - rs.hashSize
+		hasTimestamps := false
+		if header.Flags & protocol.FlagServerTimestamps != 0 && payloadSize - protocol.ServerTimestampsSize >= protocol.HeaderSize && rs.hashMatches(packet, payloadSize - protocol.ServerTimestampsSize) {
+			payloadSize -= protocol.ServerTimestampsSize
+			hasTimestamps = true
+		}
+		intPacket := header.Seq
+		sendTime := header.Timestamp
+
+		// Ignore heartbeats reflected by servers that do not know to drop them
+		if header.Flags & protocol.FlagHeartbeat != 0 {
+			continue
+		}
+
+		// Reflections of another connection's packets belong to another sequence space, so they are counted but not matched
+		if header.ConnID != uint32(connID) {
+			atomic.AddInt64(&stats.misattributed, 1)
+			continue
+		}
+
+		// Stop retransmitting the packet now that one of its attempts was reflected
+		if rt != nil {
+			rt.acknowledge(intPacket)
+		}
+
+		// Ignore packets sent during the warm-up period, but stop tracking them as sent
+		if stats.inWarmup(sendTime) {
+			set.remove(intPacket)
+			continue
+		}
+		duplicate := seen.contains(intPacket)
+
+		// Trace the packet if requested
+		if tracer != nil {
+			tracer.record(connID, intPacket, sendTime, received.recvTime.UnixNano(), rs.hashMatches(packet, payloadSize), duplicate)
+		}
+
+		// Count the packet as a duplicate if it has already been received
+		if duplicate {
+			atomic.AddInt64(&stats.duplicates, 1)
+			continue
+		}
+		seen.add(intPacket)
+
+		// Free the packet's slot in the flow control window, only once for its first reflection
+		if fw != nil {
+			fw.release()
+		}
+
+		// Count the packet as delivered by a retransmission if the first reflection is of a retransmission
+		if header.Flags & protocol.FlagRetransmit != 0 {
+			atomic.AddInt64(&stats.recovered, 1)
+		}
+
+		// Record the reordering, round trip time, jitter, and loss interval of the packet
+		stats.recordReflection(intPacket, sendTime, received.recvTime.UnixNano(), header.Flags & protocol.FlagEcho != 0)
+
+		// Measure the one-way delays if the server appended its timestamps
+		// Retransmissions carry the send time of the first attempt, so they are left out
+		if owd != nil && header.Flags & protocol.FlagRetransmit == 0 && hasTimestamps {
+			serverRecv, serverSend, _ := protocol.ParseServerTimestamps(packet[payloadSize + rs.hashSize:])
+			owd.add(sendTime, serverRecv, serverSend, received.recvTime.UnixNano())
+		}
+
+		// Verify received packet is in the set, and remove it from the set if so
+		if set.remove(intPacket) {
+			// Increment the packets received counter
+			atomic.AddInt64(&stats.received, 1)
+		} else {
+			// This condition is hit when the packets have been received, but not yet
+			// recorded in the set
+			// Increment the packets received but not sent counter
+			atomic.AddInt64(&stats.receivedButNotSent, 1)
+		}
+	}
+}
+
+// Runs the goroutines that send, receive, and count the packets of a single connection to the server
+// Each connection has its own sequence space and statistics
+// This process stops once all of the connection's goroutines have finished
+func runConnection(rs *runState, conn netsim.PacketConn, opts sendOptions, chanCap int, trackWindow int, stats *clientStats, tracer *packetTracer, connID int, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+	// Create a window to add all written packets to
+	// This will be used to verify which packets have been received from the server
+	// The window is a bitmap of bounded size, sharded so that reads and writes do not contend on a single lock
+	set := newSeqWindow(trackWindow)
+	// Create a window of the sequence numbers that have already been received
+	seen := newSeqWindow(trackWindow)
+
+	// Create channels for processing written and received packets
+	writeChan := make(chan uint64, chanCap)
+	readChan := make(chan receivedPacket, chanCap)
+
+	// Create waitgroups to wait for the senders and the remaining goroutines to finish before terminating
+	var wgSend sync.WaitGroup
+	var wgConn sync.WaitGroup
+	wgSend.Add(opts.senders)
+	wgConn.Add(3)
+
+	// Call these goroutines to handle sending and receiving packets to server
+	// The senders share the connection's sequence space
+	var seqCounter uint64
+	var measuredCounter uint64
+	var stoppedEarly int32
+
+	// Retransmit packets whose reflection has not arrived in time if requested
+	// The retransmitter keeps running while in-flight packets are drained
+	var rt *retransmitter
+	var wgRetransmit sync.WaitGroup
+	retransmitDone := make(chan struct{})
+	if opts.retransmitTimeout > 0 {
+		rt = newRetransmitter(conn, opts.dest, opts.retransmitTimeout, opts.maxAttempts)
+		wgRetransmit.Add(1)
+		go rt.run(stats, retransmitDone, &wgRetransmit)
+	}
+
+	// Limit the number of outstanding packets if requested
+	var fw *flowWindow
+	if opts.window > 0 {
+		fw = newFlowWindow(opts.window, opts.windowTimeout)
+	}
+
+	lastSend := time.Now().UnixNano()
+	for senderID := 0; senderID < opts.senders; senderID++ {
+		go sendMessages(conn, opts, senderID, &seqCounter, &measuredCounter, &stoppedEarly, &lastSend, writeChan, stats, rt, fw, &wgSend)
+	}
+
+	// Keep the flow's NAT and conntrack entries alive while the senders are idle if requested
+	var wgHeartbeat sync.WaitGroup
+	heartbeatDone := make(chan struct{})
+	if opts.heartbeat > 0 {
+		wgHeartbeat.Add(1)
+		go sendHeartbeats(conn, opts.dest, opts.connID, opts.heartbeat, &lastSend, stats, heartbeatDone, &wgHeartbeat)
+	}
+	packetSize := opts.payloadSize + rs.hashSize
+	if opts.largePayloadSize > opts.payloadSize {
+		packetSize = opts.largePayloadSize + rs.hashSize
+	}
+	if opts.messages != nil {
+		packetSize = rs.maxPayloadSize + rs.hashSize
+	}
+	if opts.owd != nil {
+		packetSize += protocol.ServerTimestampsSize
+	}
+	go receiveMessages(conn, packetSize, stats, opts.abortUnreachable, readChan, &wgConn)
+	// Call these goroutines to handle counting number of packets sent and received from server
+	go countWritten(writeChan, set, &wgConn)
+	go countWrittenRecv(rs, readChan, set, seen, stats, rt, fw, opts.owd, tracer, connID, &wgConn)
+
+	// Wait for all senders to finish
+	wgSend.Wait()
+	close(heartbeatDone)
+	wgHeartbeat.Wait()
+
+	// Give in-flight packets a chance to be received when sending stops early
+	if atomic.LoadInt32(&stoppedEarly) == 1 {
+		err := conn.SetReadDeadline(time.Now().Add(opts.drain))
+		if err != nil {
+			log.Println("Could not set read deadline for connection: ", err)
+		}
+	}
+
+	// Close the channel for sending out written packets
+	close(writeChan)
+
+	// Wait for the remaining goroutines to finish
+	wgConn.Wait()
+	close(retransmitDone)
+	wgRetransmit.Wait()
+
+	// Find the sent packets that were never received, apart from those sent during the warm-up period
+	// Packets received before being recorded as sent are still in the set, but were seen
+	if first := atomic.LoadUint64(&stats.firstMeasured); first != math.MaxUint64 {
+		stats.gaps = set.missingFrom(first, seen)
+	}
+}
+
+// Sends a heartbeat whenever nothing has been sent on the connection for the given interval, until done
+// A heartbeat is just a header with the heartbeat flag set, which the server drops without reflecting
+func sendHeartbeats(conn netsim.PacketConn, dest *destination, connID uint32, interval time.Duration, lastSend *int64, stats *clientStats, doneChan <-chan struct{}, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+	// Check twice per interval, so the connection is never idle for much longer than the interval
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneChan:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(lastSend))) < interval {
+				continue
+			}
+			heartbeat := make([]byte, protocol.HeaderSize)
+			protocol.PutHeader(heartbeat, protocol.Header{Flags: protocol.FlagHeartbeat, ConnID: connID, Timestamp: now.UnixNano()})
+			_, err := writePacket(conn, dest, heartbeat)
+			if err != nil {
+				// Sending has stopped once the write deadline has passed
+				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+					return
+				}
+				log.Println("Could not send heartbeat: ", err)
+				continue
+			}
+			atomic.StoreInt64(lastSend, now.UnixNano())
+			atomic.AddInt64(&stats.heartbeats, 1)
+		}
+	}
+}
+
+// Splits a comma separated list of servers into host:port targets, using the default port for hosts without one
+func parseTargets(hosts string, defaultPort string) ([]string, error) {
+	var targets []string
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, defaultPort)
+		}
+		targets = append(targets, host)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("At least one host is needed")
+	}
+	return targets, nil
+}
+
+// Resolves the local address for the given connection to send from, or nil to let the kernel choose one
+// Each connection after the first uses the next local port
+func resolveLocalAddr(networkName string, host string, port int, connID int) (*net.UDPAddr, error) {
+	if host == "" && port == 0 {
+		return nil, nil
+	}
+	if port != 0 {
+		port += connID
+	}
+	return net.ResolveUDPAddr(networkName, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// Number of bytes of IPv4 and UDP headers in front of each payload
+const ipUDPHeaderSize = 28
+
+// Sends a probe with the given payload size up to tries times, and reports whether it was reflected by the server
+// with a hash of hashSize bytes appended
+// A probe that is too large to send with the don't-fragment bit set counts as not reflected
+func probePayloadSize(conn *net.UDPConn, size int, hashSize int, seq uint64, tries int, timeout time.Duration) (bool, error) {
+	payload := make([]byte, size)
+	buffer := make([]byte, protocol.MaxDatagramSize)
+
+	for try := 0; try < tries; try++ {
+		protocol.PutHeader(payload, protocol.Header{Seq: seq, Timestamp: time.Now().UnixNano()})
+		_, err := conn.Write(payload)
+		if err != nil {
+			if errors.Is(err, syscall.EMSGSIZE) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		// Wait for the reflection of this probe, ignoring late reflections of earlier probes
+		err = conn.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return false, err
+		}
+		for {
+			// A timeout, or an error from an ICMP message (i.e. fragmentation needed), means this try was lost
+			n, err := conn.Read(buffer)
+			if err != nil {
+				break
+			}
+			header, err := protocol.ParseHeader(buffer[:n])
+			if err == nil && header.Seq == seq && n == size + hashSize {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Finds the largest payload size between low and high that is reflected by the server with the don't-fragment bit set,
+// with a hash of hashSize bytes appended
+// Returns 0 if not even the smallest payload is reflected
+func discoverPathMTU(conn *net.UDPConn, low int, high int, hashSize int, tries int, timeout time.Duration) (int, error) {
+	var seq uint64
+
+	// Check that the server reflects anything at all before searching
+	ok, err := probePayloadSize(conn, low, hashSize, seq, tries, timeout)
+	if err != nil || !ok {
+		return 0, err
+	}
+	log.Printf("Probe of %d bytes (IP packet %d bytes): reflected\n", low, low + ipUDPHeaderSize)
+
+	// Binary search for the largest reflected size, where low always passes
+	for low < high {
+		seq++
+		size := low + (high - low + 1) / 2
+		ok, err := probePayloadSize(conn, size, hashSize, seq, tries, timeout)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			log.Printf("Probe of %d bytes (IP packet %d bytes): reflected\n", size, size + ipUDPHeaderSize)
+			low = size
+		} else {
+			log.Printf("Probe of %d bytes (IP packet %d bytes): lost\n", size, size + ipUDPHeaderSize)
+			high = size - 1
+		}
+	}
+	return low, nil
+}
+
+// ICMP types and codes reported for traceroute probes
+const icmpDestUnreachable = 3
+const icmpPortUnreachable = 3
+const icmpTimeExceeded = 11
+
+// Reply to a single traceroute probe
+// addr: address of the node that answered, or nil if nothing did within the timeout
+// rtt: time from sending the probe to the answer
+// reached: whether the answer came from the server itself rather than a hop on the way
+// unreachable: whether the answer was an ICMP destination unreachable rather than a reflection or a time exceeded
+type hopReply struct {
+	addr		net.IP
+	rtt		time.Duration
+	reached		bool
+	unreachable	bool
+}
+
+// Maps the path to the server by sending probes with TTLs from 1 up to maxHops, tries probes per TTL,
+// and logging the node that answered each like traceroute does
+// Stops at the first TTL whose probes reach the server or a destination unreachable, and returns whether the server reflected them
+func traceRoute(conn *net.UDPConn, maxHops int, tries int, timeout time.Duration) (bool, error) {
+	var seq uint64
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		var addr net.IP
+		var rtts []string
+		reached := false
+		unreachable := false
+		for try := 0; try < tries; try++ {
+			reply, err := probeHop(conn, ttl, seq, timeout)
+			seq++
+			if err != nil {
+				return false, err
+			}
+			if reply.addr == nil && !reply.reached {
+				rtts = append(rtts, "*")
+				continue
+			}
+			if addr == nil {
+				addr = reply.addr
+			}
+			rtts = append(rtts, reply.rtt.String())
+			reached = reached || reply.reached
+			unreachable = unreachable || reply.unreachable
+		}
+
+		hop := "*"
+		if addr != nil {
+			hop = addr.String()
+		}
+		switch {
+		case reached && unreachable:
+			log.Printf("Hop %d: %s  %s  (server not listening: port unreachable)\n", ttl, hop, strings.Join(rtts, "  "))
+		case reached:
+			log.Printf("Hop %d: %s  %s  (server)\n", ttl, hop, strings.Join(rtts, "  "))
+		case unreachable:
+			log.Printf("Hop %d: %s  %s  (destination unreachable)\n", ttl, hop, strings.Join(rtts, "  "))
+		default:
+			log.Printf("Hop %d: %s  %s\n", ttl, hop, strings.Join(rtts, "  "))
+		}
+		if reached || unreachable {
+			return reached && !unreachable, nil
+		}
+	}
+	return false, nil
+}
+
+// Transfers data over the reflector path in chunks and reassembles it from the reflections, as a reliable file transfer
+// Each chunk is sent after the header of a packet whose sequence number is the chunk's index, so its reflection tells where it goes
+// At most window chunks are outstanding at a time, and chunks not reflected with a matching hash within the timeout
+// are retransmitted, up to maxAttempts attempts in total
+// Returns the reassembled data and the statistics of the transfer, or an error if a chunk was given up on or the time limit was reached
+func transferFile(rs *runState, conn netsim.PacketConn, data []byte, chunkSize int, window int, timeout time.Duration, maxAttempts int, timeLimit time.Duration) ([]byte, *clientStats, error) {
+	numChunks := (len(data) + chunkSize - 1) / chunkSize
+	stats := newClientStats(time.Second, time.Now())
+	reassembled := make([]byte, len(data))
+	if numChunks == 0 {
+		return reassembled, stats, nil
+	}
+
+	// Stop everything once the time limit is reached
+	err := conn.SetDeadline(time.Now().Add(timeLimit))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Retransmit the chunks whose reflection does not arrive in time
+	rt := newRetransmitter(conn, nil, timeout, maxAttempts)
+	var wgRetransmit sync.WaitGroup
+	retransmitDone := make(chan struct{})
+	wgRetransmit.Add(1)
+	go rt.run(stats, retransmitDone, &wgRetransmit)
+
+	// Receive the reflections of the chunks
+	var wgRecv sync.WaitGroup
+	recvChan := make(chan receivedPacket, window)
+	wgRecv.Add(1)
+	go receiveMessages(conn, protocol.HeaderSize + chunkSize + rs.hashSize, stats, false, recvChan, &wgRecv)
+
+	// Send the chunks in order, taking a slot of the window for each
+	slots := make(chan struct{}, window)
+	sendDone := make(chan struct{})
+	var wgSend sync.WaitGroup
+	wgSend.Add(1)
+	go func() {
+		defer wgSend.Done()
+		for index := 0; index < numChunks; index++ {
+			select {
+			case slots <- struct{}{}:
+			case <-sendDone:
+				return
+			}
+			chunk := data[index * chunkSize:]
+			if len(chunk) > chunkSize {
+				chunk = chunk[:chunkSize]
+			}
+			packet := make([]byte, protocol.HeaderSize + len(chunk))
+			copy(packet[protocol.HeaderSize:], chunk)
+			sendTime := time.Now()
+			protocol.PutHeader(packet, protocol.Header{Seq: uint64(index), Timestamp: sendTime.UnixNano()})
+			rt.track(uint64(index), packet, sendTime)
+			_, err := conn.Write(packet)
+			if err != nil {
+				// The retransmitter resends the chunk unless the time limit was reached
+				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+					return
+				}
+				log.Println("Could not send chunk: ", err)
+				continue
+			}
+			atomic.AddInt64(&stats.sent, 1)
+		}
+	}()
+
+	// Place every reflected chunk whose hash matches, until all chunks are in or the transfer fails
+	// Chunks with a mismatched hash are not acknowledged, so they are retransmitted
+	done := make([]bool, numChunks)
+	remaining := numChunks
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+	for remaining > 0 && err == nil {
+		select {
+		case received, ok := <-recvChan:
+			if !ok {
+				err = fmt.Errorf("time limit reached with %d of %d chunks missing", remaining, numChunks)
+				break
+			}
+			packet := received.packet
+			if len(packet) < protocol.HeaderSize + rs.hashSize || !rs.hashMatches(packet, len(packet) - rs.hashSize) {
+				continue
+			}
+			chunk, parseErr := protocol.Unmarshal(packet, rs.hashSize)
+			if parseErr != nil || chunk.Seq >= uint64(numChunks) || done[chunk.Seq] {
+				continue
+			}
+			rt.acknowledge(chunk.Seq)
+			copy(reassembled[int(chunk.Seq) * chunkSize:], chunk.Body)
+			done[chunk.Seq] = true
+			remaining--
+			atomic.AddInt64(&stats.received, 1)
+			stats.recordReflection(chunk.Seq, chunk.Timestamp, received.recvTime.UnixNano(), false)
+			<-slots
+		case <-ticker.C:
+			if abandoned := atomic.LoadInt64(&stats.abandoned); abandoned > 0 {
+				err = fmt.Errorf("gave up on %d chunks after %d attempts", abandoned, maxAttempts)
+			}
+		}
+	}
+
+	// Stop the sender, the retransmitter, and the receiver
+	close(sendDone)
+	wgSend.Wait()
+	close(retransmitDone)
+	wgRetransmit.Wait()
+	conn.SetReadDeadline(time.Now())
+	for range recvChan {
+	}
+	wgRecv.Wait()
+	if failErr := stats.failure(); failErr != nil {
+		err = failErr
+	}
+	if err != nil {
+		return nil, stats, err
+	}
+	return reassembled, stats, nil
+}
+
+// Adapts the send rate with additive increase and multiplicative decrease (AIMD) based on the observed packet loss
+// Every interval, the rate grows by step while the loss stays at or below the threshold, and is multiplied by backoff otherwise
+// rateBits: the current rate of each connection, stored as float64 bits so senders can read it atomically
+// connections: the number of connections sharing the rate
+// step: the number of packets per second added to the total rate after each interval without loss
+// backoff: the factor the total rate is multiplied by after an interval with loss
+// threshold: the loss percentage above which an interval counts as lossy
+// peaks: the highest loss-free total rate before each back-off
+type aimdController struct {
+	rateBits	uint64
+	connections	int
+	step		float64
+	backoff		float64
+	threshold	float64
+	peaks		[]float64
+}
+
+// Creates an AIMD controller with the given initial total rate
+func newAimdController(rate float64, connections int, step float64, backoff float64, threshold float64) *aimdController {
+	ac := &aimdController{connections: connections, step: step, backoff: backoff, threshold: threshold}
+	ac.setRate(rate)
+	return ac
+}
+
+// Returns the current rate of each connection
+func (ac *aimdController) connRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&ac.rateBits))
+}
+
+// Sets the total rate, which is shared evenly between the connections
+func (ac *aimdController) setRate(rate float64) {
+	atomic.StoreUint64(&ac.rateBits, math.Float64bits(rate / float64(ac.connections)))
+}
+
+// Returns the sustainable total rate, as the average of the highest loss-free rates before each back-off
+// Returns 0 if loss was never seen
+func (ac *aimdController) sustainableRate() float64 {
+	if len(ac.peaks) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, peak := range ac.peaks {
+		sum += peak
+	}
+	return sum / float64(len(ac.peaks))
+}
+
+// Adjusts the rate at the end of every loss interval, starting once the warm-up period is over
+// Each decision uses the loss of the interval before last, so its packets had a whole interval to be reflected
+// Intervals sent before the latest back-off took effect are ignored
+// This process stops once the done channel is closed
+func (ac *aimdController) run(all []*clientStats, interval time.Duration, start time.Time, doneChan <-chan struct{}, wg *sync.WaitGroup) {
+	// Close the wait group when done
+	defer wg.Done()
+
+	// Wait for the warm-up period to end
+	select {
+	case <-doneChan:
+		return
+	case <-time.After(time.Until(start)):
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Keep track of the total rate in effect during each interval
+	rate := ac.connRate() * float64(ac.connections)
+	rates := []float64{rate}
+	lastBackoff := 0
+	bestSinceBackoff := 0.0
+
+	for tick := 1; ; tick++ {
+		select {
+		case <-doneChan:
+			return
+		case <-ticker.C:
+		}
+
+		index := tick - 2
+		if index >= lastBackoff {
+			sent, received := 0, 0
+			for _, stats := range all {
+				intervalSent, intervalReceived := stats.loss.counts(index)
+				sent += intervalSent
+				received += intervalReceived
+			}
+			if sent > 0 {
+				loss := lossPercent(sent, received)
+				if loss > ac.threshold {
+					// Back off multiplicatively from the rate that caused the loss
+					if bestSinceBackoff > 0 {
+						ac.peaks = append(ac.peaks, bestSinceBackoff)
+					}
+					rate = math.Max(rates[index] * ac.backoff, ac.step)
+					lastBackoff = tick
+					bestSinceBackoff = 0
+				} else {
+					// Grow additively while there is no loss
+					bestSinceBackoff = math.Max(bestSinceBackoff, rates[index])
+					rate += ac.step
+				}
+				log.Printf("Adaptive: %.2f%% loss at %.0f packets per second, now sending %.0f packets per second\n", loss, rates[index], rate)
+			}
+		}
+
+		ac.setRate(rate)
+		rates = append(rates, rate)
+	}
+}
+
+// Upper bounds in seconds of the buckets of the RTT histogram exposed to Prometheus
+var metricsRTTBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Returns the number of recorded latencies that are at most the given value
+// Only whole buckets are counted, so the count may be slightly low for a value inside a bucket
+func (hist *latencyHistogram) countAtMost(value time.Duration) uint64 {
+	var count uint64
+	for index, bucketCount := range hist.counts {
+		if histBucketUpperBound(index) > uint64(value) {
+			break
+		}
+		count += bucketCount
+	}
+	return count
+}
+
+// Counters of every connection exported to Prometheus, statsd, and Graphite
+// They are kept with atomics, so they can be read without the lock
+var metricCounters = []struct {
+	name	string
+	help	string
+	value	func(stats *clientStats) int64
+}{
+	{"udp_client_packets_sent_total", "Packets sent after the warm-up period.", func(stats *clientStats) int64 { return int64(stats.sentCount()) }},
+	{"udp_client_packets_received_total", "Sent packets reflected by the server.", func(stats *clientStats) int64 { return int64(stats.delivered()) }},
+	{"udp_client_duplicates_total", "Reflected packets received more than once.", func(stats *clientStats) int64 { return atomic.LoadInt64(&stats.duplicates) }},
+	{"udp_client_retransmissions_total", "Packets retransmitted after their reflection did not arrive in time.", func(stats *clientStats) int64 { return atomic.LoadInt64(&stats.retransmissions) }},
+	{"udp_client_abandoned_total", "Packets given up on after the max number of attempts.", func(stats *clientStats) int64 { return atomic.LoadInt64(&stats.abandoned) }},
+	{"udp_client_window_timeouts_total", "Sends that went ahead after waiting too long on a full window.", func(stats *clientStats) int64 { return atomic.LoadInt64(&stats.windowTimeouts) }},
+}
+
+// Writes the counters and RTT histogram of every connection in the Prometheus text exposition format
+// Each series is labelled with the connection number and its target
+func writeMetrics(w io.Writer, all []*clientStats, targets []string) {
+	labels := make([]string, len(all))
+	for i := range all {
+		labels[i] = fmt.Sprintf("conn=\"%d\",target=%q", i, targets[i % len(targets)])
+	}
+
+	for _, counter := range metricCounters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		for i, stats := range all {
+			fmt.Fprintf(w, "%s{%s} %d\n", counter.name, labels[i], counter.value(stats))
+		}
+	}
+
+	// The rest is guarded by the lock of each connection's statistics
+	fmt.Fprintf(w, "# HELP udp_client_out_of_order_total Reflected packets received after a higher sequence number.\n# TYPE udp_client_out_of_order_total counter\n")
+	for i, stats := range all {
+		stats.mutex.Lock()
+		fmt.Fprintf(w, "udp_client_out_of_order_total{%s} %d\n", labels[i], stats.reorder.count)
+		stats.mutex.Unlock()
+	}
+	fmt.Fprintf(w, "# HELP udp_client_jitter_seconds Inter-arrival jitter as defined in RFC 3550.\n# TYPE udp_client_jitter_seconds gauge\n")
+	for i, stats := range all {
+		stats.mutex.Lock()
+		fmt.Fprintf(w, "udp_client_jitter_seconds{%s} %g\n", labels[i], stats.jitter.value().Seconds())
+		stats.mutex.Unlock()
+	}
+	fmt.Fprintf(w, "# HELP udp_client_rtt_seconds Round trip time of reflected packets.\n# TYPE udp_client_rtt_seconds histogram\n")
+	for i, stats := range all {
+		stats.mutex.Lock()
+		for _, bound := range metricsRTTBuckets {
+			count := stats.rtt.hist.countAtMost(time.Duration(bound * float64(time.Second)))
+			fmt.Fprintf(w, "udp_client_rtt_seconds_bucket{%s,le=\"%g\"} %d\n", labels[i], bound, count)
+		}
+		fmt.Fprintf(w, "udp_client_rtt_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels[i], stats.rtt.count)
+		fmt.Fprintf(w, "udp_client_rtt_seconds_sum{%s} %g\n", labels[i], stats.rtt.sum.Seconds())
+		fmt.Fprintf(w, "udp_client_rtt_seconds_count{%s} %d\n", labels[i], stats.rtt.count)
+		stats.mutex.Unlock()
+	}
+}
+
+// Serves the metrics of every connection on /metrics at the given address for Prometheus to scrape
+// The server runs until it is closed, which the run does when it returns
+func serveMetrics(addr string, all []*clientStats, targets []string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, all, targets)
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	log.Printf("Serving metrics on http://%s/metrics\n", listener.Addr())
+	return server, nil
+}
+
+// Pushes the metrics of every connection to a Prometheus Pushgateway under the udp_client job
+// Each push replaces the metrics of the previous one
+func pushMetrics(gateway string, all []*clientStats, targets []string) error {
+	var body bytes.Buffer
+	writeMetrics(&body, all, targets)
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(gateway, "/") + "/metrics/job/udp_client", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode / 100 != 2 {
+		return fmt.Errorf("pushgateway responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Pushes the metrics to a Pushgateway every interval until the done channel is closed
+func runMetricsPush(gateway string, all []*clientStats, targets []string, interval time.Duration, doneChan <-chan struct{}, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneChan:
+			return
+		case <-ticker.C:
+			err := pushMetrics(gateway, all, targets)
+			if err != nil {
+				log.Println("Could not push metrics: ", err)
+			}
+		}
+	}
+}
+
+// Live statistics sampled over a single interval of a run
+type liveSample struct {
+	sent		int
+	delivered	int
+	sendRate	float64
+	recvRate	float64
+	lossPercent	float64
+	p50			time.Duration
+	p90			time.Duration
+	p99			time.Duration
+}
+
+// Logs a single line of live statistics
+func logLiveSample(sample liveSample) {
+	log.Printf("Live: send %.0f pps, recv %.0f pps, loss %.2f%%, RTT p50/p90/p99 %v / %v / %v\n",
+		sample.sendRate, sample.recvRate, sample.lossPercent, sample.p50, sample.p90, sample.p99)
+}
+
+// Samples live statistics of every connection every interval and passes them to display until the done channel is closed
+// Each sample holds the send and receive rates over the interval, the loss so far, and the interval's RTT percentiles
+func reportLiveStats(all []*clientStats, interval time.Duration, display func(liveSample), doneChan <-chan struct{}, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSent := 0
+	lastDelivered := 0
+	lastTick := time.Now()
+
+	for {
+		select {
+		case <-doneChan:
+			return
+		case now := <-ticker.C:
+			sent := 0
+			delivered := 0
+			window := newLatencyHistogram()
+			for _, stats := range all {
+				sent += stats.sentCount()
+				delivered += stats.delivered()
+				window.merge(stats.swapWindow())
+			}
+			elapsed := now.Sub(lastTick).Seconds()
+
+			display(liveSample{
+				sent: sent,
+				delivered: delivered,
+				sendRate: float64(sent - lastSent) / elapsed,
+				recvRate: float64(delivered - lastDelivered) / elapsed,
+				lossPercent: lossPercent(sent, delivered),
+				p50: window.percentile(50),
+				p90: window.percentile(90),
+				p99: window.percentile(99),
+			})
+
+			lastSent = sent
+			lastDelivered = delivered
+			lastTick = now
+		}
+	}
+}
+
+// Publishes a sample of live statistics to the web dashboard
+func publishLiveSample(web *dashboard.Dashboard, sample liveSample) {
+	web.Publish(dashboard.Sample{Metrics: []dashboard.Metric{
+		{Name: "Sent", Value: float64(sample.sent)},
+		{Name: "Received", Value: float64(sample.delivered)},
+		{Name: "Loss", Value: sample.lossPercent, Unit: "%", Chart: "Packet loss (%)"},
+		{Name: "Send rate", Value: sample.sendRate, Unit: "pps", Chart: "Packets per second"},
+		{Name: "Receive rate", Value: sample.recvRate, Unit: "pps", Chart: "Packets per second"},
+		{Name: "RTT p50", Value: float64(sample.p50) / float64(time.Millisecond), Unit: "ms", Chart: "RTT (ms)"},
+		{Name: "RTT p90", Value: float64(sample.p90) / float64(time.Millisecond), Unit: "ms", Chart: "RTT (ms)"},
+		{Name: "RTT p99", Value: float64(sample.p99) / float64(time.Millisecond), Unit: "ms", Chart: "RTT (ms)"},
+	}})
+}
+
+// Number of samples kept for the graphs of the terminal dashboard
+const tuiHistory = 60
+
+// Characters used to draw sparklines, from lowest to highest
+var sparkChars = []rune("▁▂▃▄▅▆▇█")
+
+// Draws a sparkline of the values, scaled so the largest value uses the tallest character
+func sparkline(values []float64) string {
+	max := 0.0
+	for _, value := range values {
+		if value > max {
+			max = value
+		}
+	}
+	var line strings.Builder
+	for _, value := range values {
+		index := 0
+		if max > 0 {
+			index = int(value / max * float64(len(sparkChars) - 1) + 0.5)
+		}
+		line.WriteRune(sparkChars[index])
+	}
+	return line.String()
+}
+
+// Terminal dashboard that redraws live statistics in place using ANSI escape codes
+// Log output is captured while the dashboard is shown and its last lines are drawn below the statistics
+// sendRates, recvRates, p50s: the most recent samples, used for the graphs
+// logLines: the most recent log lines
+// pending: log lines captured since the dashboard was last drawn
+type tuiDashboard struct {
+	mutex		sync.Mutex
+	target		string
+	start		time.Time
+	sendRates	[]float64
+	recvRates	[]float64
+	p50s		[]float64
+	logLines	[]string
+	pending		[]string
+}
+
+// Creates a dashboard for a run against the given target and starts capturing log output
+func newTuiDashboard(target string) *tuiDashboard {
+	dash := &tuiDashboard{target: target, start: time.Now()}
+	log.SetOutput(dash)
+	return dash
+}
+
+// Captures a line of log output for the dashboard
+func (dash *tuiDashboard) Write(p []byte) (int, error) {
+	dash.mutex.Lock()
+	defer dash.mutex.Unlock()
+	line := strings.TrimRight(string(p), "\n")
+	dash.logLines = append(dash.logLines, line)
+	dash.pending = append(dash.pending, line)
+	if len(dash.logLines) > 5 {
+		dash.logLines = dash.logLines[len(dash.logLines) - 5:]
+	}
+	return len(p), nil
+}
+
+// Appends a value to a history of samples, dropping the oldest once it is full
+func appendHistory(history []float64, value float64) []float64 {
+	history = append(history, value)
+	if len(history) > tuiHistory {
+		history = history[len(history) - tuiHistory:]
+	}
+	return history
+}
+
+// Adds a sample to the dashboard and redraws it
+func (dash *tuiDashboard) update(sample liveSample) {
+	dash.mutex.Lock()
+	defer dash.mutex.Unlock()
+	dash.sendRates = appendHistory(dash.sendRates, sample.sendRate)
+	dash.recvRates = appendHistory(dash.recvRates, sample.recvRate)
+	dash.p50s = appendHistory(dash.p50s, float64(sample.p50))
+
+	var screen strings.Builder
+	// Move the cursor to the top left and clear the screen
+	screen.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&screen, "UDP client -> %s    elapsed %v\n\n", dash.target, time.Since(dash.start).Truncate(time.Second))
+	fmt.Fprintf(&screen, "Sent:      %12d    Received: %12d    Loss: %6.2f%%\n", sample.sent, sample.delivered, sample.lossPercent)
+	fmt.Fprintf(&screen, "Send rate: %12.0f pps    Recv rate: %11.0f pps\n", sample.sendRate, sample.recvRate)
+	fmt.Fprintf(&screen, "RTT p50/p90/p99: %v / %v / %v\n\n", sample.p50, sample.p90, sample.p99)
+	fmt.Fprintf(&screen, "Send pps  %s\n", sparkline(dash.sendRates))
+	fmt.Fprintf(&screen, "Recv pps  %s\n", sparkline(dash.recvRates))
+	fmt.Fprintf(&screen, "RTT p50   %s\n\n", sparkline(dash.p50s))
+	for _, line := range dash.logLines {
+		fmt.Fprintln(&screen, line)
+	}
+	os.Stdout.WriteString(screen.String())
+	dash.pending = nil
+}
+
+// Stops capturing log output and writes out the lines captured since the dashboard was last drawn
+func (dash *tuiDashboard) close() {
+	log.SetOutput(os.Stderr)
+	dash.mutex.Lock()
+	defer dash.mutex.Unlock()
+	for _, line := range dash.pending {
+		fmt.Fprintln(os.Stderr, line)
+	}
+}
+
+// Returned by Run along with the results when a server was not listening, going by the ICMP port unreachable errors and the lack of any reflection
+var ErrServerNotListening = errors.New("server not listening")
+
+// Returns the settings of the Noise sessions of a run: the client's static key from its noise_key file, or a new one, and
+// the server's public key
+func loadNoiseConfig(options Options) (noise.Config, error) {
+	config := noise.Config{RekeyAfter: options.RekeyAfter}
+	var err error
+	config.PeerKey, err = noise.ParsePublicKey(options.NoiseServerKey)
+	if err != nil {
+		return config, err
+	}
+	if options.NoiseKey != "" {
+		config.Key, err = noise.LoadOrGenerateKey(options.NoiseKey)
+	} else {
+		config.Key, err = noise.GenerateKey()
+	}
+	if err != nil {
+		return config, err
+	}
+	log.Printf("Noise public key of the client: %s\n", noise.PublicKeyString(config.Key))
+	return config, nil
+}
+
+// Returned by Run along with the results when they exceed the max_loss or max_p99 thresholds
+var ErrThresholdExceeded = errors.New("threshold exceeded")
+
+// Options of a run, one for each command line flag of udp_client, named after the flag in its tag
+// The help text of each flag in RegisterFlags describes its option
+// Network: the network to open the sockets on, which has no flag and is the host's network of the transport if nil (see netsim)
+type Options struct {
+	Host				string			`flag:"host"`
+	Port				string			`flag:"port"`
+	ConnTime			string			`flag:"c_time"`
+	SendTime			time.Duration	`flag:"send_time"`
+	RecvTime			time.Duration	`flag:"recv_time"`
+	Buffer				int				`flag:"buffer"`
+	Ramp				string			`flag:"ramp"`
+	PPS					float64			`flag:"pps"`
+	Count				int				`flag:"count"`
+	Drain				time.Duration	`flag:"drain"`
+	PayloadSize			int				`flag:"payload_size"`
+	Pattern				string			`flag:"pattern"`
+	Seed				int64			`flag:"seed"`
+	Template			string			`flag:"template"`
+	HistFile			string			`flag:"hist_file"`
+	LossInterval		time.Duration	`flag:"loss_interval"`
+	Out					string			`flag:"out"`
+	Trace				string			`flag:"trace"`
+	StatsInterval		time.Duration	`flag:"stats_interval"`
+	TUI					bool			`flag:"tui"`
+	Connections			int				`flag:"connections"`
+	Senders				int				`flag:"senders"`
+	Warmup				time.Duration	`flag:"warmup"`
+	LocalAddr			string			`flag:"local_addr"`
+	LocalPort			int				`flag:"local_port"`
+	DontFragment		bool			`flag:"df"`
+	PMTU				bool			`flag:"pmtu"`
+	Arrival				string			`flag:"arrival"`
+	Gap					time.Duration	`flag:"gap"`
+	Burst				int				`flag:"burst"`
+	BurstInterval		time.Duration	`flag:"burst_interval"`
+	TrackWindow			int				`flag:"track_window"`
+	RetransmitTimeout	time.Duration	`flag:"retransmit_timeout"`
+	MaxAttempts			int				`flag:"max_attempts"`
+	Window				int				`flag:"window"`
+	WindowTimeout		time.Duration	`flag:"window_timeout"`
+	Adaptive			bool			`flag:"adaptive"`
+	AdaptiveStep		float64			`flag:"adaptive_step"`
+	AdaptiveBackoff		float64			`flag:"adaptive_backoff"`
+	AdaptiveLoss		float64			`flag:"adaptive_loss"`
+	ResolveInterval		time.Duration	`flag:"resolve_interval"`
+	OneWay				bool			`flag:"owd"`
+	GapFile				string			`flag:"gap_file"`
+	PMTUTimeout			time.Duration	`flag:"pmtu_timeout"`
+	Traceroute			bool			`flag:"traceroute"`
+	MaxHops				int				`flag:"max_hops"`
+	HopTimeout			time.Duration	`flag:"hop_timeout"`
+	AbortUnreachable	bool			`flag:"abort_unreachable"`
+	MaxLoss				float64			`flag:"max_loss"`
+	MaxP99				time.Duration	`flag:"max_p99"`
+	CheckpointFile		string			`flag:"checkpoint"`
+	CheckpointInterval	time.Duration	`flag:"checkpoint_interval"`
+	MetricsAddr			string			`flag:"metrics_addr"`
+	DashboardAddr		string			`flag:"dashboard_addr"`
+	PushGateway			string			`flag:"push_gateway"`
+	PushInterval		time.Duration	`flag:"push_interval"`
+	MetricsExport		string			`flag:"metrics_export"`
+	MetricsPrefix		string			`flag:"metrics_prefix"`
+	Profile				string			`flag:"profile"`
+	Calls				int				`flag:"calls"`
+	HashPercent			float64			`flag:"hash_percent"`
+	RequestID			string			`flag:"request_id"`
+	Heartbeat			time.Duration	`flag:"heartbeat"`
+	AB					bool			`flag:"ab"`
+	PayloadFile			string			`flag:"payload_file"`
+	PayloadDelim		string			`flag:"payload_delim"`
+	PayloadLoop			bool			`flag:"payload_loop"`
+	TransferFile		string			`flag:"transfer_file"`
+	TransferOut			string			`flag:"transfer_out"`
+	TraceRotate			time.Duration	`flag:"trace_rotate"`
+	Algo				string			`flag:"algo"`
+	Transport			string			`flag:"transport"`
+	NoiseServerKey		string			`flag:"noise_server_key"`
+	NoiseKey			string			`flag:"noise_key"`
+	RekeyAfter			uint64			`flag:"rekey_after"`
+	DTLSPSK				string			`flag:"dtls_psk"`
+	DTLSIdentity		string			`flag:"dtls_identity"`
+	Network				netsim.Network
+}
+
+// Registers a command line flag for every option on the flag set, with the option's default as the flag's default
+func (options *Options) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&options.Host, "host", "localhost", "IPv4 of host to connect to, or a comma separated list of hosts (with optional ports) to spread the connections across (i.e. 169.254.105.13)")
+	flags.StringVar(&options.Port, "port", "40000", "Port number of host to connect to (i.e. 40000)")
+	flags.StringVar(&options.ConnTime, "c_time", "1", "How long the connection with the server will stay alive for, as a duration or a number of minutes (i.e. 30s)")
+	flags.DurationVar(&options.SendTime, "send_time", 0, "How long to send for, or 0 to send until c_time (i.e. 20s)")
+	flags.DurationVar(&options.RecvTime, "recv_time", 0, "How long to receive for, or 0 to receive until drain after sending stops (i.e. 30s)")
+	flags.IntVar(&options.Buffer, "buffer", 1000000, "The max buffer size of the channels used to record packets sent and received (i.e. 1000000)")
+	flags.StringVar(&options.Ramp, "ramp", "", "Schedule of comma separated rate:duration steps to vary the packets sent per second over time (i.e. 1000:30s,5000:60s,10000:30s)")
+	flags.Float64Var(&options.PPS, "pps", 0, "Number of packets per second to send to the server, or 0 to send as fast as possible (i.e. 10000)")
+	flags.IntVar(&options.Count, "count", 0, "Number of packets to send after the warm-up before waiting for the remaining responses, or 0 for no limit (i.e. 100000)")
+	flags.DurationVar(&options.Drain, "drain", 5 * time.Second, "How long to keep receiving responses after sending stops, so in-flight responses are not counted as lost (i.e. 5s)")
+	flags.IntVar(&options.PayloadSize, "payload_size", 100, "Number of bytes in each packet's payload (i.e. 100)")
+	flags.StringVar(&options.Pattern, "pattern", "zeros", "Contents of each payload after the header: zeros, incrementing, random, or hex (i.e. random)")
+	flags.Int64Var(&options.Seed, "seed", 1, "Seed for the random payload pattern (i.e. 1)")
+	flags.StringVar(&options.Template, "template", "", "Hex bytes repeated across each payload for the hex payload pattern (i.e. deadbeef)")
+	flags.StringVar(&options.HistFile, "hist_file", "", "CSV file to write the full RTT histogram to at exit (i.e. rtt_hist.csv)")
+	flags.DurationVar(&options.LossInterval, "loss_interval", time.Second, "Length of the intervals that packet loss is reported for, or 0 to only report the total loss (i.e. 1s)")
+	flags.StringVar(&options.Out, "out", "", "File to write the results to at exit, as CSV if it ends in .csv and as JSON otherwise (i.e. results.json)")
+	flags.StringVar(&options.Trace, "trace", "", "CSV file to write one record per reflected packet to (i.e. trace.csv)")
+	flags.DurationVar(&options.StatsInterval, "stats_interval", time.Second, "How often to print a line of live statistics while running, or 0 to disable (i.e. 1s)")
+	flags.BoolVar(&options.TUI, "tui", false, "Show a terminal dashboard with live counters and graphs instead of lines of live statistics")
+	flags.IntVar(&options.Connections, "connections", 1, "Number of UDP sockets (distinct source ports) to send from to each host, each with its own sequence space and stats (i.e. 4)")
+	flags.IntVar(&options.Senders, "senders", 1, "Number of goroutines per connection sharing the send path, each sending an even share of the rate (i.e. 4)")
+	flags.DurationVar(&options.Warmup, "warmup", 0, "Period at the start of the run whose packets are sent and received but excluded from the statistics (i.e. 5s)")
+	flags.StringVar(&options.LocalAddr, "local_addr", "", "Local IPv4 to send from, or empty to let the kernel choose (i.e. 169.254.105.20)")
+	flags.IntVar(&options.LocalPort, "local_port", 0, "Local port to send from, with each further connection using the next port, or 0 to let the kernel choose (i.e. 50000)")
+	flags.BoolVar(&options.DontFragment, "df", false, "Set the don't-fragment bit on every packet sent, so packets larger than the path MTU are dropped instead of fragmented")
+	flags.BoolVar(&options.PMTU, "pmtu", false, "Discover the path MTU to the server by probing payload sizes with the don't-fragment bit set, then exit")
+	flags.StringVar(&options.Arrival, "arrival", "constant", "Distribution of the time between sends at the pps or ramp rate: constant, poisson, or uniform (i.e. poisson)")
+	flags.DurationVar(&options.Gap, "gap", 0, "Fixed delay between consecutive packets of each sender, instead of a rate (i.e. 100us)")
+	flags.IntVar(&options.Burst, "burst", 0, "Number of back-to-back packets each sender sends in a burst every burst_interval, instead of a rate (i.e. 100)")
+	flags.DurationVar(&options.BurstInterval, "burst_interval", 10 * time.Millisecond, "Time between the starts of consecutive bursts (i.e. 10ms)")
+	flags.IntVar(&options.TrackWindow, "track_window", defaultSeqWindow, "Number of most recent sequence numbers of each connection tracked for matching responses and finding duplicates (i.e. 16777216)")
+	flags.DurationVar(&options.RetransmitTimeout, "retransmit_timeout", 0, "Retransmit packets whose reflection has not arrived within this long, or 0 to never retransmit (i.e. 1s)")
+	flags.IntVar(&options.MaxAttempts, "max_attempts", 3, "Max number of attempts to send each packet when retransmitting, including the first (i.e. 3)")
+	flags.IntVar(&options.Window, "window", 0, "Max number of packets each connection keeps outstanding (sent but not yet reflected), or 0 for no limit (i.e. 64)")
+	flags.DurationVar(&options.WindowTimeout, "window_timeout", time.Second, "How long to wait on a full window before presuming an outstanding packet lost and sending anyway (i.e. 1s)")
+	flags.BoolVar(&options.Adaptive, "adaptive", false, "Adapt the send rate every loss_interval, growing it additively without loss and backing off multiplicatively on loss, and report the sustainable rate")
+	flags.Float64Var(&options.AdaptiveStep, "adaptive_step", 100, "Number of packets per second added to the rate after each interval without loss, which is also the starting rate if pps is not set (i.e. 100)")
+	flags.Float64Var(&options.AdaptiveBackoff, "adaptive_backoff", 0.5, "Factor the rate is multiplied by after an interval with loss (i.e. 0.5)")
+	flags.Float64Var(&options.AdaptiveLoss, "adaptive_loss", 1, "Loss percentage above which an interval counts as lossy (i.e. 1)")
+	flags.DurationVar(&options.ResolveInterval, "resolve_interval", 0, "How often to re-resolve host names and switch to a changed address, or 0 to only resolve them at startup (i.e. 30s)")
+	flags.BoolVar(&options.OneWay, "owd", false, "Ask the server to append its receive and send timestamps to measure one-way delays in each direction, with the clock offset estimated")
+	flags.StringVar(&options.GapFile, "gap_file", "", "CSV file to write every range of missing sequence numbers of each connection to at exit (i.e. gaps.csv)")
+	flags.DurationVar(&options.PMTUTimeout, "pmtu_timeout", time.Second, "How long to wait for each path MTU probe to be reflected (i.e. 1s)")
+	flags.BoolVar(&options.Traceroute, "traceroute", false, "Map the path to the server by sending probes with increasing TTL and reporting the hops that answer, then exit")
+	flags.IntVar(&options.MaxHops, "max_hops", 30, "Max TTL of the traceroute probes (i.e. 30)")
+	flags.DurationVar(&options.HopTimeout, "hop_timeout", time.Second, "How long to wait for an answer to each traceroute probe (i.e. 1s)")
+	flags.BoolVar(&options.AbortUnreachable, "abort_unreachable", false, "Stop a connection as soon as its server answers with an ICMP port unreachable, instead of counting its packets as lost")
+	flags.Float64Var(&options.MaxLoss, "max_loss", -1, "Exit with a non-zero code if the packet loss percentage is above this, or negative to not check (i.e. 0.1)")
+	flags.DurationVar(&options.MaxP99, "max_p99", 0, "Exit with a non-zero code if the p99 RTT is above this, or 0 to not check (i.e. 5ms)")
+	flags.StringVar(&options.CheckpointFile, "checkpoint", "", "File to periodically write the cumulative results so far to, as CSV if it ends in .csv and as JSON otherwise (i.e. checkpoint.json)")
+	flags.DurationVar(&options.CheckpointInterval, "checkpoint_interval", time.Minute, "How often to write the checkpoint file and flush the trace file (i.e. 1m)")
+	flags.StringVar(&options.MetricsAddr, "metrics_addr", "", "Address to serve Prometheus metrics of every connection on at /metrics while running (i.e. :9200)")
+	flags.StringVar(&options.DashboardAddr, "dashboard_addr", "", "Address to serve a web dashboard on while running, streaming live counters and latency charts to browsers over WebSocket (i.e. :8088)")
+	flags.StringVar(&options.PushGateway, "push_gateway", "", "URL of a Prometheus Pushgateway to push the metrics of every connection to while running (i.e. http://pushgateway:9091)")
+	flags.DurationVar(&options.PushInterval, "push_interval", 15 * time.Second, "How often to push metrics to the Pushgateway or metrics_export (i.e. 15s)")
+	flags.StringVar(&options.MetricsExport, "metrics_export", "", "statsd daemon or Graphite server to push the metrics of every connection to while running, for environments without Prometheus (i.e. statsd://localhost:8125 or graphite://graphite:2003)")
+	flags.StringVar(&options.MetricsPrefix, "metrics_prefix", "udp_client", "Prefix of the names of the metrics pushed to metrics_export (i.e. loadtest.udp_client)")
+	flags.StringVar(&options.Profile, "profile", "", "Built-in traffic profile setting the payload size and pacing of every connection: voip, gaming, or telemetry (i.e. gaming)")
+	flags.IntVar(&options.Calls, "calls", 1, "Number of concurrent calls with the voip profile, each sent from its own connection (i.e. 10)")
+	flags.Float64Var(&options.HashPercent, "hash_percent", 100, "Percentage of packets the server has hashed by the HTTP backend, with the server hashing the rest itself as a cheap echo (i.e. 80)")
+	flags.StringVar(&options.RequestID, "request_id", "", "Prefix of a request ID sent in a protobuf metadata extension after each packet's header, followed by the connection ID and sequence number, which the server passes to the HTTP backend instead of its own (i.e. run42)")
+	flags.DurationVar(&options.Heartbeat, "heartbeat", 0, "Send a small heartbeat packet whenever a connection has sent nothing for this long, to keep NAT bindings alive at low rates, or 0 to disable (i.e. 10s)")
+	flags.BoolVar(&options.AB, "ab", false, "Send identical interleaved traffic to the two servers given as host and compare their loss and latency side by side (i.e. -host a,b -ab)")
+	flags.StringVar(&options.PayloadFile, "payload_file", "", "File to read the messages sent as payloads (after the header) from instead of generating them, or - for stdin (i.e. messages.txt)")
+	flags.StringVar(&options.PayloadDelim, "payload_delim", "newline", "How the messages of the payload file are separated: newline, or length for a big endian uint32 length before each (i.e. length)")
+	flags.BoolVar(&options.PayloadLoop, "payload_loop", false, "Send the messages of the payload file again from the first once they are all sent, instead of stopping")
+	flags.StringVar(&options.TransferFile, "transfer_file", "", "File to transfer reliably over the reflector path in chunks of payload_size minus the header, then exit (i.e. data.bin)")
+	flags.StringVar(&options.TransferOut, "transfer_out", "", "File to write the data reassembled from the reflections of a transfer_file to (i.e. data.copy)")
+	flags.DurationVar(&options.TraceRotate, "trace_rotate", 0, "How often to start a new numbered trace file, or 0 to write a single trace file (i.e. 1h)")
+	flags.StringVar(&options.Algo, "algo", digest.Default, "Hash algorithm of the digest the server appends, which must match the server's: " + strings.Join(digest.Names(), ", ") + " (i.e. sha256)")
+	flags.StringVar(&options.Transport, "transport", "udp", "Transport to send the packets over: udp, or tcp to send the same packets framed over a TCP connection per connection to a server also run with -transport tcp (i.e. tcp)")
+	flags.StringVar(&options.NoiseServerKey, "noise_server_key", "", "Public key (hex) the server logs at startup with -noise_key, to set up a Noise IK session with it on every connection and encrypt every packet (i.e. 3b6a27bc...)")
+	flags.StringVar(&options.NoiseKey, "noise_key", "", "File with the client's static Noise key, generated if it does not exist, or empty for a new key every run, which only servers accepting any client allow (i.e. client.key)")
+	flags.Uint64Var(&options.RekeyAfter, "rekey_after", 1 << 20, "Number of packets each direction of a Noise session sends before replacing its key, or 0 to never rekey (i.e. 100000)")
+	flags.StringVar(&options.DTLSPSK, "dtls_psk", "", "Pre-shared key (hex) of a DTLS 1.2 server or proxy in front of the server, to set up a DTLS session with it on every connection and send every packet as a DTLS record encrypted with TLS_PSK_WITH_AES_128_GCM_SHA256 (i.e. 0a1b2c3d...)")
+	flags.StringVar(&options.DTLSIdentity, "dtls_identity", "udp_client", "PSK identity the client names itself with in its DTLS handshakes, which the DTLS server looks up the pre-shared key by (i.e. loadtest)")
+}
+
+// Returns the options with every option at its default, as udp_client runs without flags
+func DefaultOptions() Options {
+	var options Options
+	options.RegisterFlags(flag.NewFlagSet("udp_client", flag.ContinueOnError))
+	return options
+}
+
+// Returns the value of every option by the name of its command line flag, so results record the configuration of the run
+func (options *Options) config() map[string]string {
+	config := make(map[string]string)
+	value := reflect.ValueOf(options).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if name := value.Type().Field(i).Tag.Get("flag"); name != "" {
+			config[name] = fmt.Sprint(value.Field(i).Interface())
+		}
+	}
+	return config
+}
+
+// Runs a test against the servers with the given options, logging the statistics gathered as it goes and once it ends
+// Returns the combined results, or nil results for runs that only discover the path MTU, trace the route, or transfer a file
+// Every run keeps its own state, so several can be in progress in a process at once
+// Once the context is done, sending stops and the responses still in flight are drained, so the statistics gathered so far are still reported
+func Run(ctx context.Context, options Options) (*Results, error) {
+	// A traffic profile replaces the payload size and pacing, and sends one stream from each connection
+	// Setting the flags themselves keeps the configuration recorded with the results accurate
+	var profile trafficProfile
+	if options.Profile != "" {
+		var ok bool
+		profile, ok = trafficProfiles[options.Profile]
+		if !ok {
+			return nil, fmt.Errorf("Traffic profile must be one of %s", strings.Join(trafficProfileNames(), ", "))
+		}
+		if options.PPS > 0 || options.Ramp != "" || options.Gap > 0 || options.Burst > 0 || options.Adaptive {
+			return nil, errors.New("A traffic profile cannot be combined with pps, ramp, gap, burst, or adaptive")
+		}
+		options.PayloadSize = profile.payloadSize
+		options.Gap = profile.interval
+		options.Senders = 1
+		if profile.voice {
+			if options.Calls < 1 {
+				return nil, errors.New("Number of calls must be at least 1")
+			}
+			options.Connections = options.Calls
+		}
+	}
+
+	// Look up the hash algorithm, whose digest size bounds the largest payload, and record the configuration of the run
+	rs, err := newRunState(&options)
+	if err != nil {
+		return nil, err
+	}
+	maxPayloadSize := rs.maxPayloadSize
+
+	// A packet and its reflection must each fit a single DTLS record
+	if options.DTLSPSK != "" && maxPayloadSize > dtls.MaxPacketSize - rs.hashSize {
+		maxPayloadSize = dtls.MaxPacketSize - rs.hashSize
+	}
+
+	// Bandwidth is worked out from the average payload size, which the large packets of a profile add to
+	meanPayloadSize := options.PayloadSize
+	if options.Profile != "" {
+		meanPayloadSize = profile.meanPayloadSize()
+	}
+
+	// Verify the payload fits the header and a single datagram
+	if options.PayloadSize < minPayloadSize || options.PayloadSize > maxPayloadSize {
+		return nil, fmt.Errorf("Payload size must be between %d and %d bytes", minPayloadSize, maxPayloadSize)
+	}
+
+	// The mix of hashed and echoed packets is a percentage
+	if options.HashPercent < 0 || options.HashPercent > 100 {
+		return nil, errors.New("Hash percentage must be between 0 and 100")
+	}
+
+	// Checkpoints and trace rotation need a period to run at
+	if options.CheckpointFile != "" && options.CheckpointInterval <= 0 {
+		return nil, errors.New("Checkpoint interval must be positive")
+	}
+	if (options.PushGateway != "" || options.MetricsExport != "") && options.PushInterval <= 0 {
+		return nil, errors.New("Push interval must be positive")
+	}
+	if options.TraceRotate < 0 {
+		return nil, errors.New("Trace rotation interval must not be negative")
+	}
+
+	// Only UDP sockets can have the don't-fragment bit set, probe the path, or be left unconnected to follow a changed address
+	transportNetwork, err := netsim.Transport(options.Transport)
+	if err != nil {
+		return nil, err
+	}
+	if options.Transport == "tcp" {
+		if options.Network != nil {
+			return nil, errors.New("The tcp transport cannot be combined with a simulated network")
+		}
+		if options.DontFragment || options.PMTU || options.Traceroute || options.ResolveInterval > 0 {
+			return nil, errors.New("The tcp transport cannot be combined with df, pmtu, traceroute, or resolve_interval")
+		}
+	}
+
+	// Noise sessions are set up on connected sockets, so the server's address cannot change under them
+	var noiseConfig noise.Config
+	if options.NoiseServerKey != "" {
+		if options.DontFragment || options.PMTU || options.Traceroute || options.ResolveInterval > 0 {
+			return nil, errors.New("Noise sessions cannot be combined with df, pmtu, traceroute, or resolve_interval")
+		}
+		noiseConfig, err = loadNoiseConfig(options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// DTLS sessions are set up on connected sockets as well, and a connection can only be secured once
+	var dtlsConfig dtls.Config
+	if options.DTLSPSK != "" {
+		if options.NoiseServerKey != "" {
+			return nil, errors.New("DTLS and Noise sessions cannot be combined")
+		}
+		if options.DontFragment || options.PMTU || options.Traceroute || options.ResolveInterval > 0 {
+			return nil, errors.New("DTLS sessions cannot be combined with df, pmtu, traceroute, or resolve_interval")
+		}
+		psk, err := hex.DecodeString(options.DTLSPSK)
+		if err != nil {
+			return nil, fmt.Errorf("DTLS pre-shared key is not hex: %v", err)
+		}
+		dtlsConfig = dtls.Config{PSK: psk, Identity: options.DTLSIdentity}
+	}
+
+	var exporter *metricsExporter
+	if options.MetricsExport != "" {
+		exporter, err = newMetricsExporter(options.MetricsExport, options.MetricsPrefix)
+		if err != nil {
+			return nil, err
+		}
+		defer exporter.close()
+	}
+
+	// Every target gets its own connections, which each send an even share of the packets
+	targets, err := parseTargets(options.Host, options.Port)
+	if err != nil {
+		return nil, err
+	}
+	if options.Connections < 1 {
+		return nil, errors.New("Number of connections must be at least 1")
+	}
+	totalConns := len(targets) * options.Connections
+	if options.AB && len(targets) != 2 {
+		return nil, errors.New("A/B comparison needs exactly two hosts")
+	}
+	if options.Count > 0 && options.Count < totalConns {
+		return nil, errors.New("Packet count must be at least the number of connections")
+	}
+	if options.Senders < 1 {
+		return nil, errors.New("Number of senders must be at least 1")
+	}
+
+	// Random arrivals need a mean rate to draw the time between sends from
+	if options.Arrival != "constant" && options.Arrival != "poisson" && options.Arrival != "uniform" {
+		return nil, errors.New("Arrival distribution must be one of constant, poisson, or uniform")
+	}
+	if options.Arrival != "constant" && options.PPS <= 0 && options.Ramp == "" {
+		return nil, errors.New("Poisson and uniform arrivals need a pps or ramp rate")
+	}
+
+	// Gaps and bursts replace the rate, so only one way of pacing can be used
+	if options.Gap < 0 || options.Burst < 0 {
+		return nil, errors.New("Gap and burst must not be negative")
+	}
+	if options.Gap > 0 && options.Burst > 0 {
+		return nil, errors.New("Only one of gap and burst can be used")
+	}
+	if (options.Gap > 0 || options.Burst > 0) && (options.PPS > 0 || options.Ramp != "") {
+		return nil, errors.New("Gap and burst cannot be combined with pps or ramp")
+	}
+	if options.Burst > 0 && options.BurstInterval <= 0 {
+		return nil, errors.New("Burst interval must be positive")
+	}
+
+	// A fixed gap is a burst of a single packet every gap
+	connBurst := options.Burst
+	connBurstInterval := options.BurstInterval
+	if options.Gap > 0 {
+		connBurst = 1
+		connBurstInterval = options.Gap
+	}
+
+	// The adaptive rate replaces the other ways of pacing, and decides on the loss of each loss interval
+	if options.Adaptive {
+		if options.Ramp != "" || options.Gap > 0 || options.Burst > 0 {
+			return nil, errors.New("Adaptive rate cannot be combined with ramp, gap, or burst")
+		}
+		if options.LossInterval <= 0 {
+			return nil, errors.New("Adaptive rate needs a positive loss interval")
+		}
+		if options.AdaptiveStep <= 0 || options.AdaptiveBackoff <= 0 || options.AdaptiveBackoff >= 1 {
+			return nil, errors.New("Adaptive step must be positive and adaptive backoff must be between 0 and 1")
+		}
+	}
+
+	// A full window needs a timeout so that lost packets do not stop sending
+	if options.Window < 0 {
+		return nil, errors.New("Window must not be negative")
+	}
+	if options.Window > 0 && options.WindowTimeout <= 0 {
+		return nil, errors.New("Window timeout must be positive")
+	}
+
+	// Retransmitting needs at least one retry
+	if options.RetransmitTimeout > 0 && options.MaxAttempts < 2 {
+		return nil, errors.New("Max attempts must be at least 2 when retransmitting")
+	}
+
+	// The tracking window bounds the memory used for each connection
+	if options.TrackWindow < 1 {
+		return nil, errors.New("Tracking window must be at least 1")
+	}
+
+	// Every connection needs its own local port
+	if options.LocalPort < 0 || options.LocalPort + totalConns - 1 > 65535 {
+		return nil, errors.New("Local port must be between 0 and 65535 for every connection")
+	}
+
+	// Verify the payload generator can be created before connecting
+	_, err = newPayloadGenerator(options.Pattern, options.Seed, options.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the ramp schedule if one was given
+	var ramp []rampStep
+	if options.Ramp != "" {
+		ramp, err = parseRamp(options.Ramp)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse ramp schedule: %v", err)
+		}
+	}
+
+	// Parse the time limit, which is also how long sending and receiving last unless they are given their own durations
+	timeLimit, err := parseTimeLimit(options.ConnTime)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse c_time: %v", err)
+	}
+	if options.SendTime < 0 || options.RecvTime < 0 {
+		return nil, errors.New("send_time and recv_time cannot be negative")
+	}
+	if options.SendTime > 0 && options.RecvTime > 0 && options.RecvTime < options.SendTime {
+		return nil, errors.New("recv_time cannot be shorter than send_time")
+	}
+
+	// Define the addresses of the servers
+	networkName := "udp4"
+
+	// Get address of each UDP end point
+	remoteAddrs := make([]*net.UDPAddr, len(targets))
+	for t, target := range targets {
+		remoteAddrs[t], err = net.ResolveUDPAddr(networkName, target)
+		if err != nil {
+		  return nil, err
+		}
+	}
+
+	// Open the sockets on the network of the options, which is the host's network of the transport unless simulated
+	network := options.Network
+	if network == nil {
+		network = transportNetwork
+	}
+
+	// Encrypt the packets of every connection with a Noise session, set up by a handshake when the connection opens
+	var secure *noise.Network
+	if options.NoiseServerKey != "" {
+		secure = noise.Secure(network, noiseConfig)
+		network = secure
+	}
+
+	// Send the packets of every connection as the records of a DTLS session, set up by a handshake when the connection opens
+	var dtlsNetwork *dtls.Network
+	if options.DTLSPSK != "" {
+		dtlsNetwork = dtls.Secure(network, dtlsConfig)
+		network = dtlsNetwork
+	}
+
+	// Discover the path MTU instead of running a test if requested
+	// Only a single server can be probed at a time, over a real socket since the probes rely on its options
+	if options.PMTU {
+		if len(targets) > 1 {
+			return nil, errors.New("Path MTU discovery needs a single host")
+		}
+		if options.Network != nil {
+			return nil, errors.New("Path MTU discovery needs the host's UDP network")
+		}
+		service := targets[0]
+		remoteAddr := remoteAddrs[0]
+		localAddr, err := resolveLocalAddr(networkName, options.LocalAddr, options.LocalPort, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Could not resolve local address: %v", err)
+		}
+		conn, err := net.DialUDP(networkName, localAddr, remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		err = setDontFragment(conn)
+		if err != nil {
+			return nil, fmt.Errorf("Could not set the don't-fragment bit: %v", err)
+		}
+
+		log.Printf("Discovering path MTU to %s between %d and %d byte payloads\n", service, minPayloadSize, maxPayloadSize)
+		size, err := discoverPathMTU(conn, minPayloadSize, maxPayloadSize, rs.hashSize, 3, options.PMTUTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("Could not probe path MTU: %v", err)
+		}
+		if size == 0 {
+			return nil, errors.New("No probes were reflected by the server")
+		}
+		log.Printf("Largest payload reflected: %d bytes (IP packet %d bytes)\n", size, size + ipUDPHeaderSize)
+		mtu, err := kernelPathMTU(conn)
+		if err == nil {
+			log.Println("Path MTU known to the kernel: ", strconv.Itoa(mtu))
+		}
+		return nil, nil
+	}
+
+	// Map the path to the server instead of running a test if requested
+	// Only a single server can be traced at a time
+	if options.Traceroute {
+		if len(targets) > 1 {
+			return nil, errors.New("Traceroute needs a single host")
+		}
+		if options.Network != nil {
+			return nil, errors.New("Traceroute needs the host's UDP network")
+		}
+		service := targets[0]
+		remoteAddr := remoteAddrs[0]
+		localAddr, err := resolveLocalAddr(networkName, options.LocalAddr, options.LocalPort, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Could not resolve local address: %v", err)
+		}
+		conn, err := net.DialUDP(networkName, localAddr, remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		err = setRecvErr(conn)
+		if err != nil {
+			return nil, fmt.Errorf("Could not enable ICMP error reporting: %v", err)
+		}
+
+		log.Printf("Tracing route to %s (%s), %d hops max\n", service, remoteAddr.String(), options.MaxHops)
+		reached, err := traceRoute(conn, options.MaxHops, 3, options.HopTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("Could not trace route: %v", err)
+		}
+		if !reached {
+			return nil, errors.New("No probes were reflected by the server")
+		}
+		return nil, nil
+	}
+
+	// Transfer a file reliably instead of running a test if requested
+	// Only a single server can be sent to at a time
+	if options.TransferFile != "" {
+		if len(targets) > 1 {
+			return nil, errors.New("File transfer needs a single host")
+		}
+		data, err := os.ReadFile(options.TransferFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read file to transfer: %v", err)
+		}
+		localAddr, err := resolveLocalAddr(networkName, options.LocalAddr, options.LocalPort, 0)
+		if err != nil {
+			return nil, fmt.Errorf("Could not resolve local address: %v", err)
+		}
+		conn, err := network.DialUDP(networkName, localAddr, remoteAddrs[0])
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		// Chunks are sent with the retransmit options, and a window of outstanding chunks unless set otherwise
+		chunkSize := options.PayloadSize - protocol.HeaderSize
+		if chunkSize <= 0 {
+			return nil, errors.New("Payload size must leave room for data after the header")
+		}
+		transferWindow := options.Window
+		if transferWindow <= 0 {
+			transferWindow = 64
+		}
+		transferTimeout := options.RetransmitTimeout
+		if transferTimeout <= 0 {
+			transferTimeout = time.Second
+		}
+
+		log.Printf("Transferring %s (%d bytes) to %s in %d byte chunks\n", options.TransferFile, len(data), targets[0], chunkSize)
+		transferStart := time.Now()
+		reassembled, transferStats, err := transferFile(rs, conn, data, chunkSize, transferWindow, transferTimeout, options.MaxAttempts, timeLimit)
+		elapsed := time.Since(transferStart)
+		if err != nil {
+			return nil, fmt.Errorf("Transfer failed: %v", err)
+		}
+		log.Printf("Transferred %d bytes in %d chunks in %v (%.3f Mbps), with %d retransmissions\n", len(data), transferStats.sentCount(),
+			elapsed, float64(len(data)) * 8 / elapsed.Seconds() / 1e6, atomic.LoadInt64(&transferStats.retransmissions))
+
+		// Check that the reassembled data matches the original
+		sent := sha256.Sum256(data)
+		got := sha256.Sum256(reassembled)
+		if options.TransferOut != "" {
+			err = os.WriteFile(options.TransferOut, reassembled, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("Could not write reassembled file: %v", err)
+			}
+			log.Printf("Wrote reassembled file to %s\n", options.TransferOut)
+		}
+		if sent != got {
+			return nil, fmt.Errorf("Checksum mismatch: sent sha256 %x, reassembled sha256 %x", sent, got)
+		}
+		log.Printf("Checksum match: sha256 %x\n", got)
+		return nil, nil
+	}
+
+	// Read the payloads from a file or stdin instead of generating them if requested
+	var messages *messageSource
+	if options.PayloadFile != "" {
+		if options.Profile != "" {
+			return nil, errors.New("A payload file cannot be combined with a traffic profile")
+		}
+		messages, err = newMessageSource(options.PayloadFile, options.PayloadDelim, options.PayloadLoop, maxPayloadSize - protocol.HeaderSize)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open payload file: %v", err)
+		}
+	}
+
+	// Create the per-packet trace file if requested
+	var tracer *packetTracer
+	if options.Trace != "" {
+		tracer, err = newPacketTracer(options.Trace, options.TraceRotate > 0)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create trace file: %v", err)
+		}
+	}
+
+	// Set a time limit for how long the connections will stay alive
+	// Sending stops at the send deadline, and receiving continues for the drain period after it
+	// so responses still in flight are not counted as lost, unless the receive duration is given
+	now := time.Now()
+	sendDeadline := now.Add(timeLimit)
+	if options.SendTime > 0 {
+		sendDeadline = now.Add(options.SendTime)
+	}
+	recvDeadline := sendDeadline.Add(options.Drain)
+	if options.RecvTime > 0 {
+		recvDeadline = now.Add(options.RecvTime)
+	}
+
+	// Create statistics for each connection for counting packets, packet loss in each interval, round trip times, jitter, and reordering
+	allStats := make([]*clientStats, totalConns)
+
+	// Create the adaptive rate controller if requested, starting from pps or else a single step
+	totalRate := options.PPS
+	var aimd *aimdController
+	if options.Adaptive {
+		if totalRate <= 0 {
+			totalRate = options.AdaptiveStep
+		}
+		aimd = newAimdController(totalRate, totalConns, options.AdaptiveStep, options.AdaptiveBackoff, options.AdaptiveLoss)
+	}
+	// Packets sent during the warm-up period are excluded, so the measured interval starts once it ends
+	start := time.Now().Add(options.Warmup)
+	if options.Warmup > 0 {
+		log.Printf("Warming up for %v before measuring\n", options.Warmup)
+	}
+
+	// Create waitgroup to wait for all connections to finish before terminating
+	var wg sync.WaitGroup
+	wg.Add(totalConns)
+
+	// Re-resolve the names of the servers every interval if requested, so a changed record switches their destination
+	// Servers given by address are never re-resolved
+	dests := make([]*destination, len(targets))
+	doneChan := make(chan struct{})
+	var wgResolve sync.WaitGroup
+	if options.ResolveInterval > 0 {
+		for t, target := range targets {
+			host, _, _ := net.SplitHostPort(target)
+			if net.ParseIP(host) != nil {
+				continue
+			}
+			dests[t] = newDestination(remoteAddrs[t])
+			wgResolve.Add(1)
+			go reresolveTarget(networkName, target, dests[t], options.ResolveInterval, doneChan, &wgResolve)
+		}
+	}
+
+	// Measure one-way delays to each server if requested, shared by the connections to it since they share its clock
+	owds := make([]*owdStats, len(targets))
+	if options.OneWay {
+		for t := range targets {
+			owds[t] = newOwdStats()
+		}
+	}
+
+	// Connections are assigned to the targets round-robin
+	localAddrs := make([]string, totalConns)
+	conns := make([]netsim.PacketConn, totalConns)
+	for i := 0; i < totalConns; i++ {
+		service := targets[i % len(targets)]
+		remoteAddr := remoteAddrs[i % len(targets)]
+		dest := dests[i % len(targets)]
+
+		// Bind the requested local address and port, if any
+		// Otherwise the local address is nil, meaning a local address (and a distinct source port) is automatically chosen
+		localAddr, err := resolveLocalAddr(networkName, options.LocalAddr, options.LocalPort, i)
+		if err != nil {
+			return nil, fmt.Errorf("Could not resolve local address: %v", err)
+		}
+
+		// Establish UDP connection with server
+		// Servers whose name is re-resolved can change address, so their sockets are left unconnected
+		var conn netsim.PacketConn
+		if dest != nil {
+			conn, err = network.ListenUDP(networkName, localAddr)
+		} else {
+			conn, err = network.DialUDP(networkName, localAddr, remoteAddr)
+		}
+		if err != nil {
+		  return nil, err
+		}
+
+		// Drop packets larger than the path MTU instead of fragmenting them if requested
+		if options.DontFragment {
+			udpConn, ok := conn.(*net.UDPConn)
+			if !ok {
+				return nil, errors.New("The don't-fragment bit can only be set on the host's UDP network")
+			}
+			err = setDontFragment(udpConn)
+			if err != nil {
+				return nil, fmt.Errorf("Could not set the don't-fragment bit: %v", err)
+			}
+		}
+
+		// Close the connection with done with everything
+		defer conn.Close()
+
+		// Log information about connection
+		log.Printf("Established connection %d to %s \n", i, service)
+		log.Printf("Remote UDP address: %s \n", remoteAddr.String())
+		log.Printf("Local UDP client address: %s \n", conn.LocalAddr().String())
+		localAddrs[i] = conn.LocalAddr().String()
+		conns[i] = conn
+
+		// Sending and receiving stop at their deadlines
+		err = conn.SetWriteDeadline(sendDeadline)
+		if err != nil {
+			return nil, fmt.Errorf("Could not set write deadline for connection: %v", err)
+		}
+		err = conn.SetReadDeadline(recvDeadline)
+		if err != nil {
+			return nil, fmt.Errorf("Could not set read deadline for connection: %v", err)
+		}
+
+		// Share the send rates evenly between the connections
+		// A ramp schedule takes priority over a fixed rate
+		share := float64(totalConns)
+		var connRamp []rampStep
+		for _, step := range ramp {
+			connRamp = append(connRamp, rampStep{step.rate / share, step.duration})
+		}
+
+		// Spread the packet count between the connections, with the remainder going to the first connections
+		connCount := 0
+		if options.Count > 0 {
+			connCount = options.Count / totalConns
+			if i < options.Count % totalConns {
+				connCount++
+			}
+		}
+
+		// Each connection and sender gets its own seed so that random payloads differ between them
+		opts := sendOptions{
+			rate: totalRate / share,
+			ramp: connRamp,
+			count: connCount,
+			drain: options.Drain,
+			payloadSize: options.PayloadSize,
+			pattern: options.Pattern,
+			seed: options.Seed + int64(i * options.Senders),
+			template: options.Template,
+			senders: options.Senders,
+			arrival: options.Arrival,
+			burst: connBurst,
+			burstInterval: connBurstInterval,
+			jitter: profile.jitter,
+			largePayloadSize: profile.largePayloadSize,
+			largeChance: profile.largeChance,
+			hashPercent: options.HashPercent,
+			requestID: options.RequestID,
+			heartbeat: options.Heartbeat,
+			messages: messages,
+			connID: uint32(i),
+			abortUnreachable: options.AbortUnreachable,
+			retransmitTimeout: options.RetransmitTimeout,
+			maxAttempts: options.MaxAttempts,
+			window: options.Window,
+			windowTimeout: options.WindowTimeout,
+			aimd: aimd,
+			dest: dest,
+			owd: owds[i % len(targets)],
+		}
+		allStats[i] = newClientStats(options.LossInterval, start)
+		go runConnection(rs, conn, opts, options.Buffer, options.TrackWindow, allStats[i], tracer, i, &wg)
+	}
+
+	// Stop the run early once the context is done, so the statistics gathered so far are still reported
+	// Expiring the write deadlines makes every send loop exit as if the time limit was reached,
+	// and the receive loops keep collecting in-flight responses for the drain period
+	stopDone := make(chan struct{})
+	var wgStop sync.WaitGroup
+	wgStop.Add(1)
+	go func() {
+		defer wgStop.Done()
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopped early: stopping sends and draining responses for %v\n", options.Drain)
+			for _, conn := range conns {
+				conn.SetWriteDeadline(time.Now())
+				conn.SetReadDeadline(time.Now().Add(options.Drain))
+			}
+		case <-stopDone:
+		}
+	}()
+
+	// Print live statistics while the run is in progress if requested, and stream them to a web dashboard
+	// The terminal dashboard replaces the lines of live statistics
+	// Every display gets the same samples, since taking a sample starts the RTT window over
+	var wgLive sync.WaitGroup
+	var dash *tuiDashboard
+	var displays []func(liveSample)
+	if options.TUI {
+		dash = newTuiDashboard(strings.Join(targets, ", "))
+		displays = append(displays, dash.update)
+	} else if options.StatsInterval > 0 {
+		displays = append(displays, logLiveSample)
+	}
+	if options.DashboardAddr != "" {
+		web, err := dashboard.Serve(options.DashboardAddr, "UDP client -> " + strings.Join(targets, ", "))
+		if err != nil {
+			log.Println("Could not serve dashboard: ", err)
+		} else {
+			defer web.Close()
+			displays = append(displays, func(sample liveSample) {
+				publishLiveSample(web, sample)
+			})
+		}
+	}
+	if len(displays) > 0 {
+		interval := options.StatsInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		wgLive.Add(1)
+		go reportLiveStats(allStats, interval, func(sample liveSample) {
+			for _, display := range displays {
+				display(sample)
+			}
+		}, doneChan, &wgLive)
+	}
+
+	// Adapt the send rate to the observed loss if requested
+	if aimd != nil {
+		wgLive.Add(1)
+		go aimd.run(allStats, options.LossInterval, start, doneChan, &wgLive)
+	}
+
+	// Expose the metrics to Prometheus if requested
+	if options.MetricsAddr != "" {
+		metrics, err := serveMetrics(options.MetricsAddr, allStats, targets)
+		if err != nil {
+			log.Println("Could not serve metrics: ", err)
+		} else {
+			defer metrics.Close()
+		}
+	}
+	if options.PushGateway != "" {
+		wgLive.Add(1)
+		go runMetricsPush(options.PushGateway, allStats, targets, options.PushInterval, doneChan, &wgLive)
+	}
+	if exporter != nil {
+		wgLive.Add(1)
+		go runMetricsExport(exporter, allStats, targets, options.PushInterval, doneChan, &wgLive)
+	}
+
+	// Checkpoint the results and rotate the trace file if requested, for long soak runs
+	if options.CheckpointFile != "" {
+		wgLive.Add(1)
+		go runCheckpoints(rs, allStats, options.CheckpointFile, options.CheckpointInterval, options.LossInterval, start, meanPayloadSize, tracer, doneChan, &wgLive)
+	}
+	if tracer != nil && options.TraceRotate > 0 {
+		wgLive.Add(1)
+		go tracer.rotateEvery(options.TraceRotate, doneChan, &wgLive)
+	}
+
+	// Wait for all goroutines to finish
+	wg.Wait()
+	close(stopDone)
+	wgStop.Wait()
+	close(doneChan)
+	wgLive.Wait()
+	wgResolve.Wait()
+	if dash != nil {
+		dash.close()
+	}
+
+	// Give up on the run if any connection was stopped by an error
+	for _, connStats := range allStats {
+		if err := connStats.failure(); err != nil {
+			if tracer != nil {
+				tracer.close()
+			}
+			return nil, err
+		}
+	}
+
+	// Combine the statistics of every connection
+	// The size of payloads read from a file is only known once they are sent
+	if messages != nil {
+		meanPayloadSize = messages.meanPayloadSize()
+	}
+	stats := mergeClientStats(allStats, options.LossInterval)
+	results := stats.results(start)
+	results.Config = rs.config
+	results.addBandwidth(meanPayloadSize, rs.hashSize)
+	if options.RetransmitTimeout > 0 {
+		results.Retransmit = stats.retransmitResults()
+	}
+	if aimd != nil {
+		results.SustainableRate = aimd.sustainableRate()
+	}
+	if options.HashPercent < 100 {
+		results.addMixRTT(stats)
+	}
+	if profile.voice {
+		results.MOS = estimateMOS(time.Duration(results.RTT.AvgNs), time.Duration(results.JitterNs), results.LossPercent)
+	}
+	if options.OneWay {
+		for t, target := range targets {
+			results.OneWay = append(results.OneWay, owds[t].results(target))
+		}
+	}
+	if totalConns > 1 {
+		for i, connStats := range allStats {
+			connResults := connStats.results(start)
+			connResults.LocalAddr = localAddrs[i]
+			connResults.Target = targets[i % len(targets)]
+			connResults.addBandwidth(meanPayloadSize, rs.hashSize)
+			if options.RetransmitTimeout > 0 {
+				connResults.Retransmit = connStats.retransmitResults()
+			}
+			if profile.voice {
+				connResults.MOS = estimateMOS(time.Duration(connResults.RTT.AvgNs), time.Duration(connResults.JitterNs), connResults.LossPercent)
+			}
+			results.Connections = append(results.Connections, connResults)
+		}
+	}
+
+	// Combine the statistics of the connections to each target
+	if len(targets) > 1 {
+		for t, target := range targets {
+			var targetStats []*clientStats
+			for i := t; i < totalConns; i += len(targets) {
+				targetStats = append(targetStats, allStats[i])
+			}
+			merged := mergeClientStats(targetStats, options.LossInterval)
+			targetResults := merged.results(start)
+			targetResults.Target = target
+			targetResults.addBandwidth(meanPayloadSize, rs.hashSize)
+			if options.RetransmitTimeout > 0 {
+				targetResults.Retransmit = merged.retransmitResults()
+			}
+			results.Targets = append(results.Targets, targetResults)
+		}
+	}
+
+	// Finish writing the trace file
+	if tracer != nil {
+		err = tracer.close()
+		if err != nil {
+			log.Println("Could not write trace file: ", err)
+		} else {
+			if tracer.rotating {
+				log.Printf("Wrote packet trace to %d files ending with %s\n", tracer.part + 1, tracer.currentFileName())
+			} else {
+				log.Printf("Wrote packet trace to %s\n", tracer.currentFileName())
+			}
+		}
+	}
+
+	log.Println("Packets Sent: ", strconv.Itoa(results.Sent))
+	log.Println("Packets Received: ", strconv.Itoa(results.Received))
+	log.Println("Duplicate Packets Received: ", strconv.Itoa(results.Duplicates))
+	log.Printf("Out of Order Packets Received: %d (max reordering distance: %d)\n", results.OutOfOrder, results.MaxReorderDistance)
+	log.Printf("Packet loss: %.2f%%\n", results.LossPercent)
+	stats.loss.report()
+	log.Printf("RTT min/avg/max: %v / %v / %v\n", time.Duration(results.RTT.MinNs), time.Duration(results.RTT.AvgNs), time.Duration(results.RTT.MaxNs))
+	log.Printf("RTT p50/p90/p99/p999: %v / %v / %v / %v\n", time.Duration(results.RTT.P50Ns), time.Duration(results.RTT.P90Ns), time.Duration(results.RTT.P99Ns), time.Duration(results.RTT.P999Ns))
+	log.Printf("Jitter (RFC 3550): %v\n", time.Duration(results.JitterNs))
+	log.Printf("Bandwidth sent: %.3f Mbps (payload %.3f Mbps), received: %.3f Mbps (goodput %.3f Mbps)\n",
+		results.SentMbps, results.SentPayloadMbps, results.ReceivedMbps, results.GoodputMbps)
+	if results.EchoRTT != nil {
+		log.Printf("RTT of echoed packets avg/p50/p99: %v / %v / %v\n", time.Duration(results.EchoRTT.AvgNs), time.Duration(results.EchoRTT.P50Ns), time.Duration(results.EchoRTT.P99Ns))
+		log.Printf("RTT of hashed packets avg/p50/p99: %v / %v / %v\n", time.Duration(results.HashRTT.AvgNs), time.Duration(results.HashRTT.P50Ns), time.Duration(results.HashRTT.P99Ns))
+	}
+	if profile.voice {
+		log.Printf("Estimated MOS (E-model): %.2f\n", results.MOS)
+		for i, connResults := range results.Connections {
+			log.Printf("Call %d: loss %.2f%%, jitter %v, RTT avg %v, MOS %.2f\n", i, connResults.LossPercent,
+				time.Duration(connResults.JitterNs), time.Duration(connResults.RTT.AvgNs), connResults.MOS)
+		}
+	}
+	for _, oneWay := range results.OneWay {
+		if oneWay.Samples == 0 {
+			log.Printf("One-way delay to %s: no server timestamps received (the server may be too old to add them)\n", oneWay.Target)
+			continue
+		}
+		log.Printf("One-way delay to %s: clock offset %v, server processing avg %v\n", oneWay.Target,
+			time.Duration(oneWay.ClockOffsetNs), time.Duration(oneWay.ServerProcessingAvgNs))
+		log.Printf("  client to server min/avg/max: %v / %v / %v, p50/p99: %v / %v\n", time.Duration(oneWay.Forward.MinNs),
+			time.Duration(oneWay.Forward.AvgNs), time.Duration(oneWay.Forward.MaxNs), time.Duration(oneWay.Forward.P50Ns), time.Duration(oneWay.Forward.P99Ns))
+		log.Printf("  server to client min/avg/max: %v / %v / %v, p50/p99: %v / %v\n", time.Duration(oneWay.Reverse.MinNs),
+			time.Duration(oneWay.Reverse.AvgNs), time.Duration(oneWay.Reverse.MaxNs), time.Duration(oneWay.Reverse.P50Ns), time.Duration(oneWay.Reverse.P99Ns))
+	}
+	if aimd != nil {
+		if results.SustainableRate > 0 {
+			log.Printf("Sustainable rate (AIMD): %.0f packets per second, averaged over %d back-offs\n", results.SustainableRate, len(aimd.peaks))
+		} else {
+			log.Printf("Sustainable rate (AIMD): no loss seen up to %.0f packets per second\n", aimd.connRate() * float64(totalConns))
+		}
+	}
+	if results.Misattributed > 0 {
+		log.Println("Reflections received on the wrong connection: ", strconv.Itoa(results.Misattributed))
+	}
+	if results.PortUnreachable > 0 {
+		log.Println("ICMP port unreachable errors: ", strconv.Itoa(results.PortUnreachable))
+	}
+	if results.Heartbeats > 0 {
+		log.Println("Heartbeats Sent: ", strconv.Itoa(results.Heartbeats))
+	}
+	if options.Window > 0 {
+		log.Printf("Send rate with a window of %d: %.1f packets per second (%d window timeouts)\n", options.Window,
+			float64(results.Sent) / results.DurationSeconds, results.WindowTimeouts)
+	}
+	if secure != nil {
+		secure.Stats().Log()
+	}
+	if dtlsNetwork != nil {
+		dtlsNetwork.Stats().Log()
+	}
+	if rt := results.Retransmit; rt != nil {
+		log.Println("Retransmissions Sent: ", strconv.Itoa(rt.Retransmissions))
+		log.Printf("Received on first attempt: %d (loss %.2f%%), received after retransmitting: %d, abandoned after %d attempts: %d\n",
+			rt.FirstAttemptReceived, rt.FirstAttemptLossPercent, rt.RetransmitReceived, options.MaxAttempts, rt.Abandoned)
+	}
+	// Show which sequence numbers went missing, since the pattern of losses can matter as much as their number
+	for connID, connStats := range allStats {
+		if len(connStats.gaps) == 0 {
+			continue
+		}
+		var missing uint64
+		for _, gap := range connStats.gaps {
+			missing += gap.last - gap.first + 1
+		}
+		log.Printf("Connection %d missing sequence numbers (%d in %d ranges): %s\n", connID, missing, len(connStats.gaps), formatRanges(connStats.gaps, 10))
+		if spacing, times := commonGapSpacing(connStats.gaps); times > 1 {
+			log.Printf("Connection %d most common distance between missing ranges: %d (%d times)\n", connID, spacing, times)
+		}
+	}
+	if options.AB {
+		log.Println("A/B comparison:")
+		logComparison(results.Targets[0].Target, results.Targets[1].Target, results.Targets[0], results.Targets[1])
+	}
+	for _, targetResults := range results.Targets {
+		log.Printf("Target %s: sent %d, received %d, loss %.2f%%, RTT p50/p99 %v / %v\n", targetResults.Target,
+			targetResults.Sent, targetResults.Received, targetResults.LossPercent, time.Duration(targetResults.RTT.P50Ns), time.Duration(targetResults.RTT.P99Ns))
+		if targetResults.ServerNotListening {
+			log.Printf("Target %s: server not listening\n", targetResults.Target)
+		}
+	}
+	for i, connResults := range results.Connections {
+		log.Printf("Connection %d (%s to %s): sent %d, received %d, loss %.2f%%, RTT p50/p99 %v / %v\n", i, connResults.LocalAddr, connResults.Target,
+			connResults.Sent, connResults.Received, connResults.LossPercent, time.Duration(connResults.RTT.P50Ns), time.Duration(connResults.RTT.P99Ns))
+	}
+
+	// Write out the results in a machine readable form if requested
+	if options.Out != "" {
+		err = writeResults(options.Out, results)
+		if err != nil {
+			log.Println("Could not write results: ", err)
+		} else {
+			log.Printf("Wrote results to %s\n", options.Out)
+		}
+	}
+
+	// Write out the missing sequence ranges if requested
+	if options.GapFile != "" {
+		err = writeGaps(options.GapFile, allStats)
+		if err != nil {
+			log.Println("Could not write missing sequence ranges: ", err)
+		} else {
+			log.Printf("Wrote missing sequence ranges to %s\n", options.GapFile)
+		}
+	}
+
+	// Write out the full histogram if requested
+	if options.HistFile != "" {
+		err = stats.rtt.hist.dump(options.HistFile)
+		if err != nil {
+			log.Println("Could not write RTT histogram: ", err)
+		} else {
+			log.Printf("Wrote RTT histogram to %s\n", options.HistFile)
+		}
+	}
+
+	// Push the final metrics, so the Pushgateway, statsd, or Graphite holds the totals of the whole run
+	if options.PushGateway != "" {
+		err = pushMetrics(options.PushGateway, allStats, targets)
+		if err != nil {
+			log.Println("Could not push metrics: ", err)
+		}
+	}
+	if exporter != nil {
+		err = exporter.flush(allStats, targets)
+		if err != nil {
+			log.Println("Could not export metrics: ", err)
+		}
+	}
+
+	// Bring the checkpoint up to date with the final results
+	if options.CheckpointFile != "" {
+		err = writeResultsAtomic(options.CheckpointFile, results)
+		if err != nil {
+			log.Println("Could not write checkpoint: ", err)
+		}
+	}
+
+	// Fail the run when it exceeds the thresholds, so it can gate automation
+	exceeded := checkThresholds(results, options.MaxLoss, options.MaxP99)
+	for _, reason := range exceeded {
+		log.Printf("Threshold exceeded: %s\n", reason)
+	}
+	// A server that is not listening is its own result, so it is not mistaken for a lossy path
+	notListening := results.ServerNotListening
+	for _, targetResults := range results.Targets {
+		notListening = notListening || targetResults.ServerNotListening
+	}
+	if notListening && len(results.Targets) == 0 {
+		log.Println("Server not listening")
+	}
+	log.Println("All done!")
+	if notListening {
+		return &results, ErrServerNotListening
+	}
+	if len(exceeded) > 0 {
+		return &results, ErrThresholdExceeded
+	}
+	return &results, nil
+}
@@ -0,0 +1,228 @@
+package udpclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbopardi/udp_client_server/internal/digest"
+	"github.com/nbopardi/udp_client_server/internal/protocol"
+	"github.com/nbopardi/udp_client_server/pkg/netsim"
+)
+
+// Starts a reflector on a loopback port that appends the digest of the algorithm to every packet, like the server does
+// Returns the port it listens on
+func startReflector(t *testing.T, algoName string) string {
+	algo, err := digest.Lookup(algoName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append(buffer[:n:n], algo.Sum(buffer[:n])...), from)
+		}
+	}()
+	return fmt.Sprint(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// Counts the records of a trace file whose digest matched
+func countTraceMatches(t *testing.T, fileName string) (int, int) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, matched := 0, 0
+	scanner := bufio.NewScanner(file)
+	scanner.Scan()
+	for scanner.Scan() {
+		records++
+		if strings.Split(scanner.Text(), ",")[5] == "true" {
+			matched++
+		}
+	}
+	return records, matched
+}
+
+// Runs in the same process with different hash algorithms each check the digests of their own algorithm and record their own configuration
+func TestConcurrentRuns(t *testing.T) {
+	dir := t.TempDir()
+	algos := []string{"sha256", "xxhash64"}
+	results := make([]*Results, len(algos))
+	errs := make([]error, len(algos))
+	var wg sync.WaitGroup
+	for i, algo := range algos {
+		options := DefaultOptions()
+		options.Host = "127.0.0.1"
+		options.Port = startReflector(t, algo)
+		options.Algo = algo
+		options.Count = 200
+		options.PPS = 2000
+		options.Drain = 500 * time.Millisecond
+		options.StatsInterval = 0
+		options.Trace = filepath.Join(dir, algo + ".csv")
+		wg.Add(1)
+		go func(i int, options Options) {
+			defer wg.Done()
+			results[i], errs[i] = Run(context.Background(), options)
+		}(i, options)
+	}
+	wg.Wait()
+	for i, algo := range algos {
+		if errs[i] != nil {
+			t.Fatalf("%s run failed: %v", algo, errs[i])
+		}
+		if results[i].Received != 200 || results[i].Config["algo"] != algo {
+			t.Errorf("%s run received %d packets and recorded algo %q", algo, results[i].Received, results[i].Config["algo"])
+		}
+		if records, matched := countTraceMatches(t, filepath.Join(dir, algo + ".csv")); records != 200 || matched != 200 {
+			t.Errorf("%s run traced %d reflections with %d matching digests, want 200", algo, records, matched)
+		}
+	}
+}
+
+// A run that serves metrics stops serving them when it returns, so the address is free for the next run
+func TestMetricsServerClosed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	options := DefaultOptions()
+	options.Host = "127.0.0.1"
+	options.Port = startReflector(t, "sha256")
+	options.Count = 20
+	options.PPS = 1000
+	options.Drain = 200 * time.Millisecond
+	options.StatsInterval = 0
+	options.MetricsAddr = addr
+	if _, err := Run(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("metrics address still in use after the run returned: %v", err)
+	}
+	listener.Close()
+}
+
+// Packets sent during the warm-up are sent in addition to the packet count
+func TestCountExcludesWarmup(t *testing.T) {
+	options := DefaultOptions()
+	options.Host = "127.0.0.1"
+	options.Port = startReflector(t, "sha256")
+	options.Count = 100
+	options.PPS = 1000
+	options.Warmup = 200 * time.Millisecond
+	options.Drain = 200 * time.Millisecond
+	options.StatsInterval = 0
+	results, err := Run(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Sent != 100 || results.Received != 100 {
+		t.Fatalf("sent %d and received %d packets after the warm-up, want 100", results.Sent, results.Received)
+	}
+}
+
+// A reflection frees its packet's slot in the flow control window once, while duplicates and warm-up reflections free none
+func TestFlowWindowRelease(t *testing.T) {
+	options := DefaultOptions()
+	options.Algo = "sha256"
+	rs, err := newRunState(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	stats := newClientStats(time.Second, start)
+	fw := newFlowWindow(4, time.Second)
+	for i := 0; i < 3; i++ {
+		fw.acquire()
+	}
+
+	reflection := func(seq uint64, sendTime time.Time) receivedPacket {
+		packet := make([]byte, protocol.HeaderSize)
+		protocol.PutHeader(packet, protocol.Header{Seq: seq, Timestamp: sendTime.UnixNano()})
+		return receivedPacket{packet: append(packet, rs.algo.Sum(packet)...), recvTime: time.Now()}
+	}
+	recvIn := make(chan receivedPacket, 3)
+	recvIn <- reflection(0, start.Add(-time.Second))
+	recvIn <- reflection(1, start)
+	recvIn <- reflection(1, start)
+	close(recvIn)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	countWrittenRecv(rs, recvIn, newSeqWindow(64), newSeqWindow(64), stats, nil, fw, nil, nil, 0, &wg)
+
+	if outstanding := len(fw.slots); outstanding != 2 {
+		t.Fatalf("%d packets outstanding after a reflection, its duplicate, and a warm-up reflection, want 2", outstanding)
+	}
+	if stats.duplicates != 1 {
+		t.Fatalf("counted %d duplicates, want 1", stats.duplicates)
+	}
+}
+
+// Socket whose first write fails, as a write would when the host is briefly out of buffers
+type failFirstWriteConn struct {
+	netsim.PacketConn
+	failed	int32
+}
+
+func (conn *failFirstWriteConn) Write(b []byte) (int, error) {
+	if atomic.CompareAndSwapInt32(&conn.failed, 0, 1) {
+		return 0, errors.New("no buffer space available")
+	}
+	return conn.PacketConn.Write(b)
+}
+
+// A chunk whose write fails is not counted as sent, and arrives by being retransmitted
+func TestTransferCountsOnlySentChunks(t *testing.T) {
+	options := DefaultOptions()
+	options.Algo = "sha256"
+	rs, err := newRunState(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := net.ResolveUDPAddr("udp4", "127.0.0.1:" + startReflector(t, "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := netsim.UDP.DialUDP("udp4", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data := []byte(strings.Repeat("chunk of a file ", 16))
+	reassembled, stats, err := transferFile(rs, &failFirstWriteConn{PacketConn: conn}, data, 64, 4, 50 * time.Millisecond, 5, 5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reassembled) != string(data) {
+		t.Fatal("reassembled file differs from the one sent")
+	}
+	if stats.sent != 3 || stats.retransmissions < 1 {
+		t.Fatalf("counted %d chunks sent and %d retransmissions, want 3 sent and at least 1 retransmission", stats.sent, stats.retransmissions)
+	}
+}
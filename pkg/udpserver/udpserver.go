@@ -0,0 +1,1262 @@
+// Package udpserver is the reflector of udp_server, which receives the client's packets, has a processor (the HTTP backend
+// unless another is given) compute the digest of each payload, and reflects the payloads back with their digests appended,
+// for embedding in other programs and test harnesses
+package udpserver
+
+import (
+	"log"
+	"fmt"
+	"os"
+	"net"
+	"net/http"
+	"context"
+	"net/url"
+	"encoding/json"
+    "io/ioutil"
+	"bytes"
+	"time"
+    "runtime"
+	"sync/atomic"
+	"sync"
+	"strconv"
+	"flag"
+	"errors"
+	"sort"
+	"strings"
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/nbopardi/udp_client_server/internal/backendwire"
+	"github.com/nbopardi/udp_client_server/internal/digest"
+	"github.com/nbopardi/udp_client_server/internal/protocol"
+	"github.com/nbopardi/udp_client_server/pkg/dashboard"
+	"github.com/nbopardi/udp_client_server/pkg/netsim"
+	"github.com/nbopardi/udp_client_server/pkg/noise"
+	"github.com/nbopardi/udp_client_server/pkg/pb"
+)
+
+// Identifies a flow by the client's address and the connection ID in the header of its packets
+// Clients simulating several connections behind one address are told apart by the connection ID
+type flowKey struct {
+	ip		[16]byte
+	port	int
+	connID	uint32
+}
+
+// Returns the flow a packet from the given address belongs to
+func packetFlow(addr *net.UDPAddr, header protocol.Header) flowKey {
+	key := flowKey{port: addr.Port, connID: header.ConnID}
+	copy(key.ip[:], addr.IP.To16())
+	return key
+}
+
+// Logs the number of packets received from and reflected to every flow, in order of address and connection ID
+func logFlows(recvPerFlow map[flowKey]int, sentPerFlow map[flowKey]int) {
+	var flows []flowKey
+	for key := range recvPerFlow {
+		flows = append(flows, key)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if c := bytes.Compare(flows[i].ip[:], flows[j].ip[:]); c != 0 {
+			return c < 0
+		}
+		if flows[i].port != flows[j].port {
+			return flows[i].port < flows[j].port
+		}
+		return flows[i].connID < flows[j].connID
+	})
+	for _, key := range flows {
+		addr := &net.UDPAddr{IP: net.IP(key.ip[:]), Port: key.port}
+		log.Printf("Flow %s connection %d: received %d, reflected %d\n", addr.String(), key.connID, recvPerFlow[key], sentPerFlow[key])
+	}
+}
+
+// Packet struct that is used for reflecting a packet back to its sender
+// Packet: a byte slice representing the packet's payload
+// Addr: a UDP address from the sender of the packet
+// Header: the header at the start of the payload
+// RecvTime: when the packet was received in nanoseconds since the Unix epoch, if the client asked for server timestamps
+// RequestID: the correlation ID the client gave in the packet's metadata, or empty to make one up
+type PacketStruct struct {
+	Packet 		[]byte
+	Addr 		*net.UDPAddr
+	Header		protocol.Header
+	RecvTime	int64
+	RequestID	string
+}
+
+// Reflect packets from a channel back to the client
+func reflectPacket(conn net.PacketConn, writeTimeLimit time.Duration, packetsSentCounter *int64, sentPerFlow map[flowKey]int, writeOut <-chan PacketStruct, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+    // Execute this goroutine on its own exclusive OS thread
+    runtime.LockOSThread()
+
+    // Loop for sending packets back to the client
+    // Exited when the write channel is closed and drained
+	reflectLoop:
+		for {
+			select {
+			case packet, ok := <- writeOut:
+				// If the channel has been closed and drained, exit the outer loop
+				if !ok {
+					break reflectLoop
+				} else {
+					// Set a deadline for how long server should wait to write message
+					err := conn.SetWriteDeadline(time.Now().Add(writeTimeLimit))
+					if err != nil {
+						log.Println("Could not set write deadline for connection: ", err)
+					}
+
+					// Append the receive and send times after the hash if the client asked for them
+					if packet.Header.Flags & protocol.FlagServerTimestamps != 0 {
+						packet.Packet = protocol.AppendServerTimestamps(packet.Packet, packet.RecvTime, time.Now().UnixNano())
+					}
+
+					// Reflect the message back to the client
+					_, err = conn.WriteTo(packet.Packet, packet.Addr)
+					// Error handling
+					if err != nil {
+						log.Println("Could not write message to UDP client: ", err)
+					} else {
+						// Increment the counter for the number of packets sent back
+						atomic.AddInt64(packetsSentCounter, 1)
+						sentPerFlow[packetFlow(packet.Addr, packet.Header)]++
+					}
+				}
+			default:
+				// Do nothing
+			}
+		}
+
+    // Unlock the OS thread for other goroutines to use
+    runtime.UnlockOSThread()
+}
+
+// Client of the backend's UDP hash service, which sends every request over one UDP socket and matches the responses by request ID
+// algoName: the hash algorithm to ask for, or empty for the backend's default
+// hashSize: the size of the hashes of the algorithm, which every response must match
+// pending: the channel waiting for the response of each request in flight, guarded by mutex
+type udpHashClient struct {
+	conn		*net.UDPConn
+	algoName	string
+	hashSize	int
+	timeout		time.Duration
+	nextID		uint64
+	mutex		sync.Mutex
+	pending		map[uint64]chan []byte
+}
+
+// Connects to the backend's UDP hash service and starts receiving its responses
+func dialUDPHashClient(address string, algoName string, hashSize int, timeout time.Duration) (*udpHashClient, error) {
+	if len(algoName) > 255 {
+		return nil, fmt.Errorf("hash algorithm name %q is too long", algoName)
+	}
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &udpHashClient{conn: conn, algoName: algoName, hashSize: hashSize, timeout: timeout, pending: make(map[uint64]chan []byte)}
+	go c.receive()
+	return c, nil
+}
+
+// Hands each response to the request waiting for it, dropping responses to requests that timed out
+func (c *udpHashClient) receive() {
+	buffer := make([]byte, backendwire.MaxUDPHashDatagram)
+	for {
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			// Responses are refused while the backend is not listening yet, so only stop once the socket is closed
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		id, _, _, err := backendwire.ParseUDPHashResponse(buffer[:n])
+		if err != nil {
+			continue
+		}
+		c.mutex.Lock()
+		response, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		if ok {
+			response <- append([]byte(nil), buffer[:n]...)
+		}
+	}
+}
+
+// Requests the hash of a payload from the UDP hash service, waiting up to the timeout for the response
+// The request is not retried, since a lost datagram is part of what a benchmark of the pipeline measures
+func (c *udpHashClient) hash(payload []byte) ([]byte, error) {
+	id := atomic.AddUint64(&c.nextID, 1)
+	request := backendwire.AppendUDPHashRequest(make([]byte, 0, backendwire.UDPHashHeaderSize + len(c.algoName) + len(payload)), id, c.algoName, payload)
+
+	response := make(chan []byte, 1)
+	c.mutex.Lock()
+	c.pending[id] = response
+	c.mutex.Unlock()
+	if _, err := c.conn.Write(request); err != nil {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("could not send the request to the UDP hash service: %v", err)
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case datagram := <-response:
+		_, status, body, _ := backendwire.ParseUDPHashResponse(datagram)
+		if status != backendwire.UDPHashOK {
+			return nil, fmt.Errorf("UDP hash service responded with status %d: %s", status, body)
+		}
+		if len(body) != c.hashSize {
+			return nil, fmt.Errorf("UDP hash service returned a %d byte hash instead of %d bytes", len(body), c.hashSize)
+		}
+		return body, nil
+	case <-timer.C:
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("no response from the UDP hash service within %v", c.timeout)
+	}
+}
+
+// Header carrying the correlation ID of each request to the HTTP backend, which logs it and echoes it back
+const requestIDHeader = "X-Request-ID"
+
+// Returns the correlation ID of the backend request for a packet, which is the one in the packet's metadata if the client
+// gave one, or else made of the client's address, the connection ID, and the sequence number of the packet
+// (i.e. 169.254.105.20:50000/0/42), so the packet can be found in the backend's access log
+func packetRequestID(packet PacketStruct) string {
+	if packet.RequestID != "" {
+		return packet.RequestID
+	}
+	return fmt.Sprintf("%v/%d/%d", packet.Addr, packet.Header.ConnID, packet.Header.Seq)
+}
+
+// Computes the digest the server appends to the payload of each packet it reflects, other than the packets it echoes itself
+// Process is called from many goroutines at once, up to the n_jobs of the server, with the correlation ID of the packet
+// Returns the digest, which must be as long as a digest of the server's hash algorithm, or an error to drop the packet
+type Processor interface {
+	Process(payload []byte, requestID string) ([]byte, error)
+}
+
+// Processor that gets the hash of each payload from the HTTP backend server, which it shuts down once closed
+// udp: the backend's UDP hash service to get hashes from instead of the hash endpoint, or nil to use HTTP
+// statsURL: the stats endpoint read into report before shutting the backend down, or empty to not read it
+type BackendProcessor struct {
+	client		*http.Client
+	algo		digest.Algorithm
+	service		string
+	hashURL		string
+	shutdownURL	string
+	statsURL	string
+	binaryAPI	bool
+	protobufAPI	bool
+	udp			*udpHashClient
+	report		backendStats
+}
+
+// Creates the processor for the HTTP backend server of the options, with the client for it set up from the backend options
+func NewBackendProcessor(options Options) (*BackendProcessor, error) {
+	// Define the HTTP backend server address, which is HTTPS if any of the TLS options are given
+	if (options.BackendCert == "") != (options.BackendKey == "") {
+		return nil, errors.New("backend_cert and backend_key must be given together")
+	}
+	useTLS := options.BackendTLS || options.BackendCA != "" || options.BackendCert != ""
+	scheme := "http://"
+	if useTLS {
+		scheme = "https://"
+	}
+	if options.Binary && options.Protobuf {
+		return nil, errors.New("binary and protobuf cannot be used together")
+	}
+	p := &BackendProcessor{binaryAPI: options.Binary, protobufAPI: options.Protobuf}
+	p.service = scheme + options.BackendHost + ":" + options.BackendPort
+	p.hashURL = p.service + options.HashPath
+	p.shutdownURL = p.service + options.ShutdownPath
+	if options.StatsPath != "" {
+		p.statsURL = p.service + options.StatsPath
+	}
+
+	// Look up the hash algorithm, which the server also uses to echo packets itself
+	algoName := options.Algo
+	if algoName == "" {
+		algoName = digest.Default
+	}
+	algo, err := digest.Lookup(algoName)
+	if err != nil {
+		return nil, err
+	}
+	p.algo = algo
+	if options.Algo != "" {
+		p.hashURL += "/" + options.Algo
+	}
+
+	// Get hashes over UDP instead of HTTP if requested, while still shutting the backend down over HTTP
+	if options.BackendUDP != "" {
+		p.udp, err = dialUDPHashClient(options.BackendUDP, options.Algo, algo.Size(), time.Duration(options.ResponseHeaderTime) * time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to the UDP hash service: %v", err)
+		}
+	}
+
+	// Create a transport for the HTTP client
+	tr := &http.Transport {     ExpectContinueTimeout: time.Duration(options.ExpectContinueTime) * time.Second,
+                                ResponseHeaderTimeout: time.Duration(options.ResponseHeaderTime) * time.Second,
+                                IdleConnTimeout: time.Duration(options.IdleConnTime) * time.Second,
+                                DisableKeepAlives: false,
+                                MaxIdleConnsPerHost: options.IdleConnsPerHost,
+                                MaxIdleConns: 0,
+                                MaxConnsPerHost: 0,
+                                WriteBufferSize: 0,
+                                ReadBufferSize: 0,
+    }
+
+	// Dial the Unix domain socket for every connection to the HTTP backend if one is given, with the host name left in the URLs for the Host header
+	if options.BackendSocket != "" {
+		dialer := &net.Dialer{}
+		socket := options.BackendSocket
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	if useTLS {
+		tlsConfig, err := newBackendTLSConfig(options.BackendCA, options.BackendCert, options.BackendKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not configure TLS for the HTTP backend: %v", err)
+		}
+		tr.TLSClientConfig = tlsConfig
+	}
+
+	// Authenticate every request to the HTTP backend if a token or an HMAC key is configured
+	authToken, hmacKey := options.BackendToken, options.BackendHMACKey
+	if authToken == "" {
+		authToken = os.Getenv(backendwire.AuthTokenEnv)
+	}
+	if hmacKey == "" {
+		hmacKey = os.Getenv(backendwire.HMACKeyEnv)
+	}
+	var transport http.RoundTripper = tr
+	if authToken != "" || hmacKey != "" {
+		transport = &authTransport{base: tr, token: authToken, hmacKey: []byte(hmacKey)}
+	}
+
+	// Create a client with a specific transport
+	p.client = &http.Client{Transport: transport}
+	return p, nil
+}
+
+// Returns the hash algorithm of the hashes the processor asks the backend for
+func (p *BackendProcessor) Algorithm() digest.Algorithm {
+	return p.algo
+}
+
+// Requests the hash of a payload from the HTTP backend server's hash endpoint, or from its UDP hash service if one is set
+// With binaryAPI, the payload is POSTed as raw bytes and the hash comes back raw, without the JSON and base64 overhead
+// With protobufAPI, the payload is POSTed in a HashRequest message and the hash comes back in a HashResponse message
+// Returns the hash as a byte slice, which must be as long as a digest of the hash algorithm
+func (p *BackendProcessor) Process(payload []byte, requestID string) ([]byte, error) {
+	if p.udp != nil {
+		return p.udp.hash(payload)
+	}
+	if p.binaryAPI || p.protobufAPI {
+		return p.postHash(payload, requestID)
+	}
+
+	// Marshal the packet's payload
+	requestBody, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal the packet payload: %v", err)
+	}
+	// Create a new HTTP GET Request for the hash endpoint
+	request, err := http.NewRequest("GET", p.hashURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("could not create HTTP GET request: %v", err)
+	}
+	request.Header.Set("Content-type", "application/json")
+	request.Header.Set(requestIDHeader, requestID)
+
+	// Send the request and acquire a response
+	resp, err := p.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("could not send and acquire a response from the HTTP backend: %v", err)
+	}
+
+	// Read through the body of the response
+	body, err := ioutil.ReadAll(resp.Body)
+	// Close the body of the response
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP backend responded with %s", resp.Status)
+	}
+	return p.decodeHash(body)
+}
+
+// Requests the hash of a payload from the HTTP backend server's hash endpoint with a POST of the raw payload, or of a
+// HashRequest message with protobufAPI
+// Returns the hash from the response body
+func (p *BackendProcessor) postHash(payload []byte, requestID string) ([]byte, error) {
+	contentType := "application/octet-stream"
+	if p.protobufAPI {
+		contentType = "application/x-protobuf"
+		payload = (&pb.HashRequest{Payload: payload}).Marshal()
+	}
+	request, err := http.NewRequest("POST", p.hashURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("could not create HTTP POST request: %v", err)
+	}
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set(requestIDHeader, requestID)
+
+	// Send the request and acquire a response
+	resp, err := p.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("could not send and acquire a response from the HTTP backend: %v", err)
+	}
+
+	// Read through the body of the response
+	body, err := ioutil.ReadAll(resp.Body)
+	// Close the body of the response
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the response body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP backend responded with %s", resp.Status)
+	}
+	return p.decodeHash(body)
+}
+
+// Decodes the hash from the body of a response of the hash endpoint: JSON encoded, raw bytes with binaryAPI, or a
+// HashResponse message with protobufAPI
+// Returns an error if the body is malformed or the hash is not as long as a digest of the hash algorithm
+func (p *BackendProcessor) decodeHash(body []byte) ([]byte, error) {
+	var hash []byte
+	switch {
+	case p.protobufAPI:
+		var response pb.HashResponse
+		if err := response.Unmarshal(body); err != nil {
+			return nil, fmt.Errorf("could not decode the HashResponse: %v", err)
+		}
+		hash = response.Hash
+	case p.binaryAPI:
+		hash = body
+	default:
+		// Unmarshal the hash into a byte slice
+		if err := json.Unmarshal(body, &hash); err != nil {
+			return nil, fmt.Errorf("could not unmarshal the hash into a byte slice: %v", err)
+		}
+	}
+	if len(hash) != p.algo.Size() {
+		return nil, fmt.Errorf("HTTP backend returned a %d byte hash instead of %d bytes", len(hash), p.algo.Size())
+	}
+	return hash, nil
+}
+
+// Cumulative counters the HTTP backend reports on its stats endpoint, included in the server's end-of-run report
+// fetched: whether the counters were read from the backend, since they are left zero otherwise
+type backendStats struct {
+	UptimeSeconds		float64				`json:"uptime_seconds"`
+	Requests			int64				`json:"requests"`
+	Errors				int64				`json:"errors"`
+	AverageLatencyMs	float64				`json:"average_latency_ms"`
+	PayloadsHashed		int64				`json:"payloads_hashed"`
+	BytesHashed			int64				`json:"bytes_hashed"`
+	Algorithms			map[string]int64	`json:"algorithms"`
+	fetched				bool
+}
+
+// Reads the counters of the HTTP backend from its stats endpoint into stats
+func fetchBackendStats(client *http.Client, statsURL string, stats *backendStats) error {
+	resp, err := client.Get(statsURL)
+	if err != nil {
+		return fmt.Errorf("could not send and acquire a response from the HTTP backend: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP backend responded with %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+		return fmt.Errorf("could not unmarshal the stats: %v", err)
+	}
+	stats.fetched = true
+	return nil
+}
+
+// Logs the counters of the HTTP backend, with the payloads hashed by each algorithm in order of name
+func logBackendStats(stats *backendStats) {
+	log.Printf("Backend Uptime: %.1fs\n", stats.UptimeSeconds)
+	log.Println("Backend Requests Served: ", strconv.FormatInt(stats.Requests, 10))
+	log.Println("Backend Error Responses: ", strconv.FormatInt(stats.Errors, 10))
+	log.Printf("Backend Average Latency: %.3fms\n", stats.AverageLatencyMs)
+	log.Println("Backend Payloads Hashed: ", strconv.FormatInt(stats.PayloadsHashed, 10))
+	log.Println("Backend Bytes Hashed: ", strconv.FormatInt(stats.BytesHashed, 10))
+	names := make([]string, 0, len(stats.Algorithms))
+	for name := range stats.Algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("Backend Payloads Hashed with %s: %d\n", name, stats.Algorithms[name])
+	}
+}
+
+// Reads the backend's counters while it is still up, for the end-of-run report, then shuts down the HTTP backend server
+func (p *BackendProcessor) Close() error {
+	if p.statsURL != "" {
+		if err := fetchBackendStats(p.client, p.statsURL, &p.report); err != nil {
+			log.Printf("Could not get the HTTP backend's stats: %v\n", err)
+		}
+	}
+
+	// Create a request to shutdown the HTTP backend server
+	request, err := http.NewRequest("GET", p.shutdownURL, nil)
+	if err != nil {
+		return err
+	}
+	// Send the request and output the response
+	resp, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("could not shutdown HTTP backend: %v", err)
+	}
+	log.Println(string(body))
+
+	// Close all idle connections for the HTTP backend client
+	p.client.CloseIdleConnections()
+	return nil
+}
+
+// Logs the counters of the HTTP backend read when the processor was closed, if they could be read
+func (p *BackendProcessor) LogStats() {
+	if p.report.fetched {
+		logBackendStats(&p.report)
+	}
+}
+
+// Communicates with the processor, which is the HTTP backend server unless another is given
+// Gets the hash of a packet's payload and appends it to the payload before inserting it into the write channel
+// Packets the processor fails to hash are dropped and counted in backendFailuresCounter
+func commBackend(processor Processor, packet PacketStruct, writeOut chan <- PacketStruct, tokens <-chan struct{}, backendFailuresCounter *int64, wgBackend *sync.WaitGroup) {
+    // Close wait group when done
+    defer wgBackend.Done()
+
+    // Get the hash of the packet's payload from the backend
+    buffer, err := processor.Process(packet.Packet, packetRequestID(packet))
+    if err != nil {
+        atomic.AddInt64(backendFailuresCounter, 1)
+        // Release the token all the same, or every failed request would take a job away for good
+        <- tokens
+        return
+    }
+
+    // Append the hash to the end of the packet's payload
+    packet.Packet = append(packet.Packet[:], buffer[:]...)
+
+    // Write the packet to the out channel to be reflected back to the client
+    writeOut <- packet
+
+    // Release a token, indicating that this job is finished
+    <- tokens
+}
+
+// Hashes a packet's payload in the server itself and appends the hash, for packets that ask to be echoed
+// The reflection is the same as if the HTTP backend had hashed it
+func echoPacket(packet PacketStruct, algo digest.Algorithm, writeOut chan<- PacketStruct) {
+	packet.Packet = append(packet.Packet, algo.Sum(packet.Packet)...)
+	writeOut <- packet
+}
+
+// Handles the spawning of goroutines for backend communication
+// Packets asking to be echoed are hashed right away with algo without calling the backend
+// Process stops once the UDP server stops receiving from the UDP client and every request to the backend is done
+func hashPacket(processor Processor, algo digest.Algorithm, recvIn <-chan *PacketStruct, writeOut chan<- PacketStruct, numConcurrentJobs int, packetsEchoedCounter *int64, backendFailuresCounter *int64, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+    // Execute this goroutine on its own exclusive OS thread
+    runtime.LockOSThread()
+
+	// Create a separate wait group for all requests made to the backend
+	var wgBackend sync.WaitGroup
+
+	// Create a channel to limit the number of concurrent goroutines
+	// This acts like a counting semaphore / rate limiter
+	// numConcurrentJobs must be less than ulimit -n (max number of open file descriptors)
+	var tokens = make(chan struct{}, numConcurrentJobs)
+
+	// Take packets from the receive channel in the order they arrived and spawn a goroutine to get the hash of the packet and
+    // append it to the packet's payload before inserting it into the write channel
+    // The loop ends once the receive channel is closed and every packet queued in it has been taken
+    for packet := range recvIn {
+        // Echo the packet without the backend if asked to
+        if packet.Header.Flags & protocol.FlagEcho != 0 {
+            echoPacket(*packet, algo, writeOut)
+            atomic.AddInt64(packetsEchoedCounter, 1)
+            continue
+        }
+
+        // Acquire a token for communicating with HTTP backend
+        // If the max number of goroutines (numConcurrentJobs) for communicating with the backend
+        // has been reached, this action blocks until one of those goroutines has finished
+        tokens <- struct{}{}
+
+        // Add a process to the wait group for backend communication
+        wgBackend.Add(1)
+
+        // Communicate with the HTTP backend server
+        go commBackend(processor, *packet, writeOut, tokens, backendFailuresCounter, &wgBackend)
+    }
+    log.Println("Stopped receiving, and every packet received has been passed on for hashing.")
+
+	// Wait for all requests to the backend to finish
+	wgBackend.Wait()
+    log.Println("All remaining goroutine communication with backend are complete")
+
+	// Close the channel when done hashing the packets
+	close(writeOut)
+
+    // Unlock the OS thread for other goroutines to use
+    runtime.UnlockOSThread()
+}
+
+// Receives a packet on the UDP connection until no longer receiving a response from a client
+// Queues all packets received in a channel to be taken for communicating with the HTTP backend, closing it when done
+// Blocks while the channel is full, leaving further packets in the socket's receive buffer
+// Payloads of any size up to maxPayloadSize are accepted
+// Packets without a valid header are dropped and counted as invalid, and heartbeats are dropped and counted separately
+// Stops at the first read that fails for any other reason, storing its error in recvErr
+func recvPacket(conn net.PacketConn, readTimeLimit time.Duration, maxPayloadSize int, hashSize int, packetsRecvCounter *int64, packetsInvalidCounter *int64, heartbeatsCounter *int64, recvPerFlow map[flowKey]int, recvOut chan<- *PacketStruct, recvErr *error, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+    // Execute this goroutine on its own exclusive OS thread
+    runtime.LockOSThread()
+
+	// Create buffer to read in message
+	// Large enough for the biggest payload accepted from the client
+	buffer := make([]byte, maxPayloadSize)
+
+	// Loop to handle reading packets from client
+	// Exited when time limit for waiting on client request is reached
+	receiveSendLoop:
+		for {
+
+			// Set time limit for how long to wait for client response
+			err := conn.SetReadDeadline(time.Now().Add(readTimeLimit))
+			if err != nil {
+				log.Println("Could not set read deadline for connection: ", err)
+			}
+
+			// Read message from client
+			n, from, err := conn.ReadFrom(buffer)
+			recvTime := time.Now()
+
+			// Exit from loop if read time limit reached
+			if err != nil {
+				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+						log.Println("Time limit reached for awaiting client request. No longer receiving.")
+						break receiveSendLoop
+				}
+				// Closing the server stops it receiving the same as the time limit
+				if errors.Is(err, net.ErrClosed) {
+						log.Println("Connection closed. No longer receiving.")
+						break receiveSendLoop
+				}
+				*recvErr = fmt.Errorf("could not receive message from UDP client: %v", err)
+				break receiveSendLoop
+			}
+
+			// Packets can only be reflected to UDP addresses, which every socket but a broken simulation gives
+			addr, ok := from.(*net.UDPAddr)
+			if !ok {
+				atomic.AddInt64(packetsInvalidCounter, 1)
+				continue
+			}
+			request, err := protocol.Unmarshal(buffer[:n], 0)
+			var metadata pb.PacketMetadata
+			if err == nil && request.Flags & protocol.FlagExtension != 0 {
+				err = metadata.Unmarshal(request.Extension)
+			}
+			if err != nil {
+				// Drop packets that were not sent by a compatible client
+				atomic.AddInt64(packetsInvalidCounter, 1)
+			} else if request.Flags & protocol.FlagHeartbeat != 0 {
+				// Heartbeats only keep the client's NAT binding alive, so there is nothing to reflect
+				atomic.AddInt64(heartbeatsCounter, 1)
+			} else {
+                // Copy the payload out of the read buffer, leaving room for the hash (and any server timestamps) to be appended
+                payload := make([]byte, n, n + hashSize + protocol.ServerTimestampsSize)
+                copy(payload, buffer[:n])
+
+                // Queue the packet for hashing
+                recvOut <- &PacketStruct{payload, addr, request.Header, recvTime.UnixNano(), metadata.RequestID}
+
+				// Increment the counter for number of packets received
+				atomic.AddInt64(packetsRecvCounter, 1)
+				recvPerFlow[packetFlow(addr, request.Header)]++
+			}
+
+		}
+
+    // Close the channel to signify that done reading messages from UDP client
+    close(recvOut)
+
+    // Unlock the OS thread for other goroutines to use
+    runtime.UnlockOSThread()
+}
+
+// Checks the server configuration without running the server
+// Resolves the addresses, test-binds the port of the transport, and probes the HTTP backend's hash endpoint with a canary payload
+// Prints a report of every check and returns the number of checks that failed
+func validateConfig(processor *BackendProcessor, service string, networkName string, transport string, maxPayloadSize int, numConcurrentJobs int, chanCap int) int {
+	numFailed := 0
+
+	// Print the outcome of a single check and keep track of failures
+	report := func(check string, err error) {
+		if err != nil {
+			numFailed++
+			fmt.Printf("[FAIL] %s: %v\n", check, err)
+		} else {
+			fmt.Printf("[ OK ] %s\n", check)
+		}
+	}
+
+	// Verify the numeric flags are usable
+	var err error
+	if maxPayloadSize <= 0 || maxPayloadSize > protocol.MaxDatagramSize {
+		err = fmt.Errorf("max_payload must be between 1 and %d (got %d)", protocol.MaxDatagramSize, maxPayloadSize)
+	} else if numConcurrentJobs <= 0 {
+		err = fmt.Errorf("n_jobs must be greater than 0 (got %d)", numConcurrentJobs)
+	} else if chanCap < 0 {
+		err = fmt.Errorf("buffer must not be negative (got %d)", chanCap)
+	}
+	report("Flag values", err)
+	network, err := netsim.Transport(transport)
+	report("Transport " + transport, err)
+
+	// Resolve the address of the HTTP backend server
+	backendURL, err := url.Parse(processor.service)
+	if err == nil {
+		_, err = net.ResolveTCPAddr("tcp4", backendURL.Host)
+	}
+	report("Resolve HTTP backend address " + processor.service, err)
+
+	// Resolve the address of the UDP endpoint and make sure the port can be bound
+	udpAddr, err := net.ResolveUDPAddr(networkName, service)
+	report("Resolve UDP address " + service, err)
+	if err == nil && network != nil {
+		conn, err := network.ListenUDP(networkName, udpAddr)
+		if err == nil {
+			conn.Close()
+		}
+		report("Bind " + strings.ToUpper(transport) + " port " + service, err)
+	}
+
+	// Probe the /hash endpoint with a canary payload and compare against a locally computed hash
+	canary := []byte("udp_client_server validation canary")
+	hashValue, err := processor.Process(canary, "validate")
+	if err == nil && !bytes.Equal(hashValue, processor.algo.Sum(canary)) {
+		err = fmt.Errorf("unexpected hash %x for canary payload", hashValue)
+	}
+	report("Probe HTTP backend " + processor.hashURL, err)
+
+	// Close all idle connections for the HTTP backend client
+	processor.client.CloseIdleConnections()
+
+	if numFailed == 0 {
+		fmt.Println("Configuration is valid")
+	} else {
+		fmt.Printf("Configuration is invalid: %d check(s) failed\n", numFailed)
+	}
+	return numFailed
+}
+
+// Transport that authenticates every request to the HTTP backend with a bearer token, an HMAC signature, or both
+// base: the transport that sends the authenticated requests
+type authTransport struct {
+	base	http.RoundTripper
+	token	string
+	hmacKey	[]byte
+}
+
+// Adds the authentication headers to a copy of the request and sends it
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authReq := req.Clone(req.Context())
+	if t.token != "" {
+		authReq.Header.Set("Authorization", "Bearer " + t.token)
+	}
+	if len(t.hmacKey) > 0 {
+		// Sign a copy of the body, so the original can still be sent
+		var body []byte
+		if req.GetBody != nil {
+			bodyCopy, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			body, err = ioutil.ReadAll(bodyCopy)
+			bodyCopy.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		authReq.Header.Set(backendwire.TimestampHeader, timestamp)
+		authReq.Header.Set(backendwire.SignatureHeader, backendwire.SignRequest(t.hmacKey, req.Method, req.URL.Path, timestamp, body))
+	}
+	return t.base.RoundTrip(authReq)
+}
+
+// Closes the idle connections of the base transport, so the client can still close them
+func (t *authTransport) CloseIdleConnections() {
+	if base, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		base.CloseIdleConnections()
+	}
+}
+
+// Creates the TLS configuration for connecting to the HTTP backend over HTTPS
+// The backend's certificate is verified against the CAs in the caFile, or the system's CAs if it is empty,
+// and the certificate in certFile is presented for mutual authentication if one is given
+func newBackendTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = rootCAs
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+
+// Options of the server, one for each command line flag of udp_server, named after the flag in its tag
+// The help text of each flag in RegisterFlags describes its option
+type Options struct {
+	BackendHost			string	`flag:"backend_host"`
+	BackendPort			string	`flag:"backend_port"`
+	Port				string	`flag:"port"`
+	WriteTime			int		`flag:"w_time"`
+	ReadTime			int		`flag:"r_time"`
+	Jobs				int		`flag:"n_jobs"`
+	ExpectContinueTime	int		`flag:"ec_time"`
+	ResponseHeaderTime	int		`flag:"rh_time"`
+	IdleConnTime		int		`flag:"ic_time"`
+	IdleConnsPerHost	int		`flag:"iconn_host"`
+	Buffer				int		`flag:"buffer"`
+	MaxPayload			int		`flag:"max_payload"`
+	HashPath			string	`flag:"hash_path"`
+	ShutdownPath		string	`flag:"shutdown_path"`
+	StatsPath			string	`flag:"stats_path"`
+	Validate			bool	`flag:"validate"`
+	BackendTLS			bool	`flag:"backend_tls"`
+	BackendCA			string	`flag:"backend_ca"`
+	BackendCert			string	`flag:"backend_cert"`
+	BackendKey			string	`flag:"backend_key"`
+	BackendToken		string	`flag:"backend_token"`
+	BackendHMACKey		string	`flag:"backend_hmac_key"`
+	BackendSocket		string	`flag:"backend_socket"`
+	BackendUDP			string	`flag:"backend_udp"`
+	Binary				bool	`flag:"binary"`
+	Protobuf			bool	`flag:"protobuf"`
+	Algo				string	`flag:"algo"`
+	DashboardAddr		string	`flag:"dashboard_addr"`
+	Transport			string	`flag:"transport"`
+	NoiseKey			string	`flag:"noise_key"`
+	NoisePeers			string	`flag:"noise_peers"`
+	ReplayWindow		int		`flag:"replay_window"`
+}
+
+// Registers a command line flag for every option on the flag set, with the option's default as the flag's default
+func (options *Options) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&options.BackendHost, "backend_host", "localhost", "IPv4 of the HTTP backend server (i.e. 169.254.105.13)")
+	flags.StringVar(&options.BackendPort, "backend_port", "80", "Port number of the HTTP backend server (i.e. 80)")
+	flags.StringVar(&options.Port, "port", "40000", "Port number of the server (i.e. 40000)")
+	flags.IntVar(&options.WriteTime, "w_time", 5, "Max number of seconds the connection will wait on a full send queue to free up to send a packet (i.e. 5)")
+	flags.IntVar(&options.ReadTime, "r_time", 10, "Max number of seconds the server will wait to receive a request from client before closing (i.e. 10)")
+	flags.IntVar(&options.Jobs, "n_jobs", 15000, "Max number of requests made to the HTTP backend occurring at the same time (i.e. 15000)")
+	flags.IntVar(&options.ExpectContinueTime, "ec_time", 4, "Amount of seconds to wait for the HTTP backend's first response headers after fully writing the request headers (i.e. 4)")
+	flags.IntVar(&options.ResponseHeaderTime, "rh_time", 10, "Amount of seconds to wait for the HTTP backend's response headers after fully writing the request and body (i.e. 10)")
+	flags.IntVar(&options.IdleConnTime, "ic_time", 10, "Max amount of seconds an idle (keep-alive) connection will remain idle before closing itself (i.e. 10)")
+	flags.IntVar(&options.IdleConnsPerHost, "iconn_host", 10000, "Max idle (keep-alive) connections to keep per-host (i.e. 10000)")
+	flags.IntVar(&options.Buffer, "buffer", 1000000, "Max buffer size of the channels used to store received packets until they are hashed and reflected to client (i.e. 1000000)")
+	flags.IntVar(&options.MaxPayload, "max_payload", 1472, "Max number of bytes accepted in a packet's payload from the client (i.e. 1472)")
+	flags.StringVar(&options.HashPath, "hash_path", "/hash", "Path of the HTTP backend endpoint that hashes a payload (i.e. /hash)")
+	flags.StringVar(&options.ShutdownPath, "shutdown_path", "/shutdown", "Path of the HTTP backend endpoint that shuts down the backend (i.e. /shutdown)")
+	flags.StringVar(&options.StatsPath, "stats_path", "/stats", "Path of the HTTP backend endpoint whose counters are read before shutting it down and included in the report, or empty to not read them (i.e. /stats)")
+	flags.BoolVar(&options.Validate, "validate", false, "Check the configuration, UDP port, and HTTP backend, then exit without running the server")
+	flags.BoolVar(&options.BackendTLS, "backend_tls", false, "Connect to the HTTP backend over HTTPS")
+	flags.StringVar(&options.BackendCA, "backend_ca", "", "CA certificate file (PEM) to verify the HTTP backend's certificate with, or empty for the system's CAs (i.e. ca.crt)")
+	flags.StringVar(&options.BackendCert, "backend_cert", "", "Client certificate file (PEM) to present to the HTTP backend for mutual TLS, along with backend_key (i.e. server.crt)")
+	flags.StringVar(&options.BackendKey, "backend_key", "", "Private key file (PEM) of the backend_cert (i.e. server.key)")
+	flags.StringVar(&options.BackendToken, "backend_token", "", "Bearer token to authenticate to the HTTP backend with, or empty to read it from " + backendwire.AuthTokenEnv + " (i.e. s3cret)")
+	flags.StringVar(&options.BackendHMACKey, "backend_hmac_key", "", "Key to sign every request to the HTTP backend with, or empty to read it from " + backendwire.HMACKeyEnv + " (i.e. s3cret)")
+	flags.StringVar(&options.BackendSocket, "backend_socket", "", "Path of a Unix domain socket to reach the HTTP backend through instead of TCP, for a backend on the same host listening with -listen unix:PATH (i.e. /run/backend.sock)")
+	flags.StringVar(&options.BackendUDP, "backend_udp", "", "Address of the HTTP backend's UDP hash service (its -udp_port) to get hashes from over UDP instead of HTTP, with rh_time as the timeout of each request (i.e. 169.254.105.13:8081)")
+	flags.BoolVar(&options.Binary, "binary", false, "POST each payload to the HTTP backend as raw bytes and read back the raw hash, instead of JSON in a GET request")
+	flags.BoolVar(&options.Protobuf, "protobuf", false, "POST each payload to the HTTP backend as a protobuf HashRequest and read back a HashResponse (see hash.proto), instead of JSON in a GET request")
+	flags.StringVar(&options.Algo, "algo", "", "Hash algorithm to ask the HTTP backend for at hash_path/algo, or empty for " + digest.Default + " at hash_path: " + strings.Join(digest.Names(), ", ") + " (i.e. sha256)")
+	flags.StringVar(&options.DashboardAddr, "dashboard_addr", "", "Address to serve a web dashboard on while running, streaming the server's live counters and backend latency to browsers over WebSocket (i.e. :8090)")
+	flags.StringVar(&options.Transport, "transport", "udp", "Transport to receive packets over: udp, or tcp to accept clients run with -transport tcp and reflect their packets over their connections (i.e. tcp)")
+	flags.StringVar(&options.NoiseKey, "noise_key", "", "File with the server's static Noise key, generated if it does not exist, to only accept clients that set up a Noise IK session with its public key (logged at startup) and encrypt every packet (i.e. server.key)")
+	flags.StringVar(&options.NoisePeers, "noise_peers", "", "Comma separated public keys (hex) of the clients allowed to set up Noise sessions, or empty to allow any client that knows the server's key (i.e. 9f8e...,41c2...)")
+	flags.IntVar(&options.ReplayWindow, "replay_window", 8192, "Number of packet numbers below the highest one received that each Noise session keeps track of, to drop packets that are replayed or duplicated instead of reflecting them again, or 0 to reflect every packet that decrypts (i.e. 8192)")
+}
+
+// Returns the options with every option at its default, as udp_server runs without flags
+func DefaultOptions() Options {
+	var options Options
+	options.RegisterFlags(flag.NewFlagSet("udp_server", flag.ContinueOnError))
+	return options
+}
+
+// Counters of a server once it stops serving, with the packets received from and reflected to every flow
+// Received: packets received from clients, other than invalid packets and heartbeats
+// Sent: packets reflected back to their clients
+// Invalid: packets dropped for not starting with a valid header
+// Echoed: packets the server hashed itself instead of its processor
+// BackendFailures: packets dropped because the processor could not hash them
+// Heartbeats: heartbeats received, which are dropped without being reflected
+type Report struct {
+	Received		int
+	Sent			int
+	Invalid			int
+	Echoed			int
+	BackendFailures	int
+	Heartbeats		int
+	recvPerFlow		map[flowKey]int
+	sentPerFlow		map[flowKey]int
+}
+
+// Logs the counters of the report, followed by the packets received from and reflected to every flow
+func (r *Report) Log() {
+    log.Println("Packets Received from client: ", strconv.Itoa(r.Received))
+	log.Println("Packets Sent to client: ", strconv.Itoa(r.Sent))
+	log.Println("Invalid Packets dropped: ", strconv.Itoa(r.Invalid))
+	log.Println("Packets Echoed without the backend: ", strconv.Itoa(r.Echoed))
+	log.Println("Packets dropped for failed backend requests: ", strconv.Itoa(r.BackendFailures))
+	log.Println("Heartbeats Received: ", strconv.Itoa(r.Heartbeats))
+	logFlows(r.recvPerFlow, r.sentPerFlow)
+}
+
+// UDP server reflecting the packets of clients back to them with the digest of each payload appended
+// algo: the hash algorithm of the digests, which the server computes itself for packets asking to be echoed
+// processor: computes the digests of every other packet
+// secure: the network of the server's Noise sessions, if it has a key
+type Server struct {
+	conn		net.PacketConn
+	options		Options
+	algo		digest.Algorithm
+	processor	Processor
+	secure		*noise.Network
+}
+
+// Sets up a listener on the UDP port of the options, whose packets are reflected with digests of the options' hash
+// algorithm from the processor
+// A port of 0 listens on a port chosen by the system, which LocalAddr returns
+func Listen(options Options, processor Processor) (*Server, error) {
+	// Define the server address
+	// No host provided so that ResolveUDPAddr resolves to the addreess of UDP endpoint
+	service := ":" + options.Port
+	networkName := "udp4"
+
+	// Get address of UDP endpoint
+	udpAddr, err := net.ResolveUDPAddr(networkName, service)
+	if err != nil {
+		return nil, err
+	}
+
+	// Setup listener for incoming UDP packets, or for the connections of clients carrying them over TCP
+	network, err := netsim.Transport(options.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only accept packets over Noise sessions if the server has a key
+	var secure *noise.Network
+	if options.NoiseKey != "" {
+		config := noise.Config{}
+		config.Key, err = noise.LoadOrGenerateKey(options.NoiseKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Peers, err = noise.ParsePublicKeys(options.NoisePeers)
+		if err != nil {
+			return nil, err
+		}
+		if options.ReplayWindow < 0 {
+			return nil, errors.New("replay window cannot be negative")
+		}
+		config.ReplayWindow = options.ReplayWindow
+		log.Printf("Noise public key of the server: %s\n", noise.PublicKeyString(config.Key))
+		secure = noise.Secure(network, config)
+		network = secure
+	}
+
+	udpConn, err := network.ListenUDP(networkName, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	server, err := NewServer(udpConn, options, processor)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	server.secure = secure
+	return server, nil
+}
+
+// Sets up a server on a socket the caller opened, such as one of a simulated network (see netsim), ignoring the port of
+// the options
+// The socket must give the addresses of the packets it receives as *net.UDPAddr, and is closed with the server
+func NewServer(conn net.PacketConn, options Options, processor Processor) (*Server, error) {
+	algoName := options.Algo
+	if algoName == "" {
+		algoName = digest.Default
+	}
+	algo, err := digest.Lookup(algoName)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{conn: conn, options: options, algo: algo, processor: processor}, nil
+}
+
+// Returns the local address the server is listening on
+func (s *Server) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Closes the server's UDP connection, which also stops Serve from receiving
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+// Receives packets until none arrive for the read time of the options, or the server is closed, and reflects each
+// Returns the counters of the server once every packet received has been reflected or dropped, with the error that
+// stopped it receiving if a read failed
+func (s *Server) Serve() (Report, error) {
+	options := s.options
+
+	// Set a read deadline for how long should wait for client response
+	readTimeLimit := time.Duration(options.ReadTime) * time.Second
+	// Set a write deadline for how long should wait on a full send queue to free up to send a packet
+	writeTimeLimit := time.Duration(options.WriteTime) * time.Second
+
+	// Create channel to hold packets received from client until they are hashed, in the order they arrived
+	recvChan := make(chan *PacketStruct, options.Buffer)
+	// Create channel to hold packets with hash and reflect to client
+	writeChan := make(chan PacketStruct, options.Buffer)
+
+	// Create counters for packets sent and received
+	// Count the packets of every flow, with each map only used by a single goroutine
+	var counters serverCounters
+	report := Report{recvPerFlow: make(map[flowKey]int), sentPerFlow: make(map[flowKey]int)}
+	var recvErr error
+
+	// Stream the counters and the backend's latency to a web dashboard while serving if requested
+	processor := s.processor
+	var wgDash sync.WaitGroup
+	dashDone := make(chan struct{})
+	if options.DashboardAddr != "" {
+		dash, err := dashboard.Serve(options.DashboardAddr, "UDP server on " + s.LocalAddr().String())
+		if err != nil {
+			log.Println("Could not serve dashboard: ", err)
+		} else {
+			timed := &timedProcessor{Processor: processor}
+			processor = timed
+			wgDash.Add(1)
+			go publishServerStats(dash, &counters, timed, writeChan, dashDone, &wgDash)
+			defer dash.Close()
+		}
+	}
+
+	// Create wait group to wait for all goroutines to finish before terminating
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	// Call these goroutines to handle reads and writes over UDP connection and communicate with HTTP backend over TCP
+    go recvPacket(s.conn, readTimeLimit, options.MaxPayload, s.algo.Size(), &counters.received, &counters.invalid, &counters.heartbeats, report.recvPerFlow, recvChan, &recvErr, &wg)
+	go hashPacket(processor, s.algo, recvChan, writeChan, options.Jobs, &counters.echoed, &counters.backendFailures, &wg)
+	go reflectPacket(s.conn, writeTimeLimit, &counters.sent, report.sentPerFlow, writeChan, &wg)
+
+    // Wait for all goroutines to finish
+	wg.Wait()
+	close(dashDone)
+	wgDash.Wait()
+
+	report.Received = int(counters.received)
+	report.Sent = int(counters.sent)
+	report.Invalid = int(counters.invalid)
+	report.Echoed = int(counters.echoed)
+	report.BackendFailures = int(counters.backendFailures)
+	report.Heartbeats = int(counters.heartbeats)
+	return report, recvErr
+}
+
+// Counters of a server while it serves, updated atomically so the dashboard can read them as they change
+// The fields count the same packets as those of Report
+type serverCounters struct {
+	received		int64
+	sent			int64
+	invalid			int64
+	echoed			int64
+	backendFailures	int64
+	heartbeats		int64
+}
+
+// Processor timing every call to another processor, for the dashboard's chart of the backend's latency
+// count, sum, max: the calls made since the latencies were last taken, and their total and longest duration
+type timedProcessor struct {
+	Processor
+	mutex	sync.Mutex
+	count	int
+	sum		time.Duration
+	max		time.Duration
+}
+
+func (p *timedProcessor) Process(payload []byte, requestID string) ([]byte, error) {
+	start := time.Now()
+	hash, err := p.Processor.Process(payload, requestID)
+	elapsed := time.Since(start)
+	p.mutex.Lock()
+	p.count++
+	p.sum += elapsed
+	if elapsed > p.max {
+		p.max = elapsed
+	}
+	p.mutex.Unlock()
+	return hash, err
+}
+
+// Returns the average and longest duration of the calls made since the last time, or zeros if there were none, and
+// starts over
+func (p *timedProcessor) takeLatencies() (time.Duration, time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var avg time.Duration
+	if p.count > 0 {
+		avg = p.sum / time.Duration(p.count)
+	}
+	max := p.max
+	p.count, p.sum, p.max = 0, 0, 0
+	return avg, max
+}
+
+// How often the server publishes its counters to the dashboard
+const dashboardInterval = time.Second
+
+// Publishes the server's counters, receive and reflect rates, reflect queue, and backend latency to the dashboard every
+// interval until the done channel is closed
+func publishServerStats(dash *dashboard.Dashboard, counters *serverCounters, processor *timedProcessor, writeChan chan PacketStruct, doneChan <-chan struct{}, wg *sync.WaitGroup) {
+	// Close wait group when done
+	defer wg.Done()
+
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+
+	var lastReceived, lastSent int64
+	lastTick := time.Now()
+	for {
+		select {
+		case <-doneChan:
+			return
+		case now := <-ticker.C:
+			received := atomic.LoadInt64(&counters.received)
+			sent := atomic.LoadInt64(&counters.sent)
+			elapsed := now.Sub(lastTick).Seconds()
+			avg, max := processor.takeLatencies()
+			dash.Publish(dashboard.Sample{Time: now, Metrics: []dashboard.Metric{
+				{Name: "Received", Value: float64(received)},
+				{Name: "Reflected", Value: float64(sent)},
+				{Name: "Invalid", Value: float64(atomic.LoadInt64(&counters.invalid))},
+				{Name: "Echoed", Value: float64(atomic.LoadInt64(&counters.echoed))},
+				{Name: "Backend failures", Value: float64(atomic.LoadInt64(&counters.backendFailures))},
+				{Name: "Heartbeats", Value: float64(atomic.LoadInt64(&counters.heartbeats))},
+				{Name: "Receive rate", Value: float64(received - lastReceived) / elapsed, Unit: "pps", Chart: "Packets per second"},
+				{Name: "Reflect rate", Value: float64(sent - lastSent) / elapsed, Unit: "pps", Chart: "Packets per second"},
+				{Name: "Reflect queue", Value: float64(len(writeChan)), Unit: "packets", Chart: "Reflect queue"},
+				{Name: "Backend avg", Value: float64(avg) / float64(time.Millisecond), Unit: "ms", Chart: "Backend latency (ms)"},
+				{Name: "Backend max", Value: float64(max) / float64(time.Millisecond), Unit: "ms", Chart: "Backend latency (ms)"},
+			}})
+			lastReceived, lastSent = received, sent
+			lastTick = now
+		}
+	}
+}
+
+// Main function to set up a UDP server that listens for packets sent from a UDP client
+// The server makes a call to the HTTP backend server to get the hash of each packet (fnv1a unless another algorithm is chosen)
+// The hash is appended to the end of each packet's payload and reflected back to the UDP client
+// Once the client stops sending, the HTTP backend is shut down and the counters of the server and backend are logged
+func Run(options Options) error {
+	processor, err := NewBackendProcessor(options)
+	if err != nil {
+		return err
+	}
+
+	// Only check the configuration and exit if requested
+	if options.Validate {
+		if validateConfig(processor, ":" + options.Port, "udp4", options.Transport, options.MaxPayload, options.Jobs, options.Buffer) > 0 {
+			return errors.New("configuration is invalid")
+		}
+		return nil
+	}
+
+	server, err := Listen(options, processor)
+	if err != nil {
+		return err
+	}
+	log.Printf("UDP server up and listening on port %s \n", options.Port)
+	if options.Transport == "tcp" {
+		log.Println("Packets are carried over TCP connections from clients")
+	}
+
+	// Close the UDP connection when done with everything
+	defer server.Close()
+
+	report, serveErr := server.Serve()
+
+	// Shutdown the HTTP backend now that no more packets need hashing, reading its counters first
+	if err := processor.Close(); err != nil {
+		log.Println(err)
+	}
+
+	report.Log()
+	if server.secure != nil {
+		server.secure.Stats().Log()
+	}
+	processor.LogStats()
+	if serveErr != nil {
+		return serveErr
+	}
+	log.Println("All done!")
+	return nil
+}
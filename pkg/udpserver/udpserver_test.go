@@ -0,0 +1,86 @@
+package udpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/nbopardi/udp_client_server/internal/digest"
+	"github.com/nbopardi/udp_client_server/pkg/pb"
+)
+
+// Transport answering every request with the same status and body, standing in for the HTTP backend
+type stubTransport struct {
+	status	int
+	body	[]byte
+}
+
+func (t stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		Status: http.StatusText(t.status),
+		StatusCode: t.status,
+		Header: make(http.Header),
+		Body: ioutil.NopCloser(bytes.NewReader(t.body)),
+		Request: req,
+	}, nil
+}
+
+// Whatever the backend responds with, commBackend must either reflect the packet with a digest of the right size or drop
+// it, without panicking, and release its token either way
+// api picks the encoding the processor asks for: JSON, raw bytes with binary, or protobuf
+func FuzzCommBackend(f *testing.F) {
+	algo, err := digest.Lookup(digest.Default)
+	if err != nil {
+		f.Fatal(err)
+	}
+	hash := algo.Sum([]byte("payload"))
+	jsonHash, _ := json.Marshal(hash)
+	f.Add(jsonHash, uint8(0), uint16(http.StatusOK))
+	f.Add(hash, uint8(1), uint16(http.StatusOK))
+	f.Add((&pb.HashResponse{Hash: hash}).Marshal(), uint8(2), uint16(http.StatusOK))
+	f.Add([]byte("null"), uint8(0), uint16(http.StatusOK))
+	f.Add([]byte{}, uint8(1), uint16(http.StatusOK))
+	f.Add([]byte{0x0a, 0xff}, uint8(2), uint16(http.StatusOK))
+	f.Add(hash, uint8(1), uint16(http.StatusInternalServerError))
+	f.Fuzz(func(t *testing.T, body []byte, api uint8, status uint16) {
+		if status < 100 || status > 999 {
+			return
+		}
+		processor := &BackendProcessor{
+			binaryAPI: api % 3 == 1,
+			protobufAPI: api % 3 == 2,
+			algo: algo,
+			hashURL: "http://backend/hash",
+			client: &http.Client{Transport: stubTransport{status: int(status), body: body}},
+		}
+		payload := []byte("payload")
+		tokens := make(chan struct{}, 1)
+		tokens <- struct{}{}
+		writeOut := make(chan PacketStruct, 1)
+		var failures int64
+		var wg sync.WaitGroup
+		wg.Add(1)
+		commBackend(processor, PacketStruct{Packet: payload}, writeOut, tokens, &failures, &wg)
+		wg.Wait()
+
+		if len(tokens) != 0 {
+			t.Fatal("commBackend did not release its token")
+		}
+		select {
+		case packet := <-writeOut:
+			if status != http.StatusOK {
+				t.Fatalf("reflected a packet after the backend responded with %d", status)
+			}
+			if len(packet.Packet) != len(payload) + algo.Size() || !bytes.Equal(packet.Packet[:len(payload)], payload) {
+				t.Fatalf("reflected %x for the payload %x with a %d byte digest", packet.Packet, payload, algo.Size())
+			}
+		default:
+			if failures != 1 {
+				t.Fatal("commBackend dropped a packet without counting the failure")
+			}
+		}
+	})
+}
@@ -18,6 +18,7 @@ helpFunction()
 	echo "\t-ic_time Max amount of seconds an idle (keep-alive) connection will remain idle before closing itself (default: 10)"
 	echo "\t-iconn_host Max idle (keep-alive) connections to keep per-host (default: 10000)"
 	echo "\t-buffer The max buffer size of the channel used to store received packets that are reflected to client (default: 1000000)"
+	echo "\tAny other flags (i.e. -validate) are passed through to cmd/udp_server"
 	exit 1 # Exit script after printing help
 }
 
@@ -34,15 +35,21 @@ rh_time=10
 ic_time=10
 iconn_host=10000
 buffer=1000000
+extra=""
 
 
 if [ $# -eq 0 ] ; then
 	echo "Backend host name required as positional argument 1. Aborting";
 	helpFunction
 else
-	# Verify that golang installed
+	# Verify that golang 1.20 or newer is installed
 	if ! [ -x "$(command -v go)" ]; then
-			echo "golang is not installed. Please install go1.15. Aborting"
+			echo "golang is not installed. Please install go1.20 or newer. Aborting"
+			exit 1
+	fi
+	goMinor=$(go version | sed -n 's/^go version go1\.\([0-9]*\).*/\1/p')
+	if [ -n "$goMinor" ] && [ "$goMinor" -lt 20 ]; then
+			echo "$(go version) is too old. Please install go1.20 or newer. Aborting"
 			exit 1
 	fi
 
@@ -99,11 +106,12 @@ else
 					-ic|-ic_time) ic_time="$2"; shift ;;
 					-ih|-iconn_host) iconn_host="$2"; shift ;;
 					-b|-buffer) buffer="$2"; shift ;;
-					*) echo "Unknown parameter passed: $1"; helpFunction ;;
+					-help|--help) helpFunction ;;
+					*) extra="$extra $1" ;;
 			esac
 			shift
 	done
 
 	# Run udp_server.go with positional args
-	go run ./udp_server.go -backend_host="$b_host" -backend_port="$b_port" -port="$portNum" -w_time="$w_time" -r_time="$r_time" -n_jobs="$n_jobs" -ec_time="$ec_time" -rh_time="$rh_time" -ic_time="$ic_time" -iconn_host="$iconn_host" -buffer="$buffer"
+	go run ./cmd/udp_server -backend_host="$b_host" -backend_port="$b_port" -port="$portNum" -w_time="$w_time" -r_time="$r_time" -n_jobs="$n_jobs" -ec_time="$ec_time" -rh_time="$rh_time" -ic_time="$ic_time" -iconn_host="$iconn_host" -buffer="$buffer" $extra
 fi